@@ -20,6 +20,12 @@ const (
 	pprofPrefixIndex   = "/debug/pprof"
 )
 
+// compacter is implemented by the message queues which can compact their
+// storage on demand
+type compacter interface {
+	Compact() error
+}
+
 // UnitedAdmin is the HTTP admin server of uq
 type UnitedAdmin struct {
 	host         string
@@ -35,9 +41,10 @@ func NewUnitedAdmin(host string, port int, messageQueue queue.MessageQueue) (*Un
 	s := new(UnitedAdmin)
 
 	s.adminMux = map[string]func(http.ResponseWriter, *http.Request, string){
-		"/stat":  s.statHandler,
-		"/empty": s.emptyHandler,
-		"/rm":    s.rmHandler,
+		"/stat":    s.statHandler,
+		"/empty":   s.emptyHandler,
+		"/rm":      s.rmHandler,
+		"/compact": s.compactHandler,
 	}
 
 	addr := utils.Addrcat(host, port)
@@ -117,13 +124,13 @@ func writeErrorHTTP(w http.ResponseWriter, err error) {
 	if err == nil {
 		return
 	}
-	switch e := err.(type) {
-	case *utils.Error:
-		e.WriteTo(w)
-	default:
+	e, ok := utils.AsError(err)
+	if !ok {
 		// log.Printf("unexpected error: %v", err)
 		http.Error(w, "500 Internal Error!\r\n"+err.Error(), http.StatusInternalServerError)
+		return
 	}
+	e.WriteTo(w)
 }
 
 func (s *UnitedAdmin) addHandler(w http.ResponseWriter, req *http.Request, key string) {
@@ -138,7 +145,7 @@ func (s *UnitedAdmin) addHandler(w http.ResponseWriter, req *http.Request, key s
 
 	topicName := req.FormValue("topic")
 	lineName := req.FormValue("line")
-	key = topicName + "/" + lineName
+	key = topicName + queue.KeySeparator(s.messageQueue) + lineName
 	recycle := req.FormValue("recycle")
 
 	// log.Printf("creating... %s %s", key, recycle)
@@ -246,6 +253,25 @@ func (s *UnitedAdmin) rmHandler(w http.ResponseWriter, req *http.Request, key st
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (s *UnitedAdmin) compactHandler(w http.ResponseWriter, req *http.Request, key string) {
+	if req.Method != "POST" {
+		http.Error(w, "405 Method Not Allowed!", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c, ok := s.messageQueue.(compacter)
+	if !ok {
+		http.Error(w, "501 Not Implemented!", http.StatusNotImplemented)
+		return
+	}
+	err := c.Compact()
+	if err != nil {
+		writeErrorHTTP(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // ListenAndServe implements the ListenAndServe interface
 func (s *UnitedAdmin) ListenAndServe() error {
 	addr := utils.Addrcat(s.host, s.port)
@@ -181,6 +181,25 @@ func TestAdminRemove(t *testing.T) {
 	})
 }
 
+func TestAdminCompact(t *testing.T) {
+	Convey("Test Admin Compact Api", t, func() {
+		req, err := http.NewRequest(
+			"POST",
+			"http://127.0.0.1:8800/v1/admin/compact",
+			nil,
+		)
+		So(err, ShouldBeNil)
+
+		resp, err := client.Do(req)
+		So(err, ShouldBeNil)
+		So(resp.StatusCode, ShouldEqual, http.StatusNoContent)
+
+		resp, err = client.Get("http://127.0.0.1:8800/v1/admin/compact")
+		So(err, ShouldBeNil)
+		So(resp.StatusCode, ShouldEqual, http.StatusMethodNotAllowed)
+	})
+}
+
 func TestCloseAdmin(t *testing.T) {
 	Convey("Test Close Admin", t, func() {
 		adminServer.Stop()
@@ -76,13 +76,13 @@ func writeErrorHTTP(w http.ResponseWriter, err error) {
 	if err == nil {
 		return
 	}
-	switch e := err.(type) {
-	case *utils.Error:
-		e.WriteTo(w)
-	default:
+	e, ok := utils.AsError(err)
+	if !ok {
 		// log.Printf("unexpected error: %v", err)
 		http.Error(w, "500 Internal Error!\r\n"+err.Error(), http.StatusInternalServerError)
+		return
 	}
+	e.WriteTo(w)
 }
 
 func (h *HTTPEntry) addHandler(w http.ResponseWriter, req *http.Request, key string) {
@@ -97,7 +97,7 @@ func (h *HTTPEntry) addHandler(w http.ResponseWriter, req *http.Request, key str
 
 	topicName := req.FormValue("topic")
 	lineName := req.FormValue("line")
-	key = topicName + "/" + lineName
+	key = topicName + queue.KeySeparator(h.messageQueue) + lineName
 	recycle := req.FormValue("recycle")
 
 	// log.Printf("creating... %s %s", key, recycle)
@@ -172,5 +172,8 @@ func (h *HTTPEntry) ListenAndServe() error {
 func (h *HTTPEntry) Stop() {
 	log.Printf("http entry stoping...")
 	h.stopListener.Stop()
-	h.messageQueue.Close()
+	err := h.messageQueue.Close()
+	if err != nil {
+		log.Printf("message queue close error: %s", err)
+	}
 }
@@ -172,19 +172,14 @@ func writeErrorMc(resp *response, err error) {
 	if err == nil {
 		return
 	}
-	switch e := err.(type) {
-	case *utils.Error:
-		if e.ErrorCode >= 500 {
-			resp.status = "SERVER_ERROR"
-		} else {
-			resp.status = "CLIENT_ERROR"
-		}
-		resp.msg = e.Error()
-	default:
+	e, ok := utils.AsError(err)
+	if ok && e.ErrorCode < 500 {
+		resp.status = "CLIENT_ERROR"
+	} else {
 		// log.Printf("unexpected error: %v", err)
 		resp.status = "SERVER_ERROR"
-		resp.msg = e.Error()
 	}
+	resp.msg = err.Error()
 }
 
 func (m *McEntry) process(req *request) (resp *response, quit bool) {
@@ -369,6 +364,9 @@ func (m *McEntry) ListenAndServe() error {
 func (m *McEntry) Stop() {
 	log.Printf("mc entry stoping...")
 	m.stopListener.Stop()
-	m.messageQueue.Close()
+	err := m.messageQueue.Close()
+	if err != nil {
+		log.Printf("message queue close error: %s", err)
+	}
 	log.Printf("mc entry stoped.")
 }
@@ -155,5 +155,8 @@ func (r *RedisEntry) ListenAndServe() error {
 func (r *RedisEntry) Stop() {
 	log.Printf("redis entry stoping...")
 	r.stopListener.Stop()
-	r.messageQueue.Close()
+	err := r.messageQueue.Close()
+	if err != nil {
+		log.Printf("message queue close error: %s", err)
+	}
 }
@@ -68,6 +68,6 @@ func (f *FakeQueue) Stat(key string) (*Stat, error) {
 }
 
 // Close implements Close interface
-func (f *FakeQueue) Close() {
-	return
+func (f *FakeQueue) Close() error {
+	return nil
 }
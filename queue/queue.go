@@ -14,5 +14,5 @@ type MessageQueue interface {
 	Empty(key string) error
 	Remove(key string) error
 	Stat(key string) (*Stat, error)
-	Close()
+	Close() error
 }
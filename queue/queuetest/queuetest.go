@@ -0,0 +1,98 @@
+// Package queuetest helps testing the code built on uq with a queue on an
+// in-memory store.
+package queuetest
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/buaazp/uq/queue"
+	"github.com/buaazp/uq/store"
+	"github.com/buaazp/uq/utils"
+)
+
+// NewTestQueue returns a queue on a new in-memory store, and the teardown
+// which closes it. It fails t if the queue can not be created.
+func NewTestQueue(t testing.TB) (*queue.UnitedQueue, func()) {
+	t.Helper()
+	return NewTestQueueWithOptions(t, nil)
+}
+
+// NewTestQueueWithOptions is NewTestQueue with the options of the queue,
+// nil means the defaults
+func NewTestQueueWithOptions(t testing.TB, opts *queue.Options) (*queue.UnitedQueue, func()) {
+	t.Helper()
+	ms, err := store.NewMemStore()
+	if err != nil {
+		t.Fatalf("queuetest: new mem store: %s", err)
+	}
+	q, err := queue.NewUnitedQueueWithOptions(ms, "127.0.0.1", 0, nil, "uq", opts)
+	if err != nil {
+		t.Fatalf("queuetest: new queue: %s", err)
+	}
+	teardown := func() {
+		err := q.Close()
+		if err != nil {
+			t.Errorf("queuetest: close queue: %s", err)
+		}
+	}
+	return q, teardown
+}
+
+// MustCreate creates the topic or the line of the key with the recycle,
+// like Create of the queue, and fails t if it can not. Only the lines with
+// a recycle confirm their messages.
+func MustCreate(t testing.TB, q queue.MessageQueue, key, recycle string) {
+	t.Helper()
+	err := q.Create(key, recycle)
+	if err != nil {
+		t.Fatalf("queuetest: create %s: %s", key, err)
+	}
+}
+
+// AssertPush pushes data to the topic, and fails t if it can not
+func AssertPush(t testing.TB, q queue.MessageQueue, topic string, data []byte) {
+	t.Helper()
+	err := q.Push(topic, data)
+	if err != nil {
+		t.Fatalf("queuetest: push %s: %s", topic, err)
+	}
+}
+
+// AssertPop pops a message from the line of the key, like "topic/line",
+// and fails t unless its data is wantData. It returns the key of the
+// message to confirm.
+func AssertPop(t testing.TB, q queue.MessageQueue, key string, wantData []byte) string {
+	t.Helper()
+	msgKey, data, err := q.Pop(key)
+	if err != nil {
+		t.Fatalf("queuetest: pop %s: %s", key, err)
+	}
+	if !bytes.Equal(data, wantData) {
+		t.Fatalf("queuetest: pop %s: got %q, want %q", key, data, wantData)
+	}
+	return msgKey
+}
+
+// AssertEmpty fails t unless the line of the key has no message to pop
+func AssertEmpty(t testing.TB, q queue.MessageQueue, key string) {
+	t.Helper()
+	msgKey, data, err := q.Pop(key)
+	if err == nil {
+		t.Fatalf("queuetest: pop %s: got %s %q, want no message", key, msgKey, data)
+	}
+	e, ok := utils.AsError(err)
+	if !ok || e.ErrorCode != utils.ErrNone {
+		t.Fatalf("queuetest: pop %s: %s", key, err)
+	}
+}
+
+// AssertConfirm confirms the message of the key returned by AssertPop, and
+// fails t if it can not
+func AssertConfirm(t testing.TB, q queue.MessageQueue, msgKey string) {
+	t.Helper()
+	err := q.Confirm(msgKey)
+	if err != nil {
+		t.Fatalf("queuetest: confirm %s: %s", msgKey, err)
+	}
+}
@@ -0,0 +1,41 @@
+package queuetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buaazp/uq/queue"
+)
+
+func TestPushPopConfirm(t *testing.T) {
+	q, teardown := NewTestQueue(t)
+	defer teardown()
+
+	MustCreate(t, q, "foo", "")
+	MustCreate(t, q, "foo/x", "1m")
+	AssertEmpty(t, q, "foo/x")
+	AssertPush(t, q, "foo", []byte("a"))
+	AssertPush(t, q, "foo", []byte("b"))
+	key := AssertPop(t, q, "foo/x", []byte("a"))
+	AssertConfirm(t, q, key)
+	AssertPop(t, q, "foo/x", []byte("b"))
+	AssertEmpty(t, q, "foo/x")
+}
+
+func TestNewTestQueueWithOptions(t *testing.T) {
+	q, teardown := NewTestQueueWithOptions(t, &queue.Options{AutoCreateLines: true})
+	defer teardown()
+
+	MustCreate(t, q, "foo", "")
+	AssertEmpty(t, q, "foo/x")
+	AssertPush(t, q, "foo", []byte("a"))
+	AssertPop(t, q, "foo/x", []byte("a"))
+
+	qs, err := q.Stat("foo/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qs.Recycle != time.Duration(0).String() {
+		t.Fatalf("recycle %s", qs.Recycle)
+	}
+}
@@ -0,0 +1,171 @@
+package queue
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/buaazp/uq/utils"
+)
+
+const (
+	storageKeyAliases string = "UnitedQueueAliases"
+)
+
+// getTopic returns the topic of name, which may be an alias of it
+func (u *UnitedQueue) getTopic(name string) (*topic, bool) {
+	u.topicsLock.RLock()
+	defer u.topicsLock.RUnlock()
+	t, ok := u.topics[u.resolveTopic(name)]
+	return t, ok
+}
+
+// resolveTopic returns the name of the topic aliased by name, or name if it
+// is not an alias. The caller must hold u.topicsLock.
+func (u *UnitedQueue) resolveTopic(name string) string {
+	if target, ok := u.aliases[name]; ok {
+		return target
+	}
+	return name
+}
+
+// nameTaken reports whether name is a topic or an alias, the caller must
+// hold u.topicsLock
+func (u *UnitedQueue) nameTaken(name string) bool {
+	if _, ok := u.topics[name]; ok {
+		return true
+	}
+	_, ok := u.aliases[name]
+	return ok
+}
+
+// AliasTopic makes alias another name of the topic target, so the pushes,
+// pops and every other operation on alias work on target. An alias of an
+// alias is made an alias of its topic, so there is never a cycle. Removing
+// alias removes only the alias, and removing target removes its aliases.
+func (u *UnitedQueue) AliasTopic(alias, target string) error {
+	alias = u.trimKey(alias)
+	target = u.trimKey(target)
+	if alias == "" || strings.Contains(alias, u.opts.Separator) {
+		return utils.NewError(
+			utils.ErrBadKey,
+			`alias topic name error: `+alias,
+		)
+	}
+
+	u.topicsLock.Lock()
+	defer u.topicsLock.Unlock()
+
+	target = u.resolveTopic(target)
+	if _, ok := u.topics[target]; !ok {
+		return utils.NewError(
+			utils.ErrTopicNotExisted,
+			`queue aliasTopic`,
+		)
+	}
+	if alias == target || u.nameTaken(alias) {
+		return utils.NewError(
+			utils.ErrTopicExisted,
+			`queue aliasTopic`,
+		)
+	}
+
+	u.aliases[alias] = target
+	err := u.exportAliases()
+	if err != nil {
+		delete(u.aliases, alias)
+		return err
+	}
+	return nil
+}
+
+// RemoveAlias removes the alias, its topic is left as it is
+func (u *UnitedQueue) RemoveAlias(alias string) error {
+	alias = u.trimKey(alias)
+
+	u.topicsLock.Lock()
+	defer u.topicsLock.Unlock()
+	return u.removeAlias(alias)
+}
+
+// removeAlias removes the alias, the caller must hold u.topicsLock
+func (u *UnitedQueue) removeAlias(alias string) error {
+	target, ok := u.aliases[alias]
+	if !ok {
+		return utils.NewError(
+			utils.ErrTopicNotExisted,
+			`queue removeAlias`,
+		)
+	}
+
+	delete(u.aliases, alias)
+	err := u.exportAliases()
+	if err != nil {
+		u.aliases[alias] = target
+		return err
+	}
+	return nil
+}
+
+// Aliases returns the aliases with the names of their topics
+func (u *UnitedQueue) Aliases() map[string]string {
+	u.topicsLock.RLock()
+	defer u.topicsLock.RUnlock()
+
+	aliases := make(map[string]string, len(u.aliases))
+	for alias, target := range u.aliases {
+		aliases[alias] = target
+	}
+	return aliases
+}
+
+// dropAliases removes the aliases of the topic from memory, the caller must
+// hold u.topicsLock and export them
+func (u *UnitedQueue) dropAliases(target string) bool {
+	dropped := false
+	for alias, t := range u.aliases {
+		if t == target {
+			delete(u.aliases, alias)
+			dropped = true
+		}
+	}
+	return dropped
+}
+
+func (u *UnitedQueue) exportAliases() error {
+	if len(u.aliases) == 0 {
+		err := u.delData(storageKeyAliases)
+		if err != nil && !isDataNotExisted(err) {
+			return err
+		}
+		return nil
+	}
+
+	buf, err := json.Marshal(u.aliases)
+	if err != nil {
+		return utils.NewError(
+			utils.ErrInternalError,
+			err.Error(),
+		)
+	}
+	return u.setData(storageKeyAliases, buf)
+}
+
+func (u *UnitedQueue) loadAliases() error {
+	u.aliases = make(map[string]string)
+	buf, err := u.getData(storageKeyAliases)
+	if isDataNotExisted(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(buf, &u.aliases)
+	if err != nil {
+		return utils.NewError(
+			utils.ErrInternalError,
+			err.Error(),
+		)
+	}
+	return nil
+}
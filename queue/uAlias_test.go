@@ -0,0 +1,69 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/buaazp/uq/store"
+	"github.com/buaazp/uq/utils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAliasTopic(t *testing.T) {
+	Convey("Test Alias Routes to the Target Topic", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		aq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+
+		So(aq.Create("new", ""), ShouldBeNil)
+		So(aq.Create("new/x", ""), ShouldBeNil)
+		So(aq.Create("other", ""), ShouldBeNil)
+		So(errorCode(aq.AliasTopic("old", "missing")), ShouldEqual, utils.ErrTopicNotExisted)
+		So(errorCode(aq.AliasTopic("new", "new")), ShouldEqual, utils.ErrTopicExisted)
+		So(errorCode(aq.AliasTopic("other", "new")), ShouldEqual, utils.ErrTopicExisted)
+		So(aq.AliasTopic("old", "new"), ShouldBeNil)
+		So(errorCode(aq.AliasTopic("old", "other")), ShouldEqual, utils.ErrTopicExisted)
+		So(errorCode(aq.Create("old", "")), ShouldEqual, utils.ErrTopicExisted)
+		// an alias of an alias points to the topic, so no cycle is made
+		So(aq.AliasTopic("older", "old"), ShouldBeNil)
+		So(aq.Aliases(), ShouldResemble, map[string]string{"old": "new", "older": "new"})
+		_, err = aq.DrainTo("old", "new")
+		So(errorCode(err), ShouldEqual, utils.ErrBadRequest)
+
+		So(aq.Push("old", []byte("a")), ShouldBeNil)
+		So(aq.Push("new", []byte("b")), ShouldBeNil)
+		m, err := aq.PopMessage("new/x")
+		So(err, ShouldBeNil)
+		So(string(m.Data), ShouldEqual, "a")
+		m, err = aq.PopMessage("older/x")
+		So(err, ShouldBeNil)
+		So(string(m.Data), ShouldEqual, "b")
+		So(aq.exportTopics(), ShouldBeNil)
+
+		// copied to be reloaded, since Close drops the data of a MemStore
+		mdb2, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		keys, err := mdb.Keys("")
+		So(err, ShouldBeNil)
+		for _, key := range keys {
+			data, err := mdb.Get(key)
+			So(err, ShouldBeNil)
+			So(mdb2.Set(key, data), ShouldBeNil)
+		}
+		So(aq.Close(), ShouldBeNil)
+		aq, err = NewUnitedQueue(mdb2, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer aq.Close()
+		qs, err := aq.Stat("old/x")
+		So(err, ShouldBeNil)
+		So(qs.Head, ShouldEqual, 2)
+
+		So(aq.Remove("old"), ShouldBeNil)
+		So(errorCode(aq.Push("old", []byte("c"))), ShouldEqual, utils.ErrTopicNotExisted)
+		So(aq.Push("new", []byte("c")), ShouldBeNil)
+		So(aq.Remove("new"), ShouldBeNil)
+		So(len(aq.Aliases()), ShouldEqual, 0)
+		_, err = mdb2.Get(storageKeyAliases)
+		So(err, ShouldEqual, store.ErrNotExisted)
+	})
+}
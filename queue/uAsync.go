@@ -0,0 +1,163 @@
+package queue
+
+import (
+	"log"
+	"sync"
+
+	"github.com/buaazp/uq/utils"
+)
+
+// asyncWrites is the buffer of the pushes a topic stores in the background
+// with the AsyncPushBuffer option. The writer stores them one by one in the
+// order they are buffered, so the ids are assigned in that order and the
+// tail only covers the stored messages.
+type asyncWrites struct {
+	c chan asyncWrite
+	// closing takes the write lock, so no push is buffered after it
+	lock   sync.RWMutex
+	closed bool
+	// err is the first failed write since it was last taken
+	err     error
+	errLock sync.Mutex
+	stopped chan bool
+	// spill takes the pushes while c is full, nil without AsyncSpillDir
+	spill *spillLog
+}
+
+// asyncWrite is a buffered push, or a mark of a wait for the writes
+// buffered before it if done is set. The wait takes the failure of the
+// writes if take is set.
+type asyncWrite struct {
+	e    *Envelope
+	done chan error
+	take bool
+}
+
+// startWrites starts the background writer of the topic if the queue has
+// AsyncPushBuffer set
+func (t *topic) startWrites() {
+	n := t.q.opts.AsyncPushBuffer
+	if n <= 0 {
+		return
+	}
+	w := new(asyncWrites)
+	w.c = make(chan asyncWrite, n)
+	w.stopped = make(chan bool)
+	t.writes = w
+	go t.runWrites()
+	if dir := t.q.opts.AsyncSpillDir; dir != "" {
+		w.spill = newSpillLog(dir)
+		go t.runSpill()
+	}
+}
+
+func (t *topic) runWrites() {
+	w := t.writes
+	defer close(w.stopped)
+	for aw := range w.c {
+		if aw.done != nil {
+			w.errLock.Lock()
+			if aw.take {
+				aw.done <- w.err
+				w.err = nil
+			} else {
+				aw.done <- nil
+			}
+			w.errLock.Unlock()
+			continue
+		}
+
+		t.tailLock.Lock()
+		err := t.storeEnvelopeLocked(aw.e)
+		due := err == nil && t.countPushes(1)
+		t.tailLock.Unlock()
+		err = t.flushPushes(due, err)
+		if err != nil {
+			log.Printf("topic[%s] async write error: %s", t.name, err)
+			w.failed(err)
+		}
+	}
+}
+
+// failed records err if it is the first failed write since the last taken
+func (w *asyncWrites) failed(err error) {
+	w.errLock.Lock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.errLock.Unlock()
+}
+
+// enqueue buffers aw, it blocks while the buffer is full unless the pushes
+// spill
+func (w *asyncWrites) enqueue(aw asyncWrite) error {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	if w.closed {
+		return utils.NewError(
+			utils.ErrInternalError,
+			`topic closed`,
+		)
+	}
+	if w.spill != nil {
+		return w.spill.enqueue(w.c, aw)
+	}
+	w.c <- aw
+	return nil
+}
+
+// awaitWrites waits until the pushes buffered before are stored. It takes
+// and returns the first write which failed since it was last taken if take
+// is set. It is a no-op for a topic without async writes.
+func (t *topic) awaitWrites(take bool) error {
+	if t.writes == nil {
+		return nil
+	}
+	done := make(chan error, 1)
+	err := t.writes.enqueue(asyncWrite{done: done, take: take})
+	if err != nil {
+		return err
+	}
+	return <-done
+}
+
+// stopWrites stores the buffered pushes and stops the writer
+func (t *topic) stopWrites() {
+	w := t.writes
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	if !w.closed {
+		w.closed = true
+		if w.spill != nil {
+			// the spilled pushes are stored first
+			close(w.spill.quit)
+			<-w.spill.stopped
+			w.spill.remove()
+		}
+		close(w.c)
+	}
+	w.lock.Unlock()
+	<-w.stopped
+}
+
+// Flush waits until the pushes into the topic which are buffered by the
+// AsyncPushBuffer option are stored, then persists the topic and its lines.
+// It returns the error of the first buffered push which failed to be stored
+// since the last Flush, that message is lost.
+func (u *UnitedQueue) Flush(name string) error {
+	name = u.trimKey(name)
+	t, ok := u.getTopic(name)
+	if !ok {
+		return u.wrapError("flush", name, utils.NewError(
+			utils.ErrTopicNotExisted,
+			`queue flush`,
+		))
+	}
+	err := t.awaitWrites(true)
+	if err == nil {
+		err = t.flush()
+	}
+	return u.wrapError("flush", name, err)
+}
@@ -0,0 +1,134 @@
+package queue
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/buaazp/uq/store"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// failStore is a storage whose Sets of the messages fail while fail is set
+type failStore struct {
+	store.Storage
+	mu   sync.Mutex
+	fail bool
+}
+
+func (f *failStore) Set(key string, data []byte) error {
+	f.mu.Lock()
+	fail := f.fail
+	f.mu.Unlock()
+	if fail && strings.HasPrefix(key, "/m/") {
+		return errors.New("disk full")
+	}
+	return f.Storage.Set(key, data)
+}
+
+func (f *failStore) setFail(fail bool) {
+	f.mu.Lock()
+	f.fail = fail
+	f.mu.Unlock()
+}
+
+func TestAsyncPush(t *testing.T) {
+	Convey("Test Async Pushes Are Stored in Order", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		fdb := &failStore{Storage: mdb}
+		aq, err := NewUnitedQueueWithOptions(fdb, "127.0.0.1", 9689, nil, "uq", &Options{AsyncPushBuffer: 4})
+		So(err, ShouldBeNil)
+		defer aq.Close()
+
+		So(aq.Create("foo", ""), ShouldBeNil)
+		So(aq.Create("foo/x", ""), ShouldBeNil)
+		data := []byte("0")
+		for i := 0; i < 10; i++ {
+			data[0] = byte('0' + i)
+			So(aq.Push("foo", data), ShouldBeNil)
+		}
+		ids, err := aq.PushBatch("foo", [][]byte{[]byte("a")})
+		So(err, ShouldBeNil)
+		So(ids, ShouldResemble, []uint64{10})
+		So(aq.Flush("foo"), ShouldBeNil)
+		for i := 0; i < 10; i++ {
+			key, data, err := aq.Pop("foo/x")
+			So(err, ShouldBeNil)
+			So(key, ShouldEqual, "foo/x/"+strconv.Itoa(i))
+			So(string(data), ShouldEqual, strconv.Itoa(i))
+		}
+
+		fdb.setFail(true)
+		So(aq.Push("foo", []byte("lost")), ShouldBeNil)
+		err = aq.Flush("foo")
+		So(err, ShouldNotBeNil)
+		fdb.setFail(false)
+		So(aq.Flush("foo"), ShouldBeNil)
+		So(aq.Push("foo", []byte("b")), ShouldBeNil)
+		So(aq.Flush("foo"), ShouldBeNil)
+		qs, err := aq.Stat("foo")
+		So(err, ShouldBeNil)
+		So(qs.Tail, ShouldEqual, 12)
+
+		So(aq.Reconfigure(Options{AsyncPushBuffer: 8}), ShouldNotBeNil)
+	})
+}
+
+// stallStore is a storage whose Sets of the messages block until it is
+// released
+type stallStore struct {
+	store.Storage
+	release chan bool
+}
+
+func (s *stallStore) Set(key string, data []byte) error {
+	if strings.HasPrefix(key, "/m/") {
+		<-s.release
+	}
+	return s.Storage.Set(key, data)
+}
+
+func TestAsyncSpill(t *testing.T) {
+	Convey("Test Async Pushes Spill to Disk While the Buffer is Full", t, func() {
+		dir, err := ioutil.TempDir("", "uq-spill-test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		sdb := &stallStore{Storage: mdb, release: make(chan bool)}
+		opts := &Options{AsyncPushBuffer: 2, AsyncSpillDir: dir}
+		aq, err := NewUnitedQueueWithOptions(sdb, "127.0.0.1", 9689, nil, "uq", opts)
+		So(err, ShouldBeNil)
+
+		So(aq.Create("foo", ""), ShouldBeNil)
+		So(aq.Create("foo/x", ""), ShouldBeNil)
+		// the stalled store takes none of them, they do not wait
+		for i := 0; i < 20; i++ {
+			So(aq.Push("foo", []byte(strconv.Itoa(i))), ShouldBeNil)
+		}
+		files, err := ioutil.ReadDir(dir)
+		So(err, ShouldBeNil)
+		So(files, ShouldHaveLength, 1)
+		So(files[0].Size(), ShouldBeGreaterThan, 0)
+
+		close(sdb.release)
+		So(aq.Flush("foo"), ShouldBeNil)
+		for i := 0; i < 20; i++ {
+			_, data, err := aq.Pop("foo/x")
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, strconv.Itoa(i))
+		}
+		So(aq.topics["foo"].writes.spill.writeOff, ShouldEqual, 0)
+
+		So(aq.Close(), ShouldBeNil)
+		files, err = ioutil.ReadDir(dir)
+		So(err, ShouldBeNil)
+		So(files, ShouldBeEmpty)
+	})
+}
@@ -0,0 +1,166 @@
+package queue
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buaazp/uq/store"
+	"github.com/buaazp/uq/utils"
+)
+
+const (
+	keyTopicAttrs string = ":attrs/"
+)
+
+// The attribute index of a topic keeps an empty value under the key
+// "<attrPrefix><name>=<value>:<id>" for every attribute of every message,
+// so the ids of a pair are listed with the prefix of it. A storage which
+// can not list its keys has no index, and the attributes are rejected.
+
+var attrEscaper = strings.NewReplacer("%", "%25", "/", "%2F", ":", "%3A", "=", "%3D")
+
+func (t *topic) attrKey(name, value string) string {
+	return t.q.keys.attrPrefix(t.name) + attrEscaper.Replace(name) + "=" + attrEscaper.Replace(value) + ":"
+}
+
+// checkAttrs returns ErrBadRequest for op if the storage can not list the
+// keys of the attribute index
+func (u *UnitedQueue) checkAttrs(op string) error {
+	if store.CanListKeys(u.storage) {
+		return nil
+	}
+	return utils.NewError(
+		utils.ErrBadRequest,
+		`storage can not list keys for `+op,
+	)
+}
+
+// attrIndexKey returns the index key of the attribute of message id
+func (t *topic) attrIndexKey(name, value string, id uint64) string {
+	return utils.Acatui(t.attrKey(name, value), "", id)
+}
+
+// indexAttrs adds the attributes of message id to the index
+func (t *topic) indexAttrs(id uint64, attrs map[string]string) error {
+	for name, value := range attrs {
+		err := t.q.setData(t.attrIndexKey(name, value, id), []byte{})
+		if err != nil {
+			t.unindexAttrs(id, attrs)
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *topic) unindexAttrs(id uint64, attrs map[string]string) error {
+	var first error
+	for name, value := range attrs {
+		err := t.q.delData(t.attrIndexKey(name, value, id))
+		if err != nil && !isDataNotExisted(err) && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// unindexMessage removes message id from the index before it is deleted
+func (t *topic) unindexMessage(id uint64) error {
+	if t.q.codec == RawCodec {
+		// no message has attributes
+		return nil
+	}
+	e, err := t.getEnvelope(id)
+	if isDataNotExisted(err) {
+		return nil
+	}
+	if err != nil || e == nil {
+		return err
+	}
+	return t.unindexAttrs(id, e.Attrs)
+}
+
+func (t *topic) removeAttrsData() error {
+	if !store.CanListKeys(t.q.storage) {
+		return nil
+	}
+	keys, err := store.ListKeys(t.q.storage, t.q.keys.attrPrefix(t.name))
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err = t.q.delData(key)
+		if err != nil && !isDataNotExisted(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// undelivered returns the lowest head of the lines, the topic head if there
+// is no line
+func (t *topic) undelivered() uint64 {
+	t.loadLazyAll()
+	t.linesLock.RLock()
+	defer t.linesLock.RUnlock()
+
+	if len(t.lines) == 0 {
+		return t.getHead()
+	}
+	start := t.getTail()
+	for _, l := range t.lines {
+		l.headLock.RLock()
+		if l.head < start {
+			start = l.head
+		}
+		l.headLock.RUnlock()
+	}
+	return start
+}
+
+// PushWithAttrs pushes a message with the attributes it can be found by
+// with FindByAttribute
+func (u *UnitedQueue) PushWithAttrs(name string, data []byte, attrs map[string]string) error {
+	return u.pushWith(name, data, time.Time{}, attrs, "pushWithAttrs")
+}
+
+// FindByAttribute returns the ids of the messages in the topic which have
+// the attribute name of value and are not delivered to every line yet
+func (u *UnitedQueue) FindByAttribute(topicName, name, value string) ([]uint64, error) {
+	topicName = u.trimKey(topicName)
+
+	t, ok := u.getTopic(topicName)
+	if !ok {
+		return nil, utils.NewError(
+			utils.ErrTopicNotExisted,
+			`queue findByAttribute`,
+		)
+	}
+
+	err := u.checkAttrs("findByAttribute")
+	if err != nil {
+		return nil, err
+	}
+	prefix := t.attrKey(name, value)
+	keys, err := store.ListKeys(u.storage, prefix)
+	if err != nil {
+		return nil, utils.NewError(
+			utils.ErrInternalError,
+			err.Error(),
+		)
+	}
+
+	start := t.undelivered()
+	tail := t.getTail()
+	var ids []uint64
+	for _, key := range keys {
+		id, err := strconv.ParseUint(key[len(prefix):], 10, 64)
+		if err != nil || id < start || id >= tail {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
@@ -0,0 +1,69 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/buaazp/uq/store"
+	"github.com/buaazp/uq/utils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFindByAttribute(t *testing.T) {
+	Convey("Test Find Messages by Attribute", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		aq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer aq.Close()
+
+		So(aq.Create("foo", ""), ShouldBeNil)
+		So(aq.Create("foo/x", ""), ShouldBeNil)
+		So(aq.PushWithAttrs("foo", []byte("a"), map[string]string{"color": "red"}), ShouldBeNil)
+		So(aq.PushWithAttrs("foo", []byte("b"), map[string]string{"color": "blue"}), ShouldBeNil)
+		So(aq.Push("foo", []byte("c")), ShouldBeNil)
+		So(aq.PushWithAttrs("foo", []byte("d"), map[string]string{"color": "red", "size": "a:b=c"}), ShouldBeNil)
+
+		ids, err := aq.FindByAttribute("foo", "color", "red")
+		So(err, ShouldBeNil)
+		So(ids, ShouldResemble, []uint64{0, 3})
+		ids, err = aq.FindByAttribute("foo", "size", "a:b=c")
+		So(err, ShouldBeNil)
+		So(ids, ShouldResemble, []uint64{3})
+		ids, err = aq.FindByAttribute("foo", "color", "re")
+		So(err, ShouldBeNil)
+		So(ids, ShouldBeEmpty)
+		_, err = aq.FindByAttribute("bar", "color", "red")
+		So(err, ShouldNotBeNil)
+
+		m, err := aq.PopMessage("foo/x")
+		So(err, ShouldBeNil)
+		So(m.Attrs["color"], ShouldEqual, "red")
+		ids, err = aq.FindByAttribute("foo", "color", "red")
+		So(err, ShouldBeNil)
+		So(ids, ShouldResemble, []uint64{3})
+
+		tp := aq.topics["foo"]
+		tp.clean()
+		So(tp.getHead(), ShouldEqual, 1)
+		keys, err := mdb.Keys(tp.attrKey("color", "red"))
+		So(err, ShouldBeNil)
+		So(len(keys), ShouldEqual, 1)
+	})
+
+	Convey("Test the Attributes Need a Storage Listing Its Keys", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		// keptStore hides the Keys of the MemStore
+		aq, err := NewUnitedQueue(keptStore{mdb}, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer aq.Close()
+
+		So(aq.Create("foo", ""), ShouldBeNil)
+		err = aq.PushWithAttrs("foo", []byte("a"), map[string]string{"color": "red"})
+		So(errorCode(err), ShouldEqual, utils.ErrBadRequest)
+		_, err = aq.FindByAttribute("foo", "color", "red")
+		So(errorCode(err), ShouldEqual, utils.ErrBadRequest)
+		So(aq.PushWithAttrs("foo", []byte("a"), nil), ShouldBeNil)
+		So(aq.Remove("foo"), ShouldBeNil)
+	})
+}
@@ -0,0 +1,103 @@
+package queue
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditType is the kind of an AuditEvent
+type AuditType string
+
+// The events a message goes through
+const (
+	AuditPush    AuditType = "push"
+	AuditPop     AuditType = "pop"
+	AuditConfirm AuditType = "confirm"
+)
+
+// AuditEvent records a message stored into a topic, or popped or confirmed
+// by a line. It has no payload.
+type AuditEvent struct {
+	Type  AuditType
+	Topic string
+	// Line is the line of a pop or a confirm, empty for a push
+	Line string `json:",omitempty"`
+	ID   uint64
+	Time time.Time
+}
+
+// AuditSink receives an AuditEvent for every push, pop and confirm. It is
+// called while the message is handled, so it must be quick and must not
+// call the queue. A recycled message is popped again with another event.
+type AuditSink interface {
+	Audit(e AuditEvent)
+}
+
+// audit sends the event to the AuditSink if there is one
+func (u *UnitedQueue) audit(typ AuditType, topicName, lineName string, id uint64) {
+	sink := u.opts.AuditSink
+	if sink == nil {
+		return
+	}
+	sink.Audit(AuditEvent{
+		Type:  typ,
+		Topic: topicName,
+		Line:  lineName,
+		ID:    id,
+		Time:  u.now(),
+	})
+}
+
+// auditPushes audits the pushes of n messages from the id first
+func (u *UnitedQueue) auditPushes(topicName string, first uint64, n int) {
+	if u.opts.AuditSink == nil {
+		return
+	}
+	for i := 0; i < n; i++ {
+		u.audit(AuditPush, topicName, "", first+uint64(i))
+	}
+}
+
+// FileAuditSink appends the events to a file as JSON lines. Every event is
+// written at once, so none is lost when the process stops.
+type FileAuditSink struct {
+	lock sync.Mutex
+	f    *os.File
+}
+
+// NewFileAuditSink opens the file of path for appending the events,
+// creating it if it is not there
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileAuditSink{f: f}, nil
+}
+
+// Audit implements AuditSink, the errors of writing are logged
+func (s *FileAuditSink) Audit(e AuditEvent) {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("audit marshal error: %s", err)
+		return
+	}
+	buf = append(buf, '\n')
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, err = s.f.Write(buf)
+	if err != nil {
+		log.Printf("audit write error: %s", err)
+	}
+}
+
+// Close closes the file
+func (s *FileAuditSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.f.Close()
+}
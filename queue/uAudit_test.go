@@ -0,0 +1,93 @@
+package queue
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/buaazp/uq/store"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// recordSink is an AuditSink keeping the events
+type recordSink struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (r *recordSink) Audit(e AuditEvent) {
+	r.mu.Lock()
+	r.events = append(r.events, e)
+	r.mu.Unlock()
+}
+
+func TestAuditSink(t *testing.T) {
+	Convey("Test Audit Sink Receives Pushes, Pops and Confirms", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		sink := new(recordSink)
+		aq, err := NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", &Options{AuditSink: sink})
+		So(err, ShouldBeNil)
+		defer aq.Close()
+
+		So(aq.Create("foo", ""), ShouldBeNil)
+		So(aq.Create("foo/x", "1m"), ShouldBeNil)
+		So(aq.Push("foo", []byte("a")), ShouldBeNil)
+		_, err = aq.PushBatch("foo", [][]byte{[]byte("b"), []byte("c")})
+		So(err, ShouldBeNil)
+		key, _, err := aq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		_, _, err = aq.MultiPop("foo/x", 2)
+		So(err, ShouldBeNil)
+		So(aq.Confirm(key), ShouldBeNil)
+
+		type event struct {
+			typ  AuditType
+			line string
+			id   uint64
+		}
+		var got []event
+		for _, e := range sink.events {
+			So(e.Topic, ShouldEqual, "foo")
+			So(e.Time.IsZero(), ShouldBeFalse)
+			got = append(got, event{e.Type, e.Line, e.ID})
+		}
+		So(got, ShouldResemble, []event{
+			{AuditPush, "", 0},
+			{AuditPush, "", 1},
+			{AuditPush, "", 2},
+			{AuditPop, "x", 0},
+			{AuditPop, "x", 1},
+			{AuditPop, "x", 2},
+			{AuditConfirm, "x", 0},
+		})
+	})
+
+	Convey("Test File Audit Sink Appends JSON Lines", t, func() {
+		path := filepath.Join(os.TempDir(), "uq.audit.test.log")
+		os.Remove(path)
+		defer os.Remove(path)
+		sink, err := NewFileAuditSink(path)
+		So(err, ShouldBeNil)
+		sink.Audit(AuditEvent{Type: AuditPush, Topic: "foo", ID: 1})
+		sink.Audit(AuditEvent{Type: AuditPop, Topic: "foo", Line: "x", ID: 1})
+		So(sink.Close(), ShouldBeNil)
+
+		f, err := os.Open(path)
+		So(err, ShouldBeNil)
+		defer f.Close()
+		var events []AuditEvent
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var e AuditEvent
+			So(json.Unmarshal(scanner.Bytes(), &e), ShouldBeNil)
+			events = append(events, e)
+		}
+		So(len(events), ShouldEqual, 2)
+		So(events[1].Line, ShouldEqual, "x")
+		So(events[1].Type, ShouldEqual, AuditPop)
+	})
+}
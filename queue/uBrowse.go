@@ -0,0 +1,160 @@
+package queue
+
+import (
+	"io"
+	"time"
+
+	"github.com/buaazp/uq/utils"
+)
+
+// undelivered tells whether the line has not popped the id yet, the caller
+// must hold l.headLock
+func (l *line) undelivered(id uint64) bool {
+	if l.lifo == nil {
+		return id >= l.head
+	}
+	if id >= l.lifo.Mark {
+		return true
+	}
+	for _, r := range l.lifo.Ranges {
+		if id >= r[0] && id < r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// pendingFor tells whether a line of the topic has not popped the id yet,
+// or has it inflight. The caller must hold the locks of the lines.
+func (t *topic) pendingFor(id uint64) bool {
+	for _, l := range t.lines {
+		if l.undelivered(id) || (l.getRecycle() > 0 && l.imap[id]) {
+			return true
+		}
+	}
+	return false
+}
+
+// deliverable returns the envelope of the id the line would deliver at now,
+// nil if it would skip it
+func (l *line) deliverable(id uint64, now time.Time) (*Envelope, error) {
+	e, err := l.t.getEnvelope(id)
+	if isDataNotExisted(err) || isChecksumMismatch(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if e == nil || len(e.Data) == 0 || e.expired(now) || e.olderThan(l.maxAge(), now) {
+		return nil, nil
+	}
+	return e, nil
+}
+
+// Browse returns at most limit of the messages the line would deliver, from
+// the id fromID up, and the id to browse the next page from. Nothing is
+// popped, so the messages delivered already, the inflight ones, the lost
+// ones, the expired ones and the ones older than the MaxAge of the line are
+// skipped, and the pop interceptors are not run. The messages are in the
+// order of their ids, which a LIFO line pops from the other end. The next
+// id is the tail of the topic when the line has no more messages.
+func (u *UnitedQueue) Browse(topicName, lineName string, fromID uint64, limit int) ([]Message, uint64, error) {
+	if limit <= 0 {
+		return nil, 0, utils.NewError(
+			utils.ErrBadRequest,
+			`browse limit must be positive`,
+		)
+	}
+	l, err := u.getLine(topicName, lineName, "browse")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	t := l.t
+	tail := t.getTail()
+	now := u.now()
+	var ms []Message
+	id := fromID
+	l.headLock.RLock()
+	if l.lifo == nil && id < l.head {
+		id = l.head
+	}
+	l.headLock.RUnlock()
+	for ; id < tail && len(ms) < limit; id++ {
+		l.headLock.RLock()
+		ok := l.undelivered(id)
+		l.headLock.RUnlock()
+		if !ok {
+			continue
+		}
+
+		e, err := l.deliverable(id, now)
+		if err != nil {
+			return nil, 0, err
+		}
+		if e == nil {
+			continue
+		}
+		ms = append(ms, *l.newMessage(id, e, 0))
+	}
+	if id > tail {
+		id = tail
+	}
+	return ms, id, nil
+}
+
+// ExportLine writes the messages the line would deliver to w in the order
+// it would pop them, one frame of EncodeMessage each, e.g. to process the
+// backlog offline. Like Browse nothing is popped, and the messages pushed
+// while exporting are not written. It stops at the first error of w.
+func (u *UnitedQueue) ExportLine(topicName, lineName string, w io.Writer) error {
+	key := topicName + u.opts.Separator + lineName
+	return u.wrapError("exportLine", key, u.exportLine(topicName, lineName, w))
+}
+
+func (u *UnitedQueue) exportLine(topicName, lineName string, w io.Writer) error {
+	l, err := u.getLine(topicName, lineName, "exportLine")
+	if err != nil {
+		return err
+	}
+
+	tail := l.t.getTail()
+	now := u.now()
+	l.headLock.RLock()
+	low := l.head
+	if l.lifo != nil {
+		low = l.lifo.low()
+	}
+	l.headLock.RUnlock()
+
+	n := tail - low
+	if tail < low {
+		n = 0
+	}
+	for i := uint64(0); i < n; i++ {
+		// a LIFO line pops the newest message first
+		id := low + i
+		if l.lifo != nil {
+			id = tail - 1 - i
+		}
+		l.headLock.RLock()
+		ok := l.undelivered(id)
+		l.headLock.RUnlock()
+		if !ok {
+			continue
+		}
+
+		e, err := l.deliverable(id, now)
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			continue
+		}
+		err = EncodeMessage(w, l.newMessage(id, e, 0))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
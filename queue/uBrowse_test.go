@@ -0,0 +1,142 @@
+package queue
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/buaazp/uq/utils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBrowse(t *testing.T) {
+	Convey("Test Browse a Line Without Consuming", t, func() {
+		clock := newFakeClock()
+		bq, err := newClockQueue(clock)
+		So(err, ShouldBeNil)
+		defer bq.Close()
+
+		So(bq.Create("foo", ""), ShouldBeNil)
+		So(bq.Create("foo/x", "1m"), ShouldBeNil)
+		for _, data := range []string{"a", "b"} {
+			So(bq.Push("foo", []byte(data)), ShouldBeNil)
+		}
+		So(bq.PushUntil("foo", []byte("c"), clock.Now().Add(time.Second)), ShouldBeNil)
+		for _, data := range []string{"d", "e"} {
+			So(bq.Push("foo", []byte(data)), ShouldBeNil)
+		}
+		_, _, err = bq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		clock.Advance(2 * time.Second)
+
+		ms, next, err := bq.Browse("foo", "x", 0, 2)
+		So(err, ShouldBeNil)
+		So(ms, ShouldHaveLength, 2)
+		So(ms[0].ID, ShouldEqual, 1)
+		So(ms[0].Key, ShouldEqual, "foo/x/1")
+		So(string(ms[0].Data), ShouldEqual, "b")
+		// c is expired
+		So(ms[1].ID, ShouldEqual, 3)
+		So(next, ShouldEqual, 4)
+
+		ms, next, err = bq.Browse("foo", "x", next, 2)
+		So(err, ShouldBeNil)
+		So(ms, ShouldHaveLength, 1)
+		So(string(ms[0].Data), ShouldEqual, "e")
+		So(next, ShouldEqual, 5)
+		ms, next, err = bq.Browse("foo", "x", next, 2)
+		So(err, ShouldBeNil)
+		So(ms, ShouldBeEmpty)
+		So(next, ShouldEqual, 5)
+
+		qs, err := bq.Stat("foo/x")
+		So(err, ShouldBeNil)
+		So(qs.Head, ShouldEqual, 1)
+		_, data, err := bq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "b")
+
+		_, _, err = bq.Browse("foo", "x", 0, 0)
+		So(errorCode(err), ShouldEqual, utils.ErrBadRequest)
+		_, _, err = bq.Browse("foo", "y", 0, 1)
+		So(errorCode(err), ShouldEqual, utils.ErrLineNotExisted)
+	})
+
+	Convey("Test Browse a LIFO Line", t, func() {
+		bq, err := newClockQueue(newFakeClock())
+		So(err, ShouldBeNil)
+		defer bq.Close()
+
+		So(bq.Create("foo", ""), ShouldBeNil)
+		So(bq.CreateWith(&CreateRequest{TopicName: "foo", LineName: "x", LIFO: true}), ShouldBeNil)
+		_, err = bq.PushBatch("foo", [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+		So(err, ShouldBeNil)
+		_, _, err = bq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(bq.Push("foo", []byte("d")), ShouldBeNil)
+
+		ms, next, err := bq.Browse("foo", "x", 0, 10)
+		So(err, ShouldBeNil)
+		So(ms, ShouldHaveLength, 3)
+		So(string(ms[0].Data), ShouldEqual, "a")
+		So(string(ms[1].Data), ShouldEqual, "b")
+		So(string(ms[2].Data), ShouldEqual, "d")
+		So(next, ShouldEqual, 4)
+	})
+}
+
+func TestExportLine(t *testing.T) {
+	Convey("Test Export the Backlog of a Line", t, func() {
+		clock := newFakeClock()
+		eq, err := newClockQueue(clock)
+		So(err, ShouldBeNil)
+		defer eq.Close()
+
+		So(eq.Create("foo", ""), ShouldBeNil)
+		So(eq.Create("foo/x", "1m"), ShouldBeNil)
+		req := &CreateRequest{TopicName: "foo", LineName: "y", Recycle: time.Minute, LIFO: true}
+		So(eq.CreateWith(req), ShouldBeNil)
+		So(eq.MultiPush("foo", [][]byte{[]byte("a"), []byte("b")}), ShouldBeNil)
+		So(eq.PushUntil("foo", []byte("c"), clock.Now().Add(time.Second)), ShouldBeNil)
+		So(eq.Push("foo", []byte("d")), ShouldBeNil)
+		_, _, err = eq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		_, _, err = eq.Pop("foo/y")
+		So(err, ShouldBeNil)
+		clock.Advance(2 * time.Second)
+
+		exported := func(lineName string) []string {
+			var buf bytes.Buffer
+			So(eq.ExportLine("foo", lineName, &buf), ShouldBeNil)
+			var got []string
+			for {
+				m, err := DecodeMessage(&buf)
+				if err == io.EOF {
+					return got
+				}
+				So(err, ShouldBeNil)
+				got = append(got, m.Key+"="+string(m.Data))
+			}
+		}
+		// c is expired
+		So(exported("x"), ShouldResemble, []string{"foo/x/1=b", "foo/x/3=d"})
+		So(exported("y"), ShouldResemble, []string{"foo/y/1=b", "foo/y/0=a"})
+
+		qs, err := eq.Stat("foo/x")
+		So(err, ShouldBeNil)
+		So(qs.Head, ShouldEqual, 1)
+		_, data, err := eq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "b")
+
+		var buf bytes.Buffer
+		err = eq.ExportLine("foo", "z", &buf)
+		So(errorCode(err), ShouldEqual, utils.ErrLineNotExisted)
+		qe, ok := err.(*QueueError)
+		So(ok, ShouldBeTrue)
+		So(qe.Op, ShouldEqual, "exportLine")
+		So(qe.Topic, ShouldEqual, "foo")
+		So(qe.Line, ShouldEqual, "z")
+	})
+}
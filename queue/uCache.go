@@ -0,0 +1,189 @@
+package queue
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/buaazp/uq/utils"
+)
+
+// readCache keeps the encoded values of the messages read last, up to size
+// bytes, and evicts the least recently used ones beyond
+type readCache struct {
+	size  int
+	used  int
+	lru   *list.List
+	items map[string]*list.Element
+	// removes counts the removals, a value read from the storage before
+	// one may be stale and is not added
+	removes uint64
+	lock    sync.Mutex
+}
+
+type cacheItem struct {
+	key string
+	buf []byte
+}
+
+func newReadCache(size int) *readCache {
+	c := new(readCache)
+	c.size = size
+	c.lru = list.New()
+	c.items = make(map[string]*list.Element)
+	return c
+}
+
+// get returns a copy of the cached value of key
+func (c *readCache) get(key string) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	buf := elem.Value.(*cacheItem).buf
+	return append([]byte(nil), buf...), true
+}
+
+// version returns the removals so far, to pass to add the value read after
+func (c *readCache) version() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.removes
+}
+
+// add caches a copy of the value of key read at the version, evicting the
+// least recently used values to make room. A value larger than the cache,
+// or read before a removal, is not added.
+func (c *readCache) add(key string, buf []byte, version uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if version != c.removes || len(buf) > c.size {
+		return
+	}
+	c.removeLocked(key)
+	for c.used+len(buf) > c.size {
+		c.removeLocked(c.lru.Back().Value.(*cacheItem).key)
+	}
+	c.insertLocked(key, buf)
+}
+
+// fill caches a copy of the value of key like add, but only if it fits in
+// the room left, and tells whether it did
+func (c *readCache) fill(key string, buf []byte, version uint64) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if version != c.removes {
+		return true
+	}
+	if _, ok := c.items[key]; ok {
+		return true
+	}
+	if c.used+len(buf) > c.size {
+		return false
+	}
+	c.insertLocked(key, buf)
+	return true
+}
+
+func (c *readCache) insertLocked(key string, buf []byte) {
+	item := &cacheItem{key, append([]byte(nil), buf...)}
+	c.items[key] = c.lru.PushFront(item)
+	c.used += len(buf)
+}
+
+// remove drops the value of key, which is deleted
+func (c *readCache) remove(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.removes++
+	c.removeLocked(key)
+}
+
+// forget drops the value of key, which is written. It keeps the version,
+// since a message is only written again after it is deleted.
+func (c *readCache) forget(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.removeLocked(key)
+}
+
+func (c *readCache) removeLocked(key string) {
+	elem, ok := c.items[key]
+	if !ok {
+		return
+	}
+	c.lru.Remove(elem)
+	delete(c.items, key)
+	c.used -= len(elem.Value.(*cacheItem).buf)
+}
+
+// Warmup reads the last n messages of every topic of topicNames into the
+// read cache of the ReadCacheSize option, so the first pops after a restart
+// do not wait for the storage. The topics are read in order, each from its
+// oldest message of the n, and it stops once the cache is full, so the
+// earlier topics are preferred and the values cached already are not
+// evicted.
+func (u *UnitedQueue) Warmup(topicNames []string, n int) error {
+	if u.cache == nil {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`queue warmup without read cache`,
+		)
+	}
+	if n <= 0 {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`queue warmup non-positive count`,
+		)
+	}
+
+	ts := make([]*topic, len(topicNames))
+	for i, name := range topicNames {
+		t, ok := u.getTopic(u.trimKey(name))
+		if !ok {
+			return u.wrapError("warmup", name, utils.NewError(
+				utils.ErrTopicNotExisted,
+				`queue warmup`,
+			))
+		}
+		ts[i] = t
+	}
+	for _, t := range ts {
+		full, err := t.warmup(n)
+		if err != nil {
+			return u.wrapError("warmup", t.name, err)
+		}
+		if full {
+			break
+		}
+	}
+	return nil
+}
+
+// warmup reads the last n messages of the topic into the read cache, and
+// tells whether the cache is full
+func (t *topic) warmup(n int) (bool, error) {
+	head, tail := t.getHead(), t.getTail()
+	start := head
+	if tail-head > uint64(n) {
+		start = tail - uint64(n)
+	}
+	cache := t.q.cache
+	for id := start; id < tail; id++ {
+		version := cache.version()
+		buf, err := t.readStoredMessage(id)
+		if isDataNotExisted(err) || err == nil && len(buf) == 0 {
+			// cleaned meanwhile, or not flushed yet
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if !cache.fill(t.messageKey(id), buf, version) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,105 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/buaazp/uq/store"
+	"github.com/buaazp/uq/utils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReadCache(t *testing.T) {
+	Convey("Test Read Cache Evicts the Least Recently Used", t, func() {
+		c := newReadCache(6)
+		c.add("a", []byte("aa"), c.version())
+		c.add("b", []byte("bb"), c.version())
+		c.add("c", []byte("cc"), c.version())
+		buf, ok := c.get("a")
+		So(ok, ShouldBeTrue)
+		So(string(buf), ShouldEqual, "aa")
+		buf[0] = 'x'
+
+		c.add("d", []byte("dd"), c.version())
+		_, ok = c.get("b")
+		So(ok, ShouldBeFalse)
+		buf, ok = c.get("a")
+		So(ok, ShouldBeTrue)
+		So(string(buf), ShouldEqual, "aa")
+		So(c.used, ShouldEqual, 6)
+
+		c.add("e", []byte("toolarge"), c.version())
+		_, ok = c.get("e")
+		So(ok, ShouldBeFalse)
+		So(c.fill("e", []byte("ee"), c.version()), ShouldBeFalse)
+
+		version := c.version()
+		c.remove("c")
+		c.add("f", []byte("ff"), version)
+		_, ok = c.get("f")
+		So(ok, ShouldBeFalse)
+		So(c.fill("f", []byte("ff"), c.version()), ShouldBeTrue)
+		So(c.used, ShouldEqual, 6)
+	})
+}
+
+func TestWarmup(t *testing.T) {
+	Convey("Test Warmup Reads the Last Messages into the Cache", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		uq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		So(uq.Create("foo", ""), ShouldBeNil)
+		So(uq.Warmup([]string{"foo"}, 1), ShouldNotBeNil)
+		uq.Close()
+
+		mdb, err = store.NewMemStore()
+		So(err, ShouldBeNil)
+		wq, err := NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", &Options{ReadCacheSize: 1 << 20})
+		So(err, ShouldBeNil)
+		defer wq.Close()
+		So(wq.Create("foo", ""), ShouldBeNil)
+		So(wq.Create("foo/x", ""), ShouldBeNil)
+		_, err = wq.PushBatch("foo", [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")})
+		So(err, ShouldBeNil)
+		So(wq.Warmup([]string{"foo"}, 0), ShouldNotBeNil)
+		So(errorCode(wq.Warmup([]string{"foo", "bar"}, 2)), ShouldEqual, utils.ErrTopicNotExisted)
+
+		foo := wq.topics["foo"]
+		So(wq.Warmup([]string{"foo"}, 2), ShouldBeNil)
+		So(wq.cache.items, ShouldHaveLength, 2)
+		// served by the cache once gone from the storage
+		So(mdb.Del(foo.messageKey(3)), ShouldBeNil)
+		e, err := foo.getEnvelope(3)
+		So(err, ShouldBeNil)
+		So(string(e.Data), ShouldEqual, "d")
+
+		So(foo.deleteMessage(2), ShouldBeNil)
+		_, ok := wq.cache.get(foo.messageKey(2))
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Test Warmup Is Bounded by the Cache Size", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		wq, err := NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", &Options{ReadCacheSize: 1})
+		So(err, ShouldBeNil)
+		defer wq.Close()
+		So(wq.Create("foo", ""), ShouldBeNil)
+		So(wq.Push("foo", []byte("a")), ShouldBeNil)
+		foo := wq.topics["foo"]
+		buf, err := foo.readStoredMessage(0)
+		So(err, ShouldBeNil)
+		So(wq.Reconfigure(Options{ReadCacheSize: 2}), ShouldNotBeNil)
+
+		wq.cache.size = 2*len(buf) + 1
+		_, err = wq.PushBatch("foo", [][]byte{[]byte("b"), []byte("c"), []byte("d")})
+		So(err, ShouldBeNil)
+		So(wq.Warmup([]string{"foo"}, 10), ShouldBeNil)
+		So(wq.cache.items, ShouldHaveLength, 2)
+		So(wq.cache.used, ShouldBeLessThanOrEqualTo, wq.cache.size)
+		_, ok := wq.cache.get(foo.messageKey(0))
+		So(ok, ShouldBeTrue)
+		_, ok = wq.cache.get(foo.messageKey(3))
+		So(ok, ShouldBeFalse)
+	})
+}
@@ -0,0 +1,91 @@
+package queue
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+
+	"github.com/buaazp/uq/store"
+	"github.com/buaazp/uq/utils"
+)
+
+const (
+	storageKeyChecksum string = "UnitedQueueChecksum"
+	checksumName       string = "crc32c"
+	checksumSize       int    = 4
+)
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// loadChecksum turns the checksums on if the storage is written with them,
+// or if it is new and the Checksum option is set. The mark is stored as it
+// is, so it is read before the checksums are known.
+func (u *UnitedQueue) loadChecksum() error {
+	data, err := u.storage.Get(storageKeyChecksum)
+	if err == nil {
+		if string(data) != checksumName {
+			return errors.New("unknown checksum of storage: " + string(data))
+		}
+		u.checksum = true
+		return nil
+	}
+	if err != store.ErrNotExisted {
+		return utils.NewError(
+			utils.ErrInternalError,
+			err.Error(),
+		)
+	}
+	if !u.opts.Checksum {
+		return nil
+	}
+
+	for _, key := range []string{storageKeyWord, storageKeyLayout} {
+		_, err := u.storage.Get(key)
+		if err == nil {
+			return errors.New("checksum not matched, storage is written without checksums")
+		}
+		if err != store.ErrNotExisted {
+			return utils.NewError(
+				utils.ErrInternalError,
+				err.Error(),
+			)
+		}
+	}
+	u.checksum = true
+	if u.opts.ReadOnly {
+		return nil
+	}
+	return u.putData(storageKeyChecksum, []byte(checksumName))
+}
+
+// sealValue returns data prefixed by its checksum
+func sealValue(data []byte) []byte {
+	buf := make([]byte, checksumSize+len(data))
+	copy(buf[checksumSize:], data)
+	sealInPlace(buf)
+	return buf
+}
+
+// sealInPlace fills the checksum before the value in buf
+func sealInPlace(buf []byte) {
+	sum := crc32.Checksum(buf[checksumSize:], checksumTable)
+	binary.BigEndian.PutUint32(buf, sum)
+}
+
+// openValue verifies the checksum of the stored value of key and returns
+// the value without it
+func openValue(key string, data []byte) ([]byte, error) {
+	if len(data) < checksumSize ||
+		binary.BigEndian.Uint32(data) != crc32.Checksum(data[checksumSize:], checksumTable) {
+		return nil, utils.NewError(
+			utils.ErrChecksumMismatch,
+			key,
+		)
+	}
+	return data[checksumSize:], nil
+}
+
+func isChecksumMismatch(err error) bool {
+	e, ok := err.(*utils.Error)
+	return ok && e.ErrorCode == utils.ErrChecksumMismatch
+}
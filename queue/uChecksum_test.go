@@ -0,0 +1,88 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/buaazp/uq/store"
+	"github.com/buaazp/uq/utils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// flipByte corrupts the last byte of the stored value of key
+func flipByte(s store.Storage, key string) {
+	data, err := s.Get(key)
+	So(err, ShouldBeNil)
+	buf := append([]byte(nil), data...)
+	buf[len(buf)-1] ^= 0xff
+	So(s.Set(key, buf), ShouldBeNil)
+}
+
+func TestChecksum(t *testing.T) {
+	Convey("Test Checksums Catch the Corrupted Values", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		cq, err := NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", &Options{Checksum: true})
+		So(err, ShouldBeNil)
+		So(cq.Create("foo", ""), ShouldBeNil)
+		So(cq.Create("foo/x", ""), ShouldBeNil)
+		_, err = cq.PushBatch("foo", [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+		So(err, ShouldBeNil)
+
+		key := cq.topics["foo"].messageKey(1)
+		data, err := cq.getData(key)
+		So(err, ShouldBeNil)
+		raw, err := mdb.Get(key)
+		So(err, ShouldBeNil)
+		So(len(raw), ShouldEqual, len(data)+checksumSize)
+
+		flipByte(mdb, key)
+		_, err = cq.getData(key)
+		So(errorCode(err), ShouldEqual, utils.ErrChecksumMismatch)
+		_, data, err = cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "a")
+		// the corrupted one is skipped
+		_, data, err = cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "c")
+
+		So(cq.exportTopics(), ShouldBeNil)
+		for _, t := range cq.topics {
+			t.close()
+		}
+
+		// the storage keeps the checksums without the option
+		rq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		So(rq.checksum, ShouldBeTrue)
+		qs, err := rq.Stat("foo/x")
+		So(err, ShouldBeNil)
+		So(qs.Head, ShouldEqual, 3)
+		for _, t := range rq.topics {
+			t.close()
+		}
+
+		// failing as the ones which do not decode
+		flipByte(mdb, rq.keys.line("foo", "x"))
+		_, err = rq.getData(rq.keys.line("foo", "x"))
+		So(errorCode(err), ShouldEqual, utils.ErrChecksumMismatch)
+		_, err = NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "Checksum Mismatch")
+	})
+
+	Convey("Test Checksums Not Set for a Written Storage", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		pq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		So(pq.checksum, ShouldBeFalse)
+		So(pq.Create("foo", ""), ShouldBeNil)
+		for _, t := range pq.topics {
+			t.close()
+		}
+
+		_, err = NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", &Options{Checksum: true})
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,206 @@
+package queue
+
+import (
+	"bytes"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/buaazp/uq/utils"
+)
+
+const (
+	keyChunkCount     string = "#n"
+	storageKeyChunked string = "UnitedQueueChunked"
+)
+
+// A message value longer than the ChunkSize option is split into the keys
+// "<msgkey>#0", "<msgkey>#1", ... and the number of chunks is written to
+// "<msgkey>#n" after them, while the message key itself is not written. The
+// stored values describe themselves, so a storage written with chunks is
+// read back whatever the ChunkSize is. The storage is marked before its
+// first chunk is written, so the chunks of a message are only looked for in
+// a storage marked or opened with a ChunkSize.
+
+// loadChunked reads the mark of the chunked storage, a storage opened with
+// a ChunkSize is marked too, as it may be written with chunks before the
+// mark existed
+func (u *UnitedQueue) loadChunked() error {
+	_, err := u.getData(storageKeyChunked)
+	if err == nil {
+		atomic.StoreInt32(&u.chunked, 1)
+		return nil
+	}
+	if !isDataNotExisted(err) {
+		return err
+	}
+	if u.opts.ChunkSize <= 0 {
+		return nil
+	}
+	return u.markChunked()
+}
+
+// markChunked marks the storage as holding chunked messages
+func (u *UnitedQueue) markChunked() error {
+	if atomic.LoadInt32(&u.chunked) == 1 {
+		return nil
+	}
+	if !u.opts.ReadOnly {
+		err := u.setData(storageKeyChunked, []byte(keyChunkCount))
+		if err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt32(&u.chunked, 1)
+	return nil
+}
+
+func chunkKey(key string, i int) string {
+	return key + "#" + strconv.Itoa(i)
+}
+
+// writeMessage stores the encoded value of message id, which the storage
+// expires after ttl if it can. 0 means the message never expires.
+func (t *topic) writeMessage(id uint64, buf []byte, ttl time.Duration) error {
+	key := t.messageKey(id)
+	if t.q.cache != nil {
+		t.q.cache.forget(key)
+	}
+	size := t.q.options().ChunkSize
+	if size <= 0 || len(buf) <= size {
+		return t.q.setDataTTL(key, buf, ttl)
+	}
+	err := t.q.markChunked()
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	for i := 0; i < len(buf); i += size {
+		end := i + size
+		if end > len(buf) {
+			end = len(buf)
+		}
+		err := t.q.setDataTTL(chunkKey(key, n), buf[i:end], ttl)
+		if err != nil {
+			return err
+		}
+		n++
+	}
+	return t.q.setDataTTL(key+keyChunkCount, []byte(strconv.Itoa(n)), ttl)
+}
+
+// chunkCount returns the number of chunks of the message key, 0 if it is
+// not chunked. A storage not marked is not probed.
+func (t *topic) chunkCount(key string) (int, error) {
+	if atomic.LoadInt32(&t.q.chunked) == 0 {
+		return 0, nil
+	}
+	data, err := t.q.getData(key + keyChunkCount)
+	if isDataNotExisted(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(string(data))
+	if err != nil {
+		return 0, utils.NewError(
+			utils.ErrInternalError,
+			`chunk count of `+key+` corrupted`,
+		)
+	}
+	return n, nil
+}
+
+// readMessage reads the encoded value of message id, from the read cache if
+// it is there
+func (t *topic) readMessage(id uint64) ([]byte, error) {
+	cache := t.q.cache
+	if cache == nil {
+		return t.readStoredMessage(id)
+	}
+	key := t.messageKey(id)
+	buf, ok := cache.get(key)
+	if ok {
+		return buf, nil
+	}
+	version := cache.version()
+	buf, err := t.readStoredMessage(id)
+	if err == nil && len(buf) > 0 {
+		cache.add(key, buf, version)
+	}
+	return buf, err
+}
+
+// readStoredMessage reads the encoded value of message id from the storage
+func (t *topic) readStoredMessage(id uint64) ([]byte, error) {
+	key := t.messageKey(id)
+	buf, err := t.q.getData(key)
+	if !isDataNotExisted(err) {
+		return buf, err
+	}
+
+	n, cerr := t.chunkCount(key)
+	if cerr != nil {
+		return nil, cerr
+	}
+	if n == 0 {
+		return nil, err
+	}
+	var b bytes.Buffer
+	for i := 0; i < n; i++ {
+		chunk, err := t.q.getData(chunkKey(key, i))
+		if err != nil {
+			return nil, err
+		}
+		b.Write(chunk)
+	}
+	return b.Bytes(), nil
+}
+
+// hasMessage reports whether the value of message id is stored
+func (t *topic) hasMessage(id uint64) (bool, error) {
+	key := t.messageKey(id)
+	_, err := t.q.getData(key)
+	if err == nil {
+		return true, nil
+	}
+	if !isDataNotExisted(err) {
+		return false, err
+	}
+	n, err := t.chunkCount(key)
+	return n > 0, err
+}
+
+// deleteMessage removes the value of message id with all its chunks
+func (t *topic) deleteMessage(id uint64) error {
+	key := t.messageKey(id)
+	if t.q.cache != nil {
+		t.q.cache.remove(key)
+	}
+	err := t.q.delData(key)
+	if err != nil && !isDataNotExisted(err) {
+		return err
+	}
+
+	n, cerr := t.chunkCount(key)
+	if cerr != nil {
+		return cerr
+	}
+	if n == 0 {
+		return err
+	}
+	// the count goes first, so the message is never read half deleted
+	cerr = t.q.delData(key + keyChunkCount)
+	if cerr != nil {
+		return cerr
+	}
+	for i := 0; i < n; i++ {
+		cerr = t.q.delData(chunkKey(key, i))
+		if cerr != nil && !isDataNotExisted(cerr) {
+			return cerr
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package queue
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/buaazp/uq/store"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestChunkedMessages(t *testing.T) {
+	Convey("Test Messages Split Into Chunks", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		opts := &Options{ChunkSize: 4}
+		cq, err := NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", opts)
+		So(err, ShouldBeNil)
+		defer cq.Close()
+
+		So(cq.Create("foo", ""), ShouldBeNil)
+		So(cq.Create("foo/x", ""), ShouldBeNil)
+		big := bytes.Repeat([]byte("0123456789"), 3)
+		So(cq.Push("foo", big), ShouldBeNil)
+		So(cq.Push("foo", []byte("a")), ShouldBeNil)
+
+		tp := cq.topics["foo"]
+		key := tp.messageKey(0)
+		_, err = mdb.Get(key)
+		So(err, ShouldEqual, store.ErrNotExisted)
+		_, err = mdb.Get(chunkKey(key, 0))
+		So(err, ShouldBeNil)
+		_, err = mdb.Get(tp.messageKey(1))
+		So(err, ShouldBeNil)
+
+		So(cq.Reconfigure(Options{}), ShouldBeNil)
+		_, data, err := cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(data, ShouldResemble, big)
+		_, data, err = cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "a")
+
+		So(tp.deleteMessage(0), ShouldBeNil)
+		keys, err := mdb.Keys(key)
+		So(err, ShouldBeNil)
+		So(keys, ShouldBeEmpty)
+		So(tp.deleteMessage(1), ShouldBeNil)
+	})
+
+	Convey("Test the Chunks Probed Only in a Marked Storage", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		cq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+
+		So(cq.Create("foo", ""), ShouldBeNil)
+		So(cq.Push("foo", []byte("0123456789")), ShouldBeNil)
+		tp := cq.topics["foo"]
+		So(mdb.Set(tp.messageKey(5)+keyChunkCount, []byte("1")), ShouldBeNil)
+		n, err := tp.chunkCount(tp.messageKey(5))
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 0)
+		_, err = mdb.Get(storageKeyChunked)
+		So(err, ShouldEqual, store.ErrNotExisted)
+
+		So(cq.Reconfigure(Options{ChunkSize: 4}), ShouldBeNil)
+		So(cq.Push("foo", []byte("0123456789")), ShouldBeNil)
+		_, err = mdb.Get(storageKeyChunked)
+		So(err, ShouldBeNil)
+		n, err = tp.chunkCount(tp.messageKey(1))
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 3)
+		So(cq.exportTopics(), ShouldBeNil)
+		tp.close()
+
+		cq, err = NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer cq.Close()
+		has, err := cq.topics["foo"].hasMessage(1)
+		So(err, ShouldBeNil)
+		So(has, ShouldBeTrue)
+	})
+}
@@ -0,0 +1,22 @@
+package queue
+
+import (
+	"time"
+)
+
+// Clock is the time source of a UnitedQueue. It is used by the recycle and
+// background logics so tests can drive them without sleeping.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
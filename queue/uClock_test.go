@@ -0,0 +1,368 @@
+package queue
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buaazp/uq/store"
+	"github.com/buaazp/uq/utils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+// fakeClock is a Clock which only moves when Advance is called
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1420070400, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ft := &fakeTimer{c.now.Add(d), make(chan time.Time, 1)}
+	c.timers = append(c.timers, ft)
+	return ft.c
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, ft := range c.timers {
+		if !ft.at.After(c.now) {
+			ft.c <- c.now
+		} else {
+			pending = append(pending, ft)
+		}
+	}
+	c.timers = pending
+}
+
+func newClockQueue(clock Clock) (*UnitedQueue, error) {
+	mdb, err := store.NewMemStore()
+	if err != nil {
+		return nil, err
+	}
+	opts := &Options{Clock: clock}
+	return NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", opts)
+}
+
+func TestClockRecycle(t *testing.T) {
+	Convey("Test Recycle With a Fake Clock", t, func() {
+		clock := newFakeClock()
+		cq, err := newClockQueue(clock)
+		So(err, ShouldBeNil)
+		defer cq.Close()
+
+		So(cq.Create("foo", ""), ShouldBeNil)
+		So(cq.Create("foo/x", "1m"), ShouldBeNil)
+		So(cq.Push("foo", []byte("bar")), ShouldBeNil)
+
+		id, data, err := cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "bar")
+
+		_, _, err = cq.Pop("foo/x")
+		So(err, ShouldNotBeNil)
+
+		clock.Advance(59 * time.Second)
+		_, _, err = cq.Pop("foo/x")
+		So(err, ShouldNotBeNil)
+
+		clock.Advance(2 * time.Second)
+		id2, data, err := cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(id2, ShouldEqual, id)
+		So(string(data), ShouldEqual, "bar")
+	})
+}
+
+func TestReconfigure(t *testing.T) {
+	Convey("Test Reconfigure a Running Queue", t, func() {
+		clock := newFakeClock()
+		cq, err := newClockQueue(clock)
+		So(err, ShouldBeNil)
+		defer cq.Close()
+
+		So(cq.Reconfigure(Options{Clock: newFakeClock()}), ShouldNotBeNil)
+		So(cq.Reconfigure(Options{Codec: JSONCodec}), ShouldNotBeNil)
+		So(cq.Reconfigure(Options{CleanInterval: -time.Second}), ShouldNotBeNil)
+		So(cq.Reconfigure(Options{AuditSink: new(recordSink)}), ShouldNotBeNil)
+		So(cq.Reconfigure(Options{StoreOpenTimeout: time.Second}), ShouldNotBeNil)
+		So(cq.Reconfigure(Options{StoreOpenBackoff: time.Hour}), ShouldNotBeNil)
+		So(cq.Reconfigure(Options{ReadOnly: true}), ShouldNotBeNil)
+		So(cq.Reconfigure(Options{Checksum: true}), ShouldNotBeNil)
+		So(cq.Reconfigure(Options{LazyLoad: true}), ShouldNotBeNil)
+
+		So(cq.Create("foo", ""), ShouldBeNil)
+		So(cq.Create("foo/x", ""), ShouldBeNil)
+		So(cq.Reconfigure(Options{
+			Clock:            clock,
+			MaxLinesPerTopic: 1,
+			LineIdleExpire:   time.Minute,
+			CleanInterval:    time.Minute,
+		}), ShouldBeNil)
+		So(cq.Create("foo/y", ""), ShouldNotBeNil)
+
+		removed := false
+		for i := 0; i < 100 && !removed; i++ {
+			clock.Advance(time.Minute)
+			time.Sleep(10 * time.Millisecond)
+			_, err = cq.Stat("foo/x")
+			removed = err != nil
+		}
+		So(removed, ShouldBeTrue)
+	})
+}
+
+func TestDelivered(t *testing.T) {
+	Convey("Test Delivery Count of Recycled Messages", t, func() {
+		clock := newFakeClock()
+		cq, err := newClockQueue(clock)
+		So(err, ShouldBeNil)
+		defer cq.Close()
+
+		So(cq.Create("foo", ""), ShouldBeNil)
+		So(cq.Create("foo/x", "1m"), ShouldBeNil)
+		So(cq.Push("foo", []byte("bar")), ShouldBeNil)
+
+		m, err := cq.PopMessage("foo/x")
+		So(err, ShouldBeNil)
+		So(m.Delivered, ShouldEqual, 1)
+
+		clock.Advance(2 * time.Minute)
+		m, err = cq.PopMessage("foo/x")
+		So(err, ShouldBeNil)
+		So(m.Delivered, ShouldEqual, 2)
+
+		ls := cq.topics["foo"].lines["x"].genLineStore()
+		data, err := ls.Marshal()
+		So(err, ShouldBeNil)
+		var loaded UnitedLineStore
+		So(loaded.Unmarshal(data), ShouldBeNil)
+		So(loaded.Inflights[0].Delivered, ShouldEqual, 2)
+	})
+}
+
+func TestRecycleAt(t *testing.T) {
+	Convey("Test Recycle Time of the Popped Messages", t, func() {
+		clock := newFakeClock()
+		cq, err := newClockQueue(clock)
+		So(err, ShouldBeNil)
+		defer cq.Close()
+
+		So(cq.Create("foo", ""), ShouldBeNil)
+		So(cq.Create("foo/x", "1m"), ShouldBeNil)
+		So(cq.Create("foo/y", ""), ShouldBeNil)
+		req := &CreateRequest{TopicName: "foo", LineName: "z", Recycle: time.Minute, LIFO: true}
+		So(cq.CreateWith(req), ShouldBeNil)
+		So(cq.Push("foo", []byte("bar")), ShouldBeNil)
+
+		m, err := cq.PopMessage("foo/y")
+		So(err, ShouldBeNil)
+		So(m.RecycleAt.IsZero(), ShouldBeTrue)
+		m, err = cq.PopMessage("foo/z")
+		So(err, ShouldBeNil)
+		So(m.RecycleAt, ShouldResemble, clock.Now().Add(time.Minute))
+
+		m, err = cq.PopMessage("foo/x")
+		So(err, ShouldBeNil)
+		So(m.RecycleAt, ShouldResemble, clock.Now().Add(time.Minute))
+		So(cq.ExtendVisibility("foo", "x", m.ID, 2*time.Minute), ShouldBeNil)
+
+		clock.Advance(3 * time.Minute)
+		m, err = cq.PopMessage("foo/x")
+		So(err, ShouldBeNil)
+		So(m.Delivered, ShouldEqual, 2)
+		So(m.RecycleAt, ShouldResemble, clock.Now().Add(time.Minute))
+	})
+}
+
+func TestSetRecycle(t *testing.T) {
+	Convey("Test Set Recycle of an Existing Line", t, func() {
+		clock := newFakeClock()
+		cq, err := newClockQueue(clock)
+		So(err, ShouldBeNil)
+		defer cq.Close()
+
+		So(cq.Create("foo", ""), ShouldBeNil)
+		So(cq.Create("foo/x", "1m"), ShouldBeNil)
+		So(cq.Create("foo/y", ""), ShouldBeNil)
+		So(cq.SetRecycle("foo", "y", time.Minute), ShouldNotBeNil)
+		So(cq.SetRecycle("foo", "x", 0), ShouldNotBeNil)
+		_, err = cq.GetRecycle("foo", "z")
+		So(err, ShouldNotBeNil)
+
+		So(cq.Push("foo", []byte("a")), ShouldBeNil)
+		So(cq.Push("foo", []byte("b")), ShouldBeNil)
+		_, _, err = cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+
+		So(cq.SetRecycle("foo", "x", time.Hour), ShouldBeNil)
+		d, err := cq.GetRecycle("foo", "x")
+		So(err, ShouldBeNil)
+		So(d, ShouldEqual, time.Hour)
+		data, err := cq.getData(cq.keys.lineRecycle("foo", "x"))
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "1h0m0s")
+
+		_, _, err = cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+
+		// the first message keeps the recycle it was popped with
+		clock.Advance(2 * time.Minute)
+		_, data, err = cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "a")
+		_, _, err = cq.Pop("foo/x")
+		So(err, ShouldNotBeNil)
+
+		// a shorter recycle is not held behind the longer ones inflight
+		So(cq.SetRecycle("foo", "x", time.Second), ShouldBeNil)
+		So(cq.Push("foo", []byte("c")), ShouldBeNil)
+		_, data, err = cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "c")
+		clock.Advance(2 * time.Second)
+		_, data, err = cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "c")
+	})
+}
+
+func TestPopDataOwned(t *testing.T) {
+	Convey("Test Popped Data Is Not Shared", t, func() {
+		clock := newFakeClock()
+		cq, err := newClockQueue(clock)
+		So(err, ShouldBeNil)
+		defer cq.Close()
+
+		So(cq.Create("foo", ""), ShouldBeNil)
+		So(cq.Create("foo/x", "1m"), ShouldBeNil)
+		So(cq.Create("foo/y", ""), ShouldBeNil)
+		data := []byte("bar")
+		So(cq.Push("foo", data), ShouldBeNil)
+		data[0] = 'c'
+
+		_, got, err := cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(got), ShouldEqual, "bar")
+		got[0] = 'z'
+
+		_, got, err = cq.Pop("foo/y")
+		So(err, ShouldBeNil)
+		So(string(got), ShouldEqual, "bar")
+
+		clock.Advance(2 * time.Minute)
+		_, got, err = cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(got), ShouldEqual, "bar")
+	})
+}
+
+func TestRecycleNow(t *testing.T) {
+	Convey("Test Recycle the Inflight Messages on Demand", t, func() {
+		clock := newFakeClock()
+		cq, err := newClockQueue(clock)
+		So(err, ShouldBeNil)
+		defer cq.Close()
+
+		So(cq.Create("foo", ""), ShouldBeNil)
+		So(cq.Create("foo/x", "1h"), ShouldBeNil)
+		for _, data := range []string{"a", "b", "c"} {
+			So(cq.Push("foo", []byte(data)), ShouldBeNil)
+		}
+		_, _, err = cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(cq.SetRecycle("foo", "x", time.Minute), ShouldBeNil)
+		_, _, err = cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		_, err = cq.RecycleNow("foo", "y", false)
+		So(err, ShouldNotBeNil)
+
+		// b expires before a, and only b is recycled
+		clock.Advance(2 * time.Minute)
+		n, err := cq.RecycleNow("foo", "x", false)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1)
+		_, data, err := cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "b")
+
+		// b expires before a again, but all of them pop in the order of ids
+		n, err = cq.RecycleNow("foo", "x", true)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 2)
+		_, data, err = cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "a")
+		_, data, err = cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "b")
+		_, data, err = cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "c")
+	})
+}
+
+func TestExtendVisibility(t *testing.T) {
+	Convey("Test Extend the Recycle of an Inflight Message", t, func() {
+		clock := newFakeClock()
+		cq, err := newClockQueue(clock)
+		So(err, ShouldBeNil)
+		defer cq.Close()
+
+		So(cq.Create("foo", ""), ShouldBeNil)
+		So(cq.Create("foo/x", "1m"), ShouldBeNil)
+		So(cq.Create("foo/y", ""), ShouldBeNil)
+		for _, data := range []string{"a", "b"} {
+			So(cq.Push("foo", []byte(data)), ShouldBeNil)
+		}
+		_, _, err = cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		_, _, err = cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+
+		So(errorCode(cq.ExtendVisibility("foo", "x", 2, time.Minute)), ShouldEqual, utils.ErrNotDelivered)
+		So(errorCode(cq.ExtendVisibility("foo", "y", 0, time.Minute)), ShouldEqual, utils.ErrNotDelivered)
+		So(errorCode(cq.ExtendVisibility("foo", "x", 0, 0)), ShouldEqual, utils.ErrBadRequest)
+
+		clock.Advance(30 * time.Second)
+		So(cq.ExtendVisibility("foo", "x", 0, 5*time.Minute), ShouldBeNil)
+		// shorter than the recycle left, kept
+		So(cq.ExtendVisibility("foo", "x", 1, time.Second), ShouldBeNil)
+
+		// b expires at its recycle, a is not held in front of it
+		clock.Advance(31 * time.Second)
+		key, data, err := cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "b")
+		So(cq.Confirm(key), ShouldBeNil)
+		_, _, err = cq.Pop("foo/x")
+		So(err, ShouldNotBeNil)
+
+		clock.Advance(5 * time.Minute)
+		_, data, err = cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "a")
+		So(cq.Confirm("foo/x/0"), ShouldBeNil)
+		So(errorCode(cq.ExtendVisibility("foo", "x", 0, time.Minute)), ShouldEqual, utils.ErrNotDelivered)
+	})
+}
@@ -0,0 +1,279 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+const (
+	storageKeyCodec    string = "UnitedQueueCodec"
+	binaryFlagDeadline byte   = 1 << 0
+	binaryFlagAttrs    byte   = 1 << 1
+	binaryFlagPushed   byte   = 1 << 2
+)
+
+// Envelope is the stored form of a message. Data is the content pushed by
+// the producer, the other fields are the metadata kept with it.
+type Envelope struct {
+	Data []byte
+	// Deadline is the unix nano time the message expires at, 0 means never
+	Deadline int64 `json:",omitempty"`
+	// Attrs is the attributes the message can be found by
+	Attrs map[string]string `json:",omitempty"`
+	// Pushed is the unix nano time the message is pushed at, 0 means
+	// unknown. It is only recorded while a line of the topic has a MaxAge.
+	Pushed int64 `json:",omitempty"`
+}
+
+func (e *Envelope) expired(now time.Time) bool {
+	return e.Deadline > 0 && now.UnixNano() >= e.Deadline
+}
+
+// olderThan tells whether the message is pushed longer than maxAge ago, a
+// message with an unknown push time never is
+func (e *Envelope) olderThan(maxAge time.Duration, now time.Time) bool {
+	return maxAge > 0 && e.Pushed > 0 && now.UnixNano()-e.Pushed > int64(maxAge)
+}
+
+// Codec encodes the envelopes of messages into stored values. The name of
+// the codec is recorded in the storage, so a store is always read back with
+// the codec which wrote it.
+type Codec interface {
+	Name() string
+	Marshal(e *Envelope) ([]byte, error)
+	Unmarshal(data []byte, e *Envelope) error
+}
+
+var (
+	// BinaryCodec is the default compact codec, a flags byte and the
+	// metadata flagged by it followed by the data
+	BinaryCodec Codec = binaryCodec{}
+	// RawCodec stores the data as it is, which is the format of the stores
+	// written before codecs were introduced. It drops all the metadata, and
+	// rejects the deadlines and the attrs, but not the push times which
+	// are recorded without asking.
+	RawCodec Codec = rawCodec{}
+	// JSONCodec stores the envelopes as JSON objects
+	JSONCodec Codec = jsonCodec{}
+	// GobCodec stores the envelopes with encoding/gob
+	GobCodec Codec = gobCodec{}
+)
+
+var codecs = map[string]Codec{
+	BinaryCodec.Name(): BinaryCodec,
+	RawCodec.Name():    RawCodec,
+	JSONCodec.Name():   JSONCodec,
+	GobCodec.Name():    GobCodec,
+}
+
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string {
+	return "binary"
+}
+
+func (binaryCodec) Marshal(e *Envelope) ([]byte, error) {
+	if e.Deadline <= 0 && len(e.Attrs) == 0 && e.Pushed <= 0 {
+		// the plain payload of most pushes is the zero flags byte and the data
+		buf := make([]byte, 1+len(e.Data))
+		copy(buf[1:], e.Data)
+		return buf, nil
+	}
+
+	size := 1 + len(e.Data)
+	var flags byte
+	if e.Deadline > 0 {
+		flags |= binaryFlagDeadline
+		size += 8
+	}
+	if e.Pushed > 0 {
+		flags |= binaryFlagPushed
+		size += 8
+	}
+	var names []string
+	if len(e.Attrs) > 0 {
+		flags |= binaryFlagAttrs
+		size += binary.MaxVarintLen64
+		for name, value := range e.Attrs {
+			names = append(names, name)
+			size += 2*binary.MaxVarintLen64 + len(name) + len(value)
+		}
+		sort.Strings(names)
+	}
+
+	buf := make([]byte, size)
+	buf[0] = flags
+	i := 1
+	if flags&binaryFlagDeadline != 0 {
+		binary.LittleEndian.PutUint64(buf[i:], uint64(e.Deadline))
+		i += 8
+	}
+	if flags&binaryFlagPushed != 0 {
+		binary.LittleEndian.PutUint64(buf[i:], uint64(e.Pushed))
+		i += 8
+	}
+	if flags&binaryFlagAttrs != 0 {
+		i += binary.PutUvarint(buf[i:], uint64(len(names)))
+		for _, name := range names {
+			for _, s := range []string{name, e.Attrs[name]} {
+				i += binary.PutUvarint(buf[i:], uint64(len(s)))
+				i += copy(buf[i:], s)
+			}
+		}
+	}
+	i += copy(buf[i:], e.Data)
+	return buf[:i], nil
+}
+
+// readBinaryString reads a string prefixed by its uvarint length
+func readBinaryString(data []byte) (string, int, error) {
+	l, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < l {
+		return "", 0, errors.New("binary codec: short attrs")
+	}
+	return string(data[n : n+int(l)]), n + int(l), nil
+}
+
+func (binaryCodec) Unmarshal(data []byte, e *Envelope) error {
+	if len(data) < 1 {
+		return errors.New("binary codec: short data")
+	}
+	flags := data[0]
+	i := 1
+	if flags&binaryFlagDeadline != 0 {
+		if len(data) < i+8 {
+			return errors.New("binary codec: short deadline")
+		}
+		e.Deadline = int64(binary.LittleEndian.Uint64(data[i:]))
+		i += 8
+	}
+	if flags&binaryFlagPushed != 0 {
+		if len(data) < i+8 {
+			return errors.New("binary codec: short pushed")
+		}
+		e.Pushed = int64(binary.LittleEndian.Uint64(data[i:]))
+		i += 8
+	}
+	if flags&binaryFlagAttrs != 0 {
+		count, n := binary.Uvarint(data[i:])
+		if n <= 0 {
+			return errors.New("binary codec: short attrs")
+		}
+		i += n
+		e.Attrs = make(map[string]string)
+		for j := uint64(0); j < count; j++ {
+			name, n, err := readBinaryString(data[i:])
+			if err != nil {
+				return err
+			}
+			i += n
+			value, n, err := readBinaryString(data[i:])
+			if err != nil {
+				return err
+			}
+			i += n
+			e.Attrs[name] = value
+		}
+	}
+	e.Data = data[i:]
+	return nil
+}
+
+type rawCodec struct{}
+
+func (rawCodec) Name() string {
+	return "raw"
+}
+
+func (rawCodec) Marshal(e *Envelope) ([]byte, error) {
+	if e.Deadline > 0 {
+		return nil, errors.New("raw codec: cannot store deadline")
+	}
+	if len(e.Attrs) > 0 {
+		return nil, errors.New("raw codec: cannot store attrs")
+	}
+	return e.Data, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, e *Envelope) error {
+	e.Data = data
+	return nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(e *Envelope) ([]byte, error) {
+	return json.Marshal(e)
+}
+
+func (jsonCodec) Unmarshal(data []byte, e *Envelope) error {
+	return json.Unmarshal(data, e)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) Marshal(e *Envelope) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(e)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, e *Envelope) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(e)
+}
+
+// loadCodec picks the codec recorded in the storage, or records the one of
+// the options for a new storage
+func (u *UnitedQueue) loadCodec() error {
+	var name string
+	data, err := u.getData(storageKeyCodec)
+	if err == nil {
+		name = string(data)
+	} else if !isDataNotExisted(err) {
+		return err
+	} else if _, err := u.getData(storageKeyWord); err == nil {
+		// the storage is written before codecs were introduced
+		name = RawCodec.Name()
+	}
+
+	if name == "" {
+		u.codec = u.opts.Codec
+		if u.codec == nil {
+			u.codec = BinaryCodec
+		}
+		if u.opts.ReadOnly {
+			return nil
+		}
+		return u.setData(storageKeyCodec, []byte(u.codec.Name()))
+	}
+
+	if u.opts.Codec != nil {
+		if u.opts.Codec.Name() != name {
+			return errors.New("codec not matched, storage is written by " + name)
+		}
+		u.codec = u.opts.Codec
+		return nil
+	}
+	codec, ok := codecs[name]
+	if !ok {
+		return errors.New("unknown codec of storage: " + name)
+	}
+	u.codec = codec
+	return nil
+}
@@ -0,0 +1,165 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/buaazp/uq/store"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCodecs(t *testing.T) {
+	Convey("Test Codecs Round Trip", t, func() {
+		for _, codec := range codecs {
+			buf, err := codec.Marshal(&Envelope{Data: []byte("bar")})
+			So(err, ShouldBeNil)
+			e := new(Envelope)
+			So(codec.Unmarshal(buf, e), ShouldBeNil)
+			So(string(e.Data), ShouldEqual, "bar")
+		}
+
+		for _, codec := range []Codec{BinaryCodec, JSONCodec, GobCodec} {
+			buf, err := codec.Marshal(&Envelope{Data: []byte("bar"), Deadline: 42})
+			So(err, ShouldBeNil)
+			e := new(Envelope)
+			So(codec.Unmarshal(buf, e), ShouldBeNil)
+			So(string(e.Data), ShouldEqual, "bar")
+			So(e.Deadline, ShouldEqual, 42)
+		}
+		_, err := RawCodec.Marshal(&Envelope{Data: []byte("bar"), Deadline: 42})
+		So(err, ShouldNotBeNil)
+
+		attrs := map[string]string{"color": "red", "size": ""}
+		for _, codec := range []Codec{BinaryCodec, JSONCodec, GobCodec} {
+			buf, err := codec.Marshal(&Envelope{Data: []byte("bar"), Deadline: 42, Attrs: attrs})
+			So(err, ShouldBeNil)
+			e := new(Envelope)
+			So(codec.Unmarshal(buf, e), ShouldBeNil)
+			So(string(e.Data), ShouldEqual, "bar")
+			So(e.Deadline, ShouldEqual, 42)
+			So(e.Attrs, ShouldResemble, attrs)
+		}
+		_, err = RawCodec.Marshal(&Envelope{Data: []byte("bar"), Attrs: attrs})
+		So(err, ShouldNotBeNil)
+
+		for _, codec := range []Codec{BinaryCodec, JSONCodec, GobCodec} {
+			buf, err := codec.Marshal(&Envelope{Data: []byte("bar"), Deadline: 42, Pushed: 7})
+			So(err, ShouldBeNil)
+			e := new(Envelope)
+			So(codec.Unmarshal(buf, e), ShouldBeNil)
+			So(string(e.Data), ShouldEqual, "bar")
+			So(e.Deadline, ShouldEqual, 42)
+			So(e.Pushed, ShouldEqual, 7)
+		}
+		buf, err := RawCodec.Marshal(&Envelope{Data: []byte("bar"), Pushed: 7})
+		So(err, ShouldBeNil)
+		So(string(buf), ShouldEqual, "bar")
+	})
+}
+
+func TestCodecRecorded(t *testing.T) {
+	Convey("Test Codec Is Recorded in Storage", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		opts := &Options{Codec: JSONCodec}
+		cq, err := NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", opts)
+		So(err, ShouldBeNil)
+		So(cq.Create("foo", ""), ShouldBeNil)
+		So(cq.Create("foo/x", ""), ShouldBeNil)
+		So(cq.Push("foo", []byte("bar")), ShouldBeNil)
+		So(cq.exportTopics(), ShouldBeNil)
+
+		_, err = NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", &Options{Codec: GobCodec})
+		So(err, ShouldNotBeNil)
+
+		cq2, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		So(cq2.codec.Name(), ShouldEqual, "json")
+		_, data, err := cq2.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "bar")
+	})
+}
+
+func TestCodecLegacyStorage(t *testing.T) {
+	Convey("Test Legacy Storage Uses Raw Codec", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		lq, err := NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", &Options{Codec: RawCodec})
+		So(err, ShouldBeNil)
+		So(lq.Create("foo", ""), ShouldBeNil)
+		So(lq.Create("foo/x", ""), ShouldBeNil)
+		So(lq.Push("foo", []byte("bar")), ShouldBeNil)
+		So(lq.exportTopics(), ShouldBeNil)
+
+		data, err := mdb.Get(lq.topics["foo"].messageKey(0))
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "bar")
+		So(mdb.Del(storageKeyCodec), ShouldBeNil)
+
+		lq2, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		So(lq2.codec, ShouldEqual, RawCodec)
+		_, data, err = lq2.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "bar")
+	})
+}
+
+func benchmarkCodec(b *testing.B, codec Codec) {
+	data := make([]byte, 256)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf, err := codec.Marshal(&Envelope{Data: data})
+		if err != nil {
+			b.Fatal(err)
+		}
+		var e Envelope
+		err = codec.Unmarshal(buf, &e)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBinaryCodec(b *testing.B) {
+	benchmarkCodec(b, BinaryCodec)
+}
+
+func BenchmarkGobCodec(b *testing.B) {
+	benchmarkCodec(b, GobCodec)
+}
+
+func benchmarkPush(b *testing.B, codec Codec) {
+	mdb, err := store.NewMemStore()
+	if err != nil {
+		b.Fatal(err)
+	}
+	opts := &Options{Codec: codec}
+	bq, err := NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer bq.Close()
+	err = bq.Create("foo", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	data := make([]byte, 256)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err = bq.Push("foo", data)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPushBinary(b *testing.B) {
+	benchmarkPush(b, BinaryCodec)
+}
+
+func BenchmarkPushGob(b *testing.B) {
+	benchmarkPush(b, GobCodec)
+}
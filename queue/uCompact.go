@@ -0,0 +1,50 @@
+package queue
+
+import (
+	"github.com/buaazp/uq/store"
+	"github.com/buaazp/uq/utils"
+)
+
+// Compact deletes the messages every line of the topics has consumed, as
+// the background clean does, and then compacts the storage if it is
+// store.Compactable to give the space of the deleted keys back. It is a
+// no-op for the storage which is not Compactable. Compacting may slow
+// down the queue for a while, so it is meant to be triggered at low
+// traffic.
+func (u *UnitedQueue) Compact() error {
+	err := u.checkWritable("compact")
+	if err != nil {
+		return err
+	}
+
+	u.topicsLock.RLock()
+	topics := make([]*topic, 0, len(u.topics))
+	for _, t := range u.topics {
+		topics = append(topics, t)
+	}
+	u.topicsLock.RUnlock()
+
+	for _, t := range topics {
+		if t.persist {
+			continue
+		}
+		if !t.acquireMaintenance() {
+			continue
+		}
+		t.clean()
+		t.releaseMaintenance()
+	}
+
+	c, ok := u.storage.(store.Compactable)
+	if !ok {
+		return nil
+	}
+	err = c.CompactRange()
+	if err != nil {
+		return utils.NewError(
+			utils.ErrInternalError,
+			err.Error(),
+		)
+	}
+	return nil
+}
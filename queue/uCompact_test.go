@@ -0,0 +1,58 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/buaazp/uq/store"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type compactStore struct {
+	*store.MemStore
+	compacted int
+}
+
+func (c *compactStore) CompactRange() error {
+	c.compacted++
+	return nil
+}
+
+func TestCompact(t *testing.T) {
+	Convey("Test Compact the Consumed Messages", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		cdb := &compactStore{MemStore: mdb}
+		cq, err := NewUnitedQueueWithOptions(cdb, "127.0.0.1", 9689, nil, "uq", &Options{Clock: newFakeClock()})
+		So(err, ShouldBeNil)
+		defer cq.Close()
+
+		So(cq.Create("foo", ""), ShouldBeNil)
+		So(cq.Create("foo/x", ""), ShouldBeNil)
+		_, err = cq.PushBatch("foo", [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+		So(err, ShouldBeNil)
+		for i := 0; i < 2; i++ {
+			_, _, err = cq.Pop("foo/x")
+			So(err, ShouldBeNil)
+		}
+
+		So(cq.Compact(), ShouldBeNil)
+		So(cdb.compacted, ShouldEqual, 1)
+		qs, err := cq.Stat("foo")
+		So(err, ShouldBeNil)
+		So(qs.Head, ShouldEqual, 2)
+		tp := cq.topics["foo"]
+		_, err = cq.getData(tp.messageKey(1))
+		So(isDataNotExisted(err), ShouldBeTrue)
+		_, err = cq.getData(tp.messageKey(2))
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Test Compact a Storage Not Compactable", t, func() {
+		cq, err := newClockQueue(newFakeClock())
+		So(err, ShouldBeNil)
+		defer cq.Close()
+
+		So(cq.Create("foo", ""), ShouldBeNil)
+		So(cq.Compact(), ShouldBeNil)
+	})
+}
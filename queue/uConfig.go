@@ -0,0 +1,402 @@
+package queue
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/buaazp/uq/utils"
+)
+
+const (
+	keyTopicConfig string = ":config"
+	keyLineConfig  string = ":config"
+)
+
+// TopicConfig is the tunables of a topic. The zero value of every field
+// keeps the default behavior.
+type TopicConfig struct {
+	// PushRate is the messages per second the topic accepts, 0 means
+	// unlimited
+	PushRate float64 `json:"pushRate,omitempty"`
+	// PushBurst is the messages the topic accepts at once, defaults to the
+	// PushRate. A batch of more messages is rejected with ErrBadRequest.
+	PushBurst int `json:"pushBurst,omitempty"`
+	// LagThreshold is the lag of a line which fires the LagAlert, for the
+	// lines without their own. 0 means no alert.
+	LagThreshold uint64 `json:"lagThreshold,omitempty"`
+	// PushValidator is the name of the validator registered by
+	// RegisterPushValidator which checks every message pushed, "" means no
+	// check
+	PushValidator string `json:"pushValidator,omitempty"`
+	// Paused makes the pops of every line of the topic return ErrPaused,
+	// the pushes are still accepted
+	Paused bool `json:"paused,omitempty"`
+}
+
+func (t *topic) applyConfig(cfg TopicConfig) {
+	t.configLock.Lock()
+	defer t.configLock.Unlock()
+
+	// the same limits keep the bucket, so a config change like a pause does
+	// not refill it
+	sameLimit := cfg.PushRate == t.config.PushRate && cfg.PushBurst == t.config.PushBurst
+	t.config = cfg
+	if sameLimit && t.limiter != nil {
+		return
+	}
+	t.limiter = nil
+	if cfg.PushRate > 0 {
+		t.limiter = newTokenBucket(cfg.PushRate, cfg.PushBurst, t.q.now())
+	}
+}
+
+// allowPush takes n tokens from the push limiter of the topic, n over the
+// burst is never allowed so it is rejected as a bad request
+func (t *topic) allowPush(n int) error {
+	t.configLock.RLock()
+	limiter := t.limiter
+	t.configLock.RUnlock()
+	if limiter == nil {
+		return nil
+	}
+	if !limiter.fits(n) {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`messages over the push burst`,
+		)
+	}
+	if limiter.take(n, t.q.now()) {
+		return nil
+	}
+	return t.q.backpressure(t.name, BackpressureRateLimited, utils.NewError(
+		utils.ErrRateLimited,
+		`topic push`,
+	))
+}
+
+// checkPaused returns ErrPaused if the topic or the line l is paused
+func (t *topic) checkPaused(l *line, op string) error {
+	t.configLock.RLock()
+	paused := t.config.Paused
+	t.configLock.RUnlock()
+	if !paused {
+		l.configLock.RLock()
+		paused = l.config.Paused
+		l.configLock.RUnlock()
+	}
+	if paused {
+		return utils.NewError(
+			utils.ErrPaused,
+			`topic `+op,
+		)
+	}
+	return nil
+}
+
+// backpressure lets the BackpressureHandler decide on the push into the
+// topic rejected by err
+func (u *UnitedQueue) backpressure(topicName, reason string, err error) error {
+	handler := u.options().BackpressureHandler
+	if handler == nil {
+		return err
+	}
+	return handler(topicName, reason)
+}
+
+func (t *topic) exportConfig(cfg TopicConfig) error {
+	if cfg == (TopicConfig{}) {
+		err := t.q.delData(t.q.keys.topicConfig(t.name))
+		if err != nil && !isDataNotExisted(err) {
+			return err
+		}
+		return nil
+	}
+
+	buf, err := json.Marshal(cfg)
+	if err != nil {
+		return utils.NewError(
+			utils.ErrInternalError,
+			err.Error(),
+		)
+	}
+	return t.q.setData(t.q.keys.topicConfig(t.name), buf)
+}
+
+func (t *topic) loadConfig() error {
+	buf, err := t.q.getData(t.q.keys.topicConfig(t.name))
+	if isDataNotExisted(err) {
+		t.applyConfig(TopicConfig{})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var cfg TopicConfig
+	err = json.Unmarshal(buf, &cfg)
+	if err != nil {
+		return utils.NewError(
+			utils.ErrInternalError,
+			err.Error(),
+		)
+	}
+	t.applyConfig(cfg)
+	return nil
+}
+
+func (t *topic) removeConfigData() error {
+	return t.exportConfig(TopicConfig{})
+}
+
+func (t *topic) configure(cfg TopicConfig) error {
+	if cfg.PushRate < 0 || cfg.PushBurst < 0 {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`negative topic config`,
+		)
+	}
+	if cfg.PushValidator != "" {
+		_, ok := t.q.pushValidator(cfg.PushValidator)
+		if !ok {
+			return utils.NewError(
+				utils.ErrBadRequest,
+				`push validator not registered: `+cfg.PushValidator,
+			)
+		}
+	}
+
+	err := t.exportConfig(cfg)
+	if err != nil {
+		return err
+	}
+	t.applyConfig(cfg)
+	return nil
+}
+
+// LineConfig is the tunables of a line. The zero value of every field keeps
+// the default behavior.
+type LineConfig struct {
+	// ConfirmNoop makes Confirm on a line without recycle succeed, so the
+	// consumers written for the lines with recycle work on it unchanged. By
+	// default such a Confirm returns ErrConfirmNotApplicable, since the
+	// messages of the line are confirmed as soon as they are popped.
+	ConfirmNoop bool `json:"confirmNoop,omitempty"`
+	// LagThreshold is the lag of the line which fires the LagAlert, 0
+	// means the one of the topic
+	LagThreshold uint64 `json:"lagThreshold,omitempty"`
+	// MaxAge drops the messages pushed longer than it ago instead of
+	// popping them, whatever their deadline is, so the line does not work
+	// on stale messages after an outage. Only the messages pushed while a
+	// line of the topic has a MaxAge know their push time, the others are
+	// never dropped for their age. 0 means no limit.
+	MaxAge time.Duration `json:"maxAge,omitempty"`
+	// Weight is the share of the pops of PopWeighted the line gets among
+	// the lines with messages, 0 means 1
+	Weight int `json:"weight,omitempty"`
+	// Paused makes the pops of the line return ErrPaused, its messages
+	// are kept until it is resumed
+	Paused bool `json:"paused,omitempty"`
+}
+
+func (l *line) applyConfig(cfg LineConfig) {
+	l.configLock.Lock()
+	defer l.configLock.Unlock()
+	if aged := cfg.MaxAge > 0; aged != (l.config.MaxAge > 0) {
+		if aged {
+			atomic.AddInt32(&l.t.agedLines, 1)
+		} else {
+			atomic.AddInt32(&l.t.agedLines, -1)
+		}
+	}
+	l.config = cfg
+}
+
+// maxAge returns the MaxAge of the line
+func (l *line) maxAge() time.Duration {
+	l.configLock.RLock()
+	defer l.configLock.RUnlock()
+	return l.config.MaxAge
+}
+
+func (l *line) getConfig() LineConfig {
+	l.configLock.RLock()
+	defer l.configLock.RUnlock()
+	return l.config
+}
+
+func (l *line) exportConfig(cfg LineConfig) error {
+	if cfg == (LineConfig{}) {
+		err := l.t.q.delData(l.configKey)
+		if err != nil && !isDataNotExisted(err) {
+			return err
+		}
+		return nil
+	}
+
+	buf, err := json.Marshal(cfg)
+	if err != nil {
+		return utils.NewError(
+			utils.ErrInternalError,
+			err.Error(),
+		)
+	}
+	return l.t.q.setData(l.configKey, buf)
+}
+
+func (l *line) loadConfig() error {
+	buf, err := l.t.q.getData(l.configKey)
+	if isDataNotExisted(err) {
+		l.applyConfig(LineConfig{})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var cfg LineConfig
+	err = json.Unmarshal(buf, &cfg)
+	if err != nil {
+		return utils.NewError(
+			utils.ErrInternalError,
+			err.Error(),
+		)
+	}
+	l.applyConfig(cfg)
+	return nil
+}
+
+func (l *line) removeConfigData() error {
+	err := l.exportConfig(LineConfig{})
+	if err != nil {
+		return err
+	}
+	l.applyConfig(LineConfig{})
+	return nil
+}
+
+func checkLineConfig(cfg LineConfig) error {
+	if cfg.MaxAge < 0 {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`negative line max age`,
+		)
+	}
+	if cfg.Weight < 0 {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`negative line weight`,
+		)
+	}
+	return nil
+}
+
+func (l *line) configure(cfg LineConfig) error {
+	err := checkLineConfig(cfg)
+	if err != nil {
+		return err
+	}
+	if cfg.MaxAge > 0 && l.t.q.codec == RawCodec {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`raw codec cannot store the push time for max age`,
+		)
+	}
+	err = l.exportConfig(cfg)
+	if err != nil {
+		return err
+	}
+	l.applyConfig(cfg)
+	return nil
+}
+
+// ConfigureLine replaces the config of the line of key "topic/line"
+func (u *UnitedQueue) ConfigureLine(key string, cfg LineConfig) error {
+	t, lName, err := u.lineTopic(key, "configureLine")
+	if err != nil {
+		return err
+	}
+
+	t.loadLazy(lName)
+	t.linesLock.RLock()
+	l, ok := t.lines[lName]
+	t.linesLock.RUnlock()
+	if !ok {
+		return utils.NewError(
+			utils.ErrLineNotExisted,
+			`queue configureLine`,
+		)
+	}
+
+	return l.configure(cfg)
+}
+
+// GetRecycle returns the recycle duration of the line
+func (u *UnitedQueue) GetRecycle(topicName, lineName string) (time.Duration, error) {
+	l, err := u.getLine(topicName, lineName, "getRecycle")
+	if err != nil {
+		return 0, err
+	}
+	return l.getRecycle(), nil
+}
+
+// SetRecycle changes the recycle duration of the line to d. It applies to
+// the messages popped after the change, and d must be positive, since a
+// line without recycle keeps no inflight messages to recycle.
+func (u *UnitedQueue) SetRecycle(topicName, lineName string, d time.Duration) error {
+	l, err := u.getLine(topicName, lineName, "setRecycle")
+	if err != nil {
+		return err
+	}
+	return l.setRecycle(d)
+}
+
+// RecycleNow makes the inflight messages of the line which are past their
+// recycle, or all of them if includeNotExpired is set, the next ones to pop
+// without waiting, and returns how many there are. A line without recycle
+// has no inflight message.
+func (u *UnitedQueue) RecycleNow(topicName, lineName string, includeNotExpired bool) (int, error) {
+	err := u.checkWritable("recycleNow")
+	if err != nil {
+		return 0, err
+	}
+	l, err := u.getLine(topicName, lineName, "recycleNow")
+	if err != nil {
+		return 0, err
+	}
+	return l.recycleNow(includeNotExpired), nil
+}
+
+func (u *UnitedQueue) getLine(topicName, lineName, op string) (*line, error) {
+	t, lName, err := u.lineTopic(topicName+u.opts.Separator+lineName, op)
+	if err != nil {
+		return nil, err
+	}
+
+	t.loadLazy(lName)
+	t.linesLock.RLock()
+	l, ok := t.lines[lName]
+	t.linesLock.RUnlock()
+	if !ok {
+		return nil, utils.NewError(
+			utils.ErrLineNotExisted,
+			`queue `+op,
+		)
+	}
+	return l, nil
+}
+
+// ConfigureTopic replaces the config of the topic
+func (u *UnitedQueue) ConfigureTopic(name string, cfg TopicConfig) error {
+	name = u.trimKey(name)
+
+	t, ok := u.getTopic(name)
+	if !ok {
+		return utils.NewError(
+			utils.ErrTopicNotExisted,
+			`queue configureTopic`,
+		)
+	}
+
+	return t.configure(cfg)
+}
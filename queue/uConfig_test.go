@@ -0,0 +1,269 @@
+package queue
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/buaazp/uq/store"
+	"github.com/buaazp/uq/utils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTopicRateLimit(t *testing.T) {
+	Convey("Test Push Rate Limit of a Topic", t, func() {
+		clock := newFakeClock()
+		rq, err := newClockQueue(clock)
+		So(err, ShouldBeNil)
+		defer rq.Close()
+
+		req := &CreateRequest{TopicName: "foo", TopicConfig: TopicConfig{PushRate: 2}}
+		So(rq.CreateWith(req), ShouldBeNil)
+		So(rq.Push("foo", []byte("a")), ShouldBeNil)
+		So(rq.Push("foo", []byte("b")), ShouldBeNil)
+		err = rq.Push("foo", []byte("c"))
+		So(err, ShouldNotBeNil)
+		So(errorCode(err), ShouldEqual, utils.ErrRateLimited)
+
+		clock.Advance(500 * time.Millisecond)
+		So(rq.Push("foo", []byte("c")), ShouldBeNil)
+		_, err = rq.PushBatch("foo", [][]byte{[]byte("d"), []byte("e")})
+		So(errorCode(err), ShouldEqual, utils.ErrRateLimited)
+		_, err = rq.PushBatch("foo", [][]byte{[]byte("d"), []byte("e"), []byte("f")})
+		So(errorCode(err), ShouldEqual, utils.ErrBadRequest)
+
+		So(rq.ConfigureTopic("foo", TopicConfig{PushRate: 2, Paused: true}), ShouldBeNil)
+		So(errorCode(rq.Push("foo", []byte("d"))), ShouldEqual, utils.ErrRateLimited)
+
+		So(rq.ConfigureTopic("foo", TopicConfig{}), ShouldBeNil)
+		_, err = rq.PushBatch("foo", [][]byte{[]byte("d"), []byte("e")})
+		So(err, ShouldBeNil)
+
+		So(rq.ConfigureTopic("foo", TopicConfig{PushRate: -1}), ShouldNotBeNil)
+		So(rq.ConfigureTopic("bar", TopicConfig{}), ShouldNotBeNil)
+	})
+}
+
+func TestLineConfirmNoop(t *testing.T) {
+	Convey("Test Confirm on a Line Without Recycle", t, func() {
+		clock := newFakeClock()
+		cq, err := newClockQueue(clock)
+		So(err, ShouldBeNil)
+		defer cq.Close()
+
+		So(cq.Create("foo", ""), ShouldBeNil)
+		So(cq.Create("foo/x", ""), ShouldBeNil)
+		So(cq.Push("foo", []byte("a")), ShouldBeNil)
+		key, _, err := cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+
+		err = cq.Confirm(key)
+		So(err, ShouldNotBeNil)
+		So(errorCode(err), ShouldEqual, utils.ErrConfirmNotApplicable)
+
+		So(cq.ConfigureLine("foo/y", LineConfig{ConfirmNoop: true}), ShouldNotBeNil)
+		So(cq.ConfigureLine("foo/x", LineConfig{ConfirmNoop: true}), ShouldBeNil)
+		So(cq.Confirm(key), ShouldBeNil)
+
+		l := cq.topics["foo"].lines["x"]
+		l.applyConfig(LineConfig{})
+		So(l.loadConfig(), ShouldBeNil)
+		So(l.getConfig().ConfirmNoop, ShouldBeTrue)
+
+		So(cq.ConfigureLine("foo/x", LineConfig{}), ShouldBeNil)
+		_, err = cq.getData(l.configKey)
+		So(isDataNotExisted(err), ShouldBeTrue)
+	})
+}
+
+func TestBackpressureHandler(t *testing.T) {
+	Convey("Test Backpressure Handler Decides on the Limited Pushes", t, func() {
+		clock := newFakeClock()
+		bq, err := newClockQueue(clock)
+		So(err, ShouldBeNil)
+		defer bq.Close()
+
+		var reasons []string
+		shed := true
+		handler := func(topicName, reason string) error {
+			reasons = append(reasons, topicName+": "+reason)
+			if shed {
+				return errors.New("shed")
+			}
+			return nil
+		}
+		So(bq.Reconfigure(Options{BackpressureHandler: handler}), ShouldBeNil)
+
+		req := &CreateRequest{TopicName: "foo", TopicConfig: TopicConfig{PushRate: 1}}
+		So(bq.CreateWith(req), ShouldBeNil)
+		So(bq.Push("foo", []byte("a")), ShouldBeNil)
+		err = bq.Push("foo", []byte("b"))
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "shed")
+
+		shed = false
+		So(bq.Push("foo", []byte("b")), ShouldBeNil)
+		So(bq.Push("foo", []byte("c")), ShouldBeNil)
+		So(reasons, ShouldResemble, []string{
+			"foo: " + BackpressureRateLimited,
+			"foo: " + BackpressureRateLimited,
+			"foo: " + BackpressureRateLimited,
+		})
+
+		So(bq.Reconfigure(Options{}), ShouldBeNil)
+		err = bq.Push("foo", []byte("e"))
+		So(errorCode(err), ShouldEqual, utils.ErrRateLimited)
+	})
+}
+
+func TestLineMaxAge(t *testing.T) {
+	Convey("Test Line Drops the Messages Older Than MaxAge", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		clock := newFakeClock()
+		opts := &Options{Clock: clock}
+		aq, err := NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", opts)
+		So(err, ShouldBeNil)
+
+		So(aq.Create("foo", ""), ShouldBeNil)
+		// pushed without a push time, it is never too old
+		So(aq.Push("foo", []byte("z")), ShouldBeNil)
+		req := &CreateRequest{TopicName: "foo", LineName: "x", LineConfig: LineConfig{MaxAge: time.Minute}}
+		So(aq.CreateWith(req), ShouldBeNil)
+		So(aq.Create("foo/y", ""), ShouldBeNil)
+		So(aq.Push("foo", []byte("a")), ShouldBeNil)
+		So(aq.MultiPush("foo", [][]byte{[]byte("m")}), ShouldBeNil)
+		clock.Advance(2 * time.Minute)
+		So(aq.Push("foo", []byte("b")), ShouldBeNil)
+
+		for _, want := range []string{"z", "b"} {
+			_, data, err := aq.Pop("foo/x")
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, want)
+		}
+		_, _, err = aq.Pop("foo/x")
+		So(errorCode(err), ShouldEqual, utils.ErrNone)
+		for _, want := range []string{"z", "a", "m", "b"} {
+			_, data, err := aq.Pop("foo/y")
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, want)
+		}
+
+		So(aq.exportTopics(), ShouldBeNil)
+		for _, t := range aq.topics {
+			t.close()
+		}
+		aq, err = NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", opts)
+		So(err, ShouldBeNil)
+		defer aq.Close()
+		l, err := aq.getLine("foo", "x", "test")
+		So(err, ShouldBeNil)
+		So(l.getConfig().MaxAge, ShouldEqual, time.Minute)
+		tp := l.t
+		So(tp.agedLines, ShouldEqual, 1)
+
+		So(aq.Remove("foo/x"), ShouldBeNil)
+		So(tp.agedLines, ShouldEqual, 0)
+		So(aq.Push("foo", []byte("c")), ShouldBeNil)
+		e, err := tp.getEnvelope(4)
+		So(err, ShouldBeNil)
+		So(e.Pushed, ShouldEqual, 0)
+	})
+
+	Convey("Test Negative MaxAge", t, func() {
+		aq, err := newClockQueue(newFakeClock())
+		So(err, ShouldBeNil)
+		defer aq.Close()
+
+		So(aq.Create("foo", ""), ShouldBeNil)
+		req := &CreateRequest{TopicName: "foo", LineName: "x", LineConfig: LineConfig{MaxAge: -time.Second}}
+		So(errorCode(aq.CreateWith(req)), ShouldEqual, utils.ErrBadRequest)
+		_, err = aq.Stat("foo/x")
+		So(err, ShouldNotBeNil)
+
+		So(aq.Create("foo/x", ""), ShouldBeNil)
+		err = aq.ConfigureLine("foo/x", LineConfig{MaxAge: -time.Second})
+		So(errorCode(err), ShouldEqual, utils.ErrBadRequest)
+	})
+
+	Convey("Test MaxAge With the Raw Codec", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		opts := &Options{Codec: RawCodec}
+		aq, err := NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", opts)
+		So(err, ShouldBeNil)
+		defer aq.Close()
+
+		So(aq.Create("foo", ""), ShouldBeNil)
+		req := &CreateRequest{TopicName: "foo", LineName: "x", LineConfig: LineConfig{MaxAge: time.Minute}}
+		So(errorCode(aq.CreateWith(req)), ShouldEqual, utils.ErrBadRequest)
+		So(aq.Create("foo/x", ""), ShouldBeNil)
+		err = aq.ConfigureLine("foo/x", LineConfig{MaxAge: time.Minute})
+		So(errorCode(err), ShouldEqual, utils.ErrBadRequest)
+	})
+}
+
+func TestPausedPop(t *testing.T) {
+	Convey("Test Pop of a Paused Topic or Line", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		pq, err := NewUnitedQueue(keptStore{mdb}, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		So(pq.Create("foo", ""), ShouldBeNil)
+		So(pq.Create("foo/x", "1m"), ShouldBeNil)
+		So(pq.Create("foo/y", ""), ShouldBeNil)
+
+		_, _, err = pq.Pop("foo/x")
+		So(errors.Is(err, ErrEmpty), ShouldBeTrue)
+		So(errors.Is(err, ErrPaused), ShouldBeFalse)
+
+		So(pq.Push("foo", []byte("a")), ShouldBeNil)
+		So(pq.ConfigureLine("foo/x", LineConfig{Paused: true}), ShouldBeNil)
+		_, _, err = pq.Pop("foo/x")
+		So(errors.Is(err, ErrPaused), ShouldBeTrue)
+		So(errors.Is(err, ErrEmpty), ShouldBeFalse)
+		_, _, err = pq.MultiPop("foo/x", 2)
+		So(errors.Is(err, ErrPaused), ShouldBeTrue)
+		_, err = pq.MultiPopBytes("foo/x", 10)
+		So(errors.Is(err, ErrPaused), ShouldBeTrue)
+		err = pq.Process("foo/x", func(uint64, []byte) error { return nil })
+		So(errors.Is(err, ErrPaused), ShouldBeTrue)
+		_, data, err := pq.Pop("foo/y")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "a")
+
+		So(pq.ConfigureLine("foo/x", LineConfig{}), ShouldBeNil)
+		So(pq.ConfigureTopic("foo", TopicConfig{Paused: true}), ShouldBeNil)
+		_, _, err = pq.Pop("foo/x")
+		So(errors.Is(err, ErrPaused), ShouldBeTrue)
+		_, _, err = pq.Pop("foo/y")
+		So(errors.Is(err, ErrPaused), ShouldBeTrue)
+		So(pq.Push("foo", []byte("b")), ShouldBeNil)
+
+		// the pause is kept in the storage
+		So(pq.exportTopics(), ShouldBeNil)
+		for _, t := range pq.topics {
+			t.close()
+		}
+		pq, err = NewUnitedQueue(keptStore{mdb}, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		_, _, err = pq.Pop("foo/x")
+		So(errors.Is(err, ErrPaused), ShouldBeTrue)
+		So(pq.ConfigureTopic("foo", TopicConfig{}), ShouldBeNil)
+		_, data, err = pq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "a")
+		So(pq.exportTopics(), ShouldBeNil)
+		for _, t := range pq.topics {
+			t.close()
+		}
+
+		rq, err := NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", &Options{ReadOnly: true})
+		So(err, ShouldBeNil)
+		defer rq.Close()
+		_, _, err = rq.Pop("foo/x")
+		So(errors.Is(err, ErrReadOnly), ShouldBeTrue)
+		So(errors.Is(err, ErrEmpty), ShouldBeFalse)
+		So(errors.Is(err, ErrPaused), ShouldBeFalse)
+	})
+}
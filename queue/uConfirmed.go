@@ -0,0 +1,83 @@
+package queue
+
+import (
+	"github.com/buaazp/uq/utils"
+)
+
+const (
+	// RecentConfirms is how many of the last confirmed ids every line
+	// remembers for WasConfirmed
+	RecentConfirms int = 4096
+)
+
+// confirmedIDs is a ring of the ids confirmed last, with the set of them
+type confirmedIDs struct {
+	ids  []uint64
+	next int
+	set  map[uint64]int
+}
+
+func newConfirmedIDs(size int) *confirmedIDs {
+	c := new(confirmedIDs)
+	c.ids = make([]uint64, 0, size)
+	c.set = make(map[uint64]int, size)
+	return c
+}
+
+// add remembers id, and forgets the oldest one if the ring is full
+func (c *confirmedIDs) add(id uint64) {
+	if len(c.ids) < cap(c.ids) {
+		c.ids = append(c.ids, id)
+	} else {
+		old := c.ids[c.next]
+		c.set[old]--
+		if c.set[old] == 0 {
+			delete(c.set, old)
+		}
+		c.ids[c.next] = id
+		c.next = (c.next + 1) % len(c.ids)
+	}
+	c.set[id]++
+}
+
+func (c *confirmedIDs) has(id uint64) bool {
+	return c.set[id] > 0
+}
+
+// confirmed records the confirm of id, the caller must hold
+// l.inflightLock
+func (l *line) confirmed(id uint64) {
+	if l.confirms == nil {
+		l.confirms = newConfirmedIDs(RecentConfirms)
+	}
+	l.confirms.add(id)
+}
+
+// wasConfirmed tells whether id is among the ids confirmed last
+func (l *line) wasConfirmed(id uint64) (bool, error) {
+	if l.getRecycle() == 0 {
+		return false, utils.NewError(
+			utils.ErrConfirmNotApplicable,
+			`line wasConfirmed`,
+		)
+	}
+
+	l.inflightLock.RLock()
+	defer l.inflightLock.RUnlock()
+	return l.confirms != nil && l.confirms.has(id), nil
+}
+
+// WasConfirmed tells whether the message id of the line is among the last
+// RecentConfirms confirmed, so a consumer given a message again after its
+// recycle can tell whether another one already confirmed it. The answer is
+// exact for the ids remembered, false for the older ones, and the ids are
+// only kept in memory, so they are forgotten when the queue restarts.
+func (u *UnitedQueue) WasConfirmed(topicName, lineName string, id uint64) (bool, error) {
+	key := u.confirmKey(topicName, lineName, id)
+	l, err := u.getLine(topicName, lineName, "wasConfirmed")
+	if err != nil {
+		return false, u.wrapError("wasConfirmed", key, err)
+	}
+	ok, err := l.wasConfirmed(id)
+	return ok, u.wrapError("wasConfirmed", key, err)
+}
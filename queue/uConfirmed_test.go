@@ -0,0 +1,69 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buaazp/uq/utils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWasConfirmed(t *testing.T) {
+	Convey("Test the Recently Confirmed IDs of a Line", t, func() {
+		clock := newFakeClock()
+		cq, err := newClockQueue(clock)
+		So(err, ShouldBeNil)
+		defer cq.Close()
+
+		So(cq.Create("foo", ""), ShouldBeNil)
+		So(cq.Create("foo/x", "1m"), ShouldBeNil)
+		So(cq.Create("foo/y", ""), ShouldBeNil)
+		_, err = cq.PushBatch("foo", [][]byte{[]byte("a"), []byte("b")})
+		So(err, ShouldBeNil)
+
+		key, _, err := cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		ok, err := cq.WasConfirmed("foo", "x", 0)
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+
+		// redelivered after the recycle, then confirmed by the first consumer
+		clock.Advance(2 * time.Minute)
+		again, _, err := cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(again, ShouldEqual, key)
+		So(cq.Confirm(key), ShouldBeNil)
+		ok, err = cq.WasConfirmed("foo", "x", 0)
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		_, _, err = cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		n, err := cq.ConfirmUpTo("foo", "x", 1)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1)
+		ok, err = cq.WasConfirmed("foo", "x", 1)
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		_, err = cq.WasConfirmed("foo", "y", 0)
+		So(errorCode(err), ShouldEqual, utils.ErrConfirmNotApplicable)
+		_, err = cq.WasConfirmed("foo", "z", 0)
+		So(errorCode(err), ShouldEqual, utils.ErrLineNotExisted)
+	})
+
+	Convey("Test the Oldest Confirmed IDs Are Forgotten", t, func() {
+		c := newConfirmedIDs(2)
+		c.add(1)
+		c.add(1)
+		c.add(2)
+		So(c.has(1), ShouldBeTrue)
+		c.add(3)
+		So(c.has(1), ShouldBeFalse)
+		So(c.has(2), ShouldBeTrue)
+		So(c.has(3), ShouldBeTrue)
+		c.add(4)
+		So(c.has(2), ShouldBeFalse)
+		So(c.set, ShouldHaveLength, 2)
+	})
+}
@@ -0,0 +1,30 @@
+package queue
+
+import (
+	"github.com/buaazp/uq/utils"
+)
+
+// SaveCursor stores state as the cursor of name, so a consumer can resume
+// its own bookkeeping, e.g. the rotation over several lines, after a
+// restart. The state is opaque to the queue.
+func (u *UnitedQueue) SaveCursor(name string, state []byte) error {
+	if name == "" {
+		return utils.NewError(
+			utils.ErrBadKey,
+			`cursor name is nil`,
+		)
+	}
+	return u.setData(u.keys.cursor(name), state)
+}
+
+// LoadCursor returns the state saved as the cursor of name, or an
+// ErrDataNotExisted error if there is none
+func (u *UnitedQueue) LoadCursor(name string) ([]byte, error) {
+	if name == "" {
+		return nil, utils.NewError(
+			utils.ErrBadKey,
+			`cursor name is nil`,
+		)
+	}
+	return u.getData(u.keys.cursor(name))
+}
@@ -0,0 +1,310 @@
+package queue
+
+import (
+	"log"
+	"strings"
+
+	"github.com/buaazp/uq/utils"
+)
+
+// DrainTo moves the messages of srcTopic which are not delivered to every
+// line yet into dstTopic, and returns how many are moved. The messages a
+// line has not popped or has inflight, or all the messages if there is no
+// line, are pushed to dstTopic in order, then srcTopic and all its lines
+// are left empty. The inflight messages are moved rather than lost, so
+// confirming them on srcTopic fails with ErrNotDelivered afterwards. The
+// pushes to srcTopic wait until it is drained.
+func (u *UnitedQueue) DrainTo(srcTopic, dstTopic string) (int, error) {
+	err := u.checkWritable("drainTo")
+	if err != nil {
+		return 0, err
+	}
+	im, err := u.drainTo(srcTopic, dstTopic, false)
+	if err != nil {
+		return 0, err
+	}
+	return int(im.Messages), nil
+}
+
+// Rotate moves the messages of topicName which are not delivered to every
+// line yet into a new topic archiveName, the way DrainTo does, and leaves
+// topicName empty with its lines, so the consumers go on with the messages
+// pushed after it. The archive has the persistence and the config of the
+// topic but no line, so it keeps the messages until it is drained or
+// removed. The pushes to topicName wait while it is rotated, and each goes
+// to the archive or stays. The messages inflight in the lines with recycle
+// go to the archive as well, and confirming them on topicName fails with
+// ErrNotDelivered afterwards, so none is lost.
+func (u *UnitedQueue) Rotate(topicName, archiveName string) error {
+	err := u.checkWritable("rotate")
+	if err != nil {
+		return err
+	}
+	topicName = u.trimKey(topicName)
+	archiveName = u.trimKey(archiveName)
+	if archiveName == "" || strings.Contains(archiveName, u.opts.Separator) {
+		return utils.NewError(
+			utils.ErrBadKey,
+			`rotate archive name error: `+archiveName,
+		)
+	}
+
+	u.topicsLock.RLock()
+	src, ok := u.topics[u.resolveTopic(topicName)]
+	taken := u.nameTaken(archiveName)
+	err = u.checkMaxTopics()
+	u.topicsLock.RUnlock()
+	if !ok {
+		return utils.NewError(
+			utils.ErrTopicNotExisted,
+			`queue rotate`,
+		)
+	}
+	if taken {
+		return utils.NewError(
+			utils.ErrTopicExisted,
+			`queue rotate`,
+		)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = src.awaitWrites(false)
+	if err != nil {
+		return err
+	}
+	src.configLock.RLock()
+	cfg := src.config
+	src.configLock.RUnlock()
+	archive, err := u.newTopic(archiveName, src.persist, 0, cfg)
+	if err != nil {
+		return err
+	}
+
+	u.drainLock.Lock()
+	defer u.drainLock.Unlock()
+
+	// the archive is added before the drain, which must not hold
+	// u.topicsLock since the pops take it for the dead letters
+	u.topicsLock.Lock()
+	err = u.addArchive(src, archive)
+	u.topicsLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	_, err = src.drainTo(archive, false)
+	if err != nil {
+		u.topicsLock.Lock()
+		delete(u.topics, archiveName)
+		if err := u.exportQueue(); err != nil {
+			log.Printf("topic[%s] export queue after failed rotate error: %s", archiveName, err)
+		}
+		u.topicsLock.Unlock()
+		archive.remove()
+		return err
+	}
+
+	u.registerTopic(archiveName)
+	log.Printf("topic[%s] rotated to topic[%s]", src.name, archiveName)
+	u.emit(LifecycleCreate, archiveName, "")
+	return nil
+}
+
+// addArchive adds the archive of the rotated topic src, or drops it if its
+// name is taken or src is removed meanwhile. The caller must hold
+// u.topicsLock.
+func (u *UnitedQueue) addArchive(src, archive *topic) error {
+	if u.nameTaken(archive.name) {
+		// the same head and tail are exported by both, as in createTopic
+		archive.close()
+		return utils.NewError(
+			utils.ErrTopicExisted,
+			`queue rotate`,
+		)
+	}
+	if u.topics[src.name] != src {
+		archive.remove()
+		return utils.NewError(
+			utils.ErrTopicNotExisted,
+			`queue rotate`,
+		)
+	}
+	err := u.checkMaxTopics()
+	if err != nil {
+		archive.remove()
+		return err
+	}
+
+	u.topics[archive.name] = archive
+	err = u.exportQueue()
+	if err != nil {
+		delete(u.topics, archive.name)
+		archive.remove()
+		return err
+	}
+	return nil
+}
+
+func (u *UnitedQueue) drainTo(srcTopic, dstTopic string, dryRun bool) (*Impact, error) {
+	srcTopic = u.trimKey(srcTopic)
+	dstTopic = u.trimKey(dstTopic)
+	if srcTopic == dstTopic {
+		return nil, utils.NewError(
+			utils.ErrBadRequest,
+			`drain to the same topic`,
+		)
+	}
+
+	u.topicsLock.RLock()
+	src, okSrc := u.topics[u.resolveTopic(srcTopic)]
+	dst, okDst := u.topics[u.resolveTopic(dstTopic)]
+	u.topicsLock.RUnlock()
+	if !okSrc || !okDst {
+		return nil, utils.NewError(
+			utils.ErrTopicNotExisted,
+			`queue drainTo`,
+		)
+	}
+	if src == dst {
+		// one is an alias of the other
+		return nil, utils.NewError(
+			utils.ErrBadRequest,
+			`drain to the same topic`,
+		)
+	}
+
+	for _, t := range []*topic{src, dst} {
+		err := t.awaitWrites(false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// two topics are locked at once, so the drains must not cross
+	u.drainLock.Lock()
+	defer u.drainLock.Unlock()
+
+	return src.drainTo(dst, dryRun)
+}
+
+// drainTo drains the topic into dst, or only returns the impact if dryRun
+// is set
+func (t *topic) drainTo(dst *topic, dryRun bool) (*Impact, error) {
+	t.loadLazyAll()
+	// hold every lock of the topic until it is drained, in the usual order
+	t.linesLock.Lock()
+	defer t.linesLock.Unlock()
+	for _, l := range t.lines {
+		l.inflightLock.Lock()
+		defer l.inflightLock.Unlock()
+		l.headLock.Lock()
+		defer l.headLock.Unlock()
+	}
+	t.headLock.Lock()
+	defer t.headLock.Unlock()
+	t.tailLock.Lock()
+	defer t.tailLock.Unlock()
+
+	// the inflight messages of the lines with recycle are below their
+	// heads, and are moved as well since they are not confirmed yet
+	start := t.head
+	if len(t.lines) > 0 {
+		start = t.tail
+		for _, l := range t.lines {
+			low := l.head
+			if l.getRecycle() > 0 {
+				low = l.ihead
+			}
+			if low < start {
+				start = low
+			}
+		}
+	}
+
+	now := t.q.now()
+	var es []*Envelope
+	for id := start; id < t.tail; id++ {
+		if len(t.lines) > 0 && !t.pendingFor(id) {
+			continue
+		}
+		e, err := t.getEnvelope(id)
+		if err != nil && !isDataNotExisted(err) {
+			return nil, err
+		}
+		if e == nil || len(e.Data) == 0 || e.expired(now) {
+			continue
+		}
+		es = append(es, e)
+	}
+
+	im := new(Impact)
+	for _, l := range t.lines {
+		im.addLine(l.impact(t.tail, false))
+	}
+	im.Messages = uint64(len(es))
+	if dryRun {
+		return im, nil
+	}
+
+	err := dst.pushEnvelopes(es)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, l := range t.lines {
+		l.inflight.Init()
+		l.imap = make(map[uint64]bool)
+		l.ihead = t.tail
+		l.head = t.tail
+		if l.lifo != nil {
+			l.lifo.reset(t.tail)
+		}
+		err = l.exportLine()
+		if err != nil {
+			log.Printf("topic[%s] line[%s] export after drain error: %s", t.name, l.name, err)
+		}
+	}
+	t.head = t.tail
+	err = t.exportHead()
+	if err != nil {
+		log.Printf("topic[%s] export head after drain error: %s", t.name, err)
+	}
+
+	log.Printf("topic[%s] drained %d messages to topic[%s]", t.name, len(es), dst.name)
+	return im, nil
+}
+
+// pushEnvelopes stores es at the tail without the push limit, as they are
+// moved from another topic
+func (t *topic) pushEnvelopes(es []*Envelope) error {
+	if len(es) == 0 {
+		return nil
+	}
+
+	t.tailLock.Lock()
+	defer t.tailLock.Unlock()
+
+	oldTail := t.tail
+	for _, e := range es {
+		err := t.indexAttrs(t.tail, e.Attrs)
+		if err == nil {
+			err = t.setEnvelope(t.tail, e)
+		}
+		if err != nil {
+			t.tail = oldTail
+			return err
+		}
+		t.tail++
+	}
+
+	err := t.exportTail()
+	if err != nil {
+		t.tail = oldTail
+		return err
+	}
+	t.q.auditPushes(t.name, oldTail, len(es))
+	t.notifyPushed()
+	return nil
+}
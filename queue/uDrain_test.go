@@ -0,0 +1,108 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/buaazp/uq/store"
+	"github.com/buaazp/uq/utils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDrainTo(t *testing.T) {
+	Convey("Test Drain a Topic Into Another", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		dq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer dq.Close()
+
+		So(dq.Create("old", ""), ShouldBeNil)
+		So(dq.Create("old/x", "1m"), ShouldBeNil)
+		So(dq.Create("old/y", ""), ShouldBeNil)
+		So(dq.Create("new", ""), ShouldBeNil)
+		So(dq.Create("new/x", ""), ShouldBeNil)
+		_, err = dq.PushBatch("old", [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+		So(err, ShouldBeNil)
+
+		_, err = dq.DrainTo("old", "old")
+		So(err, ShouldNotBeNil)
+		_, err = dq.DrainTo("old", "none")
+		So(err, ShouldNotBeNil)
+
+		_, _, err = dq.Pop("old/x")
+		So(err, ShouldBeNil)
+		key, _, err := dq.Pop("old/x")
+		So(err, ShouldBeNil)
+		So(dq.Confirm("old/x/0"), ShouldBeNil)
+		for i := 0; i < 2; i++ {
+			_, _, err = dq.Pop("old/y")
+			So(err, ShouldBeNil)
+		}
+
+		// b is popped by both lines but still inflight in x
+		n, err := dq.DrainTo("old", "new")
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 2)
+		So(errorCode(dq.Confirm(key)), ShouldEqual, utils.ErrNotDelivered)
+
+		for _, want := range []string{"b", "c"} {
+			_, data, err := dq.Pop("new/x")
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, want)
+		}
+		for _, line := range []string{"old/x", "old/y"} {
+			qs, err := dq.Stat(line)
+			So(err, ShouldBeNil)
+			So(qs.Count, ShouldEqual, 0)
+		}
+		So(dq.topics["old"].getHead(), ShouldEqual, 3)
+	})
+}
+
+func TestRotate(t *testing.T) {
+	Convey("Test Rotate a Topic to an Archive", t, func() {
+		rq, err := newClockQueue(newFakeClock())
+		So(err, ShouldBeNil)
+		defer rq.Close()
+
+		So(rq.Create("foo", ""), ShouldBeNil)
+		So(rq.Create("foo/x", "1m"), ShouldBeNil)
+		So(rq.Create("foo/y", ""), ShouldBeNil)
+		So(rq.Create("bar", ""), ShouldBeNil)
+		_, err = rq.PushBatch("foo", [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+		So(err, ShouldBeNil)
+		key, _, err := rq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		for i := 0; i < 3; i++ {
+			_, _, err = rq.Pop("foo/y")
+			So(err, ShouldBeNil)
+		}
+
+		So(errorCode(rq.Rotate("none", "arc")), ShouldEqual, utils.ErrTopicNotExisted)
+		So(errorCode(rq.Rotate("foo", "foo")), ShouldEqual, utils.ErrTopicExisted)
+		So(errorCode(rq.Rotate("foo", "bar")), ShouldEqual, utils.ErrTopicExisted)
+		So(errorCode(rq.Rotate("foo", "arc/x")), ShouldEqual, utils.ErrBadKey)
+
+		// a is only inflight in foo/x, it goes to the archive too
+		So(rq.Rotate("foo", "arc"), ShouldBeNil)
+		So(errorCode(rq.Confirm(key)), ShouldEqual, utils.ErrNotDelivered)
+		for _, line := range []string{"foo/x", "foo/y"} {
+			_, _, err = rq.Pop(line)
+			So(errorCode(err), ShouldEqual, utils.ErrNone)
+		}
+		So(rq.Push("foo", []byte("d")), ShouldBeNil)
+		_, data, err := rq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "d")
+
+		qs, err := rq.Stat("arc")
+		So(err, ShouldBeNil)
+		So(qs.Lines, ShouldBeEmpty)
+		So(rq.Create("arc/z", ""), ShouldBeNil)
+		for _, want := range []string{"a", "b", "c"} {
+			_, data, err := rq.Pop("arc/z")
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, want)
+		}
+	})
+}
@@ -0,0 +1,123 @@
+package queue
+
+import (
+	"sort"
+
+	"github.com/buaazp/uq/store"
+)
+
+// Impact is what a destructive operation changes, which its dry run reports
+// without changing anything
+type Impact struct {
+	// Topics is the names of the topics and aliases removed
+	Topics []string
+	// Lines is the keys "topic/line" of the lines removed, emptied or
+	// drained
+	Lines []string
+	// Keys is the storage keys of the metadata deleted, the messages are
+	// only counted by Messages
+	Keys []string
+	// Messages is how many messages are dropped, or moved by a drain
+	Messages uint64
+	// Inflights is how many inflight messages are dropped, or moved by a
+	// drain
+	Inflights uint64
+}
+
+// addLine adds the impact of a line of the topic, keeping the messages
+func (im *Impact) addLine(li *Impact) {
+	im.Lines = append(im.Lines, li.Lines...)
+	im.Keys = append(im.Keys, li.Keys...)
+	im.Inflights += li.Inflights
+}
+
+func (im *Impact) sort() {
+	sort.Strings(im.Topics)
+	sort.Strings(im.Lines)
+	sort.Strings(im.Keys)
+}
+
+// impact returns the impact of emptying the line with the topic tail, and
+// the keys it deletes when it is removed if keys is set. The caller must
+// hold l.inflightLock and l.headLock.
+func (l *line) impact(tail uint64, keys bool) *Impact {
+	im := new(Impact)
+	im.Lines = []string{l.t.name + l.t.q.opts.Separator + l.name}
+	im.Inflights = uint64(l.inflight.Len())
+	if l.lifo != nil {
+		im.Messages = l.lifo.count(tail)
+	} else {
+		im.Messages = tail - l.head
+	}
+	if keys {
+		im.Keys = []string{l.storeKey, l.recycleKey}
+		if l.lifo != nil {
+			im.Keys = append(im.Keys, l.lifoKey)
+		}
+	}
+	return im
+}
+
+// removeImpact returns the impact of removing the topic, every message of
+// it is dropped
+func (t *topic) removeImpact() (*Impact, error) {
+	t.loadLazyAll()
+	t.linesLock.RLock()
+	defer t.linesLock.RUnlock()
+	for _, l := range t.lines {
+		l.inflightLock.RLock()
+		defer l.inflightLock.RUnlock()
+		l.headLock.RLock()
+		defer l.headLock.RUnlock()
+	}
+	t.headLock.RLock()
+	defer t.headLock.RUnlock()
+	t.tailLock.RLock()
+	defer t.tailLock.RUnlock()
+
+	im := new(Impact)
+	im.Topics = []string{t.name}
+	for _, l := range t.lines {
+		im.addLine(l.impact(t.tail, true))
+	}
+	im.Keys = append(im.Keys, t.q.keys.topic(t.name), t.headKey, t.tailKey)
+	if store.CanListKeys(t.q.storage) {
+		attrs, err := store.ListKeys(t.q.storage, t.q.keys.attrPrefix(t.name))
+		if err != nil {
+			return nil, err
+		}
+		im.Keys = append(im.Keys, attrs...)
+	}
+	im.Messages = t.tail - t.head
+	return im, nil
+}
+
+// RemoveDryRun returns what Remove of key would remove, without removing
+func (u *UnitedQueue) RemoveDryRun(key string) (*Impact, error) {
+	im, err := u.remove(key, false, true)
+	if err != nil {
+		return nil, u.wrapError("remove", key, err)
+	}
+	im.sort()
+	return im, nil
+}
+
+// EmptyDryRun returns what Empty of key would drop, without emptying
+func (u *UnitedQueue) EmptyDryRun(key string) (*Impact, error) {
+	im, err := u.empty(key, true)
+	if err != nil {
+		return nil, u.wrapError("empty", key, err)
+	}
+	im.sort()
+	return im, nil
+}
+
+// DrainToDryRun returns what DrainTo would move and drop, without draining
+func (u *UnitedQueue) DrainToDryRun(srcTopic, dstTopic string) (*Impact, error) {
+	im, err := u.drainTo(srcTopic, dstTopic, true)
+	if err != nil {
+		return nil, u.wrapError("drain", srcTopic, err)
+	}
+	im.sort()
+	return im, nil
+}
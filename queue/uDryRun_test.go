@@ -0,0 +1,72 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/buaazp/uq/store"
+	"github.com/buaazp/uq/utils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDryRun(t *testing.T) {
+	Convey("Test Dry Runs Report the Impact Without Changes", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		dq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer dq.Close()
+
+		So(dq.Create("foo", ""), ShouldBeNil)
+		So(dq.Create("foo/x", "1m"), ShouldBeNil)
+		So(dq.Create("foo/y", ""), ShouldBeNil)
+		So(dq.Create("bar", ""), ShouldBeNil)
+		So(dq.AliasTopic("baz", "foo"), ShouldBeNil)
+		_, err = dq.PushBatch("foo", [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+		So(err, ShouldBeNil)
+		_, _, err = dq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		_, _, err = dq.Pop("foo/y")
+		So(err, ShouldBeNil)
+		before, err := mdb.Keys("")
+		So(err, ShouldBeNil)
+
+		im, err := dq.RemoveDryRun("foo")
+		So(err, ShouldBeNil)
+		So(im.Topics, ShouldResemble, []string{"baz", "foo"})
+		So(im.Lines, ShouldResemble, []string{"foo/x", "foo/y"})
+		So(im.Keys, ShouldContain, dq.keys.line("foo", "x"))
+		So(im.Keys, ShouldContain, dq.keys.topicHead("foo"))
+		So(im.Messages, ShouldEqual, 3)
+		So(im.Inflights, ShouldEqual, 1)
+
+		im, err = dq.RemoveDryRun("foo/y")
+		So(err, ShouldBeNil)
+		So(im.Lines, ShouldResemble, []string{"foo/y"})
+		So(im.Messages, ShouldEqual, 2)
+
+		im, err = dq.EmptyDryRun("foo")
+		So(err, ShouldBeNil)
+		So(im.Lines, ShouldResemble, []string{"foo/x", "foo/y"})
+		So(im.Keys, ShouldBeEmpty)
+		So(im.Messages, ShouldEqual, 2)
+		So(im.Inflights, ShouldEqual, 1)
+
+		im, err = dq.DrainToDryRun("foo", "bar")
+		So(err, ShouldBeNil)
+		So(im.Messages, ShouldEqual, 3)
+		So(im.Inflights, ShouldEqual, 1)
+		_, err = dq.DrainToDryRun("foo", "baz")
+		So(errorCode(err), ShouldEqual, utils.ErrBadRequest)
+
+		after, err := mdb.Keys("")
+		So(err, ShouldBeNil)
+		So(after, ShouldResemble, before)
+		qs, err := dq.Stat("foo/x")
+		So(err, ShouldBeNil)
+		So(qs.Count, ShouldEqual, 3)
+		qs, err = dq.Stat("bar")
+		So(err, ShouldBeNil)
+		So(qs.Count, ShouldEqual, 0)
+		So(dq.Aliases(), ShouldContainKey, "baz")
+	})
+}
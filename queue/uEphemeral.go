@@ -0,0 +1,43 @@
+package queue
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// touch records a push or a pop of the topic
+func (t *topic) touch() {
+	if t.idleExpire > 0 {
+		atomic.StoreInt64(&t.lastActive, t.q.now().UnixNano())
+	}
+}
+
+// idleExpired tells whether the topic is ephemeral and idle for longer
+// than its IdleExpire at now
+func (t *topic) idleExpired(now time.Time) bool {
+	if t.idleExpire <= 0 {
+		return false
+	}
+	last := atomic.LoadInt64(&t.lastActive)
+	return now.Sub(time.Unix(0, last)) > t.idleExpire
+}
+
+// expireTopic removes the ephemeral topic t if it is still idle. It runs
+// out of the background goroutine of t, which the removal waits for.
+func (u *UnitedQueue) expireTopic(t *topic) {
+	u.topicsLock.RLock()
+	current := u.topics[t.name]
+	u.topicsLock.RUnlock()
+	if current != t || !t.idleExpired(u.now()) {
+		// removed, recreated or touched meanwhile
+		return
+	}
+
+	_, err := u.removeTopic(t.name, false, false)
+	if err != nil {
+		log.Printf("topic[%s] expire error: %s", t.name, err)
+		return
+	}
+	log.Printf("topic[%s] idle for %v, expired.", t.name, t.idleExpire)
+}
@@ -0,0 +1,55 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buaazp/uq/store"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEphemeralTopic(t *testing.T) {
+	Convey("Test Ephemeral Topics Expiring After Idle", t, func() {
+		clock := newFakeClock()
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		opts := &Options{Clock: clock, CleanInterval: time.Minute}
+		eq, err := NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", opts)
+		So(err, ShouldBeNil)
+		defer eq.Close()
+
+		err = eq.CreateWith(&CreateRequest{TopicName: "bad", IdleExpire: -time.Minute})
+		So(err, ShouldNotBeNil)
+
+		req := &CreateRequest{TopicName: "reply", IdleExpire: 3 * time.Minute}
+		So(eq.CreateWith(req), ShouldBeNil)
+		So(eq.Create("reply/x", ""), ShouldBeNil)
+		So(eq.Create("kept", ""), ShouldBeNil)
+
+		data, err := eq.topics["reply"].genTopicStore().Marshal()
+		So(err, ShouldBeNil)
+		var ts UnitedTopicStore
+		So(ts.Unmarshal(data), ShouldBeNil)
+		So(ts.IdleExpire, ShouldEqual, int64(3*time.Minute))
+
+		// the pushes and pops keep the topic alive
+		for i := 0; i < 5; i++ {
+			clock.Advance(time.Minute)
+			time.Sleep(10 * time.Millisecond)
+			So(eq.Push("reply", []byte("bar")), ShouldBeNil)
+			_, _, err = eq.Pop("reply/x")
+			So(err, ShouldBeNil)
+		}
+
+		removed := false
+		for i := 0; i < 100 && !removed; i++ {
+			clock.Advance(time.Minute)
+			time.Sleep(10 * time.Millisecond)
+			_, err = eq.Stat("reply")
+			removed = err != nil
+		}
+		So(removed, ShouldBeTrue)
+		_, err = eq.Stat("kept")
+		So(err, ShouldBeNil)
+	})
+}
@@ -0,0 +1,64 @@
+package queue
+
+import (
+	"strings"
+
+	"github.com/buaazp/uq/utils"
+)
+
+// The errors of the pops to tell apart with errors.Is, they match any error
+// of their code, e.g. errors.Is(err, ErrPaused)
+var (
+	// ErrEmpty is returned by the pops of a line with no message to pop
+	ErrEmpty error = utils.NewError(utils.ErrNone, "")
+	// ErrPaused is returned by the pops of a paused topic or line
+	ErrPaused error = utils.NewError(utils.ErrPaused, "")
+	// ErrReadOnly is returned by the pops and the changes of a queue opened
+	// read only
+	ErrReadOnly error = utils.NewError(utils.ErrReadOnly, "")
+)
+
+// QueueError is returned by Create, Push, Pop and Confirm, and names the
+// topic and the line the operation failed on. Err is the cause, usually a
+// *utils.Error, which errors.Is and errors.As reach through Unwrap.
+type QueueError struct {
+	// Op is the failed operation, e.g. "push"
+	Op string
+	// Topic is the name of the topic
+	Topic string
+	// Line is the name of the line, empty for the topic operations
+	Line string
+	// Err is the cause of the failure
+	Err error
+}
+
+func (e *QueueError) Error() string {
+	name := e.Topic
+	if e.Line != "" {
+		name += "/" + e.Line
+	}
+	return "queue " + e.Op + " " + name + ": " + e.Err.Error()
+}
+
+// Unwrap returns the cause of the failure
+func (e *QueueError) Unwrap() error {
+	return e.Err
+}
+
+// wrapError wraps err of op on key "topic/line/...", nil stays nil
+func (u *UnitedQueue) wrapError(op, key string, err error) error {
+	if err == nil {
+		return nil
+	}
+	key = u.trimKey(key)
+
+	e := new(QueueError)
+	e.Op = op
+	e.Err = err
+	parts := strings.SplitN(key, u.opts.Separator, 3)
+	e.Topic = parts[0]
+	if len(parts) > 1 {
+		e.Line = parts[1]
+	}
+	return e
+}
@@ -29,7 +29,8 @@ func (u *UnitedQueue) nodeRemove(node *etcd.Node) error {
 	key := node.Key
 	name := strings.TrimPrefix(key, "/"+u.etcdKey+"/topics/")
 
-	return u.remove(name, true)
+	_, err := u.remove(name, true, false)
+	return err
 }
 
 func (u *UnitedQueue) pullTopics() error {
@@ -0,0 +1,59 @@
+package queue
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	lifecycleBuffer int = 256
+)
+
+// LifecycleType is the kind of a LifecycleEvent
+type LifecycleType string
+
+// The changes of the topics and lines
+const (
+	LifecycleCreate LifecycleType = "create"
+	LifecycleRemove LifecycleType = "remove"
+)
+
+// LifecycleEvent records a topic or a line which is created or removed. The
+// lines of a removed topic have no event of their own, and the topics made
+// by CreateMany come after their lines, once they are all persisted.
+type LifecycleEvent struct {
+	Type  LifecycleType
+	Topic string
+	// Line is the line changed, empty for a change of the topic
+	Line string `json:",omitempty"`
+	Time time.Time
+}
+
+// Events returns the channel of the lifecycle events of the queue. It is
+// buffered and never closed, and the events which do not fit in the buffer
+// are dropped and counted by EventsDropped, so the queue never waits for
+// the consumer.
+func (u *UnitedQueue) Events() <-chan LifecycleEvent {
+	return u.events
+}
+
+// EventsDropped returns how many lifecycle events are dropped since the
+// queue is created
+func (u *UnitedQueue) EventsDropped() uint64 {
+	return atomic.LoadUint64(&u.eventsDropped)
+}
+
+// emit sends the event of the topic or the line without waiting
+func (u *UnitedQueue) emit(typ LifecycleType, topicName, lineName string) {
+	e := LifecycleEvent{
+		Type:  typ,
+		Topic: topicName,
+		Line:  lineName,
+		Time:  u.now(),
+	}
+	select {
+	case u.events <- e:
+	default:
+		atomic.AddUint64(&u.eventsDropped, 1)
+	}
+}
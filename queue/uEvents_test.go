@@ -0,0 +1,50 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/buaazp/uq/store"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLifecycleEvents(t *testing.T) {
+	Convey("Test Lifecycle Events of Topics and Lines", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		clock := newFakeClock()
+		eq, err := NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", &Options{Clock: clock})
+		So(err, ShouldBeNil)
+		defer eq.Close()
+
+		So(eq.Create("foo", ""), ShouldBeNil)
+		So(eq.Create("foo/x", ""), ShouldBeNil)
+		So(eq.Create("foo/x", ""), ShouldNotBeNil)
+		errs := eq.CreateMany([]*CreateRequest{{TopicName: "bar"}, {TopicName: "bar", LineName: "y"}})
+		So(errs, ShouldResemble, []error{nil, nil})
+		So(eq.Remove("foo/x"), ShouldBeNil)
+		So(eq.Remove("foo"), ShouldBeNil)
+		_, err = eq.RemoveDryRun("bar")
+		So(err, ShouldBeNil)
+
+		var got []LifecycleEvent
+		for len(got) < 6 {
+			got = append(got, <-eq.Events())
+		}
+		So(got, ShouldResemble, []LifecycleEvent{
+			{LifecycleCreate, "foo", "", clock.Now()},
+			{LifecycleCreate, "foo", "x", clock.Now()},
+			{LifecycleCreate, "bar", "y", clock.Now()},
+			{LifecycleCreate, "bar", "", clock.Now()},
+			{LifecycleRemove, "foo", "x", clock.Now()},
+			{LifecycleRemove, "foo", "", clock.Now()},
+		})
+		So(eq.Events(), ShouldBeEmpty)
+		So(eq.EventsDropped(), ShouldEqual, 0)
+
+		// nobody consumes
+		for i := 0; i <= lifecycleBuffer; i++ {
+			eq.emit(LifecycleCreate, "baz", "")
+		}
+		So(eq.EventsDropped(), ShouldEqual, 1)
+	})
+}
@@ -0,0 +1,190 @@
+package queue
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buaazp/uq/utils"
+)
+
+// Inspect decodes the storage key of the queue store, a topic store, a
+// topic head or tail, a line store or a message, and returns its fields by
+// name with a "kind" telling which one it is. The kind is found by matching
+// the key with the keys of the loaded topics and lines, so it works with
+// every key layout. It only reads the storage, and is meant for the admin
+// tools rather than the hot path.
+func (u *UnitedQueue) Inspect(key string) (map[string]interface{}, error) {
+	if key == storageKeyWord {
+		return u.inspectQueue()
+	}
+
+	u.topicsLock.RLock()
+	ts := make([]*topic, 0, len(u.topics))
+	for _, t := range u.topics {
+		ts = append(ts, t)
+	}
+	u.topicsLock.RUnlock()
+
+	for _, t := range ts {
+		res, ok, err := t.inspect(key)
+		if ok || err != nil {
+			return res, err
+		}
+	}
+	return nil, utils.NewError(
+		utils.ErrBadKey,
+		`inspect unknown key `+key,
+	)
+}
+
+func (u *UnitedQueue) inspectQueue() (map[string]interface{}, error) {
+	data, err := u.getData(storageKeyWord)
+	if err != nil {
+		return nil, err
+	}
+	var qs UnitedQueueStore
+	err = qs.Unmarshal(data)
+	if err != nil {
+		return nil, utils.NewError(
+			utils.ErrInternalError,
+			err.Error(),
+		)
+	}
+	return map[string]interface{}{
+		"kind":   "queue",
+		"topics": qs.Topics,
+	}, nil
+}
+
+// inspect decodes key if it is a key of the topic, ok tells whether it is
+func (t *topic) inspect(key string) (res map[string]interface{}, ok bool, err error) {
+	keys := t.q.keys
+	switch key {
+	case keys.topic(t.name):
+		res, err = t.inspectTopic(key)
+		return res, true, err
+	case t.headKey, t.tailKey:
+		res, err = t.inspectOffset(key)
+		return res, true, err
+	}
+
+	t.linesLock.RLock()
+	names := make([]string, 0, len(t.lines)+len(t.lazy))
+	for name := range t.lines {
+		names = append(names, name)
+	}
+	for name := range t.lazy {
+		names = append(names, name)
+	}
+	t.linesLock.RUnlock()
+	for _, name := range names {
+		if key == keys.line(t.name, name) {
+			res, err = t.inspectLine(name)
+			return res, true, err
+		}
+	}
+
+	prefix := t.msgPrefix + ":"
+	if !strings.HasPrefix(key, prefix) {
+		return nil, false, nil
+	}
+	id, perr := strconv.ParseUint(key[len(prefix):], 10, 64)
+	if perr != nil {
+		return nil, false, nil
+	}
+	res, err = t.inspectMessage(id)
+	return res, true, err
+}
+
+func (t *topic) inspectTopic(key string) (map[string]interface{}, error) {
+	data, err := t.q.getData(key)
+	if err != nil {
+		return nil, err
+	}
+	var ts UnitedTopicStore
+	err = ts.Unmarshal(data)
+	if err != nil {
+		return nil, utils.NewError(
+			utils.ErrInternalError,
+			err.Error(),
+		)
+	}
+	return map[string]interface{}{
+		"kind":       "topic",
+		"topic":      t.name,
+		"lines":      ts.Lines,
+		"persist":    ts.Persist,
+		"idleExpire": time.Duration(ts.IdleExpire).String(),
+	}, nil
+}
+
+func (t *topic) inspectOffset(key string) (map[string]interface{}, error) {
+	data, err := t.q.getData(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 8 {
+		return nil, utils.NewError(
+			utils.ErrInternalError,
+			`inspect offset length `+utils.ItoaQuick(len(data)),
+		)
+	}
+	kind := "topicHead"
+	if key == t.tailKey {
+		kind = "topicTail"
+	}
+	return map[string]interface{}{
+		"kind":   kind,
+		"topic":  t.name,
+		"offset": binary.LittleEndian.Uint64(data),
+	}, nil
+}
+
+func (t *topic) inspectLine(name string) (map[string]interface{}, error) {
+	ls, err := t.readLineStore(name)
+	if err != nil {
+		return nil, err
+	}
+	inflights := make([]map[string]interface{}, len(ls.Inflights))
+	for i, msg := range ls.Inflights {
+		inflights[i] = map[string]interface{}{
+			"id":        msg.Tid,
+			"expire":    formatActivity(msg.Exptime),
+			"delivered": msg.Delivered,
+		}
+	}
+	return map[string]interface{}{
+		"kind":        "line",
+		"topic":       t.name,
+		"line":        name,
+		"head":        ls.Head,
+		"ihead":       ls.Ihead,
+		"inflights":   inflights,
+		"lastPop":     formatActivity(ls.LastPop),
+		"lastConfirm": formatActivity(ls.LastConfirm),
+	}, nil
+}
+
+func (t *topic) inspectMessage(id uint64) (map[string]interface{}, error) {
+	e, err := t.getEnvelope(id)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return nil, utils.NewError(
+			utils.ErrDataNotExisted,
+			t.messageKey(id),
+		)
+	}
+	return map[string]interface{}{
+		"kind":     "message",
+		"topic":    t.name,
+		"id":       id,
+		"data":     string(e.Data),
+		"deadline": formatActivity(e.Deadline),
+		"attrs":    e.Attrs,
+		"pushed":   formatActivity(e.Pushed),
+	}, nil
+}
@@ -0,0 +1,57 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/buaazp/uq/store"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestInspect(t *testing.T) {
+	Convey("Test Inspect Decoding the Store Keys", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		iq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer iq.Close()
+
+		So(iq.Create("foo", ""), ShouldBeNil)
+		So(iq.Create("foo/x", "1m"), ShouldBeNil)
+		So(iq.PushWithAttrs("foo", []byte("bar"), map[string]string{"k": "v"}), ShouldBeNil)
+		_, _, err = iq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(iq.exportTopics(), ShouldBeNil)
+
+		res, err := iq.Inspect(storageKeyWord)
+		So(err, ShouldBeNil)
+		So(res["kind"], ShouldEqual, "queue")
+		So(res["topics"], ShouldResemble, []string{"foo"})
+
+		res, err = iq.Inspect(iq.keys.topic("foo"))
+		So(err, ShouldBeNil)
+		So(res["kind"], ShouldEqual, "topic")
+		So(res["lines"], ShouldResemble, []string{"x"})
+
+		res, err = iq.Inspect(iq.keys.topicTail("foo"))
+		So(err, ShouldBeNil)
+		So(res["kind"], ShouldEqual, "topicTail")
+		So(res["offset"], ShouldEqual, uint64(1))
+
+		res, err = iq.Inspect(iq.keys.line("foo", "x"))
+		So(err, ShouldBeNil)
+		So(res["kind"], ShouldEqual, "line")
+		So(res["head"], ShouldEqual, uint64(1))
+		So(len(res["inflights"].([]map[string]interface{})), ShouldEqual, 1)
+
+		res, err = iq.Inspect(iq.topics["foo"].messageKey(0))
+		So(err, ShouldBeNil)
+		So(res["kind"], ShouldEqual, "message")
+		So(res["data"], ShouldEqual, "bar")
+		So(res["attrs"], ShouldResemble, map[string]string{"k": "v"})
+
+		_, err = iq.Inspect(iq.topics["foo"].messageKey(5))
+		So(err, ShouldNotBeNil)
+		_, err = iq.Inspect("nothing")
+		So(err, ShouldNotBeNil)
+	})
+}
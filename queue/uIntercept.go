@@ -0,0 +1,112 @@
+package queue
+
+import (
+	"strings"
+
+	"github.com/buaazp/uq/utils"
+)
+
+// PopInterceptor is called on every message popped from a line before it is
+// returned to the consumer, and returns the message to go on with, e.g. a
+// decrypted copy. Returning an error aborts the pop, and the message stays
+// inflight to be recycled like a message which is not confirmed, so it is
+// lost on a line without recycle.
+type PopInterceptor func(msg *Message) (*Message, error)
+
+// AddPopInterceptor registers fn on the topic of key "topic" or on the line
+// of key "topic/line". The interceptors of the topic run before the ones of
+// the line and each chain runs in registration order.
+func (u *UnitedQueue) AddPopInterceptor(key string, fn PopInterceptor) error {
+	if fn == nil {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`nil pop interceptor`,
+		)
+	}
+	key = u.trimKey(key)
+
+	parts := strings.Split(key, u.opts.Separator)
+	if len(parts) > 2 {
+		return utils.NewError(
+			utils.ErrBadKey,
+			`addPopInterceptor key parts error: `+utils.ItoaQuick(len(parts)),
+		)
+	}
+
+	t, ok := u.getTopic(parts[0])
+	if !ok {
+		return utils.NewError(
+			utils.ErrTopicNotExisted,
+			`queue addPopInterceptor`,
+		)
+	}
+
+	if len(parts) == 1 {
+		t.configLock.Lock()
+		t.interceptors = append(t.interceptors, fn)
+		t.configLock.Unlock()
+		return nil
+	}
+
+	t.loadLazy(parts[1])
+	t.linesLock.RLock()
+	l, ok := t.lines[parts[1]]
+	t.linesLock.RUnlock()
+	if !ok {
+		return utils.NewError(
+			utils.ErrLineNotExisted,
+			`queue addPopInterceptor`,
+		)
+	}
+	l.configLock.Lock()
+	l.interceptors = append(l.interceptors, fn)
+	l.configLock.Unlock()
+	return nil
+}
+
+// intercept runs the interceptors of the topic and the line on m
+func (t *topic) intercept(l *line, m *Message) (*Message, error) {
+	t.configLock.RLock()
+	fns := t.interceptors
+	t.configLock.RUnlock()
+	l.configLock.RLock()
+	lineFns := l.interceptors
+	l.configLock.RUnlock()
+
+	var err error
+	for _, chain := range [][]PopInterceptor{fns, lineFns} {
+		for _, fn := range chain {
+			m, err = fn(m)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return m, nil
+}
+
+// interceptDatas runs the interceptors on the messages popped together
+func (t *topic) interceptDatas(l *line, ids []uint64, datas [][]byte) error {
+	t.configLock.RLock()
+	n := len(t.interceptors)
+	t.configLock.RUnlock()
+	l.configLock.RLock()
+	n += len(l.interceptors)
+	l.configLock.RUnlock()
+	if n == 0 {
+		return nil
+	}
+
+	for i, id := range ids {
+		m := new(Message)
+		m.ID = id
+		m.Key = t.q.confirmKey(t.name, l.name, id)
+		m.Data = datas[i]
+		m, err := t.intercept(l, m)
+		if err != nil {
+			return err
+		}
+		datas[i] = m.Data
+	}
+	return nil
+}
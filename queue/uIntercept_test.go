@@ -0,0 +1,54 @@
+package queue
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPopInterceptor(t *testing.T) {
+	Convey("Test Pop Interceptors Chain in Order", t, func() {
+		clock := newFakeClock()
+		iq, err := newClockQueue(clock)
+		So(err, ShouldBeNil)
+		defer iq.Close()
+
+		So(iq.Create("foo", ""), ShouldBeNil)
+		So(iq.Create("foo/x", "1m"), ShouldBeNil)
+		So(iq.AddPopInterceptor("bar", func(m *Message) (*Message, error) { return m, nil }), ShouldNotBeNil)
+		So(iq.AddPopInterceptor("foo/y", func(m *Message) (*Message, error) { return m, nil }), ShouldNotBeNil)
+
+		So(iq.AddPopInterceptor("foo/x", func(m *Message) (*Message, error) {
+			m.Data = append(m.Data, '2')
+			return m, nil
+		}), ShouldBeNil)
+		So(iq.AddPopInterceptor("foo", func(m *Message) (*Message, error) {
+			m.Data = append(m.Data, '1')
+			return m, nil
+		}), ShouldBeNil)
+
+		So(iq.Push("foo", []byte("a")), ShouldBeNil)
+		_, data, err := iq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "a12")
+
+		denied := errors.New("denied")
+		So(iq.AddPopInterceptor("foo/x", func(m *Message) (*Message, error) {
+			return nil, denied
+		}), ShouldBeNil)
+		So(iq.Push("foo", []byte("b")), ShouldBeNil)
+		_, _, err = iq.Pop("foo/x")
+		So(errors.Is(err, denied), ShouldBeTrue)
+
+		qs, err := iq.Stat("foo/x")
+		So(err, ShouldBeNil)
+		So(qs.Head, ShouldEqual, 2)
+		So(qs.Count, ShouldEqual, 2)
+
+		clock.Advance(2 * time.Minute)
+		_, _, err = iq.MultiPop("foo/x", 2)
+		So(err, ShouldEqual, denied)
+	})
+}
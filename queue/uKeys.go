@@ -0,0 +1,229 @@
+package queue
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+
+	"github.com/buaazp/uq/utils"
+)
+
+const (
+	storageKeyLayout string = "UnitedQueueLayout"
+	storageKeyCursor string = "UnitedQueueCursor:"
+)
+
+// keyLayout builds the storage keys of the topics, lines and messages. The
+// layout is recorded in the storage, so a store is always read back with
+// the layout which wrote it.
+type keyLayout interface {
+	name() string
+	topic(topicName string) string
+	topicHead(topicName string) string
+	topicTail(topicName string) string
+	topicConfig(topicName string) string
+	line(topicName, lineName string) string
+	lineRecycle(topicName, lineName string) string
+	lineConfig(topicName, lineName string) string
+	lineLifo(topicName, lineName string) string
+	cursor(name string) string
+	// attrPrefix is the prefix of the attribute index keys of the topic
+	attrPrefix(topicName string) string
+	// messagePrefix is joined with the id into the message keys by
+	// messageKey
+	messagePrefix(topicName string) string
+}
+
+// messageKey returns the storage key of message id of the topic with the
+// message prefix, which the topic keeps so the names are not escaped for
+// every message. It is the only place the message keys are built, the
+// chunks and the attribute index are keyed from it.
+func messageKey(prefix string, id uint64) string {
+	return utils.Acatui(prefix, ":", id)
+}
+
+// legacyLayout is the layout of the stores written before the layouts were
+// introduced. It joins the names as they are, so a topic "a" with a line
+// "b" collides with a topic "a/b".
+type legacyLayout struct{}
+
+func (legacyLayout) name() string {
+	return "legacy"
+}
+
+func (legacyLayout) topic(topicName string) string {
+	return topicName
+}
+
+func (legacyLayout) topicHead(topicName string) string {
+	return topicName + keyTopicHead
+}
+
+func (legacyLayout) topicTail(topicName string) string {
+	return topicName + keyTopicTail
+}
+
+func (legacyLayout) topicConfig(topicName string) string {
+	return topicName + keyTopicConfig
+}
+
+func (legacyLayout) line(topicName, lineName string) string {
+	return topicName + "/" + lineName
+}
+
+func (legacyLayout) lineRecycle(topicName, lineName string) string {
+	return topicName + "/" + lineName + keyLineRecycle
+}
+
+func (legacyLayout) lineConfig(topicName, lineName string) string {
+	return topicName + "/" + lineName + keyLineConfig
+}
+
+func (legacyLayout) lineLifo(topicName, lineName string) string {
+	return topicName + "/" + lineName + keyLineLifo
+}
+
+func (legacyLayout) cursor(name string) string {
+	return storageKeyCursor + name
+}
+
+func (legacyLayout) attrPrefix(topicName string) string {
+	return topicName + keyTopicAttrs
+}
+
+func (legacyLayout) messagePrefix(topicName string) string {
+	return topicName
+}
+
+// escapedLayout escapes the separators in the names and puts every kind of
+// key under its own prefix, so no two names share a key
+type escapedLayout struct{}
+
+var keyEscaper = strings.NewReplacer("%", "%25", "/", "%2F", ":", "%3A")
+
+func (escapedLayout) name() string {
+	return "escaped"
+}
+
+func (escapedLayout) topic(topicName string) string {
+	return "/t/" + keyEscaper.Replace(topicName)
+}
+
+func (l escapedLayout) topicHead(topicName string) string {
+	return l.topic(topicName) + keyTopicHead
+}
+
+func (l escapedLayout) topicTail(topicName string) string {
+	return l.topic(topicName) + keyTopicTail
+}
+
+func (l escapedLayout) topicConfig(topicName string) string {
+	return l.topic(topicName) + keyTopicConfig
+}
+
+func (escapedLayout) line(topicName, lineName string) string {
+	return "/l/" + keyEscaper.Replace(topicName) + "/" + keyEscaper.Replace(lineName)
+}
+
+func (l escapedLayout) lineRecycle(topicName, lineName string) string {
+	return l.line(topicName, lineName) + keyLineRecycle
+}
+
+func (l escapedLayout) lineConfig(topicName, lineName string) string {
+	return l.line(topicName, lineName) + keyLineConfig
+}
+
+func (l escapedLayout) lineLifo(topicName, lineName string) string {
+	return l.line(topicName, lineName) + keyLineLifo
+}
+
+func (escapedLayout) cursor(name string) string {
+	return "/c/" + keyEscaper.Replace(name)
+}
+
+func (escapedLayout) attrPrefix(topicName string) string {
+	return "/a/" + keyEscaper.Replace(topicName) + "/"
+}
+
+func (escapedLayout) messagePrefix(topicName string) string {
+	return "/m/" + keyEscaper.Replace(topicName)
+}
+
+var layouts = map[string]keyLayout{
+	legacyLayout{}.name():  legacyLayout{},
+	escapedLayout{}.name(): escapedLayout{},
+}
+
+// loadLayout picks the key layout recorded in the storage, or records the
+// escaped layout for a new storage
+func (u *UnitedQueue) loadLayout() error {
+	data, err := u.getData(storageKeyLayout)
+	if err == nil {
+		layout, ok := layouts[string(data)]
+		if !ok {
+			return errors.New("unknown key layout of storage: " + string(data))
+		}
+		u.keys = layout
+		return nil
+	}
+	if !isDataNotExisted(err) {
+		return err
+	}
+
+	if _, err := u.getData(storageKeyWord); err == nil {
+		// the storage is written before layouts were introduced
+		u.keys = legacyLayout{}
+	} else {
+		u.keys = escapedLayout{}
+	}
+	if u.opts.ReadOnly {
+		return nil
+	}
+	return u.setData(storageKeyLayout, []byte(u.keys.name()))
+}
+
+// Separator returns the separator of the keys of the queue
+func (u *UnitedQueue) Separator() string {
+	return u.opts.Separator
+}
+
+// KeySeparator returns the separator of the keys of mq, which is "/"
+// unless mq has a Separator method
+func KeySeparator(mq MessageQueue) string {
+	s, ok := mq.(interface {
+		Separator() string
+	})
+	if !ok {
+		return defaultSeparator
+	}
+	return s.Separator()
+}
+
+// trimKey trims the separators around the key of the topics, the lines and
+// the messages
+func (u *UnitedQueue) trimKey(key string) string {
+	key = strings.TrimPrefix(key, u.opts.Separator)
+	return strings.TrimSuffix(key, u.opts.Separator)
+}
+
+// checkSeparator rejects a separator which may be part of an id, and a
+// custom one where the names are joined with "/" anyway, which is the keys
+// of the legacy layout and the etcd registry
+func (u *UnitedQueue) checkSeparator() error {
+	sep := u.opts.Separator
+	if sep == defaultSeparator {
+		return nil
+	}
+	if strings.IndexFunc(sep, func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r)
+	}) >= 0 {
+		return errors.New("bad separator: " + sep)
+	}
+	if u.keys.name() == (legacyLayout{}).name() {
+		return errors.New("separator " + sep + " not supported by the legacy key layout")
+	}
+	if u.etcdClient != nil {
+		return errors.New("separator " + sep + " not supported with etcd")
+	}
+	return nil
+}
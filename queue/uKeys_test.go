@@ -0,0 +1,172 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/buaazp/uq/store"
+	"github.com/buaazp/uq/utils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestKeyLayoutIsolation(t *testing.T) {
+	Convey("Test Topic a/b Is Isolated From Line b of Topic a", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		kq, err := NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", &Options{Separator: ","})
+		So(err, ShouldBeNil)
+		defer kq.Close()
+		So(kq.keys.name(), ShouldEqual, "escaped")
+
+		So(kq.Create("a", ""), ShouldBeNil)
+		So(kq.Create("a,b", "1m"), ShouldBeNil)
+		So(kq.CreateWith(&CreateRequest{TopicName: "a/b"}), ShouldBeNil)
+		So(kq.CreateWith(&CreateRequest{TopicName: "a:b"}), ShouldBeNil)
+		So(kq.Push("a", []byte("from a")), ShouldBeNil)
+		So(kq.Push("a/b", []byte("from a/b")), ShouldBeNil)
+		So(kq.exportTopics(), ShouldBeNil)
+		So(len(kq.Validate()), ShouldEqual, 0)
+
+		_, data, err := kq.Pop("a,b")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "from a")
+
+		qs, err := kq.Stat("a,b")
+		So(err, ShouldBeNil)
+		So(qs.Name, ShouldEqual, "a,b")
+		So(qs.Type, ShouldEqual, "line")
+		So(qs.Head, ShouldEqual, 1)
+		So(kq.topics["a/b"].getTail(), ShouldEqual, 1)
+
+		keys := make(map[string]bool)
+		for _, name := range []string{"a", "a/b", "a:b"} {
+			for _, key := range []string{
+				kq.keys.topic(name),
+				kq.keys.topicHead(name),
+				kq.keys.topicTail(name),
+				kq.keys.topicConfig(name),
+				kq.keys.line(name, "b"),
+				kq.keys.lineRecycle(name, "b"),
+				kq.keys.lineConfig(name, "b"),
+				kq.keys.cursor(name),
+				kq.keys.attrPrefix(name),
+				kq.topics[name].messageKey(0),
+			} {
+				So(keys[key], ShouldBeFalse)
+				keys[key] = true
+			}
+		}
+	})
+}
+
+func TestKeyLayoutLegacy(t *testing.T) {
+	Convey("Test Legacy Storage Keeps Legacy Layout", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		So(mdb.Set(storageKeyWord, []byte{}), ShouldBeNil)
+
+		lq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer lq.Close()
+		So(lq.keys.name(), ShouldEqual, "legacy")
+
+		So(lq.Create("foo", ""), ShouldBeNil)
+		So(lq.Create("foo/x", ""), ShouldBeNil)
+		So(lq.Push("foo", []byte("bar")), ShouldBeNil)
+		data, err := mdb.Get("foo:0")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "bar")
+		_, err = mdb.Get("foo/x")
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestMessageKeyAgreed(t *testing.T) {
+	Convey("Test Push and Get Agree on the Message Keys", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		mq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer mq.Close()
+
+		So(mq.Create("fo:o", ""), ShouldBeNil)
+		So(mq.Create("fo:o/x", ""), ShouldBeNil)
+		So(mq.PushWithAttrs("fo:o", []byte("bar"), map[string]string{"k": "v"}), ShouldBeNil)
+		tp := mq.topics["fo:o"]
+
+		key := messageKey(mq.keys.messagePrefix("fo:o"), 0)
+		So(tp.messageKey(0), ShouldEqual, key)
+		_, err = mdb.Get(key)
+		So(err, ShouldBeNil)
+		buf, err := tp.readMessage(0)
+		So(err, ShouldBeNil)
+		e := new(Envelope)
+		So(mq.codec.Unmarshal(buf, e), ShouldBeNil)
+		So(string(e.Data), ShouldEqual, "bar")
+		_, err = mdb.Get(tp.attrIndexKey("k", "v", 0))
+		So(err, ShouldBeNil)
+
+		m, err := mq.PopMessage("fo:o/x")
+		So(err, ShouldBeNil)
+		So(m.Key, ShouldEqual, mq.confirmKey("fo:o", "x", 0))
+	})
+}
+
+func TestSeparator(t *testing.T) {
+	Convey("Test a Custom Separator of the Keys", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		sq, err := NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", &Options{Separator: "::"})
+		So(err, ShouldBeNil)
+		defer sq.Close()
+
+		So(sq.Create("a/b", ""), ShouldBeNil)
+		So(sq.Create("a/b::c/d", "1m"), ShouldBeNil)
+		So(errorCode(sq.Create("a/b::c::d", "")), ShouldEqual, utils.ErrBadKey)
+		err = sq.CreateWith(&CreateRequest{TopicName: "a/b", LineName: "e::f"})
+		So(errorCode(err), ShouldEqual, utils.ErrBadKey)
+		So(sq.Push("::a/b::", []byte("x")), ShouldBeNil)
+
+		key, data, err := sq.Pop("a/b::c/d")
+		So(err, ShouldBeNil)
+		So(key, ShouldEqual, "a/b::c/d::0")
+		So(string(data), ShouldEqual, "x")
+		So(sq.Confirm(key), ShouldBeNil)
+
+		_, _, err = sq.Pop("a/b::c/d")
+		So(errorCode(err), ShouldEqual, utils.ErrNone)
+		So(errorCode(sq.Reconfigure(Options{Separator: "/"})), ShouldEqual, utils.ErrBadRequest)
+		So(sq.Reconfigure(Options{Separator: "::"}), ShouldBeNil)
+	})
+
+	Convey("Test the Load Errors Joined by the Separator", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		opts := &Options{Separator: "::"}
+		sq, err := NewUnitedQueueWithOptions(keptStore{mdb}, "127.0.0.1", 9689, nil, "uq", opts)
+		So(err, ShouldBeNil)
+		So(sq.Create("a/b", ""), ShouldBeNil)
+		So(sq.Create("a/b::c/d", ""), ShouldBeNil)
+		So(sq.Close(), ShouldBeNil)
+		So(mdb.Set(sq.keys.lineRecycle("a/b", "c/d"), []byte("bad")), ShouldBeNil)
+
+		sq, err = NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", &Options{Separator: "::"})
+		So(err, ShouldBeNil)
+		defer sq.Close()
+		le, ok := sq.LoadErrors().(*LoadError)
+		So(ok, ShouldBeTrue)
+		So(le.Failures["a/b::c/d"], ShouldNotBeNil)
+	})
+
+	Convey("Test the Separators Not Supported", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		_, err = NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", &Options{Separator: "1"})
+		So(err, ShouldNotBeNil)
+
+		mdb, err = store.NewMemStore()
+		So(err, ShouldBeNil)
+		So(mdb.Set(storageKeyWord, []byte{}), ShouldBeNil)
+		_, err = NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", &Options{Separator: ","})
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,52 @@
+package queue
+
+// lag returns how many messages of the topic the line has not popped yet
+func (l *line) lag() uint64 {
+	tail := l.t.getTail()
+	l.headLock.RLock()
+	defer l.headLock.RUnlock()
+	if l.lifo != nil {
+		return l.lifo.count(tail)
+	}
+	if tail < l.head {
+		return 0
+	}
+	return tail - l.head
+}
+
+// checkLags calls the LagAlert for the lines of the topic which fall behind
+// their LagThreshold, and the LagRecovered for the alerted ones which catch
+// up or have the threshold removed. It is called by the background
+// goroutine, so every crossing is reported once.
+func (t *topic) checkLags() {
+	opts := t.q.options()
+	t.configLock.RLock()
+	topicThreshold := t.config.LagThreshold
+	t.configLock.RUnlock()
+
+	t.linesLock.RLock()
+	lines := make([]*line, 0, len(t.lines))
+	for _, l := range t.lines {
+		lines = append(lines, l)
+	}
+	t.linesLock.RUnlock()
+
+	for _, l := range lines {
+		threshold := l.getConfig().LagThreshold
+		if threshold == 0 {
+			threshold = topicThreshold
+		}
+		lag := l.lag()
+		if !l.lagging && threshold > 0 && lag > threshold {
+			l.lagging = true
+			if opts.LagAlert != nil {
+				opts.LagAlert(t.name, l.name, lag)
+			}
+		} else if l.lagging && (threshold == 0 || lag <= threshold) {
+			l.lagging = false
+			if opts.LagRecovered != nil {
+				opts.LagRecovered(t.name, l.name, lag)
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/buaazp/uq/store"
+	"github.com/buaazp/uq/utils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLagAlert(t *testing.T) {
+	Convey("Test Lag Alerts Fire Once per Crossing", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		var alerts, recoveries []string
+		opts := &Options{
+			Clock: newFakeClock(),
+			LagAlert: func(topicName, lineName string, lag uint64) {
+				alerts = append(alerts, topicName+"/"+lineName+":"+utils.ItoaQuick(int(lag)))
+			},
+			LagRecovered: func(topicName, lineName string, lag uint64) {
+				recoveries = append(recoveries, topicName+"/"+lineName+":"+utils.ItoaQuick(int(lag)))
+			},
+		}
+		lq, err := NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", opts)
+		So(err, ShouldBeNil)
+		defer lq.Close()
+
+		req := &CreateRequest{TopicName: "foo", TopicConfig: TopicConfig{LagThreshold: 2}}
+		So(lq.CreateWith(req), ShouldBeNil)
+		So(lq.Create("foo/x", ""), ShouldBeNil)
+		So(lq.Create("foo/y", ""), ShouldBeNil)
+		So(lq.ConfigureLine("foo/y", LineConfig{LagThreshold: 5}), ShouldBeNil)
+		tp := lq.topics["foo"]
+
+		_, err = lq.PushBatch("foo", [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+		So(err, ShouldBeNil)
+		tp.checkLags()
+		tp.checkLags()
+		So(alerts, ShouldResemble, []string{"foo/x:3"})
+		So(recoveries, ShouldBeEmpty)
+
+		_, _, err = lq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		tp.checkLags()
+		So(recoveries, ShouldResemble, []string{"foo/x:2"})
+
+		_, err = lq.PushBatch("foo", [][]byte{[]byte("d"), []byte("e"), []byte("f")})
+		So(err, ShouldBeNil)
+		alerts = nil
+		tp.checkLags()
+		So(alerts, ShouldHaveLength, 2)
+		So(alerts, ShouldContain, "foo/x:5")
+		So(alerts, ShouldContain, "foo/y:6")
+
+		// no threshold left for x
+		So(lq.ConfigureTopic("foo", TopicConfig{}), ShouldBeNil)
+		recoveries = nil
+		tp.checkLags()
+		So(recoveries, ShouldResemble, []string{"foo/x:5"})
+	})
+}
@@ -0,0 +1,76 @@
+package queue
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+)
+
+// readLineStore reads the stored offsets and inflight messages of the line
+func (t *topic) readLineStore(lineName string) (UnitedLineStore, error) {
+	var ls UnitedLineStore
+	lineStoreKey := t.q.keys.line(t.name, lineName)
+	lineStoreData, err := t.q.getData(lineStoreKey)
+	if err != nil {
+		return ls, err
+	}
+	if len(lineStoreData) == 0 {
+		return ls, errors.New("line backup data missing: " + lineStoreKey)
+	}
+	err = ls.Unmarshal(lineStoreData)
+	return ls, err
+}
+
+// lazyLoaded tells whether every line of the topic is loaded
+func (t *topic) lazyLoaded() bool {
+	return atomic.LoadInt32(&t.lazyCount) == 0
+}
+
+// loadLazy loads the line left by LazyLoad, if it is not loaded yet. The
+// caller must not hold t.linesLock.
+func (t *topic) loadLazy(name string) {
+	if t.lazyLoaded() {
+		return
+	}
+	t.linesLock.Lock()
+	defer t.linesLock.Unlock()
+	if t.lazy[name] {
+		t.loadLazyLocked(name)
+	}
+}
+
+// loadLazyAll loads all the lines left by LazyLoad. The caller must not
+// hold t.linesLock.
+func (t *topic) loadLazyAll() {
+	if t.lazyLoaded() {
+		return
+	}
+	t.linesLock.Lock()
+	defer t.linesLock.Unlock()
+	t.loadLazyAllLocked()
+}
+
+// loadLazyAllLocked loads all the lines left by LazyLoad, the caller must
+// hold t.linesLock
+func (t *topic) loadLazyAllLocked() {
+	for name := range t.lazy {
+		t.loadLazyLocked(name)
+	}
+}
+
+// loadLazyLocked loads the line, the caller must hold t.linesLock
+func (t *topic) loadLazyLocked(name string) {
+	delete(t.lazy, name)
+	atomic.AddInt32(&t.lazyCount, -1)
+
+	ls, err := t.readLineStore(name)
+	if err == nil {
+		var l *line
+		l, err = t.loadLine(name, ls)
+		if err == nil {
+			t.lines[name] = l
+			return
+		}
+	}
+	log.Printf("line[%s/%s] lazy load error, dropped: %s", t.name, name, err)
+}
@@ -0,0 +1,65 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/buaazp/uq/store"
+	"github.com/buaazp/uq/utils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLazyLoad(t *testing.T) {
+	Convey("Test Lazy Load the Lines When They Are First Used", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		eq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		for _, key := range []string{"foo", "foo/x", "foo/y", "foo/z"} {
+			So(eq.Create(key, ""), ShouldBeNil)
+		}
+		_, err = eq.PushBatch("foo", [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+		So(err, ShouldBeNil)
+		_, _, err = eq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(eq.exportTopics(), ShouldBeNil)
+		for _, t := range eq.topics {
+			t.close()
+		}
+		So(mdb.Set(eq.keys.lineRecycle("foo", "z"), []byte("bad")), ShouldBeNil)
+
+		opts := &Options{LazyLoad: true}
+		lq, err := NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", opts)
+		So(err, ShouldBeNil)
+		So(lq.LoadErrors(), ShouldBeNil)
+		foo := lq.topics["foo"]
+		So(foo.lines, ShouldBeEmpty)
+		So(foo.lazyLoaded(), ShouldBeFalse)
+		So(foo.getEnd(), ShouldEqual, 0)
+
+		_, data, err := lq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "b")
+		So(foo.lines, ShouldHaveLength, 1)
+		So(lq.Create("foo/y", ""), ShouldNotBeNil)
+
+		// the lines not loaded stay in the topic store
+		So(lq.exportTopics(), ShouldBeNil)
+		topicData, err := mdb.Get(lq.keys.topic("foo"))
+		So(err, ShouldBeNil)
+		var ts UnitedTopicStore
+		So(ts.Unmarshal(topicData), ShouldBeNil)
+		So(ts.Lines, ShouldHaveLength, 3)
+
+		qs, err := lq.Stat("foo/y")
+		So(err, ShouldBeNil)
+		So(qs.Head, ShouldEqual, 0)
+		_, err = lq.Stat("foo/z")
+		So(errorCode(err), ShouldEqual, utils.ErrLineNotExisted)
+		So(foo.lazyLoaded(), ShouldBeTrue)
+
+		qs, err = lq.Stat("foo")
+		So(err, ShouldBeNil)
+		So(qs.Lines, ShouldHaveLength, 2)
+		lq.Close()
+	})
+}
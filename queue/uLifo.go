@@ -0,0 +1,175 @@
+package queue
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/buaazp/uq/utils"
+)
+
+const (
+	keyLineLifo string = ":lifo"
+)
+
+// lifoState is the undelivered ids of a LIFO line. The ids from Mark to the
+// tail of the topic are pushed after the last pop from the tail, and Ranges
+// is a stack of the half-open id ranges left below by the earlier pops, the
+// lowest range at the bottom. A LIFO line pops the newest pushed message
+// first and the older ones only when no newer one is left, so the old
+// messages starve as long as the pushes keep up with the pops.
+type lifoState struct {
+	Mark   uint64
+	Ranges [][2]uint64 `json:",omitempty"`
+}
+
+// next returns the id to pop with the topic tail, false if there is none
+func (s *lifoState) next(tail uint64) (uint64, bool) {
+	if tail > s.Mark {
+		return tail - 1, true
+	}
+	if n := len(s.Ranges); n > 0 {
+		return s.Ranges[n-1][1] - 1, true
+	}
+	return 0, false
+}
+
+// take marks the id returned by next as delivered
+func (s *lifoState) take(id uint64) {
+	if id >= s.Mark {
+		if id > s.Mark {
+			s.Ranges = append(s.Ranges, [2]uint64{s.Mark, id})
+		}
+		s.Mark = id + 1
+		return
+	}
+	n := len(s.Ranges)
+	s.Ranges[n-1][1]--
+	if s.Ranges[n-1][0] == s.Ranges[n-1][1] {
+		s.Ranges = s.Ranges[:n-1]
+	}
+}
+
+// low returns the lowest undelivered id, which is the head of the line
+func (s *lifoState) low() uint64 {
+	if len(s.Ranges) > 0 {
+		return s.Ranges[0][0]
+	}
+	return s.Mark
+}
+
+// count returns how many ids are undelivered with the topic tail
+func (s *lifoState) count(tail uint64) uint64 {
+	var n uint64
+	if tail > s.Mark {
+		n = tail - s.Mark
+	}
+	for _, r := range s.Ranges {
+		n += r[1] - r[0]
+	}
+	return n
+}
+
+// reset makes every id below the topic tail delivered
+func (s *lifoState) reset(tail uint64) {
+	s.Mark = tail
+	s.Ranges = nil
+}
+
+func (l *line) exportLifo() error {
+	buf, err := json.Marshal(l.lifo)
+	if err != nil {
+		return utils.NewError(
+			utils.ErrInternalError,
+			err.Error(),
+		)
+	}
+	return l.t.q.setData(l.lifoKey, buf)
+}
+
+// loadLifo loads the LIFO state of the line, which is not LIFO if there is
+// none in the storage
+func (l *line) loadLifo() error {
+	buf, err := l.t.q.getData(l.lifoKey)
+	if isDataNotExisted(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s := new(lifoState)
+	err = json.Unmarshal(buf, s)
+	if err != nil {
+		return utils.NewError(
+			utils.ErrInternalError,
+			err.Error(),
+		)
+	}
+	l.lifo = s
+	return nil
+}
+
+func (l *line) removeLifoData() error {
+	if l.lifo == nil {
+		return nil
+	}
+	return l.t.q.delData(l.lifoKey)
+}
+
+// popLIFO pops the newest undelivered message of a LIFO line like popFit,
+// the caller must hold l.inflightLock and l.headLock
+func (l *line) popLIFO(now time.Time, limit int) (*Message, error) {
+	for {
+		tid, ok := l.lifo.next(l.t.getTail())
+		if !ok {
+			return nil, utils.NewError(
+				utils.ErrNone,
+				`line pop`,
+			)
+		}
+		e, skip, err := l.getMessage(tid, now)
+		if err != nil {
+			return nil, err
+		}
+		if !skip && !fits(e, limit) {
+			return nil, nil
+		}
+
+		l.lifo.take(tid)
+		l.head = l.lifo.low()
+		if skip {
+			l.skip(tid)
+			continue
+		}
+
+		if l.getRecycle() > 0 {
+			msg := new(InflightMessage)
+			msg.Tid = tid
+			msg.Exptime = now.Add(l.getRecycle()).UnixNano()
+			msg.Delivered = 1
+
+			l.pushInflight(msg)
+			l.imap[tid] = true
+			return l.inflightMessage(msg, e), nil
+		}
+		return l.newMessage(tid, e, 1), nil
+	}
+}
+
+// mPopLIFO pops at most n messages of a LIFO line one by one
+func (l *line) mPopLIFO(n int) ([]uint64, [][]byte, error) {
+	var ids []uint64
+	var datas [][]byte
+	for len(ids) < n {
+		m, err := l.pop()
+		if err != nil {
+			if len(ids) > 0 {
+				break
+			}
+			return nil, nil, err
+		}
+		ids = append(ids, m.ID)
+		datas = append(datas, m.Data)
+	}
+	return ids, datas, nil
+}
@@ -0,0 +1,57 @@
+package queue
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket limits the rate of pushing, it holds up to burst tokens and
+// refills rate tokens per second
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	b := new(tokenBucket)
+	b.rate = rate
+	b.burst = float64(burst)
+	if b.burst < 1 {
+		b.burst = rate
+	}
+	if b.burst < 1 {
+		b.burst = 1
+	}
+	b.tokens = b.burst
+	b.last = now
+	return b
+}
+
+// fits tells if n tokens can ever be taken at once
+func (b *tokenBucket) fits(n int) bool {
+	return float64(n) <= b.burst
+}
+
+// take takes n tokens if there are enough of them
+func (b *tokenBucket) take(n int, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+
+	need := float64(n)
+	if b.tokens < need {
+		return false
+	}
+	b.tokens -= need
+	return true
+}
@@ -3,7 +3,9 @@ package queue
 import (
 	"container/list"
 	"log"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/buaazp/uq/utils"
@@ -14,16 +16,37 @@ type line struct {
 	head         uint64
 	headLock     sync.RWMutex
 	recycle      time.Duration
+	storeKey     string
 	recycleKey   string
+	configKey    string
+	lifoKey      string
+	lifo         *lifoState
+	config       LineConfig
+	interceptors []PopInterceptor
+	configLock   sync.RWMutex
 	inflight     *list.List
 	inflightLock sync.RWMutex
 	ihead        uint64
 	imap         map[uint64]bool
-	t            *topic
+	lastPop      int64
+	lastConfirm  int64
+	since        int64
+	waiters      map[uint64]chan bool
+	waitersLock  sync.Mutex
+	// lagging is set after the LagAlert of the line, it is only used by
+	// the background goroutine of the topic
+	lagging bool
+	t       *topic
+
+	// confirms is the ids confirmed last, nil until the first confirm
+	confirms *confirmedIDs
+	// weighted is the current weight of the line in PopWeighted, guarded
+	// by the weightedLock of the queue
+	weighted int
 }
 
 func (l *line) exportRecycle() error {
-	lineRecycleData := []byte(l.recycle.String())
+	lineRecycleData := []byte(l.getRecycle().String())
 	err := l.t.q.setData(l.recycleKey, lineRecycleData)
 	if err != nil {
 		return err
@@ -39,6 +62,49 @@ func (l *line) removeRecycleData() error {
 	return nil
 }
 
+// getRecycle returns the recycle duration of the line. setRecycle changes
+// it atomically, so it is always read through here.
+func (l *line) getRecycle() time.Duration {
+	return time.Duration(atomic.LoadInt64((*int64)(&l.recycle)))
+}
+
+// setRecycle persists and applies the recycle duration d of the line. The
+// messages already inflight keep the expire time they were popped with.
+func (l *line) setRecycle(d time.Duration) error {
+	l.inflightLock.Lock()
+	defer l.inflightLock.Unlock()
+
+	if d <= 0 || l.recycle == 0 {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`line setRecycle cannot turn recycle on or off`,
+		)
+	}
+	old := l.recycle
+	atomic.StoreInt64((*int64)(&l.recycle), int64(d))
+	err := l.exportRecycle()
+	if err != nil {
+		atomic.StoreInt64((*int64)(&l.recycle), int64(old))
+		return err
+	}
+	l.t.q.registerLine(l.t.name, l.name, d.String())
+	return nil
+}
+
+// pushInflight adds msg to the inflight list in the order of the expire
+// time, so the front is always the first to expire. The new ones expire
+// last unless the recycle is shortened, so it looks from the back. The
+// caller must hold l.inflightLock.
+func (l *line) pushInflight(msg *InflightMessage) {
+	for m := l.inflight.Back(); m != nil; m = m.Prev() {
+		if m.Value.(*InflightMessage).Exptime <= msg.Exptime {
+			l.inflight.InsertAfter(msg, m)
+			return
+		}
+	}
+	l.inflight.PushFront(msg)
+}
+
 func (l *line) genLineStore() *UnitedLineStore {
 	inflights := make([]*InflightMessage, l.inflight.Len())
 	i := 0
@@ -53,33 +119,31 @@ func (l *line) genLineStore() *UnitedLineStore {
 	ls.Head = l.head
 	ls.Inflights = inflights
 	ls.Ihead = l.ihead
+	ls.LastPop = l.lastPop
+	ls.LastConfirm = l.lastConfirm
 	return ls
 }
 
 func (l *line) exportLine() error {
 	// log.Printf("start export line[%s]...", l.name)
 	ls := l.genLineStore()
-	buf, err := ls.Marshal()
-	if err != nil {
-		return utils.NewError(
-			utils.ErrInternalError,
-			err.Error(),
-		)
-	}
-
-	lineStoreKey := l.t.name + "/" + l.name
-	err = l.t.q.setData(lineStoreKey, buf)
+	err := l.t.q.setStore(l.storeKey, ls)
 	if err != nil {
 		return err
 	}
+	if l.lifo != nil {
+		err = l.exportLifo()
+		if err != nil {
+			return err
+		}
+	}
 
 	// log.Printf("line[%s] export finisded.", l.name)
 	return nil
 }
 
 func (l *line) removeLineData() error {
-	lineStoreKey := l.t.name + "/" + l.name
-	err := l.t.q.delData(lineStoreKey)
+	err := l.t.q.delData(l.storeKey)
 	if err != nil {
 		return err
 	}
@@ -88,6 +152,34 @@ func (l *line) removeLineData() error {
 	return nil
 }
 
+// addWaiter returns a channel which is closed when the message is confirmed
+func (l *line) addWaiter(id uint64) chan bool {
+	l.waitersLock.Lock()
+	defer l.waitersLock.Unlock()
+
+	done := make(chan bool)
+	l.waiters[id] = done
+	return done
+}
+
+func (l *line) delWaiter(id uint64) {
+	l.waitersLock.Lock()
+	defer l.waitersLock.Unlock()
+
+	delete(l.waiters, id)
+}
+
+func (l *line) notifyWaiter(id uint64) {
+	l.waitersLock.Lock()
+	defer l.waitersLock.Unlock()
+
+	done, ok := l.waiters[id]
+	if ok {
+		close(done)
+		delete(l.waiters, id)
+	}
+}
+
 func (l *line) updateiHead() {
 	for l.ihead < l.head {
 		id := l.ihead
@@ -104,97 +196,180 @@ func (l *line) updateiHead() {
 	}
 }
 
-func (l *line) pop() (uint64, []byte, error) {
+// getMessage gets the envelope of id, skip is true if the message must not
+// be delivered, because it is expired or its body is missing from the
+// storage though the id is still valid for the line
+func (l *line) getMessage(id uint64, now time.Time) (e *Envelope, skip bool, err error) {
+	e, err = l.t.getEnvelope(id)
+	if isChecksumMismatch(err) {
+		log.Printf("line[%s/%s] message %d is corrupted, skipped: %s", l.t.name, l.name, id, err)
+		l.t.q.deadLetter(l.t.name, l.name, id)
+		return nil, true, nil
+	}
+	if err != nil && !isDataNotExisted(err) {
+		return nil, false, err
+	}
+	if e == nil && l.t.q.expiresNatively() {
+		// the storage may have expired it, which tells no lost message
+		// from an expired one, so it is not a dead letter
+		log.Printf("line[%s/%s] message %d is expired or lost, skipped", l.t.name, l.name, id)
+		return nil, true, nil
+	}
+	if e == nil || len(e.Data) == 0 {
+		// pushing empty messages is not allowed, so it is lost
+		log.Printf("line[%s/%s] message %d is lost, skipped", l.t.name, l.name, id)
+		l.t.q.deadLetter(l.t.name, l.name, id)
+		return nil, true, nil
+	}
+	if e.expired(now) || e.olderThan(l.maxAge(), now) {
+		return nil, true, nil
+	}
+	return e, false, nil
+}
+
+// skip skips the undeliverable message of id, the caller must hold
+// l.inflightLock
+func (l *line) skip(id uint64) {
+	if l.getRecycle() > 0 {
+		l.imap[id] = false
+		l.updateiHead()
+	}
+}
+
+func (l *line) pop() (*Message, error) {
+	return l.popFit(0)
+}
+
+// popFit pops a message like pop if its data is not longer than limit, or
+// returns a nil message leaving it to be popped next. 0 means no limit.
+// The line stays locked from reading the head to advancing it, so the
+// concurrent pops of a line claim distinct messages. With recycle the
+// claim is a lease until RecycleAt, which a confirm ends and
+// ExtendVisibility renews.
+func (l *line) popFit(limit int) (*Message, error) {
 	l.inflightLock.Lock()
 	defer l.inflightLock.Unlock()
 
-	now := time.Now()
-	if l.recycle > 0 {
-
-		m := l.inflight.Front()
-		if m != nil {
+	now := l.t.q.now()
+	l.lastPop = now.UnixNano()
+	if l.getRecycle() > 0 {
+		for m := l.inflight.Front(); m != nil; m = l.inflight.Front() {
 			msg := m.Value.(*InflightMessage)
 			exp := time.Unix(0, msg.Exptime)
-			if now.After(exp) {
-				// log.Printf("key[%s/%d] is expired.", l.name, msg.Tid)
-				msg.Exptime = now.Add(l.recycle).UnixNano()
-				data, err := l.t.getData(msg.Tid)
-				if err != nil {
-					return 0, nil, err
-				}
-				l.inflight.Remove(m)
-				l.inflight.PushBack(msg)
-				// log.Printf("key[%s/%s/%d] poped.", l.t.name, l.name, msg.Tid)
-				return msg.Tid, data, nil
+			if !now.After(exp) {
+				break
+			}
+
+			// log.Printf("key[%s/%d] is expired.", l.name, msg.Tid)
+			e, skip, err := l.getMessage(msg.Tid, now)
+			if err != nil {
+				return nil, err
+			}
+			if !skip && !fits(e, limit) {
+				return nil, nil
 			}
+			l.inflight.Remove(m)
+			if skip {
+				l.skip(msg.Tid)
+				continue
+			}
+			msg.Exptime = now.Add(l.getRecycle()).UnixNano()
+			redeliver(msg)
+			l.pushInflight(msg)
+			// log.Printf("key[%s/%s/%d] poped.", l.t.name, l.name, msg.Tid)
+			return l.inflightMessage(msg, e), nil
 		}
 	}
 
 	l.headLock.Lock()
 	defer l.headLock.Unlock()
-	tid := l.head
+	if l.lifo != nil {
+		return l.popLIFO(now, limit)
+	}
 
 	topicTail := l.t.getTail()
-	if l.head >= topicTail {
-		// log.Printf("line[%s] is blank. head:%d - tail:%d", l.name, l.head, l.t.tail)
-		return 0, nil, utils.NewError(
-			utils.ErrNone,
-			`line pop`,
-		)
-	}
+	for l.head < topicTail {
+		tid := l.head
+		e, skip, err := l.getMessage(tid, now)
+		if err != nil {
+			return nil, err
+		}
+		if !skip && !fits(e, limit) {
+			return nil, nil
+		}
 
-	data, err := l.t.getData(tid)
-	if err != nil {
-		return 0, nil, err
-	}
+		l.head++
+		if skip {
+			l.skip(tid)
+			continue
+		}
 
-	l.head++
+		if l.getRecycle() > 0 {
+			msg := new(InflightMessage)
+			msg.Tid = tid
+			msg.Exptime = now.Add(l.getRecycle()).UnixNano()
+			msg.Delivered = 1
 
-	if l.recycle > 0 {
-		msg := new(InflightMessage)
-		msg.Tid = tid
-		msg.Exptime = now.Add(l.recycle).UnixNano()
+			l.pushInflight(msg)
+			// log.Printf("key[%s/%s/%d] flighted.", l.t.name, l.name, l.head)
+			l.imap[tid] = true
+			return l.inflightMessage(msg, e), nil
+		}
 
-		l.inflight.PushBack(msg)
-		// log.Printf("key[%s/%s/%d] flighted.", l.t.name, l.name, l.head)
-		l.imap[tid] = true
+		return l.newMessage(tid, e, 1), nil
 	}
 
-	return tid, data, nil
+	// log.Printf("line[%s] is blank. head:%d - tail:%d", l.name, l.head, l.t.tail)
+	return nil, utils.NewError(
+		utils.ErrNone,
+		`line pop`,
+	)
 }
 
 func (l *line) mPop(n int) ([]uint64, [][]byte, error) {
+	if l.lifo != nil {
+		return l.mPopLIFO(n)
+	}
 	l.inflightLock.Lock()
 	defer l.inflightLock.Unlock()
 
 	fc := 0
 	var ids []uint64
 	var datas [][]byte
-	now := time.Now()
-	if l.recycle > 0 {
-		for m := l.inflight.Front(); m != nil && fc < n; m = m.Next() {
+	now := l.t.q.now()
+	l.lastPop = now.UnixNano()
+	if l.getRecycle() > 0 {
+		for m := l.inflight.Front(); m != nil && fc < n; {
 			msg := m.Value.(*InflightMessage)
 			exp := time.Unix(0, msg.Exptime)
-			if now.After(exp) {
-				msg := m.Value.(*InflightMessage)
-				data, err := l.t.getData(msg.Tid)
-				if err != nil {
-					return nil, nil, err
-				}
+			if !now.After(exp) {
+				break
+			}
+
+			next := m.Next()
+			e, skip, err := l.getMessage(msg.Tid, now)
+			if err != nil {
+				return nil, nil, err
+			}
+			if skip {
+				l.inflight.Remove(m)
+				l.skip(msg.Tid)
+			} else {
 				ids = append(ids, msg.Tid)
-				datas = append(datas, data)
+				datas = append(datas, e.Data)
 				fc++
-			} else {
-				break
 			}
+			m = next
 		}
-		exptime := now.Add(l.recycle).UnixNano()
-		for i := 0; i < fc; i++ {
-			m := l.inflight.Front()
-			msg := m.Value.(*InflightMessage)
+		exptime := now.Add(l.getRecycle()).UnixNano()
+		msgs := make([]*InflightMessage, fc)
+		for i := range msgs {
+			msgs[i] = l.inflight.Remove(l.inflight.Front()).(*InflightMessage)
+		}
+		for _, msg := range msgs {
 			msg.Exptime = exptime
-			l.inflight.Remove(m)
-			l.inflight.PushBack(msg)
+			redeliver(msg)
+			l.pushInflight(msg)
 		}
 		if fc >= n {
 			return ids, datas, nil
@@ -204,7 +379,7 @@ func (l *line) mPop(n int) ([]uint64, [][]byte, error) {
 	l.headLock.Lock()
 	defer l.headLock.Unlock()
 
-	for ; fc < n; fc++ {
+	for fc < n {
 		tid := l.head
 		topicTail := l.t.getTail()
 		if l.head >= topicTail {
@@ -212,22 +387,28 @@ func (l *line) mPop(n int) ([]uint64, [][]byte, error) {
 			break
 		}
 
-		data, err := l.t.getData(tid)
+		e, skip, err := l.getMessage(tid, now)
 		if err != nil {
 			log.Printf("get data failed: %s", err)
 			break
 		}
 
 		l.head++
+		if skip {
+			l.skip(tid)
+			continue
+		}
 		ids = append(ids, tid)
-		datas = append(datas, data)
+		datas = append(datas, e.Data)
+		fc++
 
-		if l.recycle > 0 {
+		if l.getRecycle() > 0 {
 			msg := new(InflightMessage)
 			msg.Tid = tid
-			msg.Exptime = now.Add(l.recycle).UnixNano()
+			msg.Exptime = now.Add(l.getRecycle()).UnixNano()
+			msg.Delivered = 1
 
-			l.inflight.PushBack(msg)
+			l.pushInflight(msg)
 			// log.Printf("key[%s/%s/%d] flighted.", l.t.name, l.name, l.head)
 			l.imap[tid] = true
 		}
@@ -242,10 +423,64 @@ func (l *line) mPop(n int) ([]uint64, [][]byte, error) {
 	)
 }
 
+// fits tells whether the data of e is not longer than limit, 0 means no
+// limit
+func fits(e *Envelope, limit int) bool {
+	return limit <= 0 || len(e.Data) <= limit
+}
+
+// mPopBytes pops the messages one by one while their data fit in maxBytes
+// altogether, the first one always does
+func (l *line) mPopBytes(maxBytes int) ([]*Message, error) {
+	var ms []*Message
+	size := 0
+	for {
+		limit := 0
+		if len(ms) > 0 {
+			limit = maxBytes - size
+			if limit <= 0 {
+				break
+			}
+		}
+		m, err := l.popFit(limit)
+		if err != nil {
+			if len(ms) > 0 {
+				break
+			}
+			return nil, err
+		}
+		if m == nil {
+			break
+		}
+		ms = append(ms, m)
+		size += len(m.Data)
+	}
+	return ms, nil
+}
+
+// redeliver counts another delivery of the recycled message. A message
+// parked by PopMatching is not delivered yet, so it counts its first one.
+func redeliver(msg *InflightMessage) {
+	msg.Delivered++
+}
+
 func (l *line) confirm(id uint64) error {
-	if l.recycle == 0 {
-		return utils.NewError(
-			utils.ErrNotDelivered,
+	_, err := l.confirmAdvance(id)
+	return err
+}
+
+// confirmAdvance confirms id like confirm, and returns the ihead of the line
+// after it, below which every message is confirmed. A line without recycle
+// confirms as it pops, so its head is returned.
+func (l *line) confirmAdvance(id uint64) (uint64, error) {
+	if l.getRecycle() == 0 {
+		if l.getConfig().ConfirmNoop {
+			l.headLock.RLock()
+			defer l.headLock.RUnlock()
+			return l.head, nil
+		}
+		return 0, utils.NewError(
+			utils.ErrConfirmNotApplicable,
 			`line confirm`,
 		)
 	}
@@ -253,8 +488,9 @@ func (l *line) confirm(id uint64) error {
 	l.headLock.RLock()
 	defer l.headLock.RUnlock()
 	head := l.head
-	if id >= head {
-		return utils.NewError(
+	// a LIFO line delivers above its head, only the inflight list tells
+	if id >= head && l.lifo == nil {
+		return 0, utils.NewError(
 			utils.ErrNotDelivered,
 			`line confirm`,
 		)
@@ -262,6 +498,7 @@ func (l *line) confirm(id uint64) error {
 
 	l.inflightLock.Lock()
 	defer l.inflightLock.Unlock()
+	l.lastConfirm = l.t.q.now().UnixNano()
 
 	for m := l.inflight.Front(); m != nil; m = m.Next() {
 		msg := m.Value.(*InflightMessage)
@@ -269,54 +506,233 @@ func (l *line) confirm(id uint64) error {
 			l.inflight.Remove(m)
 			// log.Printf("key[%s/%s/%d] comfirmed.", l.t.name, l.name, id)
 			l.imap[id] = false
+			l.confirmed(id)
 			l.updateiHead()
+			l.notifyWaiter(id)
+			l.t.q.audit(AuditConfirm, l.t.name, l.name, id)
+			return l.ihead, nil
+		}
+	}
+
+	return 0, utils.NewError(
+		utils.ErrNotDelivered,
+		`line confirm`,
+	)
+}
+
+// confirmUpTo confirms the inflight messages of ids up to id, and exports
+// the line once after them. It returns how many are confirmed, which are
+// kept confirmed even if the export fails.
+func (l *line) confirmUpTo(id uint64) (int, error) {
+	if l.getRecycle() == 0 {
+		if l.getConfig().ConfirmNoop {
+			return 0, nil
+		}
+		return 0, utils.NewError(
+			utils.ErrConfirmNotApplicable,
+			`line confirmUpTo`,
+		)
+	}
+
+	l.inflightLock.Lock()
+	defer l.inflightLock.Unlock()
+	l.headLock.RLock()
+	defer l.headLock.RUnlock()
+	// a LIFO line delivers above its head, up to the tail
+	if (l.lifo == nil && id >= l.head) || (l.lifo != nil && id >= l.t.getTail()) {
+		return 0, utils.NewError(
+			utils.ErrNotDelivered,
+			`line confirmUpTo`,
+		)
+	}
+	l.lastConfirm = l.t.q.now().UnixNano()
+
+	n := 0
+	for m := l.inflight.Front(); m != nil; {
+		next := m.Next()
+		msg := m.Value.(*InflightMessage)
+		if msg.Tid <= id {
+			l.inflight.Remove(m)
+			l.imap[msg.Tid] = false
+			l.confirmed(msg.Tid)
+			l.notifyWaiter(msg.Tid)
+			l.t.q.audit(AuditConfirm, l.t.name, l.name, msg.Tid)
+			n++
+		}
+		m = next
+	}
+	if n == 0 {
+		return 0, utils.NewError(
+			utils.ErrNotDelivered,
+			`line confirmUpTo`,
+		)
+	}
+	l.updateiHead()
+	return n, l.exportLine()
+}
+
+// extend delays the recycle of the inflight message of id to d from now,
+// it never brings the recycle forward
+func (l *line) extend(id uint64, d time.Duration) error {
+	l.inflightLock.Lock()
+	defer l.inflightLock.Unlock()
+
+	for m := l.inflight.Front(); m != nil; m = m.Next() {
+		msg := m.Value.(*InflightMessage)
+		if msg.Tid != id {
+			continue
+		}
+		exptime := l.t.q.now().Add(d).UnixNano()
+		if exptime <= msg.Exptime {
 			return nil
 		}
+		msg.Exptime = exptime
+		// keep it behind the ones expiring before, so they are not held
+		at := m
+		for next := m.Next(); next != nil && next.Value.(*InflightMessage).Exptime <= exptime; next = next.Next() {
+			at = next
+		}
+		if at != m {
+			l.inflight.MoveAfter(m, at)
+		}
+		return nil
 	}
 
 	return utils.NewError(
 		utils.ErrNotDelivered,
-		`line confirm`,
+		`line extend`,
 	)
 }
 
+// requeue makes the inflight message of id expire at once, so it is the
+// next one to pop. It returns false if the message is not inflight.
+func (l *line) requeue(id uint64) bool {
+	l.inflightLock.Lock()
+	defer l.inflightLock.Unlock()
+
+	for m := l.inflight.Front(); m != nil; m = m.Next() {
+		msg := m.Value.(*InflightMessage)
+		if msg.Tid == id {
+			msg.Exptime = 0
+			l.inflight.MoveToFront(m)
+			return true
+		}
+	}
+	return false
+}
+
+// recycleNow makes the expired inflight messages, or all of them if all is
+// set, expire at once and moves them to the front in the order of their
+// ids, so they are the next ones to pop. It returns how many are moved.
+func (l *line) recycleNow(all bool) int {
+	l.inflightLock.Lock()
+	defer l.inflightLock.Unlock()
+
+	now := l.t.q.now()
+	var moved []*list.Element
+	for m := l.inflight.Front(); m != nil; m = m.Next() {
+		msg := m.Value.(*InflightMessage)
+		if all || now.After(time.Unix(0, msg.Exptime)) {
+			msg.Exptime = 0
+			moved = append(moved, m)
+		}
+	}
+	// the inflight list is in the order of expiry, the recycled messages
+	// are popped again in the order they were pushed
+	sort.Slice(moved, func(i, j int) bool {
+		return moved[i].Value.(*InflightMessage).Tid < moved[j].Value.(*InflightMessage).Tid
+	})
+	for i := len(moved) - 1; i >= 0; i-- {
+		l.inflight.MoveToFront(moved[i])
+	}
+	return len(moved)
+}
+
 func (l *line) stat() *Stat {
 	l.inflightLock.RLock()
 	defer l.inflightLock.RUnlock()
 	l.headLock.RLock()
 	defer l.headLock.RUnlock()
+	return l.statLocked(l.t.getTail())
+}
 
+// statLocked returns the stat of the line with the topic tail, the caller
+// must hold l.inflightLock and l.headLock
+func (l *line) statLocked(tail uint64) *Stat {
 	qs := new(Stat)
-	qs.Name = l.t.name + "/" + l.name
+	qs.Name = l.t.name + l.t.q.opts.Separator + l.name
 	qs.Type = "line"
-	qs.Recycle = l.recycle.String()
+	qs.Recycle = l.getRecycle().String()
 	qs.IHead = l.ihead
 	inflightLen := uint64(l.inflight.Len())
 	qs.Head = l.head
-	qs.Tail = l.t.getTail()
-	qs.Count = inflightLen + qs.Tail - qs.Head
+	qs.Tail = tail
+	if l.lifo != nil {
+		qs.Count = inflightLen + l.lifo.count(tail)
+	} else {
+		qs.Count = inflightLen + qs.Tail - qs.Head
+	}
+	qs.LastPop = formatActivity(l.lastPop)
+	qs.LastConfirm = formatActivity(l.lastConfirm)
 
 	return qs
 }
 
-func (l *line) empty() error {
+// idleSince returns the time of the last activity of the line, the time it
+// was created or loaded if there is none yet. The caller must hold
+// l.inflightLock.
+func (l *line) idleSince() time.Time {
+	last := l.since
+	if l.lastPop > last {
+		last = l.lastPop
+	}
+	if l.lastConfirm > last {
+		last = l.lastConfirm
+	}
+	return time.Unix(0, last)
+}
+
+func (l *line) isIdle(now time.Time, expire time.Duration) bool {
+	l.inflightLock.RLock()
+	defer l.inflightLock.RUnlock()
+	return now.Sub(l.idleSince()) > expire
+}
+
+func formatActivity(ts int64) string {
+	if ts == 0 {
+		return ""
+	}
+	return time.Unix(0, ts).Format(time.RFC3339Nano)
+}
+
+// empty empties the line, or only returns the impact if dryRun is set
+func (l *line) empty(dryRun bool) (*Impact, error) {
 	l.inflightLock.Lock()
 	defer l.inflightLock.Unlock()
-	l.inflight.Init()
-	l.imap = make(map[uint64]bool)
-	l.ihead = l.t.getTail()
-
 	l.headLock.Lock()
 	defer l.headLock.Unlock()
-	l.head = l.t.getTail()
+
+	tail := l.t.getTail()
+	im := l.impact(tail, false)
+	if dryRun {
+		return im, nil
+	}
+
+	l.inflight.Init()
+	l.imap = make(map[uint64]bool)
+	l.ihead = tail
+	l.head = tail
+	if l.lifo != nil {
+		l.lifo.reset(tail)
+	}
 
 	err := l.exportLine()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	log.Printf("line[%s] empty succ", l.name)
-	return nil
+	return im, nil
 }
 
 func (l *line) remove() error {
@@ -330,6 +746,16 @@ func (l *line) remove() error {
 		log.Printf("line[%s] removeRecycleData error: %s", l.name, err)
 	}
 
+	err = l.removeConfigData()
+	if err != nil {
+		log.Printf("line[%s] removeConfigData error: %s", l.name, err)
+	}
+
+	err = l.removeLifoData()
+	if err != nil {
+		log.Printf("line[%s] removeLifoData error: %s", l.name, err)
+	}
+
 	log.Printf("line[%s] remove succ", l.name)
 	return nil
 }
@@ -0,0 +1,124 @@
+package queue
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/buaazp/uq/utils"
+)
+
+// PopMatching pops the first message of the line whose attributes match,
+// and returns its id and data. The messages it passes over are not lost,
+// they are left inflight already expired, so the next pop of the line
+// delivers them in the order of their ids. So the line must have recycle
+// and must not be LIFO. match runs with the line locked, so it must not
+// call the queue.
+func (u *UnitedQueue) PopMatching(name string, match func(headers map[string]string) bool) (uint64, []byte, error) {
+	err := u.checkWritable("popMatching")
+	if err != nil {
+		return 0, nil, u.wrapError("popMatching", name, err)
+	}
+
+	t, lName, err := u.lineTopic(name, "popMatching")
+	if err != nil {
+		return 0, nil, u.wrapError("popMatching", name, err)
+	}
+
+	m, err := t.popMatching(lName, match)
+	if err != nil {
+		return 0, nil, u.wrapError("popMatching", name, err)
+	}
+	return m.ID, m.Data, nil
+}
+
+func (t *topic) popMatching(name string, match func(headers map[string]string) bool) (*Message, error) {
+	l, err := t.popLine(name, "popMatching")
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := l.popMatching(match)
+	if err != nil {
+		return nil, err
+	}
+	t.q.audit(AuditPop, t.name, l.name, m.ID)
+	return t.intercept(l, m)
+}
+
+// popMatching pops the first message matching like popFit. The expired
+// inflight messages are looked at first, then the ones from the head. The
+// head is moved past the match, and the messages before it are parked
+// inflight with no expire time and no delivery.
+func (l *line) popMatching(match func(headers map[string]string) bool) (*Message, error) {
+	l.inflightLock.Lock()
+	defer l.inflightLock.Unlock()
+
+	if l.getRecycle() <= 0 || l.lifo != nil {
+		return nil, utils.NewError(
+			utils.ErrBadRequest,
+			`line popMatching needs a recycle line not in LIFO`,
+		)
+	}
+
+	now := l.t.q.now()
+	l.lastPop = now.UnixNano()
+	var next *list.Element
+	for m := l.inflight.Front(); m != nil; m = next {
+		next = m.Next()
+		msg := m.Value.(*InflightMessage)
+		if !now.After(time.Unix(0, msg.Exptime)) {
+			break
+		}
+
+		e, skip, err := l.getMessage(msg.Tid, now)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			l.inflight.Remove(m)
+			l.skip(msg.Tid)
+			continue
+		}
+		if !match(e.Attrs) {
+			continue
+		}
+		l.inflight.Remove(m)
+		msg.Exptime = now.Add(l.getRecycle()).UnixNano()
+		redeliver(msg)
+		l.pushInflight(msg)
+		return l.inflightMessage(msg, e), nil
+	}
+
+	l.headLock.Lock()
+	defer l.headLock.Unlock()
+
+	topicTail := l.t.getTail()
+	for id := l.head; id < topicTail; id++ {
+		e, err := l.deliverable(id, now)
+		if err != nil {
+			return nil, err
+		}
+		if e == nil || !match(e.Attrs) {
+			continue
+		}
+
+		for p := l.head; p < id; p++ {
+			l.pushInflight(&InflightMessage{Tid: p})
+			l.imap[p] = true
+		}
+		l.head = id + 1
+
+		msg := new(InflightMessage)
+		msg.Tid = id
+		msg.Exptime = now.Add(l.getRecycle()).UnixNano()
+		msg.Delivered = 1
+		l.pushInflight(msg)
+		l.imap[id] = true
+		return l.inflightMessage(msg, e), nil
+	}
+
+	return nil, utils.NewError(
+		utils.ErrNone,
+		`line popMatching`,
+	)
+}
@@ -0,0 +1,65 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buaazp/uq/utils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPopMatching(t *testing.T) {
+	Convey("Test Pop the Messages Matching Their Attributes", t, func() {
+		clock := newFakeClock()
+		cq, err := newClockQueue(clock)
+		So(err, ShouldBeNil)
+		defer cq.Close()
+
+		So(cq.Create("foo", ""), ShouldBeNil)
+		So(cq.Create("foo/x", "1m"), ShouldBeNil)
+		So(cq.Create("foo/y", ""), ShouldBeNil)
+		So(cq.PushWithAttrs("foo", []byte("a"), map[string]string{"region": "eu"}), ShouldBeNil)
+		So(cq.Push("foo", []byte("b")), ShouldBeNil)
+		So(cq.PushWithAttrs("foo", []byte("c"), map[string]string{"region": "us"}), ShouldBeNil)
+		So(cq.PushWithAttrs("foo", []byte("d"), map[string]string{"region": "us"}), ShouldBeNil)
+
+		us := func(headers map[string]string) bool {
+			return headers["region"] == "us"
+		}
+		id, data, err := cq.PopMatching("foo/x", us)
+		So(err, ShouldBeNil)
+		So(id, ShouldEqual, 2)
+		So(string(data), ShouldEqual, "c")
+
+		_, _, err = cq.PopMatching("foo/x", func(headers map[string]string) bool {
+			return headers["region"] == "asia"
+		})
+		So(errorCode(err), ShouldEqual, utils.ErrNone)
+
+		m, err := cq.PopMessage("foo/x")
+		So(err, ShouldBeNil)
+		So(string(m.Data), ShouldEqual, "a")
+		So(m.Delivered, ShouldEqual, 1)
+		m, err = cq.PopMessage("foo/x")
+		So(err, ShouldBeNil)
+		So(string(m.Data), ShouldEqual, "b")
+		So(m.Delivered, ShouldEqual, 1)
+		So(cq.Confirm(m.Key), ShouldBeNil)
+
+		id, data, err = cq.PopMatching("foo/x", us)
+		So(err, ShouldBeNil)
+		So(id, ShouldEqual, 3)
+		So(string(data), ShouldEqual, "d")
+		_, err = cq.PopMessage("foo/x")
+		So(errorCode(err), ShouldEqual, utils.ErrNone)
+
+		clock.Advance(2 * time.Minute)
+		id, data, err = cq.PopMatching("foo/x", us)
+		So(err, ShouldBeNil)
+		So(id, ShouldEqual, 2)
+		So(string(data), ShouldEqual, "c")
+
+		_, _, err = cq.PopMatching("foo/y", us)
+		So(errorCode(err), ShouldEqual, utils.ErrBadRequest)
+	})
+}
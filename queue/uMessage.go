@@ -0,0 +1,58 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/buaazp/uq/utils"
+)
+
+// Message is a message popped from a line. Pop returns the key and the data
+// of it, while PopMessage returns the whole message, so the metadata added
+// to it later does not change any signature.
+type Message struct {
+	// ID is the id of the message in its topic
+	ID uint64
+	// Key is the key to confirm the message, formatted as "topic/line/id"
+	Key string
+	// Data is the content pushed by the producer. It is read for every pop
+	// and never shared, so the consumer can keep and change it.
+	Data []byte
+	// Deadline is the time the message expires at, zero means never
+	Deadline time.Time
+	// Delivered is how many times the message is delivered by the line, 1
+	// for the first delivery and more if it was recycled
+	Delivered uint32
+	// Attrs is the attributes pushed with the message
+	Attrs map[string]string
+	// RecycleAt is the time the popped message is recycled at unless it is
+	// confirmed, ExtendVisibility delays it. Zero means the line has no
+	// recycle and the message is confirmed by the pop.
+	RecycleAt time.Time
+}
+
+// confirmKey returns the key "topic/line/id" message id popped from the line
+// is confirmed by
+func (u *UnitedQueue) confirmKey(topicName, lineName string, id uint64) string {
+	return utils.Acatui(topicName+u.opts.Separator+lineName, u.opts.Separator, id)
+}
+
+func (l *line) newMessage(id uint64, e *Envelope, delivered uint32) *Message {
+	m := new(Message)
+	m.ID = id
+	m.Delivered = delivered
+	m.Key = l.t.q.confirmKey(l.t.name, l.name, id)
+	m.Data = e.Data
+	m.Attrs = e.Attrs
+	if e.Deadline > 0 {
+		m.Deadline = time.Unix(0, e.Deadline)
+	}
+	return m
+}
+
+// inflightMessage returns the message of the inflight msg just popped, with
+// its recycle time
+func (l *line) inflightMessage(msg *InflightMessage, e *Envelope) *Message {
+	m := l.newMessage(msg.Tid, e, msg.Delivered)
+	m.RecycleAt = time.Unix(0, msg.Exptime)
+	return m
+}
@@ -0,0 +1,151 @@
+package queue
+
+import "time"
+
+// Options is the tunables of a UnitedQueue. The zero value of every field
+// keeps the default behavior.
+type Options struct {
+	// Clock is the time source, defaults to the system clock
+	Clock Clock
+	// OnExportError is called when the background backup of a line still
+	// fails after all retries, so the data of the line is not durable
+	OnExportError func(topicName, lineName string, err error)
+	// LagAlert is called by the background goroutine of the topic when a
+	// line falls more messages behind than its LagThreshold, and
+	// LagRecovered when its lag drops back to it. The lag is the messages
+	// the line has not popped yet, checked every CleanInterval.
+	LagAlert     func(topicName, lineName string, lag uint64)
+	LagRecovered func(topicName, lineName string, lag uint64)
+	// MaxLinesPerTopic limits the lines of one topic, 0 means unlimited
+	MaxLinesPerTopic int
+	// MaxTopics limits the topics of the queue, 0 means unlimited
+	MaxTopics int
+	// LineIdleExpire removes a line that is neither popped nor confirmed
+	// for the duration, 0 means lines never expire
+	LineIdleExpire time.Duration
+	// DeadLetterTopic receives the keys of the messages which are lost from
+	// the storage when lines of other topics pop them, empty means they are
+	// only logged
+	DeadLetterTopic string
+	// Codec encodes the stored messages of a new storage, defaults to
+	// BinaryCodec. An existing storage must be opened with the codec which
+	// is recorded in it.
+	Codec Codec
+	// BackupInterval is the interval of the background backup of lines
+	BackupInterval time.Duration
+	// CleanInterval is the interval of the background clean of topics
+	CleanInterval time.Duration
+	// CleanWindowStart and CleanWindowEnd limit the background clean of
+	// the messages consumed to the time of day between them, in the
+	// location of the Clock, e.g. 2h and 4h for 2am to 4am. The window
+	// wraps midnight if the start is after the end, and the same start and
+	// end, like both 0, means any time. The backups, the recycles and
+	// Compact are never limited.
+	CleanWindowStart time.Duration
+	CleanWindowEnd   time.Duration
+	// CleanPausePushRate skips the background clean of a topic while it is
+	// pushed more than so many messages a second since its last clean, 0
+	// means never
+	CleanPausePushRate int
+	// ChunkSize splits the stored messages longer than it into several
+	// keys, for the storages limiting the size of values. 0 means never.
+	ChunkSize int
+	// PersistEvery exports the topic and its lines after every PersistEvery
+	// pushes besides the BackupInterval, 1 makes every push durable at the
+	// cost of throughput. 0 means only on interval. A push which fails to
+	// be flushed returns the error, though the message is stored.
+	PersistEvery int
+	// AutoCreateTopics creates the topic on the first push into it instead
+	// of returning ErrTopicNotExisted. The created topic has no line, so the
+	// messages pushed before a line is created are never delivered.
+	AutoCreateTopics bool
+	// AutoCreateLines creates the line on the first Pop or MultiPop from it
+	// instead of returning ErrLineNotExisted, when its topic exists. The
+	// created line has no recycle and starts at the head of the topic.
+	AutoCreateLines bool
+	// MaintenanceWorkers limits the topics running their background backup
+	// or clean at once, so the storage is not hammered by all the topics at
+	// the same time. 0 means unlimited.
+	MaintenanceWorkers int
+	// AsyncPushBuffer makes Push and the pushes with metadata return once
+	// the message is buffered, and a writer of every topic stores them in
+	// order. The buffer of each topic holds so many pushes, a push waits
+	// while it is full. A buffered message is neither popped nor durable
+	// until it is stored, Flush waits for that. The batches and the other
+	// pushes wait for the buffered ones. 0 means the pushes store at once.
+	AsyncPushBuffer int
+	// AsyncSpillDir makes the pushes spill to a temporary file in the
+	// directory while the AsyncPushBuffer of their topic is full, instead of
+	// waiting. They are replayed into the buffer in order once it has room,
+	// and the file is truncated when they are stored and removed when the
+	// topic is closed. The spilled pushes are lost if the process dies. ""
+	// means the pushes wait.
+	AsyncSpillDir string
+	// ReadCacheSize keeps the values of the messages read last in memory up
+	// to so many bytes, so the pops and the reads of Warmup are served
+	// without the storage. 0 means no cache.
+	ReadCacheSize int
+	// BackpressureHandler is called with the topic and the reason when a
+	// push hits a limit and is going to be rejected. The push proceeds if it
+	// returns nil, or is rejected with the error it returns. nil means the
+	// pushes are rejected with the error of the limit.
+	BackpressureHandler func(topicName, reason string) error
+	// AuditSink receives an event for every push, pop and confirm, nil
+	// means none.
+	AuditSink AuditSink
+	// StoreOpenTimeout keeps retrying the first read of the storage which
+	// fails for the duration before NewUnitedQueue gives up, for a storage
+	// which starts with the queue. 0 means no retry.
+	StoreOpenTimeout time.Duration
+	// StoreOpenBackoff is the first wait between the retries of opening the
+	// storage, doubled after every retry up to a few seconds
+	StoreOpenBackoff time.Duration
+	// ReadOnly opens the queue for inspecting the storage without touching
+	// it. The pushes, pops, confirms and the other changes return
+	// ErrReadOnly, the stats, the snapshots and the dry runs work, and the
+	// topics run no background backup or clean.
+	ReadOnly bool
+	// Checksum prefixes every value stored by a new storage with its CRC
+	// checksum, which is verified when it is read back. A corrupted message
+	// is skipped as a lost one, the other values fail with
+	// ErrChecksumMismatch. The storage records it, so it is always read
+	// with the checksums once written with them, and the option can not be
+	// set for a storage written without them.
+	Checksum bool
+	// LazyLoad registers the lines of the stored topics when the queue is
+	// loaded, but reads their offsets and inflight messages when they are
+	// first used, which speeds up loading many lines. A topic is not
+	// cleaned while it has a line not loaded yet, and the inflight
+	// messages of such a line expire once it is loaded. A line which fails
+	// to load then is dropped like a broken one, without a LoadErrors
+	// entry.
+	LazyLoad bool
+	// Separator joins the topic, the line and the id in the keys given to
+	// the queue and the keys of the popped messages, so the names can not
+	// contain it. It can not be a letter, a digit or a space, and a
+	// separator other than "/" needs a storage written with the escaped key
+	// layout and no etcd. Empty means "/".
+	Separator string
+}
+
+// BackpressureRateLimited is the reason of a push over the PushRate of its
+// topic given to the BackpressureHandler
+const BackpressureRateLimited = "rate limited"
+
+func (o *Options) setDefaults() {
+	if o.Clock == nil {
+		o.Clock = systemClock{}
+	}
+	if o.BackupInterval <= 0 {
+		o.BackupInterval = bgBackupInterval
+	}
+	if o.CleanInterval <= 0 {
+		o.CleanInterval = bgCleanInterval
+	}
+	if o.Separator == "" {
+		o.Separator = defaultSeparator
+	}
+	if o.StoreOpenBackoff <= 0 {
+		o.StoreOpenBackoff = storeOpenBackoff
+	}
+}
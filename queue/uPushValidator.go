@@ -0,0 +1,65 @@
+package queue
+
+import (
+	"github.com/buaazp/uq/utils"
+)
+
+// PushValidator checks a message before it is stored, e.g. that data is
+// valid JSON. The headers are the attributes of the message, nil for the
+// pushes without. Returning an error rejects the push with it, and nothing
+// is stored.
+type PushValidator func(data []byte, headers map[string]string) error
+
+// RegisterPushValidator registers fn under name, to be set as the
+// PushValidator in the config of the topics. Only the name is stored in the
+// config, so a queue reopened on the same storage must register its
+// validators again, and rejects the pushes into the topics of a validator
+// not registered yet. Registering a name again replaces its validator.
+func (u *UnitedQueue) RegisterPushValidator(name string, fn PushValidator) error {
+	if name == "" || fn == nil {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`push validator needs a name and a func`,
+		)
+	}
+
+	u.validatorsLock.Lock()
+	defer u.validatorsLock.Unlock()
+	if u.validators == nil {
+		u.validators = make(map[string]PushValidator)
+	}
+	u.validators[name] = fn
+	return nil
+}
+
+func (u *UnitedQueue) pushValidator(name string) (PushValidator, bool) {
+	u.validatorsLock.RLock()
+	defer u.validatorsLock.RUnlock()
+	fn, ok := u.validators[name]
+	return fn, ok
+}
+
+// validatePush runs the PushValidator of the topic on every data
+func (t *topic) validatePush(datas [][]byte, headers map[string]string) error {
+	t.configLock.RLock()
+	name := t.config.PushValidator
+	t.configLock.RUnlock()
+	if name == "" {
+		return nil
+	}
+
+	fn, ok := t.q.pushValidator(name)
+	if !ok {
+		return utils.NewError(
+			utils.ErrInternalError,
+			`push validator not registered: `+name,
+		)
+	}
+	for _, data := range datas {
+		err := fn(data, headers)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/buaazp/uq/store"
+	"github.com/buaazp/uq/utils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPushValidator(t *testing.T) {
+	Convey("Test Push Validator Rejects the Bad Messages", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		vq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+
+		errNotJSON := errors.New("not json")
+		validJSON := func(data []byte, headers map[string]string) error {
+			if !json.Valid(data) {
+				return errNotJSON
+			}
+			return nil
+		}
+		So(errorCode(vq.RegisterPushValidator("", validJSON)), ShouldEqual, utils.ErrBadRequest)
+		So(errorCode(vq.RegisterPushValidator("json", nil)), ShouldEqual, utils.ErrBadRequest)
+
+		So(vq.Create("foo", ""), ShouldBeNil)
+		So(vq.Create("foo/x", ""), ShouldBeNil)
+		err = vq.ConfigureTopic("foo", TopicConfig{PushValidator: "json"})
+		So(errorCode(err), ShouldEqual, utils.ErrBadRequest)
+		So(vq.RegisterPushValidator("json", validJSON), ShouldBeNil)
+		So(vq.ConfigureTopic("foo", TopicConfig{PushValidator: "json"}), ShouldBeNil)
+
+		So(vq.Push("foo", []byte(`{"a":1}`)), ShouldBeNil)
+		So(vq.Push("foo", []byte("a")), ShouldNotBeNil)
+		_, err = vq.PushBatch("foo", [][]byte{[]byte(`1`), []byte("{")})
+		So(err, ShouldNotBeNil)
+		So(vq.PushWithAttrs("foo", []byte("}"), map[string]string{"k": "v"}), ShouldNotBeNil)
+		So(vq.topics["foo"].getTail(), ShouldEqual, 1)
+
+		So(vq.exportTopics(), ShouldBeNil)
+		for _, t := range vq.topics {
+			t.close()
+		}
+		vq, err = NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer vq.Close()
+
+		// the validator is stored by its name only
+		err = vq.Push("foo", []byte(`2`))
+		So(errorCode(err), ShouldEqual, utils.ErrInternalError)
+		So(vq.RegisterPushValidator("json", validJSON), ShouldBeNil)
+		So(vq.Push("foo", []byte(`2`)), ShouldBeNil)
+		_, err = vq.PushBatch("foo", [][]byte{[]byte(`3`), []byte(`4`)})
+		So(err, ShouldBeNil)
+		So(vq.topics["foo"].getTail(), ShouldEqual, 4)
+	})
+}
@@ -1,12 +1,16 @@
 package queue
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"log"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/buaazp/uq/store"
@@ -19,6 +23,11 @@ const (
 	bgBackupInterval time.Duration = 10 * time.Second
 	bgCleanInterval  time.Duration = 20 * time.Second
 	bgCleanTimeout   time.Duration = 5 * time.Second
+	bgExportRetries  int           = 3
+	bgExportBackoff  time.Duration = 50 * time.Millisecond
+	storeOpenBackoff time.Duration = 100 * time.Millisecond
+	storeOpenMaxWait time.Duration = 5 * time.Second
+	defaultSeparator string        = "/"
 	keyTopicStore    string        = ":store"
 	keyTopicHead     string        = ":head"
 	keyTopicTail     string        = ":tail"
@@ -30,6 +39,11 @@ const (
 
 // UnitedQueue is a implemention of message queue in uq
 type UnitedQueue struct {
+	// eventsDropped is accessed atomically, first for the 64 bit alignment
+	eventsDropped uint64
+	// loadState is accessed atomically, it tells whether Load is done
+	loadState int32
+
 	topics     map[string]*topic
 	topicsLock sync.RWMutex
 	storage    store.Storage
@@ -39,16 +53,75 @@ type UnitedQueue struct {
 	etcdKey    string
 	etcdStop   chan bool
 	wg         sync.WaitGroup
+	opts       Options
+	optsLock   sync.RWMutex
+	codec      Codec
+	keys       keyLayout
+	// checksum is set if the stored values are prefixed by their checksums
+	checksum bool
+	// chunked is set once the storage may hold chunked messages
+	chunked    int32
+	subsQuit   chan bool
+	drainLock  sync.Mutex
+	subsWg     sync.WaitGroup
+	loadErrors *LoadError
+	aliases    map[string]string
+	// maintenance holds a token for every topic running its background
+	// work, nil if it is unlimited
+	maintenance chan bool
+	// cache is the read cache of the messages, nil without ReadCacheSize
+	cache  *readCache
+	events chan LifecycleEvent
+	// validators is the PushValidators registered by their names
+	validators     map[string]PushValidator
+	validatorsLock sync.RWMutex
+	// weightedLock serializes PopWeighted, which shares the current
+	// weights of the lines
+	weightedLock sync.Mutex
 }
 
 // NewUnitedQueue returns a new UnitedQueue
 func NewUnitedQueue(storage store.Storage, ip string, port int, etcdServers []string, etcdKey string) (*UnitedQueue, error) {
+	return NewUnitedQueueWithOptions(storage, ip, port, etcdServers, etcdKey, nil)
+}
+
+// NewUnitedQueueWithOptions returns a new UnitedQueue tuned by opts, a nil
+// opts is the same as NewUnitedQueue. It is OpenUnitedQueue followed by
+// Load.
+func NewUnitedQueueWithOptions(storage store.Storage, ip string, port int, etcdServers []string, etcdKey string, opts *Options) (*UnitedQueue, error) {
+	uq, err := OpenUnitedQueue(storage, ip, port, etcdServers, etcdKey, opts)
+	if err != nil {
+		return nil, err
+	}
+	err = uq.Load(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return uq, nil
+}
+
+// OpenUnitedQueue returns a new UnitedQueue tuned by opts which is not
+// loaded yet, it does not touch the storage. Load must be called before the
+// queue is used, the changes are rejected with ErrNotLoaded until then.
+func OpenUnitedQueue(storage store.Storage, ip string, port int, etcdServers []string, etcdKey string, opts *Options) (*UnitedQueue, error) {
 	topics := make(map[string]*topic)
 	etcdStop := make(chan bool)
 	uq := new(UnitedQueue)
 	uq.topics = topics
 	uq.storage = storage
 	uq.etcdStop = etcdStop
+	uq.subsQuit = make(chan bool)
+	uq.events = make(chan LifecycleEvent, lifecycleBuffer)
+	if opts != nil {
+		uq.opts = *opts
+	}
+	uq.opts.setDefaults()
+	if uq.opts.MaintenanceWorkers > 0 {
+		uq.maintenance = make(chan bool, uq.opts.MaintenanceWorkers)
+	}
+	if uq.opts.ReadCacheSize > 0 {
+		uq.cache = newReadCache(uq.opts.ReadCacheSize)
+	}
 
 	if len(etcdServers) > 0 {
 		selfAddr := utils.Addrcat(ip, port)
@@ -57,18 +130,285 @@ func NewUnitedQueue(storage store.Storage, ip string, port int, etcdServers []st
 		uq.etcdClient = etcdClient
 		uq.etcdKey = etcdKey
 	}
+	return uq, nil
+}
+
+const (
+	queueOpened int32 = iota
+	queueLoading
+	queueLoaded
+	queueLoadFailed
+)
+
+// Load reads the queue from the storage and starts it. It returns the error
+// of ctx if ctx is done before, e.g. while the storage is not ready in the
+// StoreOpenTimeout. Load can be called once only, a queue which fails to
+// load can only be closed.
+func (u *UnitedQueue) Load(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&u.loadState, queueOpened, queueLoading) {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`queue load called twice`,
+		)
+	}
 
-	err := uq.loadQueue()
+	err := u.load(ctx)
 	if err != nil {
-		return nil, err
+		atomic.StoreInt32(&u.loadState, queueLoadFailed)
+		return err
 	}
+	atomic.StoreInt32(&u.loadState, queueLoaded)
+	go u.etcdRun()
+	return nil
+}
 
-	go uq.etcdRun()
-	return uq, nil
+func (u *UnitedQueue) load(ctx context.Context) error {
+	err := u.waitStorage(ctx)
+	if err != nil {
+		return err
+	}
+	err = u.loadChecksum()
+	if err != nil {
+		return err
+	}
+	err = u.loadLayout()
+	if err != nil {
+		return err
+	}
+	err = u.checkSeparator()
+	if err != nil {
+		return err
+	}
+	err = u.loadCodec()
+	if err != nil {
+		return err
+	}
+	err = u.loadChunked()
+	if err != nil {
+		return err
+	}
+	err = u.loadQueue(ctx)
+	if err != nil {
+		return err
+	}
+	return u.loadAliases()
+}
+
+func (u *UnitedQueue) loaded() bool {
+	return atomic.LoadInt32(&u.loadState) == queueLoaded
+}
+
+// loadStarted tells whether the storage can be written, by Load or after
+func (u *UnitedQueue) loadStarted() bool {
+	state := atomic.LoadInt32(&u.loadState)
+	return state == queueLoading || state == queueLoaded
+}
+
+func (u *UnitedQueue) now() time.Time {
+	return u.opts.Clock.Now()
+}
+
+// options returns the current options, the Clock and the Separator are
+// never changed so they can be read without the lock
+func (u *UnitedQueue) options() Options {
+	u.optsLock.RLock()
+	defer u.optsLock.RUnlock()
+	return u.opts
+}
+
+// Reconfigure changes the options of the running queue, the background
+// goroutines of the topics restart their timers with the new intervals.
+// The Clock, the Codec, the MaintenanceWorkers, the AsyncPushBuffer, the
+// AsyncSpillDir, the ReadCacheSize, the AuditSink, the StoreOpenTimeout,
+// the StoreOpenBackoff, the ReadOnly, the Checksum, the LazyLoad and the
+// Separator can not be changed at runtime, leave them zero to keep the
+// current ones.
+func (u *UnitedQueue) Reconfigure(opts Options) error {
+	if opts.Clock != nil && opts.Clock != u.opts.Clock {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`clock can not be changed at runtime`,
+		)
+	}
+	if opts.Codec != nil && opts.Codec.Name() != u.codec.Name() {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`codec can not be changed at runtime`,
+		)
+	}
+	if opts.MaintenanceWorkers != 0 && opts.MaintenanceWorkers != u.opts.MaintenanceWorkers {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`maintenance workers can not be changed at runtime`,
+		)
+	}
+	if opts.Separator != "" && opts.Separator != u.opts.Separator {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`separator can not be changed at runtime`,
+		)
+	}
+	if opts.AsyncPushBuffer != 0 && opts.AsyncPushBuffer != u.opts.AsyncPushBuffer {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`async push buffer can not be changed at runtime`,
+		)
+	}
+	if opts.AsyncSpillDir != "" && opts.AsyncSpillDir != u.opts.AsyncSpillDir {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`async spill dir can not be changed at runtime`,
+		)
+	}
+	if opts.ReadCacheSize != 0 && opts.ReadCacheSize != u.opts.ReadCacheSize {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`read cache size can not be changed at runtime`,
+		)
+	}
+	if opts.AuditSink != nil && opts.AuditSink != u.opts.AuditSink {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`audit sink can not be changed at runtime`,
+		)
+	}
+	if opts.StoreOpenTimeout != 0 && opts.StoreOpenTimeout != u.opts.StoreOpenTimeout {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`store open timeout can not be changed at runtime`,
+		)
+	}
+	if opts.StoreOpenBackoff != 0 && opts.StoreOpenBackoff != u.opts.StoreOpenBackoff {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`store open backoff can not be changed at runtime`,
+		)
+	}
+	if opts.ReadOnly && !u.opts.ReadOnly {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`read only can not be changed at runtime`,
+		)
+	}
+	if opts.Checksum && !u.opts.Checksum {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`checksum can not be changed at runtime`,
+		)
+	}
+	if opts.LazyLoad && !u.opts.LazyLoad {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`lazy load can not be changed at runtime`,
+		)
+	}
+	if opts.MaxLinesPerTopic < 0 || opts.MaxTopics < 0 || opts.LineIdleExpire < 0 || opts.ChunkSize < 0 || opts.PersistEvery < 0 ||
+		opts.BackupInterval < 0 || opts.CleanInterval < 0 || opts.CleanPausePushRate < 0 {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`negative options`,
+		)
+	}
+	if !validTimeOfDay(opts.CleanWindowStart) || !validTimeOfDay(opts.CleanWindowEnd) {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`clean window out of day`,
+		)
+	}
+	opts.setDefaults()
+
+	u.optsLock.Lock()
+	u.opts.OnExportError = opts.OnExportError
+	u.opts.BackpressureHandler = opts.BackpressureHandler
+	u.opts.LagAlert = opts.LagAlert
+	u.opts.LagRecovered = opts.LagRecovered
+	u.opts.MaxLinesPerTopic = opts.MaxLinesPerTopic
+	u.opts.MaxTopics = opts.MaxTopics
+	u.opts.LineIdleExpire = opts.LineIdleExpire
+	u.opts.DeadLetterTopic = opts.DeadLetterTopic
+	u.opts.BackupInterval = opts.BackupInterval
+	u.opts.CleanInterval = opts.CleanInterval
+	u.opts.CleanWindowStart = opts.CleanWindowStart
+	u.opts.CleanWindowEnd = opts.CleanWindowEnd
+	u.opts.CleanPausePushRate = opts.CleanPausePushRate
+	u.opts.ChunkSize = opts.ChunkSize
+	u.opts.PersistEvery = opts.PersistEvery
+	u.opts.AutoCreateTopics = opts.AutoCreateTopics
+	u.opts.AutoCreateLines = opts.AutoCreateLines
+	u.optsLock.Unlock()
+
+	u.topicsLock.RLock()
+	defer u.topicsLock.RUnlock()
+	for _, t := range u.topics {
+		t.reconfigured()
+	}
+	return nil
+}
+
+// checkWritable returns ErrReadOnly for op if the queue is read only, and
+// ErrNotLoaded if it is not loaded yet or failed to
+func (u *UnitedQueue) checkWritable(op string) error {
+	if !u.loadStarted() {
+		return utils.NewError(
+			utils.ErrNotLoaded,
+			`queue `+op,
+		)
+	}
+	if !u.opts.ReadOnly {
+		return nil
+	}
+	return utils.NewError(
+		utils.ErrReadOnly,
+		`queue `+op,
+	)
 }
 
 func (u *UnitedQueue) setData(key string, data []byte) error {
-	err := u.storage.Set(key, data)
+	if u.checksum {
+		data = sealValue(data)
+	}
+	return u.putData(key, data)
+}
+
+// setDataTTL sets the value of key like setData, and lets the storage
+// expire it after ttl if it can. A ttl not above 0 means the value never
+// expires.
+func (u *UnitedQueue) setDataTTL(key string, data []byte, ttl time.Duration) error {
+	if ttl <= 0 || !u.expiresNatively() {
+		return u.setData(key, data)
+	}
+	err := u.checkWritable("set " + key)
+	if err != nil {
+		return err
+	}
+	if u.checksum {
+		data = sealValue(data)
+	}
+	err = u.storage.(store.ExpiringStore).SetWithTTL(key, data, ttl)
+	if err != nil {
+		return utils.NewError(
+			utils.ErrInternalError,
+			err.Error(),
+		)
+	}
+	return nil
+}
+
+// expiresNatively tells whether the storage expires the messages with a
+// deadline by itself
+func (u *UnitedQueue) expiresNatively() bool {
+	return store.CanExpire(u.storage)
+}
+
+// putData sets the value as it is to the storage
+func (u *UnitedQueue) putData(key string, data []byte) error {
+	// the last guard of the read only storage, the changes in memory are
+	// rejected before
+	err := u.checkWritable("set " + key)
+	if err != nil {
+		return err
+	}
+	err = u.storage.Set(key, data)
 	if err != nil {
 		// log.Printf("key[%s] set data error: %s", key, err)
 		return utils.NewError(
@@ -79,8 +419,56 @@ func (u *UnitedQueue) setData(key string, data []byte) error {
 	return nil
 }
 
+// storeMarshaler is implemented by the protobuf stores of the queue
+type storeMarshaler interface {
+	Size() int
+	MarshalTo(data []byte) (int, error)
+}
+
+// storeBufPool keeps the buffers the stores are marshaled into, so the
+// backups of many topics do not allocate one for every store
+var storeBufPool = sync.Pool{
+	New: func() interface{} {
+		return new([]byte)
+	},
+}
+
+// setStore marshals m into a pooled buffer and sets it to key
+func (u *UnitedQueue) setStore(key string, m storeMarshaler) error {
+	bufp := storeBufPool.Get().(*[]byte)
+	defer storeBufPool.Put(bufp)
+
+	// the checksum is filled in the room left before the store
+	off := 0
+	if u.checksum {
+		off = checksumSize
+	}
+	size := off + m.Size()
+	if cap(*bufp) < size {
+		*bufp = make([]byte, size)
+	}
+	buf := (*bufp)[:size]
+	n, err := m.MarshalTo(buf[off:])
+	if err != nil {
+		return utils.NewError(
+			utils.ErrInternalError,
+			err.Error(),
+		)
+	}
+	if u.checksum {
+		sealInPlace(buf[:off+n])
+	}
+	return u.putData(key, buf[:off+n])
+}
+
 func (u *UnitedQueue) getData(key string) ([]byte, error) {
 	data, err := u.storage.Get(key)
+	if err == store.ErrNotExisted {
+		return nil, utils.NewError(
+			utils.ErrDataNotExisted,
+			key,
+		)
+	}
 	if err != nil {
 		// log.Printf("key[%s] get data error: %s", key, err)
 		return nil, utils.NewError(
@@ -88,11 +476,24 @@ func (u *UnitedQueue) getData(key string) ([]byte, error) {
 			err.Error(),
 		)
 	}
+	if u.checksum {
+		return openValue(key, data)
+	}
 	return data, nil
 }
 
 func (u *UnitedQueue) delData(key string) error {
-	err := u.storage.Del(key)
+	err := u.checkWritable("del " + key)
+	if err != nil {
+		return err
+	}
+	err = u.storage.Del(key)
+	if err == store.ErrNotExisted {
+		return utils.NewError(
+			utils.ErrDataNotExisted,
+			key,
+		)
+	}
 	if err != nil {
 		// log.Printf("key[%s] del data error: %s", key, err)
 		return utils.NewError(
@@ -103,27 +504,105 @@ func (u *UnitedQueue) delData(key string) error {
 	return nil
 }
 
+// isDataNotExisted reports whether err is a missing key of the storage
+func isDataNotExisted(err error) bool {
+	e, ok := err.(*utils.Error)
+	return ok && e.ErrorCode == utils.ErrDataNotExisted
+}
+
+// deadLetter records the key of a lost message to the DeadLetterTopic
+func (u *UnitedQueue) deadLetter(topicName, lineName string, id uint64) {
+	deadTopic := u.options().DeadLetterTopic
+	if deadTopic == "" || deadTopic == topicName {
+		return
+	}
+
+	key := u.confirmKey(topicName, lineName, id)
+	err := u.Push(deadTopic, []byte(key))
+	if err != nil {
+		log.Printf("dead letter %s error: %s", key, err)
+	}
+}
+
+// PersistError is the error of an export which failed to persist some of
+// the topics or lines. Failures is keyed by "topic" or "topic/line".
+type PersistError struct {
+	Failures map[string]error
+}
+
+func newPersistError() *PersistError {
+	return new(PersistError)
+}
+
+func (e *PersistError) add(name string, err error) {
+	// made on the first failure, as most exports have none
+	if e.Failures == nil {
+		e.Failures = make(map[string]error)
+	}
+	e.Failures[name] = err
+}
+
+func (e *PersistError) merge(err error) {
+	if pe, ok := err.(*PersistError); ok {
+		for name, err := range pe.Failures {
+			e.add(name, err)
+		}
+	}
+}
+
+func (e *PersistError) errorOrNil() error {
+	if len(e.Failures) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Error implements the error interface
+func (e *PersistError) Error() string {
+	names := make([]string, 0, len(e.Failures))
+	for name := range e.Failures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	causes := make([]string, len(names))
+	for i, name := range names {
+		causes[i] = name + ": " + e.Failures[name].Error()
+	}
+	return "persist failed: " + strings.Join(causes, "; ")
+}
+
 func (u *UnitedQueue) exportTopics() error {
+	return u.exportTopicsEach(nil)
+}
+
+// exportTopicsEach exports the topics like exportTopics, and calls done
+// with the name of every topic exported with all its lines
+func (u *UnitedQueue) exportTopicsEach(done func(name string)) error {
 	u.topicsLock.RLock()
 	defer u.topicsLock.RUnlock()
 
+	pe := newPersistError()
 	for _, t := range u.topics {
 		err := t.exportLines()
 		if err != nil {
 			log.Printf("topic[%s] export lines error: %s", t.name, err)
-			continue
+			pe.merge(err)
 		}
 		t.linesLock.RLock()
-		err = t.exportTopic()
+		err2 := t.exportTopic()
 		t.linesLock.RUnlock()
-		if err != nil {
-			log.Printf("topic[%s] export error: %s", t.name, err)
-			continue
+		if err2 != nil {
+			log.Printf("topic[%s] export error: %s", t.name, err2)
+			pe.add(t.name, err2)
+		}
+		if err == nil && err2 == nil && done != nil {
+			done(t.name)
 		}
 	}
 
 	// log.Printf("export all topics succ.")
-	return nil
+	return pe.errorOrNil()
 }
 
 func (u *UnitedQueue) genQueueStore() *UnitedQueueStore {
@@ -142,15 +621,7 @@ func (u *UnitedQueue) genQueueStore() *UnitedQueueStore {
 func (u *UnitedQueue) exportQueue() error {
 	// log.Printf("start export queue...")
 	qs := u.genQueueStore()
-	buf, err := qs.Marshal()
-	if err != nil {
-		return utils.NewError(
-			utils.ErrInternalError,
-			err.Error(),
-		)
-	}
-
-	err = u.setData(storageKeyWord, buf)
+	err := u.setStore(storageKeyWord, qs)
 	if err != nil {
 		return err
 	}
@@ -159,43 +630,96 @@ func (u *UnitedQueue) exportQueue() error {
 	return nil
 }
 
+// LoadError is the error of loading the topics or lines which are broken in
+// the storage. Failures is keyed by "topic" or "topic/line".
+type LoadError struct {
+	Failures map[string]error
+}
+
+func newLoadError() *LoadError {
+	le := new(LoadError)
+	le.Failures = make(map[string]error)
+	return le
+}
+
+func (e *LoadError) add(name string, err error) {
+	e.Failures[name] = err
+}
+
+// Error implements the error interface
+func (e *LoadError) Error() string {
+	names := make([]string, 0, len(e.Failures))
+	for name := range e.Failures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	causes := make([]string, len(names))
+	for i, name := range names {
+		causes[i] = name + ": " + e.Failures[name].Error()
+	}
+	return "load failed: " + strings.Join(causes, "; ")
+}
+
+// LoadErrors returns a *LoadError listing the lines which were skipped when
+// the queue was loaded, or nil if every line was loaded. The skipped lines
+// are dropped from the storage by the next export of their topic.
+func (u *UnitedQueue) LoadErrors() error {
+	if len(u.loadErrors.Failures) == 0 {
+		return nil
+	}
+	return u.loadErrors
+}
+
 func (u *UnitedQueue) loadTopic(topicName string, ts UnitedTopicStore) (*topic, error) {
 	t := new(topic)
 	t.name = topicName
 	t.persist = ts.Persist
+	t.idleExpire = time.Duration(ts.IdleExpire)
+	// the activity before the restart is unknown, so an ephemeral topic
+	// lives for another idle duration
+	t.lastActive = u.now().UnixNano()
 	t.q = u
+	t.pushed = make(chan bool)
+	t.reconfig = make(chan bool, 1)
 	t.quit = make(chan bool)
 
-	t.headKey = topicName + keyTopicHead
+	t.headKey = u.keys.topicHead(topicName)
+	t.msgPrefix = u.keys.messagePrefix(topicName)
 	topicHeadData, err := u.getData(t.headKey)
 	if err != nil {
 		return nil, err
 	}
 	t.head = binary.LittleEndian.Uint64(topicHeadData)
-	t.tailKey = topicName + keyTopicTail
+	t.tailKey = u.keys.topicTail(topicName)
 	topicTailData, err := u.getData(t.tailKey)
 	if err != nil {
 		return nil, err
 	}
 	t.tail = binary.LittleEndian.Uint64(topicTailData)
+	err = t.loadConfig()
+	if err != nil {
+		return nil, err
+	}
 
 	lines := make(map[string]*line)
-	for _, lineName := range ts.Lines {
-		lineStoreKey := topicName + "/" + lineName
-		lineStoreData, err := u.getData(lineStoreKey)
-		if err != nil {
-			return nil, err
-		}
-		if len(lineStoreData) == 0 {
-			return nil, errors.New("line backup data missing: " + lineStoreKey)
+	if u.opts.LazyLoad {
+		t.lazy = make(map[string]bool, len(ts.Lines))
+		for _, lineName := range ts.Lines {
+			t.lazy[lineName] = true
 		}
-		var ls UnitedLineStore
-		err = ls.Unmarshal(lineStoreData)
+		t.lazyCount = int32(len(t.lazy))
+		ts.Lines = nil
+	}
+	for _, lineName := range ts.Lines {
+		ls, err := t.readLineStore(lineName)
 		if err != nil {
 			return nil, err
 		}
 		l, err := t.loadLine(lineName, ls)
 		if err != nil {
+			log.Printf("line[%s/%s] load error, skipped: %s", topicName, lineName, err)
+			u.loadErrors.add(topicName+u.opts.Separator+lineName, err)
 			continue
 		}
 		lines[lineName] = l
@@ -205,18 +729,59 @@ func (u *UnitedQueue) loadTopic(topicName string, ts UnitedTopicStore) (*topic,
 
 	u.registerTopic(t.name)
 
-	t.start()
+	if !u.opts.ReadOnly {
+		t.startWrites()
+		t.start()
+	}
 	// log.Printf("topic[%s] load succ.", topicName)
 	// log.Printf("topic: %v", t)
 	return t, nil
 }
 
-func (u *UnitedQueue) loadQueue() error {
+// waitStorage reads the queue store until the storage answers, retrying
+// with backoff for the StoreOpenTimeout. A missing queue store is an answer
+// of a new storage.
+func (u *UnitedQueue) waitStorage(ctx context.Context) error {
+	clock := u.opts.Clock
+	deadline := clock.Now().Add(u.opts.StoreOpenTimeout)
+	backoff := u.opts.StoreOpenBackoff
+	for {
+		_, err := u.getData(storageKeyWord)
+		if err == nil || isDataNotExisted(err) {
+			return nil
+		}
+		wait := deadline.Sub(clock.Now())
+		if wait <= 0 {
+			return err
+		}
+		if backoff < wait {
+			wait = backoff
+		}
+		log.Printf("storage is not ready, retry in %v: %s", wait, err)
+		select {
+		case <-clock.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+		if backoff > storeOpenMaxWait {
+			backoff = storeOpenMaxWait
+		}
+	}
+}
+
+// loadQueue loads the topics in the order of their names. It tries every
+// topic, and returns a *LoadError listing the broken ones if there is any.
+func (u *UnitedQueue) loadQueue(ctx context.Context) error {
+	u.loadErrors = newLoadError()
 	unitedQueueStoreData, err := u.getData(storageKeyWord)
-	if err != nil {
+	if isDataNotExisted(err) {
 		// log.Printf("storage not existed: %s", err)
 		return nil
 	}
+	if err != nil {
+		return err
+	}
 
 	if len(unitedQueueStoreData) > 0 {
 		var qs UnitedQueueStore
@@ -224,27 +789,30 @@ func (u *UnitedQueue) loadQueue() error {
 		if err != nil {
 			return err
 		}
+		sort.Strings(qs.Topics)
+		le := newLoadError()
 		for _, topicName := range qs.Topics {
-			topicStoreData, err := u.getData(topicName)
-			if err != nil {
-				return err
-			}
-			if len(topicStoreData) == 0 {
-				return errors.New("topic backup data missing: " + topicName)
-			}
-			var ts UnitedTopicStore
-			err = ts.Unmarshal(topicStoreData)
-			if err != nil {
-				return err
+			if ctx.Err() != nil {
+				for _, t := range u.topics {
+					t.close()
+				}
+				return ctx.Err()
 			}
-			t, err := u.loadTopic(topicName, ts)
+			t, err := u.loadTopicStore(topicName)
 			if err != nil {
-				return err
+				le.add(topicName, err)
+				continue
 			}
 			u.topicsLock.Lock()
 			u.topics[topicName] = t
 			u.topicsLock.Unlock()
 		}
+		if len(le.Failures) > 0 {
+			for _, t := range u.topics {
+				t.close()
+			}
+			return le
+		}
 	}
 
 	// log.Printf("united queue load finisded.")
@@ -252,17 +820,38 @@ func (u *UnitedQueue) loadQueue() error {
 	return nil
 }
 
-func (u *UnitedQueue) newTopic(name string, persist bool) (*topic, error) {
+func (u *UnitedQueue) loadTopicStore(topicName string) (*topic, error) {
+	topicStoreData, err := u.getData(u.keys.topic(topicName))
+	if err != nil {
+		return nil, err
+	}
+	if len(topicStoreData) == 0 {
+		return nil, errors.New("topic backup data missing: " + topicName)
+	}
+	var ts UnitedTopicStore
+	err = ts.Unmarshal(topicStoreData)
+	if err != nil {
+		return nil, err
+	}
+	return u.loadTopic(topicName, ts)
+}
+
+func (u *UnitedQueue) newTopic(name string, persist bool, idleExpire time.Duration, cfg TopicConfig) (*topic, error) {
 	lines := make(map[string]*line)
 	t := new(topic)
 	t.name = name
 	t.persist = persist
+	t.idleExpire = idleExpire
+	t.lastActive = u.now().UnixNano()
 	t.lines = lines
 	t.head = 0
-	t.headKey = name + keyTopicHead
+	t.headKey = u.keys.topicHead(name)
+	t.msgPrefix = u.keys.messagePrefix(name)
 	t.tail = 0
-	t.tailKey = name + keyTopicTail
+	t.tailKey = u.keys.topicTail(name)
 	t.q = u
+	t.pushed = make(chan bool)
+	t.reconfig = make(chan bool, 1)
 	t.quit = make(chan bool)
 
 	err := t.exportHead()
@@ -273,14 +862,38 @@ func (u *UnitedQueue) newTopic(name string, persist bool) (*topic, error) {
 	if err != nil {
 		return nil, err
 	}
+	// a topic without lines is loaded back only if its store is exported
+	err = t.exportTopic()
+	if err != nil {
+		return nil, err
+	}
+	err = t.configure(cfg)
+	if err != nil {
+		return nil, err
+	}
 
+	t.startWrites()
 	t.start()
 	return t, nil
 }
 
-func (u *UnitedQueue) createTopic(name string, persist, fromEtcd bool) error {
+// checkMaxTopics returns ErrTooManyTopics if no more topic can be created,
+// the caller must hold u.topicsLock
+func (u *UnitedQueue) checkMaxTopics() error {
+	max := u.options().MaxTopics
+	if max > 0 && len(u.topics) >= max {
+		return utils.NewError(
+			utils.ErrTooManyTopics,
+			`queue createTopic`,
+		)
+	}
+	return nil
+}
+
+func (u *UnitedQueue) createTopic(name string, persist bool, idleExpire time.Duration, cfg TopicConfig, fromEtcd bool) error {
 	u.topicsLock.RLock()
-	_, ok := u.topics[name]
+	ok := u.nameTaken(name)
+	err := u.checkMaxTopics()
 	u.topicsLock.RUnlock()
 	if ok {
 		return utils.NewError(
@@ -288,14 +901,32 @@ func (u *UnitedQueue) createTopic(name string, persist, fromEtcd bool) error {
 			`queue createTopic`,
 		)
 	}
+	if err != nil {
+		return err
+	}
 
-	t, err := u.newTopic(name, persist)
+	t, err := u.newTopic(name, persist, idleExpire, cfg)
 	if err != nil {
 		return err
 	}
 
 	u.topicsLock.Lock()
 	defer u.topicsLock.Unlock()
+	if u.nameTaken(name) {
+		// created by another call meanwhile, the same head and tail are
+		// exported by both so only the goroutine is stopped
+		t.close()
+		return utils.NewError(
+			utils.ErrTopicExisted,
+			`queue createTopic`,
+		)
+	}
+	err = u.checkMaxTopics()
+	if err != nil {
+		// other topics are created meanwhile
+		t.remove()
+		return err
+	}
 	u.topics[name] = t
 
 	err = u.exportQueue()
@@ -309,83 +940,315 @@ func (u *UnitedQueue) createTopic(name string, persist, fromEtcd bool) error {
 		u.registerTopic(t.name)
 	}
 	log.Printf("topic[%s] created.", name)
+	u.emit(LifecycleCreate, name, "")
 	return nil
 }
 
-func (u *UnitedQueue) create(key, arg string, fromEtcd bool) error {
-	key = strings.TrimPrefix(key, "/")
-	key = strings.TrimSuffix(key, "/")
+// CreateRequest is the request to create a topic or a line
+type CreateRequest struct {
+	// TopicName is the name of the topic
+	TopicName string
+	// LineName is the name of the line, empty means creating the topic
+	LineName string
+	// Persist keeps the messages of the topic after all lines consumed them
+	Persist bool
+	// IdleExpire makes the topic ephemeral, it is removed with its lines
+	// and messages after no push or pop for the duration. 0 means the
+	// topic never expires, and it is ignored for a line. The duration is
+	// stored, so a topic loaded after a restart expires once it is idle
+	// for the duration again. An ephemeral topic counts to MaxTopics until
+	// it is removed, which happens on the CleanInterval after it expires.
+	IdleExpire time.Duration
+	// TopicConfig is the config of the topic
+	TopicConfig TopicConfig
+	// Recycle is the recycle duration of the line
+	Recycle time.Duration
+	// StartID is the id the line starts to consume from, nil means the
+	// head of the topic. It must not be below the head, and is clamped to
+	// the tail of the topic.
+	StartID *uint64
+	// LIFO makes the line pop the newest message first, and the older ones
+	// only when there is no newer one left. The old messages of a busy LIFO
+	// line may never be popped, so it suits the consumers which only care
+	// about the recent ones.
+	LIFO bool
+	// LineConfig is the config of the line
+	LineConfig LineConfig
+}
 
-	var topicName, lineName string
-	var err error
-	parts := strings.Split(key, "/")
+func (u *UnitedQueue) parseCreate(key, arg string) (*CreateRequest, error) {
+	key = u.trimKey(key)
+
+	parts := strings.Split(key, u.opts.Separator)
 	if len(parts) < 1 || len(parts) > 2 {
-		return utils.NewError(
+		return nil, utils.NewError(
 			utils.ErrBadKey,
 			`create key parts error: `+utils.ItoaQuick(len(parts)),
 		)
 	}
 
-	topicName = parts[0]
-	if topicName == "" {
-		return utils.NewError(
-			utils.ErrBadKey,
-			`create topic is nil`,
-		)
-	}
-
+	req := new(CreateRequest)
+	req.TopicName = parts[0]
 	if len(parts) == 2 {
-		lineName = parts[1]
-		var recycle time.Duration
+		req.LineName = parts[1]
 		if arg != "" {
-			recycle, err = time.ParseDuration(arg)
+			recycle, err := time.ParseDuration(arg)
 			if err != nil {
-				return utils.NewError(
+				return nil, utils.NewError(
 					utils.ErrBadRequest,
 					err.Error(),
 				)
 			}
+			req.Recycle = recycle
 		}
+	} else if arg == "persist" {
+		req.Persist = true
+	}
 
-		u.topicsLock.RLock()
-		t, ok := u.topics[topicName]
-		u.topicsLock.RUnlock()
-		if !ok {
-			return utils.NewError(
-				utils.ErrTopicNotExisted,
-				`queue create`,
-			)
-		}
+	return req, nil
+}
+
+func (u *UnitedQueue) create(key, arg string, fromEtcd bool) error {
+	req, err := u.parseCreate(key, arg)
+	if err != nil {
+		return err
+	}
+	return u.createWith(req, fromEtcd)
+}
+
+// checkCreateRequest rejects the request without a topic name, which a
+// line needs as well as a topic, the names with the separator and a
+// negative IdleExpire
+func (u *UnitedQueue) checkCreateRequest(req *CreateRequest) error {
+	sep := u.opts.Separator
+	if strings.Contains(req.TopicName, sep) || strings.Contains(req.LineName, sep) {
+		return utils.NewError(
+			utils.ErrBadKey,
+			`create name contains separator `+sep,
+		)
+	}
+	if req.IdleExpire < 0 {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`create idle expire is negative`,
+		)
+	}
+	if req.TopicName != "" {
+		return nil
+	}
+	if req.LineName != "" {
+		return utils.NewError(
+			utils.ErrBadKey,
+			`create line `+req.LineName+` without topic name`,
+		)
+	}
+	return utils.NewError(
+		utils.ErrBadKey,
+		`create topic is nil`,
+	)
+}
+
+func (u *UnitedQueue) createWith(req *CreateRequest, fromEtcd bool) error {
+	err := u.checkWritable("create")
+	if err != nil {
+		return err
+	}
+	err = u.checkCreateRequest(req)
+	if err != nil {
+		return err
+	}
 
-		err = t.createLine(lineName, recycle, fromEtcd)
+	if req.LineName == "" {
+		err = u.createTopic(req.TopicName, req.Persist, req.IdleExpire, req.TopicConfig, fromEtcd)
 		if err != nil {
-			// log.Printf("create line[%s] error: %s", lineName, err)
+			// log.Printf("create topic[%s] error: %s", req.TopicName, err)
 			return err
 		}
-	} else {
-		var persist bool
-		if arg == "persist" {
-			persist = true
+		return nil
+	}
+
+	t, ok := u.getTopic(req.TopicName)
+	if !ok {
+		return utils.NewError(
+			utils.ErrTopicNotExisted,
+			`queue create`,
+		)
+	}
+
+	err = t.createLine(req.LineName, req.Recycle, req.StartID, req.LIFO, req.LineConfig, fromEtcd)
+	if err != nil {
+		// log.Printf("create line[%s] error: %s", req.LineName, err)
+		return err
+	}
+	return nil
+}
+
+// Create implements Create interface
+func (u *UnitedQueue) Create(key, arg string) error {
+	return u.wrapError("create", key, u.create(key, arg, false))
+}
+
+// CreateWith creates the topic or the line described by req
+func (u *UnitedQueue) CreateWith(req *CreateRequest) error {
+	err := u.createWith(req, false)
+	if err != nil {
+		return &QueueError{Op: "create", Topic: req.TopicName, Line: req.LineName, Err: err}
+	}
+	return nil
+}
+
+// CreateMany creates the topics and lines of reqs under one lock, and
+// exports the queue only once at the end. The error of each request is in
+// its slot, and the existing ones report ErrTopicExisted or ErrLineExisted
+// without aborting the others.
+func (u *UnitedQueue) CreateMany(reqs []*CreateRequest) []error {
+	errs := make([]error, len(reqs))
+	err := u.checkWritable("createMany")
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	u.topicsLock.Lock()
+	defer u.topicsLock.Unlock()
+
+	// the requests depending on the new topics fail if exporting them fails
+	created := make(map[string][]int)
+	for i, req := range reqs {
+		errs[i] = u.checkCreateRequest(req)
+		if errs[i] != nil {
+			continue
 		}
-		err = u.createTopic(topicName, persist, fromEtcd)
-		if err != nil {
-			// log.Printf("create topic[%s] error: %s", topicName, err)
-			return err
+
+		if req.LineName == "" {
+			if u.nameTaken(req.TopicName) {
+				errs[i] = utils.NewError(
+					utils.ErrTopicExisted,
+					`queue createMany`,
+				)
+				continue
+			}
+			t, err := u.newTopic(req.TopicName, req.Persist, req.IdleExpire, req.TopicConfig)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			u.topics[req.TopicName] = t
+			created[req.TopicName] = append(created[req.TopicName], i)
+			continue
+		}
+
+		t, ok := u.topics[u.resolveTopic(req.TopicName)]
+		if !ok {
+			errs[i] = utils.NewError(
+				utils.ErrTopicNotExisted,
+				`queue createMany`,
+			)
+			continue
+		}
+		errs[i] = t.createLine(req.LineName, req.Recycle, req.StartID, req.LIFO, req.LineConfig, false)
+		if _, ok := created[req.TopicName]; ok && errs[i] == nil {
+			created[req.TopicName] = append(created[req.TopicName], i)
+		}
+	}
+	if len(created) == 0 {
+		return errs
+	}
+
+	err = u.exportQueue()
+	if err != nil {
+		for name, indexes := range created {
+			u.topics[name].remove()
+			delete(u.topics, name)
+			for _, i := range indexes {
+				errs[i] = err
+			}
 		}
+		return errs
+	}
+
+	for name := range created {
+		u.registerTopic(name)
+		log.Printf("topic[%s] created.", name)
+		u.emit(LifecycleCreate, name, "")
+	}
+	return errs
+}
+
+// Push implements Push interface
+func (u *UnitedQueue) Push(key string, data []byte) error {
+	return u.wrapError("push", key, u.push(key, data))
+}
+
+func (u *UnitedQueue) push(key string, data []byte) error {
+	key = u.trimKey(key)
+
+	if len(data) <= 0 {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`message has no content`,
+		)
+	}
+
+	t, err := u.pushTopic(key, "push")
+	if err != nil {
+		return err
+	}
+
+	return t.push(data)
+}
+
+// pushTopic returns the topic to push into, which is created first if it
+// does not exist and the AutoCreateTopics option is set
+func (u *UnitedQueue) pushTopic(name, op string) (*topic, error) {
+	err := u.checkWritable(op)
+	if err != nil {
+		return nil, err
+	}
+
+	t, ok := u.getTopic(name)
+	if ok {
+		return t, nil
+	}
+	if !u.options().AutoCreateTopics || name == "" {
+		return nil, utils.NewError(
+			utils.ErrTopicNotExisted,
+			`queue `+op,
+		)
+	}
+
+	err = u.createTopic(name, false, 0, TopicConfig{}, false)
+	if err != nil && !isTopicExisted(err) {
+		return nil, err
+	}
+
+	t, ok = u.getTopic(name)
+	if !ok {
+		// removed right after being created
+		return nil, utils.NewError(
+			utils.ErrTopicNotExisted,
+			`queue `+op,
+		)
 	}
+	return t, nil
+}
 
-	return err
+func isTopicExisted(err error) bool {
+	e, ok := err.(*utils.Error)
+	return ok && e.ErrorCode == utils.ErrTopicExisted
 }
 
-// Create implements Create interface
-func (u *UnitedQueue) Create(key, arg string) error {
-	return u.create(key, arg, false)
+func isLineExisted(err error) bool {
+	e, ok := err.(*utils.Error)
+	return ok && e.ErrorCode == utils.ErrLineExisted
 }
 
-// Push implements Push interface
-func (u *UnitedQueue) Push(key string, data []byte) error {
-	key = strings.TrimPrefix(key, "/")
-	key = strings.TrimSuffix(key, "/")
+// PushAndWait pushes a message into the topic and blocks until it is
+// confirmed in the line named lineName or the timeout expires
+func (u *UnitedQueue) PushAndWait(name, lineName string, data []byte, timeout time.Duration) error {
+	name = u.trimKey(name)
 
 	if len(data) <= 0 {
 		return utils.NewError(
@@ -394,88 +1257,266 @@ func (u *UnitedQueue) Push(key string, data []byte) error {
 		)
 	}
 
-	u.topicsLock.RLock()
-	t, ok := u.topics[key]
-	u.topicsLock.RUnlock()
+	err := u.checkWritable("pushAndWait")
+	if err != nil {
+		return err
+	}
+
+	t, ok := u.getTopic(name)
 	if !ok {
 		return utils.NewError(
 			utils.ErrTopicNotExisted,
-			`queue push`,
+			`queue pushAndWait`,
 		)
 	}
 
-	return t.push(data)
+	return t.pushAndWait(lineName, data, timeout)
+}
+
+// PushUntil pushes a message into the topic which expires at deadline, the
+// lines skip it instead of delivering it after that.
+//
+// If store.CanExpire tells the storage expires the keys, it removes the
+// message at the deadline by its own clock. The offsets of the topic and
+// its lines are not changed by that, so the lines skip the gap when they
+// reach it, and an inflight message removed this way is never redelivered.
+// The lines count the message in their Stat until they pass it. A message
+// missing from such a storage may be expired, so it is only logged and not
+// sent to the DeadLetterTopic even if it is lost for another reason.
+func (u *UnitedQueue) PushUntil(name string, data []byte, deadline time.Time) error {
+	return u.pushWith(name, data, deadline, nil, "pushUntil")
+}
+
+// pushWith pushes a message with the metadata, a zero deadline means never
+func (u *UnitedQueue) pushWith(name string, data []byte, deadline time.Time, attrs map[string]string, op string) error {
+	name = u.trimKey(name)
+
+	if len(data) <= 0 {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`message has no content`,
+		)
+	}
+	if u.codec == RawCodec {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`raw codec cannot store metadata`,
+		)
+	}
+	if len(attrs) > 0 {
+		err := u.checkAttrs(op)
+		if err != nil {
+			return err
+		}
+	}
+
+	t, err := u.pushTopic(name, op)
+	if err != nil {
+		return err
+	}
+
+	e := new(Envelope)
+	e.Data = data
+	if !deadline.IsZero() {
+		e.Deadline = deadline.UnixNano()
+	}
+	e.Attrs = attrs
+	return t.pushEnvelope(e)
 }
 
 // MultiPush implements MultiPush interface
 func (u *UnitedQueue) MultiPush(key string, datas [][]byte) error {
-	key = strings.TrimPrefix(key, "/")
-	key = strings.TrimSuffix(key, "/")
+	_, err := u.PushBatch(key, datas)
+	return err
+}
+
+// PushBatch pushes the datas into the topic like MultiPush, and returns the
+// contiguous ids assigned to them in input order. The ids are the same as
+// the ones in the keys returned by Pop.
+func (u *UnitedQueue) PushBatch(key string, datas [][]byte) ([]uint64, error) {
+	return u.PushBatchWith(key, datas, BatchOptions{})
+}
+
+// BatchOptions is the tunables of a batch push. The zero value pushes every
+// data as PushBatch does.
+type BatchOptions struct {
+	// Dedup stores the identical datas of the batch only once, and returns
+	// the id of the first one for all of them. The datas pushed by other
+	// calls are never compared.
+	Dedup bool
+}
+
+// PushBatchWith pushes the datas into the topic like PushBatch, tuned by
+// opts. The ids are in input order, but the ones of duplicates are
+// repeated, so they are not contiguous when Dedup drops some.
+func (u *UnitedQueue) PushBatchWith(key string, datas [][]byte, opts BatchOptions) ([]uint64, error) {
+	key = u.trimKey(key)
 
 	for i, data := range datas {
 		if len(data) <= 0 {
 			cause := "message " + strconv.Itoa(i) + " has no content"
-			return utils.NewError(
+			return nil, utils.NewError(
 				utils.ErrBadRequest,
 				cause,
 			)
 		}
 	}
 
-	u.topicsLock.RLock()
-	t, ok := u.topics[key]
-	u.topicsLock.RUnlock()
-	if !ok {
-		return utils.NewError(
-			utils.ErrTopicNotExisted,
-			`queue multiPush`,
-		)
+	t, err := u.pushTopic(key, "multiPush")
+	if err != nil {
+		return nil, err
+	}
+	if !opts.Dedup {
+		return t.mPush(datas)
+	}
+
+	// index maps every data to its first occurrence in uniques
+	index := make([]int, len(datas))
+	firsts := make(map[[sha256.Size]byte]int)
+	uniques := make([][]byte, 0, len(datas))
+	for i, data := range datas {
+		sum := sha256.Sum256(data)
+		j, ok := firsts[sum]
+		if !ok {
+			j = len(uniques)
+			firsts[sum] = j
+			uniques = append(uniques, data)
+		}
+		index[i] = j
 	}
 
-	return t.mPush(datas)
+	uniqueIDs, err := t.mPush(uniques)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint64, len(datas))
+	for i, j := range index {
+		ids[i] = uniqueIDs[j]
+	}
+	return ids, nil
 }
 
-// Pop implements Pop interface
+// Pop implements Pop interface. The data returned is owned by the caller
+// like the Data of PopMessage.
 func (u *UnitedQueue) Pop(key string) (string, []byte, error) {
-	key = strings.TrimPrefix(key, "/")
-	key = strings.TrimSuffix(key, "/")
+	m, err := u.PopMessage(key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return m.Key, m.Data, nil
+}
+
+// PopMessage pops a message from the line like Pop, and returns it with
+// its metadata. Confirm it with the Key of the message.
+func (u *UnitedQueue) PopMessage(key string) (*Message, error) {
+	err := u.checkWritable("pop")
+	if err != nil {
+		return nil, u.wrapError("pop", key, err)
+	}
+
+	t, lName, err := u.lineTopic(key, "pop")
+	if err != nil {
+		return nil, u.wrapError("pop", key, err)
+	}
+
+	m, err := t.pop(lName)
+	if err != nil {
+		return nil, u.wrapError("pop", key, err)
+	}
+	return m, nil
+}
+
+// Process pops a message from the line and passes it to handler. The
+// message is confirmed if handler returns nil, otherwise it is requeued to
+// be popped again at once and the error of handler is returned. The
+// messages of a line without recycle are never requeued.
+func (u *UnitedQueue) Process(name string, handler func(id uint64, data []byte) error) error {
+	err := u.checkWritable("process")
+	if err != nil {
+		return err
+	}
+
+	t, lName, err := u.lineTopic(name, "process")
+	if err != nil {
+		return err
+	}
+
+	return t.process(lName, handler)
+}
+
+// PopAck pops a message from the line like Pop, and returns its data with
+// ack confirming it and nack requeueing it to be popped again at once, so
+// the caller needs no key to settle it. They return the errors of a
+// confirm of the message, and nack of a line without recycle returns
+// ErrConfirmNotApplicable unless the line has ConfirmNoop. The closures are
+// nil if the pop fails, with ErrNone if the line is empty.
+func (u *UnitedQueue) PopAck(name string) (data []byte, ack func() error, nack func() error, err error) {
+	err = u.checkWritable("popAck")
+	if err != nil {
+		return nil, nil, nil, u.wrapError("popAck", name, err)
+	}
+
+	t, lName, err := u.lineTopic(name, "popAck")
+	if err != nil {
+		return nil, nil, nil, u.wrapError("popAck", name, err)
+	}
+
+	m, err := t.pop(lName)
+	if err != nil {
+		return nil, nil, nil, u.wrapError("popAck", name, err)
+	}
+
+	ack = func() error {
+		return u.Confirm(m.Key)
+	}
+	nack = func() error {
+		err := u.checkWritable("requeue")
+		if err == nil {
+			err = t.requeue(lName, m.ID)
+		}
+		return u.wrapError("requeue", m.Key, err)
+	}
+	return m.Data, ack, nack, nil
+}
 
-	parts := strings.Split(key, "/")
+// lineTopic splits key "topic/line" and returns the topic and line name
+func (u *UnitedQueue) lineTopic(key, op string) (*topic, string, error) {
+	key = u.trimKey(key)
+
+	parts := strings.Split(key, u.opts.Separator)
 	if len(parts) != 2 {
-		return "", nil, utils.NewError(
+		return nil, "", utils.NewError(
 			utils.ErrBadKey,
-			`pop key parts error: `+utils.ItoaQuick(len(parts)),
+			op+` key parts error: `+utils.ItoaQuick(len(parts)),
 		)
 	}
 
 	tName := parts[0]
 	lName := parts[1]
 
-	u.topicsLock.RLock()
-	t, ok := u.topics[tName]
-	u.topicsLock.RUnlock()
+	t, ok := u.getTopic(tName)
 	if !ok {
 		// log.Printf("topic[%s] not existed.", tName)
-		return "", nil, utils.NewError(
+		return nil, "", utils.NewError(
 			utils.ErrTopicNotExisted,
-			`queue pop`,
+			`queue `+op,
 		)
 	}
 
-	id, data, err := t.pop(lName)
-	if err != nil {
-		return "", nil, err
-	}
-
-	return utils.Acatui(key, "/", id), data, nil
+	return t, lName, nil
 }
 
 // MultiPop implements MultiPop interface
 func (u *UnitedQueue) MultiPop(key string, n int) ([]string, [][]byte, error) {
-	key = strings.TrimPrefix(key, "/")
-	key = strings.TrimSuffix(key, "/")
+	err := u.checkWritable("multiPop")
+	if err != nil {
+		return nil, nil, err
+	}
 
-	parts := strings.Split(key, "/")
+	key = u.trimKey(key)
+
+	parts := strings.Split(key, u.opts.Separator)
 	if len(parts) != 2 {
 		return nil, nil, utils.NewError(
 			utils.ErrBadKey,
@@ -486,9 +1527,7 @@ func (u *UnitedQueue) MultiPop(key string, n int) ([]string, [][]byte, error) {
 	tName := parts[0]
 	lName := parts[1]
 
-	u.topicsLock.RLock()
-	t, ok := u.topics[tName]
-	u.topicsLock.RUnlock()
+	t, ok := u.getTopic(tName)
 	if !ok {
 		// log.Printf("topic[%s] not existed.", tName)
 		return nil, nil, utils.NewError(
@@ -504,17 +1543,53 @@ func (u *UnitedQueue) MultiPop(key string, n int) ([]string, [][]byte, error) {
 
 	keys := make([]string, len(ids))
 	for i, id := range ids {
-		keys[i] = utils.Acatui(key, "/", id)
+		keys[i] = u.confirmKey(tName, lName, id)
 	}
 	return keys, datas, nil
 }
 
+// MultiPopBytes pops the messages of the line one by one while their data
+// fit in maxBytes altogether, so a batch can be sized for the payload of
+// the consumer. The first message is returned even if it is longer. All of
+// them go inflight like the ones of MultiPop. It returns ErrNone if the
+// line is empty.
+func (u *UnitedQueue) MultiPopBytes(name string, maxBytes int) ([]Message, error) {
+	err := u.checkWritable("multiPopBytes")
+	if err != nil {
+		return nil, u.wrapError("multiPopBytes", name, err)
+	}
+	if maxBytes <= 0 {
+		return nil, u.wrapError("multiPopBytes", name, utils.NewError(
+			utils.ErrBadRequest,
+			`max bytes must be positive`,
+		))
+	}
+
+	t, lName, err := u.lineTopic(name, "multiPopBytes")
+	if err != nil {
+		return nil, u.wrapError("multiPopBytes", name, err)
+	}
+	ms, err := t.mPopBytes(lName, maxBytes)
+	if err != nil {
+		return nil, u.wrapError("multiPopBytes", name, err)
+	}
+	return ms, nil
+}
+
 // Confirm implements Confirm interface
 func (u *UnitedQueue) Confirm(key string) error {
-	key = strings.TrimPrefix(key, "/")
-	key = strings.TrimSuffix(key, "/")
+	return u.wrapError("confirm", key, u.confirm(key))
+}
+
+func (u *UnitedQueue) confirm(key string) error {
+	err := u.checkWritable("confirm")
+	if err != nil {
+		return err
+	}
+
+	key = u.trimKey(key)
 
-	parts := strings.Split(key, "/")
+	parts := strings.Split(key, u.opts.Separator)
 	if len(parts) != 3 {
 		return utils.NewError(
 			utils.ErrBadKey,
@@ -531,9 +1606,7 @@ func (u *UnitedQueue) Confirm(key string) error {
 		)
 	}
 
-	u.topicsLock.RLock()
-	t, ok := u.topics[topicName]
-	u.topicsLock.RUnlock()
+	t, ok := u.getTopic(topicName)
 	if !ok {
 		// log.Printf("topic[%s] not existed.", topicName)
 		return utils.NewError(
@@ -545,6 +1618,69 @@ func (u *UnitedQueue) Confirm(key string) error {
 	return t.confirm(lineName, id)
 }
 
+// ExtendVisibility delays the recycle of the inflight message id of the
+// line to extend from now, so a slow consumer keeps it while processing.
+// The recycle is never brought forward. It returns ErrNotDelivered if the
+// message is not inflight.
+func (u *UnitedQueue) ExtendVisibility(topicName, lineName string, id uint64, extend time.Duration) error {
+	key := u.confirmKey(topicName, lineName, id)
+	err := u.checkWritable("extendVisibility")
+	if err != nil {
+		return u.wrapError("extendVisibility", key, err)
+	}
+	if extend <= 0 {
+		return u.wrapError("extendVisibility", key, utils.NewError(
+			utils.ErrBadRequest,
+			`extend must be positive`,
+		))
+	}
+
+	l, err := u.getLine(topicName, lineName, "extendVisibility")
+	if err != nil {
+		return u.wrapError("extendVisibility", key, err)
+	}
+	return u.wrapError("extendVisibility", key, l.extend(id, extend))
+}
+
+// ConfirmAdvance confirms the inflight message id of the line like Confirm,
+// and returns the ihead of the line after it, below which every message is
+// confirmed. The ihead does not move when an older message is still
+// inflight.
+func (u *UnitedQueue) ConfirmAdvance(topicName, lineName string, id uint64) (uint64, error) {
+	key := u.confirmKey(topicName, lineName, id)
+	err := u.checkWritable("confirm")
+	if err != nil {
+		return 0, u.wrapError("confirm", key, err)
+	}
+
+	l, err := u.getLine(topicName, lineName, "confirm")
+	if err != nil {
+		return 0, u.wrapError("confirm", key, err)
+	}
+	head, err := l.confirmAdvance(id)
+	return head, u.wrapError("confirm", key, err)
+}
+
+// ConfirmUpTo confirms every inflight message of the line with an id up to
+// id, and returns how many are confirmed. The line is persisted once after
+// them, a failure of which is returned with the count, though the messages
+// stay confirmed. It returns ErrNotDelivered if id is not popped yet or no
+// inflight message is at or below it.
+func (u *UnitedQueue) ConfirmUpTo(topicName, lineName string, id uint64) (int, error) {
+	key := u.confirmKey(topicName, lineName, id)
+	err := u.checkWritable("confirmUpTo")
+	if err != nil {
+		return 0, u.wrapError("confirmUpTo", key, err)
+	}
+
+	l, err := u.getLine(topicName, lineName, "confirmUpTo")
+	if err != nil {
+		return 0, u.wrapError("confirmUpTo", key, err)
+	}
+	n, err := l.confirmUpTo(id)
+	return n, u.wrapError("confirmUpTo", key, err)
+}
+
 // MultiConfirm implements MultiConfirm interface
 func (u *UnitedQueue) MultiConfirm(keys []string) []error {
 	errs := make([]error, len(keys))
@@ -556,11 +1692,10 @@ func (u *UnitedQueue) MultiConfirm(keys []string) []error {
 
 // Stat implements Stat interface
 func (u *UnitedQueue) Stat(key string) (*Stat, error) {
-	key = strings.TrimPrefix(key, "/")
-	key = strings.TrimSuffix(key, "/")
+	key = u.trimKey(key)
 
 	var topicName, lineName string
-	parts := strings.Split(key, "/")
+	parts := strings.Split(key, u.opts.Separator)
 	if len(parts) < 1 || len(parts) > 2 {
 		return nil, utils.NewError(
 			utils.ErrBadKey,
@@ -576,9 +1711,7 @@ func (u *UnitedQueue) Stat(key string) (*Stat, error) {
 		)
 	}
 
-	u.topicsLock.RLock()
-	t, ok := u.topics[topicName]
-	u.topicsLock.RUnlock()
+	t, ok := u.getTopic(topicName)
 	if !ok {
 		return nil, utils.NewError(
 			utils.ErrTopicNotExisted,
@@ -595,15 +1728,43 @@ func (u *UnitedQueue) Stat(key string) (*Stat, error) {
 	return qs, nil
 }
 
+// AllStats returns the stats of all the topics keyed by their names, each
+// with the stats of its lines. Every topic is taken at one point, but the
+// topics are locked one after another, not all at once.
+func (u *UnitedQueue) AllStats() map[string]*Stat {
+	u.topicsLock.RLock()
+	ts := make([]*topic, 0, len(u.topics))
+	for _, t := range u.topics {
+		ts = append(ts, t)
+	}
+	u.topicsLock.RUnlock()
+
+	stats := make(map[string]*Stat, len(ts))
+	for _, t := range ts {
+		stats[t.name] = t.snapshotStat()
+	}
+	return stats
+}
+
 // Empty implements Empty interface
 func (u *UnitedQueue) Empty(key string) error {
-	key = strings.TrimPrefix(key, "/")
-	key = strings.TrimSuffix(key, "/")
+	err := u.checkWritable("empty")
+	if err != nil {
+		return err
+	}
+	_, err = u.empty(key, false)
+	return err
+}
+
+// empty empties the topic or the line of key, or only returns the impact if
+// dryRun is set
+func (u *UnitedQueue) empty(key string, dryRun bool) (*Impact, error) {
+	key = u.trimKey(key)
 
 	var topicName, lineName string
-	parts := strings.Split(key, "/")
+	parts := strings.Split(key, u.opts.Separator)
 	if len(parts) < 1 || len(parts) > 2 {
-		return utils.NewError(
+		return nil, utils.NewError(
 			utils.ErrBadKey,
 			`empty key parts error: `+utils.ItoaQuick(len(parts)),
 		)
@@ -612,17 +1773,15 @@ func (u *UnitedQueue) Empty(key string) error {
 	topicName = parts[0]
 
 	if topicName == "" {
-		return utils.NewError(
+		return nil, utils.NewError(
 			utils.ErrBadKey,
 			`empty topic is nil`,
 		)
 	}
 
-	u.topicsLock.RLock()
-	t, ok := u.topics[topicName]
-	u.topicsLock.RUnlock()
+	t, ok := u.getTopic(topicName)
 	if !ok {
-		return utils.NewError(
+		return nil, utils.NewError(
 			utils.ErrTopicNotExisted,
 			`queue empty`,
 		)
@@ -630,7 +1789,7 @@ func (u *UnitedQueue) Empty(key string) error {
 
 	if len(parts) == 2 {
 		lineName = parts[1]
-		return t.emptyLine(lineName)
+		return t.emptyLine(lineName, dryRun)
 		// err = t.emptyLine(lineName)
 		// if err != nil {
 		// 	log.Printf("empty line[%s] error: %s", lineName, err)
@@ -638,43 +1797,73 @@ func (u *UnitedQueue) Empty(key string) error {
 		// return err
 	}
 
-	return t.empty()
+	return t.empty(dryRun)
 }
 
-func (u *UnitedQueue) removeTopic(name string, fromEtcd bool) error {
+// removeTopic removes the topic or the alias, or only returns the impact if
+// dryRun is set
+func (u *UnitedQueue) removeTopic(name string, fromEtcd, dryRun bool) (*Impact, error) {
 	u.topicsLock.Lock()
 	defer u.topicsLock.Unlock()
 
+	if _, ok := u.aliases[name]; ok {
+		im := &Impact{Topics: []string{name}}
+		if dryRun {
+			return im, nil
+		}
+		return im, u.removeAlias(name)
+	}
 	t, ok := u.topics[name]
 	if !ok {
-		return utils.NewError(
+		return nil, utils.NewError(
 			utils.ErrTopicNotExisted,
 			`queue remove`,
 		)
 	}
 
+	im, err := t.removeImpact()
+	if err != nil {
+		return nil, err
+	}
+	for alias, target := range u.aliases {
+		if target == name {
+			im.Topics = append(im.Topics, alias)
+		}
+	}
+	if dryRun {
+		return im, nil
+	}
+
 	delete(u.topics, name)
-	err := u.exportQueue()
+	err = u.exportQueue()
 	if err != nil {
 		u.topics[name] = t
-		return err
+		return nil, err
+	}
+	if u.dropAliases(name) {
+		err = u.exportAliases()
+		if err != nil {
+			log.Printf("topic[%s] export aliases error: %s", name, err)
+		}
 	}
 
 	if !fromEtcd {
 		u.unRegisterTopic(name)
 	}
+	u.emit(LifecycleRemove, name, "")
 
-	return t.remove()
+	return im, t.remove()
 }
 
-func (u *UnitedQueue) remove(key string, fromEtcd bool) error {
-	key = strings.TrimPrefix(key, "/")
-	key = strings.TrimSuffix(key, "/")
+// remove removes the topic or the line of key, or only returns the impact
+// if dryRun is set
+func (u *UnitedQueue) remove(key string, fromEtcd, dryRun bool) (*Impact, error) {
+	key = u.trimKey(key)
 
 	var topicName, lineName string
-	parts := strings.Split(key, "/")
+	parts := strings.Split(key, u.opts.Separator)
 	if len(parts) < 1 || len(parts) > 2 {
-		return utils.NewError(
+		return nil, utils.NewError(
 			utils.ErrBadKey,
 			`remove key parts error: `+utils.ItoaQuick(len(parts)),
 		)
@@ -682,50 +1871,170 @@ func (u *UnitedQueue) remove(key string, fromEtcd bool) error {
 
 	topicName = parts[0]
 	if topicName == "" {
-		return utils.NewError(
+		return nil, utils.NewError(
 			utils.ErrBadKey,
 			`rmove topic is nil`,
 		)
 	}
 
 	if len(parts) == 1 {
-		return u.removeTopic(topicName, fromEtcd)
+		return u.removeTopic(topicName, fromEtcd, dryRun)
 	}
 
-	u.topicsLock.RLock()
-	t, ok := u.topics[topicName]
-	u.topicsLock.RUnlock()
+	t, ok := u.getTopic(topicName)
 	if !ok {
-		return utils.NewError(
+		return nil, utils.NewError(
 			utils.ErrTopicNotExisted,
 			`queue remove`,
 		)
 	}
 
 	lineName = parts[1]
-	return t.removeLine(lineName, fromEtcd)
+	return t.removeLine(lineName, fromEtcd, dryRun)
 }
 
 // Remove implements Remove interface
 func (u *UnitedQueue) Remove(key string) error {
-	return u.remove(key, false)
+	err := u.checkWritable("remove")
+	if err != nil {
+		return err
+	}
+	_, err = u.remove(key, false, false)
+	return err
+}
+
+// Truncate removes every topic with its lines and messages, and the
+// aliases, like a queue just created on an empty storage. The cursors are
+// kept. It returns the first error of the topics, which are all removed
+// anyway.
+func (u *UnitedQueue) Truncate() error {
+	err := u.checkWritable("truncate")
+	if err != nil {
+		return err
+	}
+
+	u.topicsLock.Lock()
+	defer u.topicsLock.Unlock()
+
+	topics := u.topics
+	u.topics = make(map[string]*topic)
+	err = u.exportQueue()
+	if err != nil {
+		u.topics = topics
+		return err
+	}
+	if len(u.aliases) > 0 {
+		u.aliases = make(map[string]string)
+		err = u.exportAliases()
+		if err != nil {
+			log.Printf("truncate export aliases error: %s", err)
+		}
+	}
+
+	names := make([]string, 0, len(topics))
+	for name := range topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var firstErr error
+	for _, name := range names {
+		u.unRegisterTopic(name)
+		u.emit(LifecycleRemove, name, "")
+		err = topics[name].remove()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	log.Printf("uq truncated %d topics.", len(names))
+	return firstErr
+}
+
+// Close implements Close interface. It returns a *PersistError listing the
+// topics and lines which were not persisted, so the caller can react.
+func (u *UnitedQueue) Close() error {
+	return u.close(nil)
+}
+
+// CloseWithTimeout closes the queue like Close, but returns ErrTimeout if
+// it has not finished in d, e.g. on a storage which hangs, and logs the
+// topics which are not persisted by then. The background goroutines are
+// all told to stop first, and only the ones blocked in the storage are
+// left running with the rest of the close, which still closes the storage
+// if it recovers.
+func (u *UnitedQueue) CloseWithTimeout(d time.Duration) error {
+	// a read only queue exports nothing
+	var names []string
+	if !u.opts.ReadOnly {
+		u.topicsLock.RLock()
+		for name := range u.topics {
+			names = append(names, name)
+		}
+		u.topicsLock.RUnlock()
+	}
+
+	var exportedLock sync.Mutex
+	exported := make(map[string]bool)
+	closed := make(chan error, 1)
+	go func() {
+		closed <- u.close(func(name string) {
+			exportedLock.Lock()
+			exported[name] = true
+			exportedLock.Unlock()
+		})
+	}()
+
+	select {
+	case err := <-closed:
+		return err
+	case <-u.opts.Clock.After(d):
+	}
+
+	var pending []string
+	exportedLock.Lock()
+	for _, name := range names {
+		if !exported[name] {
+			pending = append(pending, name)
+		}
+	}
+	exportedLock.Unlock()
+	sort.Strings(pending)
+	log.Printf("uq close timeout after %v, topics not persisted: %v", d, pending)
+	return utils.NewError(
+		utils.ErrTimeout,
+		`queue close`,
+	)
 }
 
-// Close implements Close interface
-func (u *UnitedQueue) Close() {
+// close stops the queue, done is called with the name of every topic
+// exported
+func (u *UnitedQueue) close(done func(name string)) error {
 	log.Printf("uq stoping...")
 	close(u.etcdStop)
 	u.wg.Wait()
+	close(u.subsQuit)
+	u.subsWg.Wait()
 
 	for _, t := range u.topics {
 		t.close()
 	}
 
-	err := u.exportTopics()
-	if err != nil {
-		log.Printf("export queue error: %s", err)
+	// a queue not loaded would export no topic over the stored ones
+	var exportErr error
+	if !u.opts.ReadOnly && u.loaded() {
+		exportErr = u.exportTopicsEach(done)
+	}
+	if exportErr != nil {
+		log.Printf("export queue error: %s", exportErr)
 	}
 
-	u.storage.Close()
+	err := u.storage.Close()
+	if err != nil {
+		log.Printf("storage close error: %s", err)
+	}
 	log.Printf("uq stoped.")
+
+	if exportErr != nil {
+		return exportErr
+	}
+	return err
 }
@@ -1,11 +1,17 @@
 package queue
 
 import (
+	"context"
+	"errors"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/buaazp/uq/store"
+	"github.com/buaazp/uq/utils"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -19,6 +25,15 @@ var (
 	uq  *UnitedQueue
 )
 
+// errorCode returns the code of the uq error in the chain of err
+func errorCode(err error) int {
+	e, ok := utils.AsError(err)
+	if !ok {
+		return 0
+	}
+	return e.ErrorCode
+}
+
 func TestNewUnitedQueue(t *testing.T) {
 	Convey("Test New Uq", t, func() {
 		ldb, err = store.NewLevelStore(dbPath)
@@ -138,6 +153,35 @@ func TestMultiConfirm(t *testing.T) {
 	})
 }
 
+func TestPushAndWait(t *testing.T) {
+	Convey("Test Push a Message and Wait for Confirm", t, func() {
+		err = uq.Create("zp/w", "10s")
+		So(err, ShouldBeNil)
+
+		go func() {
+			for {
+				id, _, err := uq.Pop("zp/w")
+				if err == nil {
+					uq.Confirm(id)
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+
+		err = uq.PushAndWait("zp", "w", []byte("ping"), 3*time.Second)
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Test Push and Wait Timeout", t, func() {
+		err = uq.PushAndWait("zp", "w", []byte("lost"), 100*time.Millisecond)
+		So(err, ShouldNotBeNil)
+
+		err = uq.PushAndWait("zp", "z", []byte("noRecycle"), time.Second)
+		So(err, ShouldNotBeNil)
+	})
+}
+
 func TestStat(t *testing.T) {
 	Convey("Test Stat Line", t, func() {
 		key := "foo/y"
@@ -212,3 +256,1157 @@ func TestLoad(t *testing.T) {
 		So(err, ShouldBeNil)
 	})
 }
+
+func TestClosePersistError(t *testing.T) {
+	Convey("Test Close Reports Unpersisted Topics", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		fs := &flakyStore{Storage: mdb}
+		fq, err := NewUnitedQueue(fs, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+
+		So(fq.Create("foo", ""), ShouldBeNil)
+		So(fq.Create("foo/x", ""), ShouldBeNil)
+		So(fq.Create("bar", ""), ShouldBeNil)
+
+		fs.setFails(100)
+		err = fq.Close()
+		So(err, ShouldNotBeNil)
+		pe, ok := err.(*PersistError)
+		So(ok, ShouldBeTrue)
+		So(len(pe.Failures), ShouldEqual, 3)
+		So(pe.Failures["foo/x"], ShouldNotBeNil)
+		So(pe.Failures["foo"], ShouldNotBeNil)
+		So(pe.Failures["bar"], ShouldNotBeNil)
+	})
+}
+
+// hangStore is a storage whose Sets hang once it is wedged, until it is
+// released
+type hangStore struct {
+	store.Storage
+	mu      sync.Mutex
+	release chan bool
+}
+
+func (h *hangStore) wedge() {
+	h.mu.Lock()
+	h.release = make(chan bool)
+	h.mu.Unlock()
+}
+
+func (h *hangStore) Set(key string, data []byte) error {
+	h.mu.Lock()
+	release := h.release
+	h.mu.Unlock()
+	if release != nil {
+		<-release
+	}
+	return h.Storage.Set(key, data)
+}
+
+func TestCloseWithTimeout(t *testing.T) {
+	Convey("Test Close With a Timeout", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		cq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		So(cq.Create("foo", ""), ShouldBeNil)
+		So(cq.CloseWithTimeout(time.Second), ShouldBeNil)
+	})
+
+	Convey("Test Close With a Timeout on a Hanging Storage", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		hs := &hangStore{Storage: mdb}
+		hq, err := NewUnitedQueue(hs, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		So(hq.Create("foo", ""), ShouldBeNil)
+		So(hq.Create("foo/x", ""), ShouldBeNil)
+
+		hs.wedge()
+		start := time.Now()
+		err = hq.CloseWithTimeout(20 * time.Millisecond)
+		So(errorCode(err), ShouldEqual, utils.ErrTimeout)
+		So(time.Since(start), ShouldBeLessThan, time.Second)
+		close(hs.release)
+	})
+}
+
+func TestPushBatch(t *testing.T) {
+	Convey("Test Push Batch Returns IDs", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		bq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer bq.Close()
+
+		So(bq.Create("foo", ""), ShouldBeNil)
+		So(bq.Create("foo/x", ""), ShouldBeNil)
+		So(bq.Push("foo", []byte("first")), ShouldBeNil)
+
+		datas := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+		ids, err := bq.PushBatch("foo", datas)
+		So(err, ShouldBeNil)
+		So(ids, ShouldResemble, []uint64{1, 2, 3})
+
+		_, _, err = bq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		for i, id := range ids {
+			key, data, err := bq.Pop("foo/x")
+			So(err, ShouldBeNil)
+			So(key, ShouldEqual, utils.Acatui("foo/x", "/", id))
+			So(data, ShouldResemble, datas[i])
+		}
+
+		_, err = bq.PushBatch("foo", [][]byte{[]byte("d"), nil})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestCreateWithStartID(t *testing.T) {
+	Convey("Test Create a Line From a Start ID", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		sq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer sq.Close()
+
+		So(sq.CreateWith(&CreateRequest{TopicName: "foo", Persist: true}), ShouldBeNil)
+		_, err = sq.PushBatch("foo", [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+		So(err, ShouldBeNil)
+
+		start := uint64(2)
+		So(sq.CreateWith(&CreateRequest{TopicName: "foo", LineName: "x", StartID: &start}), ShouldBeNil)
+		key, data, err := sq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(key, ShouldEqual, "foo/x/2")
+		So(string(data), ShouldEqual, "c")
+
+		start = 10
+		So(sq.CreateWith(&CreateRequest{TopicName: "foo", LineName: "y", StartID: &start}), ShouldBeNil)
+		qs, err := sq.Stat("foo/y")
+		So(err, ShouldBeNil)
+		So(qs.Head, ShouldEqual, 3)
+
+		sq.topics["foo"].head = 1
+		start = 0
+		err = sq.CreateWith(&CreateRequest{TopicName: "foo", LineName: "z", StartID: &start})
+		So(err, ShouldNotBeNil)
+		So(errorCode(err), ShouldEqual, utils.ErrBadRequest)
+	})
+}
+
+func TestCreateLineWithoutTopic(t *testing.T) {
+	Convey("Test Create a Line Without a Topic Name", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		sq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer sq.Close()
+
+		So(sq.Create("foo", ""), ShouldBeNil)
+		err = sq.CreateWith(&CreateRequest{TopicName: "", LineName: "x"})
+		So(errorCode(err), ShouldEqual, utils.ErrBadKey)
+		errs := sq.CreateMany([]*CreateRequest{{TopicName: "", LineName: "x"}})
+		So(errorCode(errs[0]), ShouldEqual, utils.ErrBadKey)
+		So(sq.topics["foo"].lines, ShouldBeEmpty)
+	})
+}
+
+func TestConfirmUpTo(t *testing.T) {
+	Convey("Test Confirm the Inflight Messages Up to an Id", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		cq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer cq.Close()
+
+		So(cq.Create("foo", ""), ShouldBeNil)
+		So(cq.Create("foo/x", "1m"), ShouldBeNil)
+		So(cq.Create("foo/y", ""), ShouldBeNil)
+		_, err = cq.PushBatch("foo", [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")})
+		So(err, ShouldBeNil)
+		for i := 0; i < 4; i++ {
+			_, _, err = cq.Pop("foo/x")
+			So(err, ShouldBeNil)
+		}
+		So(cq.Confirm("foo/x/1"), ShouldBeNil)
+
+		_, err = cq.ConfirmUpTo("foo", "x", 4)
+		So(errorCode(err), ShouldEqual, utils.ErrNotDelivered)
+		n, err := cq.ConfirmUpTo("foo", "x", 2)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 2)
+		qs, err := cq.Stat("foo/x")
+		So(err, ShouldBeNil)
+		So(qs.IHead, ShouldEqual, 3)
+		data, err := mdb.Get(cq.keys.line("foo", "x"))
+		So(err, ShouldBeNil)
+		ls := new(UnitedLineStore)
+		So(ls.Unmarshal(data), ShouldBeNil)
+		So(ls.Ihead, ShouldEqual, 3)
+
+		_, err = cq.ConfirmUpTo("foo", "x", 2)
+		So(errorCode(err), ShouldEqual, utils.ErrNotDelivered)
+		n, err = cq.ConfirmUpTo("foo", "x", 3)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1)
+
+		_, err = cq.ConfirmUpTo("foo", "y", 0)
+		So(errorCode(err), ShouldEqual, utils.ErrConfirmNotApplicable)
+		_, err = cq.ConfirmUpTo("foo", "z", 0)
+		So(errorCode(err), ShouldEqual, utils.ErrLineNotExisted)
+	})
+}
+
+func TestConfirmAdvance(t *testing.T) {
+	Convey("Test Confirm Returns the Head Confirmed", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		cq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer cq.Close()
+
+		So(cq.Create("foo", ""), ShouldBeNil)
+		So(cq.Create("foo/x", "1m"), ShouldBeNil)
+		So(cq.Create("foo/y", ""), ShouldBeNil)
+		_, err = cq.PushBatch("foo", [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+		So(err, ShouldBeNil)
+		for i := 0; i < 3; i++ {
+			_, _, err = cq.Pop("foo/x")
+			So(err, ShouldBeNil)
+		}
+
+		// out of order, 0 is still inflight
+		head, err := cq.ConfirmAdvance("foo", "x", 1)
+		So(err, ShouldBeNil)
+		So(head, ShouldEqual, 0)
+		head, err = cq.ConfirmAdvance("foo", "x", 0)
+		So(err, ShouldBeNil)
+		So(head, ShouldEqual, 2)
+		_, err = cq.ConfirmAdvance("foo", "x", 0)
+		So(errorCode(err), ShouldEqual, utils.ErrNotDelivered)
+		head, err = cq.ConfirmAdvance("foo", "x", 2)
+		So(err, ShouldBeNil)
+		So(head, ShouldEqual, 3)
+
+		_, err = cq.ConfirmAdvance("foo", "y", 0)
+		So(errorCode(err), ShouldEqual, utils.ErrConfirmNotApplicable)
+		So(cq.ConfigureLine("foo/y", LineConfig{ConfirmNoop: true}), ShouldBeNil)
+		_, _, err = cq.Pop("foo/y")
+		So(err, ShouldBeNil)
+		head, err = cq.ConfirmAdvance("foo", "y", 0)
+		So(err, ShouldBeNil)
+		So(head, ShouldEqual, 1)
+		_, err = cq.ConfirmAdvance("foo", "z", 0)
+		So(errorCode(err), ShouldEqual, utils.ErrLineNotExisted)
+	})
+}
+
+func TestPushUntil(t *testing.T) {
+	Convey("Test Push a Message With a Deadline", t, func() {
+		clock := newFakeClock()
+		dq, err := newClockQueue(clock)
+		So(err, ShouldBeNil)
+		defer dq.Close()
+
+		So(dq.Create("foo", ""), ShouldBeNil)
+		So(dq.Create("foo/x", ""), ShouldBeNil)
+		So(dq.Create("foo/y", ""), ShouldBeNil)
+		deadline := clock.Now().Add(time.Minute)
+		So(dq.PushUntil("foo", []byte("a"), deadline), ShouldBeNil)
+		So(dq.Push("foo", []byte("b")), ShouldBeNil)
+
+		_, data, err := dq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "a")
+
+		clock.Advance(time.Minute)
+		key, data, err := dq.Pop("foo/y")
+		So(err, ShouldBeNil)
+		So(key, ShouldEqual, "foo/y/1")
+		So(string(data), ShouldEqual, "b")
+	})
+}
+
+// ttlStore records the ttls of the keys set with SetWithTTL
+type ttlStore struct {
+	store.Storage
+	ttls map[string]time.Duration
+}
+
+func (s *ttlStore) SetWithTTL(key string, data []byte, ttl time.Duration) error {
+	s.ttls[key] = ttl
+	return s.Set(key, data)
+}
+
+func TestPushUntilExpiringStore(t *testing.T) {
+	Convey("Test Push a Message With a Deadline to an ExpiringStore", t, func() {
+		clock := newFakeClock()
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		ts := &ttlStore{Storage: mdb, ttls: make(map[string]time.Duration)}
+		opts := &Options{Clock: clock, DeadLetterTopic: "dead"}
+		dq, err := NewUnitedQueueWithOptions(ts, "127.0.0.1", 9689, nil, "uq", opts)
+		So(err, ShouldBeNil)
+		defer dq.Close()
+
+		So(dq.Create("dead", ""), ShouldBeNil)
+		So(dq.Create("dead/x", ""), ShouldBeNil)
+		So(dq.Create("foo", ""), ShouldBeNil)
+		So(dq.Create("foo/x", ""), ShouldBeNil)
+		So(dq.PushUntil("foo", []byte("a"), clock.Now().Add(time.Minute)), ShouldBeNil)
+		So(dq.Push("foo", []byte("b")), ShouldBeNil)
+
+		foo := dq.topics["foo"]
+		So(ts.ttls, ShouldResemble, map[string]time.Duration{foo.messageKey(0): time.Minute})
+
+		// the storage expires the message by itself
+		So(mdb.Del(foo.messageKey(0)), ShouldBeNil)
+		key, data, err := dq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(key, ShouldEqual, "foo/x/1")
+		So(string(data), ShouldEqual, "b")
+		_, _, err = dq.Pop("dead/x")
+		So(errorCode(err), ShouldEqual, utils.ErrNone)
+	})
+}
+
+func TestPopMessage(t *testing.T) {
+	Convey("Test Pop a Message With Metadata", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		mq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer mq.Close()
+
+		So(mq.Create("foo", ""), ShouldBeNil)
+		So(mq.Create("foo/x", "1m"), ShouldBeNil)
+		deadline := time.Now().Add(time.Hour)
+		So(mq.PushUntil("foo", []byte("a"), deadline), ShouldBeNil)
+		So(mq.Push("foo", []byte("b")), ShouldBeNil)
+
+		m, err := mq.PopMessage("/foo/x/")
+		So(err, ShouldBeNil)
+		So(m.ID, ShouldEqual, 0)
+		So(m.Key, ShouldEqual, "foo/x/0")
+		So(string(m.Data), ShouldEqual, "a")
+		So(m.Deadline.UnixNano(), ShouldEqual, deadline.UnixNano())
+		So(mq.Confirm(m.Key), ShouldBeNil)
+
+		key, data, err := mq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(key, ShouldEqual, "foo/x/1")
+		So(string(data), ShouldEqual, "b")
+
+		_, err = mq.PopMessage("foo")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestPopAck(t *testing.T) {
+	Convey("Test PopAck Settling the Popped Message", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		aq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer aq.Close()
+
+		So(aq.Create("foo", ""), ShouldBeNil)
+		So(aq.Create("foo/x", "1m"), ShouldBeNil)
+		So(aq.Create("foo/y", ""), ShouldBeNil)
+		So(aq.MultiPush("foo", [][]byte{[]byte("a"), []byte("b")}), ShouldBeNil)
+
+		data, ack, nack, err := aq.PopAck("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "a")
+		So(nack(), ShouldBeNil)
+
+		data, ack, nack, err = aq.PopAck("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "a")
+		So(ack(), ShouldBeNil)
+		So(errorCode(ack()), ShouldEqual, utils.ErrNotDelivered)
+		So(errorCode(nack()), ShouldEqual, utils.ErrNotDelivered)
+
+		data, ack, _, err = aq.PopAck("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "b")
+		So(ack(), ShouldBeNil)
+		qs, err := aq.Stat("foo/x")
+		So(err, ShouldBeNil)
+		So(qs.IHead, ShouldEqual, 2)
+
+		data, ack, nack, err = aq.PopAck("foo/x")
+		So(errorCode(err), ShouldEqual, utils.ErrNone)
+		So(data, ShouldBeNil)
+		So(ack, ShouldBeNil)
+		So(nack, ShouldBeNil)
+
+		_, _, nack, err = aq.PopAck("foo/y")
+		So(err, ShouldBeNil)
+		So(errorCode(nack()), ShouldEqual, utils.ErrConfirmNotApplicable)
+	})
+}
+
+func TestProcess(t *testing.T) {
+	Convey("Test Process a Message", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		pq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer pq.Close()
+
+		So(pq.Create("foo", ""), ShouldBeNil)
+		So(pq.Create("foo/x", "1m"), ShouldBeNil)
+		So(pq.Push("foo", []byte("a")), ShouldBeNil)
+		So(pq.Push("foo", []byte("b")), ShouldBeNil)
+
+		failed := errors.New("handler failed")
+		err = pq.Process("foo/x", func(id uint64, data []byte) error {
+			So(string(data), ShouldEqual, "a")
+			return failed
+		})
+		So(err, ShouldEqual, failed)
+
+		var got []string
+		handler := func(id uint64, data []byte) error {
+			got = append(got, string(data))
+			return nil
+		}
+		So(pq.Process("foo/x", handler), ShouldBeNil)
+		So(pq.Process("foo/x", handler), ShouldBeNil)
+		So(got, ShouldResemble, []string{"a", "b"})
+
+		err = pq.Process("foo/x", handler)
+		So(err, ShouldNotBeNil)
+		So(errorCode(err), ShouldEqual, utils.ErrNone)
+
+		qs, err := pq.Stat("foo/x")
+		So(err, ShouldBeNil)
+		So(qs.Count, ShouldEqual, 0)
+	})
+}
+
+func TestCreateMany(t *testing.T) {
+	Convey("Test Create Many Topics and Lines", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		cq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer cq.Close()
+
+		So(cq.Create("foo", ""), ShouldBeNil)
+		errs := cq.CreateMany([]*CreateRequest{
+			{TopicName: "foo"},
+			{TopicName: "bar"},
+			{TopicName: "bar", LineName: "x", Recycle: time.Minute},
+			{TopicName: "bar", LineName: "x"},
+			{TopicName: "baz", LineName: "x"},
+			{TopicName: ""},
+		})
+		So(len(errs), ShouldEqual, 6)
+		So(errorCode(errs[0]), ShouldEqual, utils.ErrTopicExisted)
+		So(errs[1], ShouldBeNil)
+		So(errs[2], ShouldBeNil)
+		So(errorCode(errs[3]), ShouldEqual, utils.ErrLineExisted)
+		So(errorCode(errs[4]), ShouldEqual, utils.ErrTopicNotExisted)
+		So(errorCode(errs[5]), ShouldEqual, utils.ErrBadKey)
+
+		qs, err := cq.Stat("bar/x")
+		So(err, ShouldBeNil)
+		So(qs.Recycle, ShouldEqual, "1m0s")
+		So(cq.exportTopics(), ShouldBeNil)
+		So(len(cq.Validate()), ShouldEqual, 0)
+	})
+}
+
+func TestQueueError(t *testing.T) {
+	Convey("Test Errors Name the Topic and the Line", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		eq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer eq.Close()
+
+		err = eq.Push("foo", []byte("a"))
+		So(err, ShouldNotBeNil)
+		qe, ok := err.(*QueueError)
+		So(ok, ShouldBeTrue)
+		So(qe.Op, ShouldEqual, "push")
+		So(qe.Topic, ShouldEqual, "foo")
+		So(errors.Is(err, utils.NewError(utils.ErrTopicNotExisted, "")), ShouldBeTrue)
+		So(errors.Is(err, utils.NewError(utils.ErrLineNotExisted, "")), ShouldBeFalse)
+
+		So(eq.Create("foo", ""), ShouldBeNil)
+		_, _, err = eq.Pop("foo/x")
+		So(err, ShouldNotBeNil)
+		qe = err.(*QueueError)
+		So(qe.Line, ShouldEqual, "x")
+		So(errorCode(err), ShouldEqual, utils.ErrLineNotExisted)
+
+		err = eq.Confirm("foo/x/1")
+		So(err.Error(), ShouldStartWith, "queue confirm foo/x: ")
+		err = eq.Create("foo", "")
+		So(errorCode(err), ShouldEqual, utils.ErrTopicExisted)
+	})
+}
+
+func TestCursor(t *testing.T) {
+	Convey("Test Save and Load a Consumer Cursor", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		cq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer cq.Close()
+
+		_, err = cq.LoadCursor("rr")
+		So(errorCode(err), ShouldEqual, utils.ErrDataNotExisted)
+		So(cq.SaveCursor("", []byte("1")), ShouldNotBeNil)
+		So(cq.SaveCursor("rr", []byte("foo/x")), ShouldBeNil)
+		_, err = mdb.Get(cq.keys.cursor("rr"))
+		So(err, ShouldBeNil)
+
+		state, err := cq.LoadCursor("rr")
+		So(err, ShouldBeNil)
+		So(string(state), ShouldEqual, "foo/x")
+	})
+}
+
+func TestAutoCreateTopics(t *testing.T) {
+	Convey("Test Push Creates the Topic", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		aq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer aq.Close()
+
+		So(errorCode(aq.Push("foo", []byte("a"))), ShouldEqual, utils.ErrTopicNotExisted)
+		So(aq.Reconfigure(Options{AutoCreateTopics: true}), ShouldBeNil)
+
+		done := make(chan error, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				done <- aq.Push("foo", []byte("a"))
+			}()
+		}
+		So(<-done, ShouldBeNil)
+		So(<-done, ShouldBeNil)
+		_, err = aq.PushBatch("bar", [][]byte{[]byte("b")})
+		So(err, ShouldBeNil)
+
+		So(aq.topics["foo"].getTail(), ShouldEqual, 2)
+		So(len(aq.Validate()), ShouldEqual, 0)
+		So(errorCode(aq.Push("", []byte("a"))), ShouldEqual, utils.ErrTopicNotExisted)
+	})
+}
+
+func TestPopMissingLine(t *testing.T) {
+	Convey("Test Pop From a Line Which Does Not Exist", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		pq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer pq.Close()
+
+		So(pq.Create("foo", ""), ShouldBeNil)
+		So(pq.Push("foo", []byte("a")), ShouldBeNil)
+		// the topic has no line
+		_, _, err = pq.Pop("foo/x")
+		So(errorCode(err), ShouldEqual, utils.ErrLineNotExisted)
+		So(pq.Create("foo/y", ""), ShouldBeNil)
+		_, _, err = pq.Pop("foo/x")
+		So(errorCode(err), ShouldEqual, utils.ErrLineNotExisted)
+		_, _, err = pq.MultiPop("foo/x", 2)
+		So(errorCode(err), ShouldEqual, utils.ErrLineNotExisted)
+		_, _, err = pq.Pop("bar/x")
+		So(errorCode(err), ShouldEqual, utils.ErrTopicNotExisted)
+		So(pq.topics["foo"].lines, ShouldHaveLength, 1)
+
+		So(pq.Reconfigure(Options{AutoCreateLines: true}), ShouldBeNil)
+		_, data, err := pq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "a")
+		So(pq.topics["foo"].lines["x"].getRecycle(), ShouldEqual, 0)
+		keys, _, err := pq.MultiPop("foo/z", 2)
+		So(err, ShouldBeNil)
+		So(keys, ShouldHaveLength, 1)
+		So(pq.topics["foo"].lines, ShouldHaveLength, 3)
+		_, _, err = pq.Pop("bar/x")
+		So(errorCode(err), ShouldEqual, utils.ErrTopicNotExisted)
+		So(len(pq.Validate()), ShouldEqual, 0)
+	})
+}
+
+func TestLoadErrors(t *testing.T) {
+	Convey("Test Load Reports the Broken Topics and Lines", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		lq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		So(lq.LoadErrors(), ShouldBeNil)
+		for _, key := range []string{"a", "b", "c", "a/x", "a/y"} {
+			So(lq.Create(key, ""), ShouldBeNil)
+		}
+		So(lq.exportTopics(), ShouldBeNil)
+		So(mdb.Set(lq.keys.lineRecycle("a", "y"), []byte("bad")), ShouldBeNil)
+		topicKey := lq.keys.topic("b")
+		topicData, err := mdb.Get(topicKey)
+		So(err, ShouldBeNil)
+		So(mdb.Del(topicKey), ShouldBeNil)
+		for _, t := range lq.topics {
+			t.close()
+		}
+
+		_, err = NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		le, ok := err.(*LoadError)
+		So(ok, ShouldBeTrue)
+		So(len(le.Failures), ShouldEqual, 1)
+		So(le.Failures["b"], ShouldNotBeNil)
+
+		So(mdb.Set(topicKey, topicData), ShouldBeNil)
+		lq, err = NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer lq.Close()
+		le, ok = lq.LoadErrors().(*LoadError)
+		So(ok, ShouldBeTrue)
+		So(len(le.Failures), ShouldEqual, 1)
+		So(le.Failures["a/y"], ShouldNotBeNil)
+		So(len(lq.topics), ShouldEqual, 3)
+		So(len(lq.topics["a"].lines), ShouldEqual, 1)
+	})
+}
+
+func TestMaxTopics(t *testing.T) {
+	Convey("Test Topics Limit of a Queue", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		opts := &Options{MaxTopics: 2, AutoCreateTopics: true}
+		tq, err := NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", opts)
+		So(err, ShouldBeNil)
+		defer tq.Close()
+
+		So(tq.Create("foo", ""), ShouldBeNil)
+		So(tq.Create("bar", ""), ShouldBeNil)
+
+		err = tq.Create("baz", "")
+		So(errorCode(err), ShouldEqual, utils.ErrTooManyTopics)
+		So(errorCode(tq.Push("baz", []byte("a"))), ShouldEqual, utils.ErrTooManyTopics)
+		So(errorCode(tq.Create("foo", "")), ShouldEqual, utils.ErrTopicExisted)
+
+		So(tq.Remove("bar"), ShouldBeNil)
+		So(tq.Create("baz", ""), ShouldBeNil)
+	})
+}
+
+// discardStore is a storage whose Set drops the data once discard is set,
+// so the benchmarks count the allocations of the queue only
+type discardStore struct {
+	store.Storage
+	discard bool
+}
+
+func (d *discardStore) Set(key string, data []byte) error {
+	if d.discard {
+		return nil
+	}
+	return d.Storage.Set(key, data)
+}
+
+func BenchmarkExportTopics(b *testing.B) {
+	mdb, err := store.NewMemStore()
+	if err != nil {
+		b.Fatal(err)
+	}
+	ddb := &discardStore{Storage: mdb}
+	bq, err := NewUnitedQueue(ddb, "127.0.0.1", 9689, nil, "uq")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer bq.Close()
+	for i := 0; i < 100; i++ {
+		name := "foo" + strconv.Itoa(i)
+		for _, key := range []string{name, name + "/x", name + "/y"} {
+			err = bq.Create(key, "1h")
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		for j := 0; j < 10; j++ {
+			err = bq.Push(name, []byte("bar"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			_, _, err = bq.Pop(name + "/x")
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	ddb.discard = true
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err = bq.exportTopics()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestAllStats(t *testing.T) {
+	Convey("Test Stats of All the Topics", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		sq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer sq.Close()
+		So(len(sq.AllStats()), ShouldEqual, 0)
+
+		for _, key := range []string{"foo", "foo/y", "foo/x", "bar"} {
+			So(sq.Create(key, "1m"), ShouldBeNil)
+		}
+		So(sq.Push("foo", []byte("a")), ShouldBeNil)
+		So(sq.Push("foo", []byte("b")), ShouldBeNil)
+		So(sq.Push("bar", []byte("c")), ShouldBeNil)
+		_, _, err = sq.Pop("foo/x")
+		So(err, ShouldBeNil)
+
+		stats := sq.AllStats()
+		So(len(stats), ShouldEqual, 2)
+		So(stats["bar"].Count, ShouldEqual, 1)
+		So(len(stats["bar"].Lines), ShouldEqual, 0)
+		foo := stats["foo"]
+		So(foo.Count, ShouldEqual, 2)
+		So(len(foo.Lines), ShouldEqual, 2)
+		So(foo.Lines[0].Name, ShouldEqual, "foo/x")
+		So(foo.Lines[0].Head, ShouldEqual, 1)
+		So(foo.Lines[0].Count, ShouldEqual, 2)
+		So(foo.Lines[1].Name, ShouldEqual, "foo/y")
+		So(foo.Lines[1].Count, ShouldEqual, 2)
+	})
+}
+
+func TestPushBatchDedup(t *testing.T) {
+	Convey("Test Batch Push Stores Duplicates Once", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		bq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer bq.Close()
+
+		So(bq.Create("foo", ""), ShouldBeNil)
+		So(bq.Create("foo/x", ""), ShouldBeNil)
+		datas := [][]byte{[]byte("a"), []byte("b"), []byte("a"), []byte("c"), []byte("b")}
+		ids, err := bq.PushBatchWith("foo", datas, BatchOptions{Dedup: true})
+		So(err, ShouldBeNil)
+		So(ids, ShouldResemble, []uint64{0, 1, 0, 2, 1})
+
+		ids, err = bq.PushBatch("foo", datas[:3])
+		So(err, ShouldBeNil)
+		So(ids, ShouldResemble, []uint64{3, 4, 5})
+
+		var got []string
+		for {
+			_, data, err := bq.Pop("foo/x")
+			if err != nil {
+				break
+			}
+			got = append(got, string(data))
+		}
+		So(got, ShouldResemble, []string{"a", "b", "c", "a", "b", "a"})
+	})
+}
+
+func TestLIFOLine(t *testing.T) {
+	Convey("Test LIFO Line Pops the Newest Message First", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		lq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+
+		So(lq.Create("foo", ""), ShouldBeNil)
+		req := &CreateRequest{TopicName: "foo", LineName: "x", Recycle: time.Minute, LIFO: true}
+		So(lq.CreateWith(req), ShouldBeNil)
+		_, err = lq.PushBatch("foo", [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+		So(err, ShouldBeNil)
+
+		key, data, err := lq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(key, ShouldEqual, "foo/x/2")
+		So(string(data), ShouldEqual, "c")
+		So(lq.Push("foo", []byte("d")), ShouldBeNil)
+		_, data, err = lq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "d")
+		_, data, err = lq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "b")
+
+		// confirmed above the head of the line
+		So(lq.Confirm("foo/x/3"), ShouldBeNil)
+		qs, err := lq.Stat("foo/x")
+		So(err, ShouldBeNil)
+		So(qs.Head, ShouldEqual, 0)
+		So(qs.Count, ShouldEqual, 3)
+		So(lq.Validate(), ShouldBeEmpty)
+
+		So(lq.exportTopics(), ShouldBeNil)
+		for _, t := range lq.topics {
+			t.close()
+		}
+		lq, err = NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer lq.Close()
+
+		_, data, err = lq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "a")
+		_, _, err = lq.Pop("foo/x")
+		So(errorCode(err), ShouldEqual, utils.ErrNone)
+		qs, err = lq.Stat("foo/x")
+		So(err, ShouldBeNil)
+		So(qs.Head, ShouldEqual, 4)
+		So(qs.Count, ShouldEqual, 3)
+	})
+}
+
+// downStore is a storage whose Gets fail until it is up
+type downStore struct {
+	store.Storage
+	mu    sync.Mutex
+	fails int
+}
+
+func (d *downStore) Get(key string) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.fails > 0 {
+		d.fails--
+		return nil, errors.New("connection refused")
+	}
+	return d.Storage.Get(key)
+}
+
+func TestStoreOpenTimeout(t *testing.T) {
+	Convey("Test Queue Waits the Storage to be Ready", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		ddb := &downStore{Storage: mdb, fails: 1}
+		_, err = NewUnitedQueue(ddb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldNotBeNil)
+
+		ddb.fails = 3
+		opts := &Options{StoreOpenTimeout: time.Second, StoreOpenBackoff: time.Millisecond}
+		sq, err := NewUnitedQueueWithOptions(ddb, "127.0.0.1", 9689, nil, "uq", opts)
+		So(err, ShouldBeNil)
+		So(ddb.fails, ShouldEqual, 0)
+		sq.Close()
+
+		ddb.fails = 1000
+		opts = &Options{StoreOpenTimeout: 20 * time.Millisecond, StoreOpenBackoff: time.Millisecond}
+		_, err = NewUnitedQueueWithOptions(ddb, "127.0.0.1", 9689, nil, "uq", opts)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestReadOnly(t *testing.T) {
+	Convey("Test Read Only Queue Leaves the Storage Untouched", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		wq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		So(wq.Create("foo", ""), ShouldBeNil)
+		So(wq.Create("foo/x", "1m"), ShouldBeNil)
+		_, err = wq.PushBatch("foo", [][]byte{[]byte("a"), []byte("b")})
+		So(err, ShouldBeNil)
+		_, _, err = wq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(wq.exportTopics(), ShouldBeNil)
+		for _, t := range wq.topics {
+			t.close()
+		}
+
+		dump := func() map[string]string {
+			keys, err := mdb.Keys("")
+			So(err, ShouldBeNil)
+			m := make(map[string]string)
+			for _, key := range keys {
+				data, err := mdb.Get(key)
+				So(err, ShouldBeNil)
+				m[key] = string(data)
+			}
+			return m
+		}
+		before := dump()
+
+		rq, err := NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", &Options{ReadOnly: true})
+		So(err, ShouldBeNil)
+		So(errorCode(rq.Push("foo", []byte("c"))), ShouldEqual, utils.ErrReadOnly)
+		_, _, err = rq.Pop("foo/x")
+		So(errorCode(err), ShouldEqual, utils.ErrReadOnly)
+		So(errorCode(rq.Confirm("foo/x/0")), ShouldEqual, utils.ErrReadOnly)
+		So(errorCode(rq.Create("bar", "")), ShouldEqual, utils.ErrReadOnly)
+		So(errorCode(rq.Remove("foo")), ShouldEqual, utils.ErrReadOnly)
+		So(errorCode(rq.Empty("foo/x")), ShouldEqual, utils.ErrReadOnly)
+		So(errorCode(rq.SaveCursor("c", []byte("1"))), ShouldEqual, utils.ErrReadOnly)
+
+		qs, err := rq.Stat("foo/x")
+		So(err, ShouldBeNil)
+		So(qs.Count, ShouldEqual, 2)
+		So(qs.IHead, ShouldEqual, 0)
+		So(rq.AllStats(), ShouldContainKey, "foo")
+		im, err := rq.RemoveDryRun("foo")
+		So(err, ShouldBeNil)
+		So(im.Messages, ShouldEqual, 2)
+		So(rq.Validate(), ShouldBeEmpty)
+		So(rq.topics["foo"].running, ShouldBeFalse)
+
+		So(dump(), ShouldResemble, before)
+	})
+}
+
+func TestMultiPopBytes(t *testing.T) {
+	Convey("Test Multi Pop the Messages Fitting in Bytes", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		bq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer bq.Close()
+
+		So(bq.Create("foo", ""), ShouldBeNil)
+		So(bq.Create("foo/x", "1m"), ShouldBeNil)
+		_, err = bq.PushBatch("foo", [][]byte{
+			[]byte("aaaaaaaaaa"), []byte("bbb"), []byte("ccc"), []byte("dddddd"),
+		})
+		So(err, ShouldBeNil)
+
+		_, err = bq.MultiPopBytes("foo/x", 0)
+		So(errorCode(err), ShouldEqual, utils.ErrBadRequest)
+
+		// the first message is returned even if it is longer
+		ms, err := bq.MultiPopBytes("foo/x", 4)
+		So(err, ShouldBeNil)
+		So(ms, ShouldHaveLength, 1)
+		So(string(ms[0].Data), ShouldEqual, "aaaaaaaaaa")
+
+		ms, err = bq.MultiPopBytes("foo/x", 8)
+		So(err, ShouldBeNil)
+		So(ms, ShouldHaveLength, 2)
+		So(ms[0].ID, ShouldEqual, 1)
+		So(ms[1].ID, ShouldEqual, 2)
+		qs, err := bq.Stat("foo/x")
+		So(err, ShouldBeNil)
+		So(qs.Head, ShouldEqual, 3)
+		So(qs.IHead, ShouldEqual, 0)
+
+		ms, err = bq.MultiPopBytes("foo/x", 100)
+		So(err, ShouldBeNil)
+		So(ms, ShouldHaveLength, 1)
+		So(string(ms[0].Data), ShouldEqual, "dddddd")
+		_, err = bq.MultiPopBytes("foo/x", 100)
+		So(errorCode(err), ShouldEqual, utils.ErrNone)
+	})
+}
+
+// keptStore is a storage which stays open when the queue is closed
+type keptStore struct {
+	store.Storage
+}
+
+func (keptStore) Close() error {
+	return nil
+}
+
+func TestOpenAndLoad(t *testing.T) {
+	Convey("Test Open a Queue and Load It Later", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		eq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		So(eq.Create("foo", ""), ShouldBeNil)
+		So(eq.exportTopics(), ShouldBeNil)
+		for _, t := range eq.topics {
+			t.close()
+		}
+
+		// closed before loading, the stored topics are kept
+		oq, err := OpenUnitedQueue(keptStore{mdb}, "127.0.0.1", 9689, nil, "uq", nil)
+		So(err, ShouldBeNil)
+		So(errorCode(oq.Push("foo", []byte("a"))), ShouldEqual, utils.ErrNotLoaded)
+		So(oq.Close(), ShouldBeNil)
+
+		oq, err = OpenUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq", nil)
+		So(err, ShouldBeNil)
+		So(oq.Load(context.Background()), ShouldBeNil)
+		So(errorCode(oq.Load(context.Background())), ShouldEqual, utils.ErrBadRequest)
+		So(oq.Push("foo", []byte("a")), ShouldBeNil)
+		So(oq.exportTopics(), ShouldBeNil)
+		for _, t := range oq.topics {
+			t.close()
+		}
+
+		ddb := &downStore{Storage: mdb, fails: 1000}
+		opts := &Options{StoreOpenTimeout: time.Hour, StoreOpenBackoff: time.Millisecond}
+		dq, err := OpenUnitedQueue(ddb, "127.0.0.1", 9689, nil, "uq", opts)
+		So(err, ShouldBeNil)
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		So(dq.Load(ctx), ShouldEqual, context.DeadlineExceeded)
+		So(errorCode(dq.Push("foo", []byte("b"))), ShouldEqual, utils.ErrNotLoaded)
+	})
+}
+
+func TestConfirmOtherLine(t *testing.T) {
+	Convey("Test Confirm Only Affects Its Own Line", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		cq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer cq.Close()
+
+		So(cq.Create("foo", ""), ShouldBeNil)
+		So(cq.Create("foo/x", "1m"), ShouldBeNil)
+		So(cq.Create("foo/y", "1m"), ShouldBeNil)
+		So(cq.Create("foo/z", "1m"), ShouldBeNil)
+		So(cq.Push("foo", []byte("a")), ShouldBeNil)
+
+		key, _, err := cq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(key, ShouldEqual, "foo/x/0")
+		key, _, err = cq.Pop("foo/y")
+		So(err, ShouldBeNil)
+		So(key, ShouldEqual, "foo/y/0")
+
+		So(cq.Confirm("foo/x/0"), ShouldBeNil)
+		// the id is delivered in every line, but not popped from z yet
+		So(errorCode(cq.Confirm("foo/z/0")), ShouldEqual, utils.ErrNotDelivered)
+		So(errorCode(cq.Confirm("foo/x/0")), ShouldEqual, utils.ErrNotDelivered)
+
+		y := cq.topics["foo"].lines["y"]
+		So(y.inflight.Len(), ShouldEqual, 1)
+		So(y.imap[0], ShouldBeTrue)
+		ok, err := cq.WasConfirmed("foo", "y", 0)
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+		So(cq.Confirm("foo/y/0"), ShouldBeNil)
+		So(y.inflight.Len(), ShouldEqual, 0)
+	})
+}
+
+func TestTruncate(t *testing.T) {
+	Convey("Test Truncate the Whole Queue", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		tq, err := NewUnitedQueue(keptStore{mdb}, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+
+		for _, key := range []string{"foo", "foo/x", "bar", "bar/y"} {
+			So(tq.Create(key, "1m"), ShouldBeNil)
+		}
+		So(tq.AliasTopic("baz", "foo"), ShouldBeNil)
+		So(tq.SaveCursor("c", []byte("1")), ShouldBeNil)
+		So(tq.MultiPush("foo", [][]byte{[]byte("a"), []byte("b")}), ShouldBeNil)
+		So(tq.Push("bar", []byte("c")), ShouldBeNil)
+		_, _, err = tq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		foo := tq.topics["foo"]
+
+		So(tq.Truncate(), ShouldBeNil)
+		So(tq.topics, ShouldBeEmpty)
+		So(tq.Aliases(), ShouldBeEmpty)
+		_, running := <-foo.quit
+		So(running, ShouldBeFalse)
+		keys, err := mdb.Keys("")
+		So(err, ShouldBeNil)
+		So(keys, ShouldContain, tq.keys.cursor("c"))
+		for _, key := range keys {
+			So(strings.Contains(key, "foo") || strings.Contains(key, "bar"), ShouldBeFalse)
+		}
+
+		So(tq.Create("foo", ""), ShouldBeNil)
+		So(tq.Create("foo/x", ""), ShouldBeNil)
+		So(tq.Push("foo", []byte("d")), ShouldBeNil)
+		key, data, err := tq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(key, ShouldEqual, "foo/x/0")
+		So(string(data), ShouldEqual, "d")
+		So(tq.Close(), ShouldBeNil)
+
+		rq, err := NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", &Options{ReadOnly: true})
+		So(err, ShouldBeNil)
+		So(errorCode(rq.Truncate()), ShouldEqual, utils.ErrReadOnly)
+	})
+}
+
+func TestConcurrentPop(t *testing.T) {
+	Convey("Test Concurrent Pops of One Line Partition the Messages", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		pq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer pq.Close()
+
+		const total = 1000
+		const poppers = 8
+		So(pq.Create("foo", ""), ShouldBeNil)
+		So(pq.Create("foo/x", ""), ShouldBeNil)
+		So(pq.Create("foo/y", "1h"), ShouldBeNil)
+		datas := make([][]byte, total)
+		for i := range datas {
+			datas[i] = []byte(strconv.Itoa(i))
+		}
+		So(pq.MultiPush("foo", datas), ShouldBeNil)
+
+		for _, key := range []string{"foo/x", "foo/y"} {
+			var wg sync.WaitGroup
+			popped := make([][]uint64, poppers)
+			for i := 0; i < poppers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for {
+						if i%2 == 0 {
+							m, err := pq.PopMessage(key)
+							if err != nil {
+								return
+							}
+							popped[i] = append(popped[i], m.ID)
+							continue
+						}
+						keys, _, err := pq.MultiPop(key, 3)
+						if err != nil {
+							return
+						}
+						for _, k := range keys {
+							id, err := strconv.ParseUint(k[strings.LastIndex(k, "/")+1:], 10, 64)
+							if err != nil {
+								return
+							}
+							popped[i] = append(popped[i], id)
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			seen := make(map[uint64]int)
+			for _, ids := range popped {
+				for _, id := range ids {
+					seen[id]++
+				}
+			}
+			So(len(seen), ShouldEqual, total)
+			for id := uint64(0); id < total; id++ {
+				So(seen[id], ShouldEqual, 1)
+			}
+		}
+
+		qs, err := pq.Stat("foo/y")
+		So(err, ShouldBeNil)
+		So(qs.Head, ShouldEqual, total)
+		So(qs.IHead, ShouldEqual, 0)
+	})
+}
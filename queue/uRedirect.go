@@ -0,0 +1,94 @@
+package queue
+
+import (
+	"github.com/buaazp/uq/utils"
+)
+
+// inflightID tells whether id is popped and not confirmed yet by the line
+func (l *line) inflightID(id uint64) bool {
+	l.inflightLock.RLock()
+	defer l.inflightLock.RUnlock()
+	return l.imap[id]
+}
+
+// redirected makes id deliverable again by the line, before the other
+// messages, unless it is not popped yet or inflight already
+func (l *line) redirected(id uint64) error {
+	if l.getRecycle() == 0 {
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`redirect to a line without recycle`,
+		)
+	}
+
+	l.inflightLock.Lock()
+	defer l.inflightLock.Unlock()
+	l.headLock.RLock()
+	defer l.headLock.RUnlock()
+	if l.undelivered(id) || l.imap[id] {
+		return nil
+	}
+
+	// expired already, so the next pop takes it
+	msg := new(InflightMessage)
+	msg.Tid = id
+	l.inflight.PushFront(msg)
+	l.imap[id] = true
+	// the clean keeps the message while the line has not confirmed it
+	if id < l.ihead {
+		l.ihead = id
+	}
+	return nil
+}
+
+// Redirect hands the message id inflight in the line fromLine over to the
+// line toLine of the same topic. It is confirmed in fromLine, and toLine
+// delivers it again on its next pop, unless toLine has not popped it yet or
+// has it inflight. toLine must have a recycle, and the message is never
+// lost, though it is deliverable in both lines for a moment. It returns
+// ErrNotDelivered if the message is not inflight in fromLine.
+func (u *UnitedQueue) Redirect(topicName, fromLine, toLine string, id uint64) error {
+	key := u.confirmKey(topicName, fromLine, id)
+	err := u.checkWritable("redirect")
+	if err != nil {
+		return u.wrapError("redirect", key, err)
+	}
+	if fromLine == toLine {
+		return u.wrapError("redirect", key, utils.NewError(
+			utils.ErrBadRequest,
+			`redirect to the same line`,
+		))
+	}
+
+	from, err := u.getLine(topicName, fromLine, "redirect")
+	if err != nil {
+		return u.wrapError("redirect", key, err)
+	}
+	to, err := u.getLine(topicName, toLine, "redirect")
+	if err != nil {
+		return u.wrapError("redirect", key, err)
+	}
+	if from.getRecycle() == 0 || !from.inflightID(id) {
+		return u.wrapError("redirect", key, utils.NewError(
+			utils.ErrNotDelivered,
+			`queue redirect`,
+		))
+	}
+
+	// toLine takes it first, so the clean never sees it confirmed by both
+	err = to.redirected(id)
+	if err != nil {
+		return u.wrapError("redirect", key, err)
+	}
+	err = from.confirm(id)
+	if err != nil && !isNotDelivered(err) {
+		return u.wrapError("redirect", key, err)
+	}
+	// confirmed meanwhile by a consumer of fromLine
+	return nil
+}
+
+func isNotDelivered(err error) bool {
+	e, ok := err.(*utils.Error)
+	return ok && e.ErrorCode == utils.ErrNotDelivered
+}
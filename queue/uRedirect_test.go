@@ -0,0 +1,64 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/buaazp/uq/store"
+	"github.com/buaazp/uq/utils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRedirect(t *testing.T) {
+	Convey("Test Redirect an Inflight Message to Another Line", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		rq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer rq.Close()
+
+		So(rq.Create("foo", ""), ShouldBeNil)
+		So(rq.Create("foo/x", "1m"), ShouldBeNil)
+		So(rq.Create("foo/y", "1m"), ShouldBeNil)
+		So(rq.Create("foo/z", ""), ShouldBeNil)
+		So(rq.MultiPush("foo", [][]byte{[]byte("a"), []byte("b")}), ShouldBeNil)
+
+		So(errorCode(rq.Redirect("foo", "x", "y", 0)), ShouldEqual, utils.ErrNotDelivered)
+		_, _, err = rq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(errorCode(rq.Redirect("foo", "x", "x", 0)), ShouldEqual, utils.ErrBadRequest)
+		So(errorCode(rq.Redirect("foo", "x", "w", 0)), ShouldEqual, utils.ErrLineNotExisted)
+		So(errorCode(rq.Redirect("foo", "x", "z", 0)), ShouldEqual, utils.ErrBadRequest)
+
+		// y delivered and confirmed it already
+		for _, data := range []string{"a", "b"} {
+			key, got, err := rq.Pop("foo/y")
+			So(err, ShouldBeNil)
+			So(string(got), ShouldEqual, data)
+			So(rq.Confirm(key), ShouldBeNil)
+		}
+		So(rq.Redirect("foo", "x", "y", 0), ShouldBeNil)
+		ok, err := rq.WasConfirmed("foo", "x", 0)
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+		So(errorCode(rq.Confirm("foo/x/0")), ShouldEqual, utils.ErrNotDelivered)
+
+		qs, err := rq.Stat("foo/y")
+		So(err, ShouldBeNil)
+		So(qs.IHead, ShouldEqual, 0)
+		key, data, err := rq.Pop("foo/y")
+		So(err, ShouldBeNil)
+		So(key, ShouldEqual, "foo/y/0")
+		So(string(data), ShouldEqual, "a")
+		So(rq.Confirm(key), ShouldBeNil)
+		qs, err = rq.Stat("foo/y")
+		So(err, ShouldBeNil)
+		So(qs.IHead, ShouldEqual, 2)
+
+		// y has not popped b yet, it is delivered once only
+		So(rq.Create("foo/v", "1m"), ShouldBeNil)
+		_, _, err = rq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(rq.Redirect("foo", "x", "v", 1), ShouldBeNil)
+		So(rq.topics["foo"].lines["v"].inflight.Len(), ShouldEqual, 0)
+	})
+}
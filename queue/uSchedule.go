@@ -0,0 +1,72 @@
+package queue
+
+import (
+	"time"
+)
+
+const day = 24 * time.Hour
+
+// validTimeOfDay tells whether d is an offset from midnight
+func validTimeOfDay(d time.Duration) bool {
+	return d >= 0 && d < day
+}
+
+// timeOfDay returns the offset of t from its midnight
+func timeOfDay(t time.Time) time.Duration {
+	h, m, s := t.Clock()
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute +
+		time.Duration(s)*time.Second + time.Duration(t.Nanosecond())
+}
+
+// inTimeWindow tells whether the time of day of now is in [start, end),
+// which wraps midnight if start is after end and is the whole day if they
+// are the same
+func inTimeWindow(now time.Time, start, end time.Duration) bool {
+	if start == end {
+		return true
+	}
+	d := timeOfDay(now)
+	if start < end {
+		return d >= start && d < end
+	}
+	return d >= start || d < end
+}
+
+// pushLoad measures the pushes into the topic between its cleans, it is
+// only used by the background goroutine of the topic
+type pushLoad struct {
+	t     *topic
+	tail  uint64
+	since time.Time
+}
+
+func newPushLoad(t *topic) *pushLoad {
+	p := new(pushLoad)
+	p.t = t
+	p.tail = t.getTail()
+	p.since = t.q.now()
+	return p
+}
+
+// cleanAllowed tells whether the clean may run now by the clean window and
+// the push rate since the last call
+func (p *pushLoad) cleanAllowed(opts Options) bool {
+	now := p.t.q.now()
+	tail := p.t.getTail()
+	var pushes uint64
+	if tail > p.tail {
+		pushes = tail - p.tail
+	}
+	elapsed := now.Sub(p.since)
+	p.tail = tail
+	p.since = now
+
+	if !inTimeWindow(now, opts.CleanWindowStart, opts.CleanWindowEnd) {
+		return false
+	}
+	rate := opts.CleanPausePushRate
+	if rate > 0 && elapsed > 0 && float64(pushes)/elapsed.Seconds() > float64(rate) {
+		return false
+	}
+	return true
+}
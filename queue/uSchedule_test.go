@@ -0,0 +1,57 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buaazp/uq/utils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCleanWindow(t *testing.T) {
+	Convey("Test the Time Windows of a Day", t, func() {
+		at := func(h, m int) time.Time {
+			return time.Date(2015, 1, 1, h, m, 0, 0, time.UTC)
+		}
+		So(inTimeWindow(at(3, 0), 0, 0), ShouldBeTrue)
+		So(inTimeWindow(at(3, 0), 2*time.Hour, 4*time.Hour), ShouldBeTrue)
+		So(inTimeWindow(at(4, 0), 2*time.Hour, 4*time.Hour), ShouldBeFalse)
+		So(inTimeWindow(at(1, 59), 2*time.Hour, 4*time.Hour), ShouldBeFalse)
+		So(inTimeWindow(at(23, 30), 23*time.Hour, time.Hour), ShouldBeTrue)
+		So(inTimeWindow(at(0, 30), 23*time.Hour, time.Hour), ShouldBeTrue)
+		So(inTimeWindow(at(12, 0), 23*time.Hour, time.Hour), ShouldBeFalse)
+	})
+
+	Convey("Test the Clean Is Limited by the Window and the Push Rate", t, func() {
+		clock := newFakeClock()
+		wq, err := newClockQueue(clock)
+		So(err, ShouldBeNil)
+		defer wq.Close()
+		So(wq.Create("foo", ""), ShouldBeNil)
+		tp := wq.topics["foo"]
+		load := newPushLoad(tp)
+
+		now := timeOfDay(clock.Now())
+		opts := Options{
+			CleanWindowStart: (now + time.Hour) % day,
+			CleanWindowEnd:   (now + 2*time.Hour) % day,
+		}
+		So(load.cleanAllowed(opts), ShouldBeFalse)
+		clock.Advance(time.Hour)
+		So(load.cleanAllowed(opts), ShouldBeTrue)
+
+		opts = Options{CleanPausePushRate: 1}
+		clock.Advance(time.Second)
+		_, err = wq.PushBatch("foo", [][]byte{[]byte("a"), []byte("b")})
+		So(err, ShouldBeNil)
+		So(load.cleanAllowed(opts), ShouldBeFalse)
+		clock.Advance(time.Second)
+		So(wq.Push("foo", []byte("c")), ShouldBeNil)
+		So(load.cleanAllowed(opts), ShouldBeTrue)
+
+		err = wq.Reconfigure(Options{CleanWindowStart: day})
+		So(errorCode(err), ShouldEqual, utils.ErrBadRequest)
+		So(wq.Reconfigure(Options{CleanWindowStart: 2 * time.Hour, CleanWindowEnd: 4 * time.Hour}), ShouldBeNil)
+		So(wq.options().CleanWindowEnd, ShouldEqual, 4*time.Hour)
+	})
+}
@@ -0,0 +1,265 @@
+package queue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+
+	"github.com/buaazp/uq/store"
+	"github.com/buaazp/uq/utils"
+)
+
+const (
+	snapshotMagic string = "UQSNAP1\n"
+)
+
+// A snapshot is the magic followed by the records of the storage keys, each
+// a uvarint length and the key then a uvarint length and the value, and
+// ends with a record of an empty key. The queue store goes last, so a
+// storage restored from a truncated snapshot is not loaded as a queue.
+
+type snapshotWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (sw *snapshotWriter) write(key string, value []byte) {
+	if sw.err != nil {
+		return
+	}
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(key)))
+	sw.w.Write(buf[:n])
+	sw.w.WriteString(key)
+	n = binary.PutUvarint(buf[:], uint64(len(value)))
+	sw.w.Write(buf[:n])
+	_, sw.err = sw.w.Write(value)
+}
+
+// copy writes the record of key as it is in the storage, if it is there
+func (sw *snapshotWriter) copy(u *UnitedQueue, key string) {
+	if sw.err != nil {
+		return
+	}
+	data, err := u.getData(key)
+	if isDataNotExisted(err) {
+		return
+	}
+	if err != nil {
+		sw.err = err
+		return
+	}
+	sw.write(key, data)
+}
+
+// ConsistentSnapshot writes a snapshot of the queue to w which Restore
+// loads into an empty storage. Every topic is captured at one point with
+// the offsets of its lines, and the pushes go on while its messages are
+// written, but they are not in the snapshot. The topics are not cleaned
+// until they are written. The cursors are only in the snapshot of a
+// storage which lists its keys.
+func (u *UnitedQueue) ConsistentSnapshot(w io.Writer) error {
+	sw := &snapshotWriter{w: bufio.NewWriter(w)}
+	sw.w.WriteString(snapshotMagic)
+	sw.write(storageKeyLayout, []byte(u.keys.name()))
+	sw.write(storageKeyCodec, []byte(u.codec.Name()))
+	u.topicsLock.RLock()
+	sw.copy(u, storageKeyAliases)
+	u.topicsLock.RUnlock()
+
+	if store.CanListKeys(u.storage) {
+		cursors, err := store.ListKeys(u.storage, u.keys.cursor(""))
+		if err != nil {
+			return err
+		}
+		for _, key := range cursors {
+			sw.copy(u, key)
+		}
+	}
+
+	u.topicsLock.RLock()
+	ts := make([]*topic, 0, len(u.topics))
+	for _, t := range u.topics {
+		ts = append(ts, t)
+	}
+	qs := u.genQueueStore()
+	u.topicsLock.RUnlock()
+	sort.Slice(ts, func(i, j int) bool { return ts[i].name < ts[j].name })
+
+	for _, t := range ts {
+		t.snapshot(sw)
+	}
+
+	buf, err := qs.Marshal()
+	if err != nil {
+		return utils.NewError(
+			utils.ErrInternalError,
+			err.Error(),
+		)
+	}
+	sw.write(storageKeyWord, buf)
+	sw.write("", nil)
+	if sw.err != nil {
+		return sw.err
+	}
+	return sw.w.Flush()
+}
+
+// snapshot writes the records of the topic. The head stays locked until
+// its messages are written, so they are not cleaned meanwhile.
+func (t *topic) snapshot(sw *snapshotWriter) {
+	type lineRecord struct {
+		l       *line
+		store   []byte
+		recycle string
+		lifo    []byte
+	}
+
+	t.loadLazyAll()
+	t.linesLock.RLock()
+	lines := make([]*line, 0, len(t.lines))
+	for _, l := range t.lines {
+		lines = append(lines, l)
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i].name < lines[j].name })
+	for _, l := range lines {
+		l.inflightLock.RLock()
+		l.headLock.RLock()
+	}
+	t.headLock.RLock()
+	defer t.headLock.RUnlock()
+	t.tailLock.RLock()
+
+	head := t.head
+	tail := t.tail
+	topicStore, err := t.genTopicStore().Marshal()
+	records := make([]lineRecord, len(lines))
+	for i, l := range lines {
+		var lineStore, lifo []byte
+		if err == nil {
+			lineStore, err = l.genLineStore().Marshal()
+		}
+		if err == nil && l.lifo != nil {
+			lifo, err = json.Marshal(l.lifo)
+		}
+		records[i] = lineRecord{l, lineStore, l.getRecycle().String(), lifo}
+	}
+
+	t.tailLock.RUnlock()
+	for _, l := range lines {
+		l.headLock.RUnlock()
+		l.inflightLock.RUnlock()
+	}
+	t.linesLock.RUnlock()
+	if err != nil {
+		sw.err = utils.NewError(
+			utils.ErrInternalError,
+			err.Error(),
+		)
+		return
+	}
+
+	u := t.q
+	sw.write(u.keys.topic(t.name), topicStore)
+	offset := make([]byte, 8)
+	binary.LittleEndian.PutUint64(offset, head)
+	sw.write(t.headKey, offset)
+	offset = make([]byte, 8)
+	binary.LittleEndian.PutUint64(offset, tail)
+	sw.write(t.tailKey, offset)
+	sw.copy(u, u.keys.topicConfig(t.name))
+	for _, r := range records {
+		sw.write(r.l.storeKey, r.store)
+		sw.write(r.l.recycleKey, []byte(r.recycle))
+		sw.copy(u, r.l.configKey)
+		if r.lifo != nil {
+			sw.write(r.l.lifoKey, r.lifo)
+		}
+	}
+
+	for id := head; id < tail && sw.err == nil; id++ {
+		buf, err := t.readMessage(id)
+		if isDataNotExisted(err) {
+			// lost, the pops skip it as well
+			continue
+		}
+		if err != nil {
+			sw.err = err
+			return
+		}
+		sw.write(t.messageKey(id), buf)
+
+		if u.codec == RawCodec {
+			continue
+		}
+		e := new(Envelope)
+		err = u.codec.Unmarshal(buf, e)
+		if err != nil {
+			sw.err = err
+			return
+		}
+		for name, value := range e.Attrs {
+			sw.write(t.attrIndexKey(name, value, id), []byte{})
+		}
+	}
+}
+
+// readSnapshotString reads a string prefixed by its uvarint length
+func readSnapshotString(r *bufio.Reader) (string, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, l)
+	_, err = io.ReadFull(r, buf)
+	return string(buf), err
+}
+
+// Restore writes the snapshot written by ConsistentSnapshot into the empty
+// storage, which is then opened by NewUnitedQueue like the one snapshotted.
+// The values are restored without checksums.
+func Restore(r io.Reader, storage store.Storage) error {
+	for _, key := range []string{storageKeyWord, storageKeyLayout} {
+		_, err := storage.Get(key)
+		if err == nil {
+			return utils.NewError(
+				utils.ErrBadRequest,
+				`restore into a used storage`,
+			)
+		}
+		if err != store.ErrNotExisted {
+			return err
+		}
+	}
+
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(snapshotMagic))
+	_, err := io.ReadFull(br, magic)
+	if err != nil || string(magic) != snapshotMagic {
+		return errors.New("restore: not a snapshot")
+	}
+	for {
+		key, err := readSnapshotString(br)
+		if err == nil && key == "" {
+			_, err = readSnapshotString(br)
+			return err
+		}
+		var value string
+		if err == nil {
+			value, err = readSnapshotString(br)
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return errors.New("restore: snapshot truncated: " + err.Error())
+		}
+		err = storage.Set(key, []byte(value))
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package queue
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/buaazp/uq/store"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConsistentSnapshot(t *testing.T) {
+	Convey("Test Snapshot a Live Queue and Restore It", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		sq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer sq.Close()
+
+		So(sq.Create("foo", ""), ShouldBeNil)
+		So(sq.Create("foo/x", "1h"), ShouldBeNil)
+		So(sq.Create("foo/y", ""), ShouldBeNil)
+		So(sq.Create("bar", ""), ShouldBeNil)
+		for _, data := range []string{"a", "b", "c"} {
+			So(sq.Push("foo", []byte(data)), ShouldBeNil)
+		}
+		So(sq.PushWithAttrs("foo", []byte("d"), map[string]string{"color": "red"}), ShouldBeNil)
+		So(sq.Push("bar", []byte("e")), ShouldBeNil)
+		So(sq.SaveCursor("c1", []byte("42")), ShouldBeNil)
+		_, _, err = sq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		_, _, err = sq.Pop("foo/y")
+		So(err, ShouldBeNil)
+
+		var buf bytes.Buffer
+		So(sq.ConsistentSnapshot(&buf), ShouldBeNil)
+		// not in the snapshot
+		So(sq.Push("foo", []byte("f")), ShouldBeNil)
+
+		So(Restore(bytes.NewReader(buf.Bytes()), mdb), ShouldNotBeNil)
+		rdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		So(Restore(bytes.NewReader(buf.Bytes()[:buf.Len()-3]), rdb), ShouldNotBeNil)
+
+		rdb, err = store.NewMemStore()
+		So(err, ShouldBeNil)
+		So(Restore(bytes.NewReader(buf.Bytes()), rdb), ShouldBeNil)
+		rq, err := NewUnitedQueue(rdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer rq.Close()
+		So(len(rq.Validate()), ShouldEqual, 0)
+
+		qs, err := rq.Stat("foo/x")
+		So(err, ShouldBeNil)
+		So(qs.Head, ShouldEqual, 1)
+		So(qs.Tail, ShouldEqual, 4)
+		So(qs.Count, ShouldEqual, 4)
+		_, data, err := rq.Pop("foo/y")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "b")
+		qs, err = rq.Stat("bar")
+		So(err, ShouldBeNil)
+		So(qs.Tail, ShouldEqual, 1)
+		ids, err := rq.FindByAttribute("foo", "color", "red")
+		So(err, ShouldBeNil)
+		So(ids, ShouldResemble, []uint64{3})
+		state, err := rq.LoadCursor("c1")
+		So(err, ShouldBeNil)
+		So(string(state), ShouldEqual, "42")
+	})
+}
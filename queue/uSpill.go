@@ -0,0 +1,231 @@
+package queue
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/buaazp/uq/utils"
+)
+
+const spillHeaderSize = 4
+
+// spillLog is the file the pushes go to while the async buffer of a topic
+// is full, with the AsyncSpillDir option. Once a push is spilled the later
+// ones are spilled too until the log is replayed into the buffer, so the
+// order is kept. The waits for the writes are kept in memory, after the
+// spilled pushes buffered before them.
+type spillLog struct {
+	dir string
+	f   *os.File
+
+	lock sync.Mutex
+	// readOff is the offset of the next record to replay, writeOff the one
+	// of the next record to spill
+	readOff  int64
+	writeOff int64
+	// written and replayed count the records, so the log is empty when
+	// they are equal
+	written  uint64
+	replayed uint64
+	marks    []spillMark
+
+	signal  chan bool
+	quit    chan bool
+	stopped chan bool
+}
+
+// spillMark is a wait for the writes buffered after the first after
+// records of the log
+type spillMark struct {
+	after uint64
+	aw    asyncWrite
+}
+
+func newSpillLog(dir string) *spillLog {
+	s := new(spillLog)
+	s.dir = dir
+	s.signal = make(chan bool, 1)
+	s.quit = make(chan bool)
+	s.stopped = make(chan bool)
+	return s
+}
+
+// enqueue buffers aw into c if the log is empty and c is not full, or
+// spills it. The log is not empty until it is truncated.
+func (s *spillLog) enqueue(c chan asyncWrite, aw asyncWrite) error {
+	s.lock.Lock()
+	if s.writeOff == 0 && len(s.marks) == 0 {
+		if aw.done != nil {
+			s.lock.Unlock()
+			c <- aw
+			return nil
+		}
+		select {
+		case c <- aw:
+			s.lock.Unlock()
+			return nil
+		default:
+		}
+	}
+	defer s.lock.Unlock()
+
+	if aw.done != nil {
+		s.marks = append(s.marks, spillMark{after: s.written, aw: aw})
+		return nil
+	}
+	err := s.append(aw.e)
+	if err != nil {
+		return utils.NewError(
+			utils.ErrInternalError,
+			`spill push: `+err.Error(),
+		)
+	}
+	s.written++
+	select {
+	case s.signal <- true:
+	default:
+	}
+	return nil
+}
+
+// append writes e at the end of the log, the caller must hold s.lock
+func (s *spillLog) append(e *Envelope) error {
+	if s.f == nil {
+		f, err := ioutil.TempFile(s.dir, "uq-spill-")
+		if err != nil {
+			return err
+		}
+		s.f = f
+	}
+	data, err := BinaryCodec.Marshal(e)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, spillHeaderSize+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[spillHeaderSize:], data)
+	_, err = s.f.WriteAt(buf, s.writeOff)
+	if err != nil {
+		return err
+	}
+	s.writeOff += int64(len(buf))
+	return nil
+}
+
+// read returns the record at off and its size in the log
+func (s *spillLog) read(off int64) (*Envelope, int64, error) {
+	var header [spillHeaderSize]byte
+	_, err := s.f.ReadAt(header[:], off)
+	if err != nil {
+		return nil, 0, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	data := make([]byte, size)
+	_, err = s.f.ReadAt(data, off+spillHeaderSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	e := new(Envelope)
+	err = BinaryCodec.Unmarshal(data, e)
+	if err != nil {
+		return nil, 0, err
+	}
+	return e, int64(spillHeaderSize + len(data)), nil
+}
+
+// runSpill replays the log into the buffer of the topic whenever pushes are
+// spilled, and all of it when the writes stop
+func (t *topic) runSpill() {
+	s := t.writes.spill
+	defer close(s.stopped)
+	for {
+		select {
+		case <-s.signal:
+			t.replaySpill()
+		case <-s.quit:
+			t.replaySpill()
+			return
+		}
+	}
+}
+
+// replaySpill moves the records and the waits of the log into the buffer in
+// order until the log is empty. The log is truncated once the writer has
+// stored the records, before the waits buffered after them.
+func (t *topic) replaySpill() {
+	w := t.writes
+	s := w.spill
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for {
+		if s.written == s.replayed && s.writeOff > 0 {
+			s.lock.Unlock()
+			done := make(chan error, 1)
+			w.c <- asyncWrite{done: done}
+			<-done
+			s.lock.Lock()
+			if s.written == s.replayed {
+				s.truncate(t.name)
+			}
+			continue
+		}
+		if len(s.marks) > 0 && s.marks[0].after <= s.replayed {
+			aw := s.marks[0].aw
+			s.marks = s.marks[1:]
+			s.lock.Unlock()
+			w.c <- aw
+			s.lock.Lock()
+			continue
+		}
+		if s.written == s.replayed {
+			return
+		}
+
+		off := s.readOff
+		s.lock.Unlock()
+		e, n, err := s.read(off)
+		if err == nil {
+			w.c <- asyncWrite{e: e}
+		} else {
+			w.failed(err)
+		}
+		s.lock.Lock()
+		if err != nil {
+			// the records left can not be found in the log
+			log.Printf("topic[%s] spill replay error, %d pushes lost: %s", t.name, s.written-s.replayed, err)
+			s.readOff = s.writeOff
+			s.replayed = s.written
+			continue
+		}
+		s.readOff += n
+		s.replayed++
+	}
+}
+
+// truncate empties the log file, the caller must hold s.lock. The file is
+// written from the start again even if it fails, the stale records are
+// never read.
+func (s *spillLog) truncate(topicName string) {
+	err := s.f.Truncate(0)
+	if err != nil {
+		log.Printf("topic[%s] spill truncate error: %s", topicName, err)
+	}
+	s.readOff = 0
+	s.writeOff = 0
+}
+
+// remove deletes the log file, the caller must have stopped the replay
+func (s *spillLog) remove() {
+	if s.f == nil {
+		return
+	}
+	name := s.f.Name()
+	s.f.Close()
+	err := os.Remove(name)
+	if err != nil {
+		log.Printf("spill log remove error: %s", err)
+	}
+}
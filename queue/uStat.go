@@ -16,6 +16,9 @@ type Stat struct {
 	IHead   uint64  `json:"ihead"`
 	Tail    uint64  `json:"tail"`
 	Count   uint64  `json:"count"`
+
+	LastPop     string `json:"lastpop,omitempty"`
+	LastConfirm string `json:"lastconfirm,omitempty"`
 }
 
 // ToString returns the string of Stat
@@ -50,6 +53,10 @@ func (q *Stat) ToStrings() []string {
 	}
 	replys = append(replys, "tail:"+strconv.FormatUint(q.Tail, 10))
 	replys = append(replys, "count:"+strconv.FormatUint(q.Count, 10))
+	if q.Type == "line" {
+		replys = append(replys, "lastpop:"+q.LastPop)
+		replys = append(replys, "lastconfirm:"+q.LastConfirm)
+	}
 
 	if q.Type == "topic" && q.Lines != nil {
 		for _, lineStat := range q.Lines {
@@ -0,0 +1,290 @@
+package queue
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buaazp/uq/utils"
+)
+
+const (
+	subPollInterval time.Duration = time.Second
+)
+
+// Subscription is a stream of the messages popped from a line. The channel
+// C is closed when the subscription is stopped, the line is removed or the
+// queue is closed. The messages which are delivered but not confirmed stay
+// inflight in the line as the popped ones do.
+type Subscription struct {
+	// C is the channel the messages are delivered on
+	C <-chan *Message
+
+	c        chan *Message
+	key      string
+	q        *UnitedQueue
+	quit     chan bool
+	quitOnce sync.Once
+
+	// unconfirmed is the ids delivered by an at least once subscription
+	// and not confirmed through it, nil for the other subscriptions
+	unconfirmed     map[uint64]bool
+	unconfirmedLock sync.Mutex
+}
+
+// Subscribe returns a Subscription which keeps popping messages from the
+// line of key "topic/line". A message is popped only when it is going to be
+// delivered, but the last popped one of a line without recycle is dropped
+// if the subscription is stopped before the consumer receives it.
+func (u *UnitedQueue) Subscribe(key string) (*Subscription, error) {
+	return u.subscribe(key, false)
+}
+
+// SubscribeAtLeastOnce returns a Subscription like Subscribe, but the
+// messages which are delivered and not confirmed by Confirm of the
+// subscription are recycled at once when it is stopped or the queue is
+// closed, so they are popped again without waiting the recycle. The line
+// must have a recycle.
+func (u *UnitedQueue) SubscribeAtLeastOnce(key string) (*Subscription, error) {
+	return u.subscribe(key, true)
+}
+
+func (u *UnitedQueue) subscribe(key string, atLeastOnce bool) (*Subscription, error) {
+	err := u.checkWritable("subscribe")
+	if err != nil {
+		return nil, err
+	}
+
+	key = u.trimKey(key)
+
+	parts := strings.Split(key, u.opts.Separator)
+	if len(parts) != 2 {
+		return nil, utils.NewError(
+			utils.ErrBadKey,
+			`subscribe key parts error: `+utils.ItoaQuick(len(parts)),
+		)
+	}
+
+	t, ok := u.getTopic(parts[0])
+	if !ok {
+		return nil, utils.NewError(
+			utils.ErrTopicNotExisted,
+			`queue subscribe`,
+		)
+	}
+	t.loadLazy(parts[1])
+	t.linesLock.RLock()
+	l, ok := t.lines[parts[1]]
+	t.linesLock.RUnlock()
+	if !ok {
+		return nil, utils.NewError(
+			utils.ErrLineNotExisted,
+			`queue subscribe`,
+		)
+	}
+	if atLeastOnce && l.getRecycle() == 0 {
+		return nil, utils.NewError(
+			utils.ErrBadRequest,
+			`subscribe at least once line without recycle`,
+		)
+	}
+
+	c := make(chan *Message)
+	s := new(Subscription)
+	s.C = c
+	s.c = c
+	s.key = key
+	s.q = u
+	s.quit = make(chan bool)
+	if atLeastOnce {
+		s.unconfirmed = make(map[uint64]bool)
+	}
+
+	u.subsWg.Add(1)
+	go s.run(t)
+	return s, nil
+}
+
+// Stop stops the subscription and closes its channel
+func (s *Subscription) Stop() {
+	s.quitOnce.Do(func() {
+		close(s.quit)
+	})
+}
+
+// Confirm confirms the message delivered by the subscription, so it is not
+// recycled when an at least once subscription is stopped
+func (s *Subscription) Confirm(m *Message) error {
+	err := s.q.Confirm(m.Key)
+	if err != nil {
+		return err
+	}
+	s.unconfirmedLock.Lock()
+	delete(s.unconfirmed, m.ID)
+	s.unconfirmedLock.Unlock()
+	return nil
+}
+
+// track records the message about to be delivered by an at least once
+// subscription
+func (s *Subscription) track(m *Message) {
+	if s.unconfirmed == nil {
+		return
+	}
+	s.unconfirmedLock.Lock()
+	s.unconfirmed[m.ID] = true
+	s.unconfirmedLock.Unlock()
+}
+
+// recycleUnconfirmed recycles the tracked messages at once. The ones which
+// are confirmed out of the subscription are not inflight any more, so they
+// are left as they are.
+func (s *Subscription) recycleUnconfirmed(t *topic) {
+	if s.unconfirmed == nil {
+		return
+	}
+	sep := t.q.opts.Separator
+	lineName := s.key[strings.Index(s.key, sep)+len(sep):]
+	t.linesLock.RLock()
+	l, ok := t.lines[lineName]
+	t.linesLock.RUnlock()
+
+	s.unconfirmedLock.Lock()
+	defer s.unconfirmedLock.Unlock()
+	if ok {
+		ids := make([]uint64, 0, len(s.unconfirmed))
+		for id := range s.unconfirmed {
+			ids = append(ids, id)
+		}
+		// requeue moves to the front, so the lowest id goes last
+		sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+		for _, id := range ids {
+			l.requeue(id)
+		}
+	}
+	s.unconfirmed = make(map[uint64]bool)
+}
+
+func (s *Subscription) run(t *topic) {
+	defer s.q.subsWg.Done()
+	defer close(s.c)
+	defer s.recycleUnconfirmed(t)
+
+	clock := s.q.opts.Clock
+	for {
+		// take the push channel before popping, so a push between the pop
+		// and the wait is not missed
+		pushed := t.pushedChan()
+		m, err := s.q.PopMessage(s.key)
+		if err == nil {
+			// tracked before it is sent, so a stop between is recycled too
+			s.track(m)
+			select {
+			case s.c <- m:
+				continue
+			case <-s.quit:
+				return
+			case <-s.q.subsQuit:
+				return
+			}
+		}
+
+		e, ok := utils.AsError(err)
+		if ok && (e.ErrorCode == utils.ErrTopicNotExisted || e.ErrorCode == utils.ErrLineNotExisted) {
+			return
+		}
+		if !ok || e.ErrorCode != utils.ErrNone && e.ErrorCode != utils.ErrPaused {
+			log.Printf("subscription[%s] pop error: %s", s.key, err)
+		}
+
+		select {
+		case <-pushed:
+		case <-clock.After(subPollInterval):
+			// the inflight messages are recycled without pushing
+		case <-s.quit:
+			return
+		case <-s.q.subsQuit:
+			return
+		}
+	}
+}
+
+// PopFirstAvailable blocks until any line of the targets "topic/line" has a
+// message and returns the target with the popped message. The targets are
+// tried in order, so an earlier one is preferred when several have messages.
+// The paused targets are waited for like the empty ones. It returns the
+// error of ctx when ctx is done before any message arrives.
+func (u *UnitedQueue) PopFirstAvailable(ctx context.Context, targets []string) (string, *Message, error) {
+	if len(targets) == 0 {
+		return "", nil, utils.NewError(
+			utils.ErrBadRequest,
+			`pop first available no targets`,
+		)
+	}
+	err := u.checkWritable("pop first available")
+	if err != nil {
+		return "", nil, err
+	}
+	ts := make([]*topic, len(targets))
+	for i, target := range targets {
+		t, _, err := u.lineTopic(target, "pop first available")
+		if err != nil {
+			return "", nil, err
+		}
+		ts[i] = t
+	}
+
+	n := len(ts)
+	cases := make([]reflect.SelectCase, n+3)
+	cases[n] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())}
+	cases[n+1] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(u.subsQuit)}
+	for {
+		// take the push channels before popping, so a push between the
+		// pops and the wait is not missed
+		for i, t := range ts {
+			cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(t.pushedChan())}
+		}
+		for _, target := range targets {
+			m, err := u.PopMessage(target)
+			if err == nil {
+				return target, m, nil
+			}
+			e, ok := utils.AsError(err)
+			if !ok || e.ErrorCode != utils.ErrNone && e.ErrorCode != utils.ErrPaused {
+				return "", nil, err
+			}
+		}
+
+		// the inflight messages are recycled without pushing
+		poll := u.opts.Clock.After(subPollInterval)
+		cases[n+2] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(poll)}
+		chosen, _, _ := reflect.Select(cases)
+		switch chosen {
+		case n:
+			return "", nil, ctx.Err()
+		case n + 1:
+			return "", nil, utils.NewError(
+				utils.ErrInternalError,
+				`pop first available queue closed`,
+			)
+		}
+	}
+}
+
+// pushedChan returns a channel which is closed on the next push
+func (t *topic) pushedChan() <-chan bool {
+	t.pushedLock.Lock()
+	defer t.pushedLock.Unlock()
+	return t.pushed
+}
+
+func (t *topic) notifyPushed() {
+	t.pushedLock.Lock()
+	defer t.pushedLock.Unlock()
+	close(t.pushed)
+	t.pushed = make(chan bool)
+}
@@ -0,0 +1,151 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/buaazp/uq/store"
+	"github.com/buaazp/uq/utils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	subDbPath = "/tmp/uq.subscribe.test.db"
+)
+
+func TestSubscribeClose(t *testing.T) {
+	Convey("Test Close Closes the Subscriptions", t, func() {
+		ldb, err := store.NewLevelStore(subDbPath)
+		So(err, ShouldBeNil)
+		sq, err := NewUnitedQueue(ldb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+
+		So(sq.Create("foo", ""), ShouldBeNil)
+		So(sq.Create("foo/x", "1m"), ShouldBeNil)
+		_, err = sq.Subscribe("foo/y")
+		So(err, ShouldNotBeNil)
+
+		sub, err := sq.Subscribe("foo/x")
+		So(err, ShouldBeNil)
+		So(sq.Push("foo", []byte("bar")), ShouldBeNil)
+
+		var m *Message
+		select {
+		case m = <-sub.C:
+		case <-time.After(time.Second):
+		}
+		So(m, ShouldNotBeNil)
+		So(string(m.Data), ShouldEqual, "bar")
+
+		closed := make(chan error)
+		go func() {
+			closed <- sq.Close()
+		}()
+		select {
+		case err = <-closed:
+		case <-time.After(time.Second):
+			err = errors.New("close timeout")
+		}
+		So(err, ShouldBeNil)
+
+		_, ok := <-sub.C
+		So(ok, ShouldBeFalse)
+
+		ldb, err = store.NewLevelStore(subDbPath)
+		So(err, ShouldBeNil)
+		sq, err = NewUnitedQueue(ldb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		qs, err := sq.Stat("foo/x")
+		So(err, ShouldBeNil)
+		So(qs.Head, ShouldEqual, 1)
+		So(qs.Count, ShouldEqual, 1)
+		sq.Close()
+
+		So(os.RemoveAll(subDbPath), ShouldBeNil)
+	})
+}
+
+func TestPopFirstAvailable(t *testing.T) {
+	Convey("Test Pop From the First Available Line", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		pq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer pq.Close()
+
+		So(pq.Create("foo", ""), ShouldBeNil)
+		So(pq.Create("foo/x", ""), ShouldBeNil)
+		So(pq.Create("bar", ""), ShouldBeNil)
+		So(pq.Create("bar/x", ""), ShouldBeNil)
+		targets := []string{"foo/x", "bar/x"}
+
+		_, _, err = pq.PopFirstAvailable(context.Background(), []string{"baz/x"})
+		So(err, ShouldNotBeNil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, _, err = pq.PopFirstAvailable(ctx, targets)
+		cancel()
+		So(err, ShouldEqual, context.DeadlineExceeded)
+
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			pq.Push("bar", []byte("hello"))
+		}()
+		ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+		target, m, err := pq.PopFirstAvailable(ctx, targets)
+		cancel()
+		So(err, ShouldBeNil)
+		So(target, ShouldEqual, "bar/x")
+		So(string(m.Data), ShouldEqual, "hello")
+	})
+}
+
+func TestSubscribeAtLeastOnce(t *testing.T) {
+	Convey("Test Stop Recycles the Unconfirmed Messages", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		sq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer sq.Close()
+
+		So(sq.Create("foo", ""), ShouldBeNil)
+		So(sq.Create("foo/x", "1h"), ShouldBeNil)
+		So(sq.Create("foo/y", ""), ShouldBeNil)
+		_, err = sq.SubscribeAtLeastOnce("foo/y")
+		So(errorCode(err), ShouldEqual, utils.ErrBadRequest)
+
+		for _, data := range []string{"a", "b", "c"} {
+			So(sq.Push("foo", []byte(data)), ShouldBeNil)
+		}
+		sub, err := sq.SubscribeAtLeastOnce("foo/x")
+		So(err, ShouldBeNil)
+
+		var ms []*Message
+		for i := 0; i < 3; i++ {
+			select {
+			case m := <-sub.C:
+				ms = append(ms, m)
+			case <-time.After(time.Second):
+			}
+		}
+		So(len(ms), ShouldEqual, 3)
+		So(sub.Confirm(ms[1]), ShouldBeNil)
+
+		sub.Stop()
+		for range sub.C {
+		}
+
+		m, err := sq.PopMessage("foo/x")
+		So(err, ShouldBeNil)
+		So(string(m.Data), ShouldEqual, "a")
+		So(m.Delivered, ShouldEqual, 2)
+		m, err = sq.PopMessage("foo/x")
+		So(err, ShouldBeNil)
+		So(string(m.Data), ShouldEqual, "c")
+		_, err = sq.PopMessage("foo/x")
+		So(errorCode(err), ShouldEqual, utils.ErrNone)
+	})
+}
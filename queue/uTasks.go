@@ -0,0 +1,88 @@
+package queue
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// TopicTaskStatus is the health of the background goroutine of a topic,
+// which backs up the lines and cleans the consumed messages on intervals.
+// A LastBackup or LastClean much older than its interval tells the
+// goroutine is stuck or gone.
+type TopicTaskStatus struct {
+	Topic string
+	// Running tells whether the background goroutine is running
+	Running bool
+	// LastBackup is when the lines were last backed up without an error,
+	// zero if never
+	LastBackup time.Time
+	// BackupError is the error of the last backup, nil if it succeeded
+	BackupError error
+	// LastClean is when the topic was last cleaned without an error, zero
+	// if never. The persistent topics are never cleaned.
+	LastClean time.Time
+	// CleanError is the error of the last clean, nil if it succeeded
+	CleanError error
+}
+
+// taskStatus records the runs of the background tasks of a topic
+type taskStatus struct {
+	sync.Mutex
+	running     bool
+	lastBackup  time.Time
+	backupError error
+	lastClean   time.Time
+	cleanError  error
+}
+
+func (ts *taskStatus) setRunning(running bool) {
+	ts.Lock()
+	defer ts.Unlock()
+	ts.running = running
+}
+
+func (ts *taskStatus) backedUp(now time.Time, err error) {
+	ts.Lock()
+	defer ts.Unlock()
+	ts.backupError = err
+	if err == nil {
+		ts.lastBackup = now
+	}
+}
+
+func (ts *taskStatus) cleaned(now time.Time, err error) {
+	ts.Lock()
+	defer ts.Unlock()
+	ts.cleanError = err
+	if err == nil {
+		ts.lastClean = now
+	}
+}
+
+// TaskStatus returns the health of the background tasks of every topic,
+// sorted by the topic names
+func (u *UnitedQueue) TaskStatus() []TopicTaskStatus {
+	u.topicsLock.RLock()
+	topics := make([]*topic, 0, len(u.topics))
+	for _, t := range u.topics {
+		topics = append(topics, t)
+	}
+	u.topicsLock.RUnlock()
+	sort.Slice(topics, func(i, j int) bool { return topics[i].name < topics[j].name })
+
+	statuses := make([]TopicTaskStatus, 0, len(topics))
+	for _, t := range topics {
+		t.tasks.Lock()
+		statuses = append(statuses, TopicTaskStatus{
+			Topic:       t.name,
+			Running:     t.tasks.running,
+			LastBackup:  t.tasks.lastBackup,
+			BackupError: t.tasks.backupError,
+			LastClean:   t.tasks.lastClean,
+			CleanError:  t.tasks.cleanError,
+		})
+		t.tasks.Unlock()
+	}
+	return statuses
+}
@@ -0,0 +1,59 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/buaazp/uq/store"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTaskStatus(t *testing.T) {
+	Convey("Test Task Status of the Topics", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		fs := &flakyStore{Storage: mdb}
+		tq, err := NewUnitedQueue(fs, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+
+		So(tq.Create("foo", ""), ShouldBeNil)
+		So(tq.Create("foo/x", ""), ShouldBeNil)
+		So(tq.Create("bar", ""), ShouldBeNil)
+		ss := tq.TaskStatus()
+		So(ss, ShouldHaveLength, 2)
+		So(ss[0].Topic, ShouldEqual, "bar")
+		So(ss[1], ShouldResemble, TopicTaskStatus{Topic: "foo", Running: true})
+
+		tp := tq.topics["foo"]
+		So(tp.backupLines(), ShouldBeFalse)
+		backup := tq.TaskStatus()[1].LastBackup
+		So(backup.IsZero(), ShouldBeFalse)
+		fs.setFails(100)
+		So(tp.backupLines(), ShouldBeFalse)
+		fs.setFails(0)
+		ss = tq.TaskStatus()
+		So(ss[1].BackupError, ShouldNotBeNil)
+		So(ss[1].LastBackup, ShouldEqual, backup)
+
+		for _, data := range []string{"a", "b"} {
+			So(tq.Push("foo", []byte(data)), ShouldBeNil)
+			_, _, err = tq.Pop("foo/x")
+			So(err, ShouldBeNil)
+		}
+		fs.setFails(100)
+		tp.clean()
+		fs.setFails(0)
+		ss = tq.TaskStatus()
+		So(ss[1].CleanError, ShouldNotBeNil)
+		So(ss[1].LastClean.IsZero(), ShouldBeTrue)
+		tp.clean()
+		ss = tq.TaskStatus()
+		So(ss[1].CleanError, ShouldBeNil)
+		So(ss[1].LastClean.IsZero(), ShouldBeFalse)
+		So(tp.getHead(), ShouldEqual, 2)
+
+		So(tq.Close(), ShouldBeNil)
+		for _, s := range tq.TaskStatus() {
+			So(s.Running, ShouldBeFalse)
+		}
+	})
+}
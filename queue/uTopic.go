@@ -4,37 +4,104 @@ import (
 	"container/list"
 	"encoding/binary"
 	"log"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/buaazp/uq/utils"
 )
 
 type topic struct {
-	name      string
-	persist   bool
-	lines     map[string]*line
-	linesLock sync.RWMutex
+	name    string
+	persist bool
+	// idleExpire removes the topic after no push or pop for the duration,
+	// 0 means the topic never expires. lastActive is the time of the last
+	// push or pop, read and written atomically.
+	idleExpire time.Duration
+	lastActive int64
+	lines      map[string]*line
+	linesLock  sync.RWMutex
+	// lazy is the lines not loaded yet with LazyLoad, guarded by
+	// linesLock, and lazyCount is its size for the readers without it
+	lazy      map[string]bool
+	lazyCount int32
 	head      uint64
 	headLock  sync.RWMutex
 	headKey   string
 	tail      uint64
 	tailLock  sync.RWMutex
 	tailKey   string
+	msgPrefix string
 	q         *UnitedQueue
 
-	quit chan bool
-	wg   sync.WaitGroup
+	pushed     chan bool
+	pushedLock sync.Mutex
+
+	config       TopicConfig
+	limiter      *tokenBucket
+	interceptors []PopInterceptor
+	configLock   sync.RWMutex
+
+	reconfig chan bool
+	// agedLines is the lines with a MaxAge, the pushes record their time
+	// while there is one
+	agedLines int32
+	// unflushed is the pushes since the last flush, guarded by tailLock
+	unflushed int
+	// writes buffers the pushes with AsyncPushBuffer, nil without it
+	writes *asyncWrites
+
+	running     bool
+	runningLock sync.Mutex
+	tasks       taskStatus
+	quit        chan bool
+	wg          sync.WaitGroup
 }
 
-func (t *topic) getData(id uint64) ([]byte, error) {
-	key := utils.Acatui(t.name, ":", id)
-	return t.q.getData(key)
+func (t *topic) messageKey(id uint64) string {
+	return messageKey(t.msgPrefix, id)
+}
+
+func (t *topic) getEnvelope(id uint64) (*Envelope, error) {
+	buf, err := t.readMessage(id)
+	if err != nil || len(buf) == 0 {
+		return nil, err
+	}
+
+	e := new(Envelope)
+	err = t.q.codec.Unmarshal(buf, e)
+	if err != nil {
+		return nil, utils.NewError(
+			utils.ErrInternalError,
+			err.Error(),
+		)
+	}
+	return e, nil
 }
 
 func (t *topic) setData(id uint64, data []byte) error {
-	key := utils.Acatui(t.name, ":", id)
-	return t.q.setData(key, data)
+	e := new(Envelope)
+	e.Data = data
+	return t.setEnvelope(id, e)
+}
+
+func (t *topic) setEnvelope(id uint64, e *Envelope) error {
+	buf, err := t.q.codec.Marshal(e)
+	if err != nil {
+		return utils.NewError(
+			utils.ErrInternalError,
+			err.Error(),
+		)
+	}
+
+	var ttl time.Duration
+	if e.Deadline > 0 {
+		// an expired message is stored anyway, the pops skip it
+		ttl = time.Unix(0, e.Deadline).Sub(t.q.now())
+	}
+	return t.writeMessage(id, buf, ttl)
 }
 
 func (t *topic) getHead() uint64 {
@@ -86,31 +153,25 @@ func (t *topic) removeTailData() error {
 }
 
 func (t *topic) genTopicStore() *UnitedTopicStore {
-	lines := make([]string, len(t.lines))
-	i := 0
+	lines := make([]string, 0, len(t.lines)+len(t.lazy))
 	for _, line := range t.lines {
-		lines[i] = line.name
-		i++
+		lines = append(lines, line.name)
+	}
+	for name := range t.lazy {
+		lines = append(lines, name)
 	}
 
 	ts := new(UnitedTopicStore)
 	ts.Lines = lines
 	ts.Persist = t.persist
+	ts.IdleExpire = int64(t.idleExpire)
 
 	return ts
 }
 
 func (t *topic) exportTopic() error {
 	ts := t.genTopicStore()
-	buf, err := ts.Marshal()
-	if err != nil {
-		return utils.NewError(
-			utils.ErrInternalError,
-			err.Error(),
-		)
-	}
-
-	err = t.q.setData(t.name, buf)
+	err := t.q.setStore(t.q.keys.topic(t.name), ts)
 	if err != nil {
 		return err
 	}
@@ -120,7 +181,7 @@ func (t *topic) exportTopic() error {
 }
 
 func (t *topic) removeTopicData() error {
-	err := t.q.delData(t.name)
+	err := t.q.delData(t.q.keys.topic(t.name))
 	if err != nil {
 		return err
 	}
@@ -131,6 +192,7 @@ func (t *topic) exportLines() error {
 	t.linesLock.RLock()
 	defer t.linesLock.RUnlock()
 
+	pe := newPersistError()
 	for lineName, l := range t.lines {
 		l.inflightLock.RLock()
 		l.headLock.RLock()
@@ -139,19 +201,111 @@ func (t *topic) exportLines() error {
 		l.headLock.RUnlock()
 		if err != nil {
 			log.Printf("topic[%s] line[%s] export error: %s", t.name, lineName, err)
+			pe.add(t.name+t.q.opts.Separator+lineName, err)
 			continue
 		}
 	}
 
 	// log.Printf("topic[%s]'s all lines exported.", t.name)
-	return nil
+	return pe.errorOrNil()
+}
+
+// flush exports the topic and all its lines at once
+func (t *topic) flush() error {
+	t.linesLock.RLock()
+	err := t.exportTopic()
+	t.linesLock.RUnlock()
+	if err != nil {
+		return err
+	}
+	return t.exportLines()
+}
+
+// countPushes counts n pushes, the caller must hold t.tailLock. It reports
+// whether the topic should be flushed by the PersistEvery option.
+func (t *topic) countPushes(n int) bool {
+	every := t.q.options().PersistEvery
+	if every <= 0 {
+		return false
+	}
+	t.unflushed += n
+	if t.unflushed < every {
+		return false
+	}
+	t.unflushed = 0
+	return true
+}
+
+// flushPushes flushes the topic if countPushes asked to, the caller must
+// not hold t.tailLock
+func (t *topic) flushPushes(due bool, err error) error {
+	if err != nil || !due {
+		return err
+	}
+	return t.flush()
+}
+
+// exportLineRetry exports the line and retries with backoff on failure
+func (t *topic) exportLineRetry(l *line) (quit bool, err error) {
+	backoff := bgExportBackoff
+	for i := 0; ; i++ {
+		l.inflightLock.RLock()
+		l.headLock.RLock()
+		err = l.exportLine()
+		l.inflightLock.RUnlock()
+		l.headLock.RUnlock()
+		if err == nil || i >= bgExportRetries {
+			return
+		}
+
+		select {
+		case <-t.quit:
+			quit = true
+			return
+		case <-t.q.opts.Clock.After(backoff):
+			backoff *= 2
+		}
+	}
+}
+
+// backupLines is the background version of exportLines, which retries the
+// failed lines and reports the ones that are still failing
+func (t *topic) backupLines() (quit bool) {
+	t.linesLock.RLock()
+	lines := make([]*line, 0, len(t.lines))
+	for _, l := range t.lines {
+		lines = append(lines, l)
+	}
+	t.linesLock.RUnlock()
+
+	var lastErr error
+	for _, l := range lines {
+		quit, err := t.exportLineRetry(l)
+		if quit {
+			return true
+		}
+		if err != nil {
+			log.Printf("topic[%s] line[%s] backup error: %s", t.name, l.name, err)
+			onExportError := t.q.options().OnExportError
+			if onExportError != nil {
+				onExportError(t.name, l.name, err)
+			}
+			lastErr = err
+		}
+	}
+	t.tasks.backedUp(t.q.now(), lastErr)
+	return false
 }
 
 func (t *topic) loadLine(lineName string, ls UnitedLineStore) (*line, error) {
 	// log.Printf("topic[%s] loading inflights: %v", t.name, ls.Inflights)
 	l := new(line)
 	l.name = lineName
-	l.recycleKey = t.name + "/" + lineName + keyLineRecycle
+	l.storeKey = t.q.keys.line(t.name, lineName)
+	l.recycleKey = t.q.keys.lineRecycle(t.name, lineName)
+	l.configKey = t.q.keys.lineConfig(t.name, lineName)
+	l.lifoKey = t.q.keys.lineLifo(t.name, lineName)
+	l.t = t
 	lineRecycleData, err := t.q.getData(l.recycleKey)
 	if err != nil {
 		return nil, err
@@ -174,24 +328,43 @@ func (t *topic) loadLine(lineName string, ls UnitedLineStore) (*line, error) {
 	inflight := list.New()
 	for index := range ls.Inflights {
 		msg := ls.Inflights[index]
+		// the records before the count keep 0 for the delivered ones,
+		// only the ones parked by PopMatching have no expire time
+		if msg.Delivered == 0 && msg.Exptime != 0 {
+			msg.Delivered = 1
+		}
 		inflight.PushBack(msg)
 		imap[msg.Tid] = true
 	}
 	l.inflight = inflight
-	l.t = t
+	l.lastPop = ls.LastPop
+	l.lastConfirm = ls.LastConfirm
+	l.since = t.q.now().UnixNano()
+	l.waiters = make(map[uint64]chan bool)
+	err = l.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	err = l.loadLifo()
+	if err != nil {
+		return nil, err
+	}
 
-	t.q.registerLine(t.name, l.name, l.recycle.String())
+	t.q.registerLine(t.name, l.name, l.getRecycle().String())
 	return l, nil
 }
 
 func (t *topic) getEnd() uint64 {
 	var end uint64
-	if len(t.lines) == 0 {
+	if !t.lazyLoaded() {
+		// the heads of the lines not loaded are unknown
+		end = t.head
+	} else if len(t.lines) == 0 {
 		end = t.head
 	} else {
 		end = t.tail
 		for _, l := range t.lines {
-			if l.recycle > 0 {
+			if l.getRecycle() > 0 {
 				if l.ihead < end {
 					end = l.ihead
 				}
@@ -211,8 +384,15 @@ func (t *topic) clean() (quit bool) {
 	t.headLock.Lock()
 	defer t.headLock.Unlock()
 
+	var cleanErr error
+	defer func() {
+		if !quit {
+			t.tasks.cleaned(t.q.now(), cleanErr)
+		}
+	}()
+
 	// starting := t.head
-	endTime := time.Now().Add(bgCleanTimeout)
+	endTime := t.q.now().Add(bgCleanTimeout)
 	// log.Printf("topic[%s] begin to clean at %d", t.name, starting)
 
 	// defer func() {
@@ -232,15 +412,21 @@ func (t *topic) clean() (quit bool) {
 			// nothing todo
 		}
 
-		if time.Now().After(endTime) {
+		if t.q.now().After(endTime) {
 			// log.Printf("topic[%s] cleaning timeout, break at %d", t.name, t.head)
 			return
 		}
 
-		key := utils.Acatui(t.name, ":", t.head)
-		err := t.q.delData(key)
+		err := t.unindexMessage(t.head)
 		if err != nil {
-			log.Printf("topic[%s] del %s error; %s", t.name, key, err)
+			log.Printf("topic[%s] unindex %s error; %s", t.name, t.messageKey(t.head), err)
+			cleanErr = err
+			return
+		}
+		err = t.deleteMessage(t.head)
+		if err != nil && !isDataNotExisted(err) {
+			log.Printf("topic[%s] del %s error; %s", t.name, t.messageKey(t.head), err)
+			cleanErr = err
 			return
 		}
 
@@ -248,6 +434,7 @@ func (t *topic) clean() (quit bool) {
 		err = t.exportHead()
 		if err != nil {
 			log.Printf("topic[%s] export head error: %s", t.name, err)
+			cleanErr = err
 			return
 		}
 	}
@@ -255,29 +442,101 @@ func (t *topic) clean() (quit bool) {
 	return
 }
 
+// expireLines removes the lines idle for longer than LineIdleExpire
+func (t *topic) expireLines() {
+	expire := t.q.options().LineIdleExpire
+	if expire <= 0 {
+		return
+	}
+
+	now := t.q.now()
+	var idles []string
+	t.linesLock.RLock()
+	for name, l := range t.lines {
+		if l.isIdle(now, expire) {
+			idles = append(idles, name)
+		}
+	}
+	t.linesLock.RUnlock()
+
+	for _, name := range idles {
+		_, err := t.removeLine(name, false, false)
+		if err != nil {
+			log.Printf("topic[%s] line[%s] expire error: %s", t.name, name, err)
+			continue
+		}
+		log.Printf("topic[%s] line[%s] idle for %v, expired.", t.name, name, expire)
+	}
+}
+
+// acquireMaintenance waits for a maintenance token of the queue, it returns
+// false if the topic quits meanwhile
+func (t *topic) acquireMaintenance() bool {
+	if t.q.maintenance == nil {
+		return true
+	}
+	select {
+	case t.q.maintenance <- true:
+		return true
+	case <-t.quit:
+		return false
+	}
+}
+
+func (t *topic) releaseMaintenance() {
+	if t.q.maintenance != nil {
+		<-t.q.maintenance
+	}
+}
+
 func (t *topic) backgroundClean() {
-	t.wg.Add(1)
 	defer t.wg.Done()
+	defer t.tasks.setRunning(false)
 
+	clock := t.q.opts.Clock
+	opts := t.q.options()
 	bgQuit := false
-	backupTick := time.NewTicker(bgBackupInterval)
-	cleanTick := time.NewTicker(bgCleanInterval)
+	backupTick := clock.After(opts.BackupInterval)
+	cleanTick := clock.After(opts.CleanInterval)
+	load := newPushLoad(t)
 	for !bgQuit {
 		select {
-		case <-backupTick.C:
-			err := t.exportLines()
-			if err != nil {
-				log.Printf("topic[%s] export lines error: %s", t.name, err)
+		case <-t.reconfig:
+			opts = t.q.options()
+			backupTick = clock.After(opts.BackupInterval)
+			cleanTick = clock.After(opts.CleanInterval)
+		case <-backupTick:
+			backupTick = clock.After(opts.BackupInterval)
+			if !t.acquireMaintenance() {
+				bgQuit = true
+				break
 			}
-		case <-cleanTick.C:
-			if !t.persist {
+			if t.backupLines() {
+				bgQuit = true
+			}
+			t.releaseMaintenance()
+		case <-cleanTick:
+			cleanTick = clock.After(opts.CleanInterval)
+			if !t.acquireMaintenance() {
+				bgQuit = true
+				break
+			}
+			t.expireLines()
+			if t.idleExpired(t.q.now()) {
+				// removing the topic waits for this goroutine
+				go t.q.expireTopic(t)
+			}
+			t.checkLags()
+			if !t.persist && load.cleanAllowed(opts) {
 				log.Printf("cleaning... %v", t.persist)
 				bgQuit := t.clean()
 				if bgQuit {
 					// log.Printf("topic[%s] t.clean return quit: %v", t.name, bgQuit)
+					t.releaseMaintenance()
 					break
 				}
 			}
+			t.releaseMaintenance()
 		case <-t.quit:
 			// log.Printf("topic[%s] background clean catched quit", t.name)
 			bgQuit = true
@@ -287,12 +546,33 @@ func (t *topic) backgroundClean() {
 	// log.Printf("topic[%s] background clean exit.", t.name)
 }
 
+// reconfigured tells the background goroutine to reload the options
+func (t *topic) reconfigured() {
+	select {
+	case t.reconfig <- true:
+	default:
+		// a reload is pending already
+	}
+}
+
+// start starts the background goroutine of the topic, it is a no-op if the
+// goroutine is running already
 func (t *topic) start() {
+	t.runningLock.Lock()
+	defer t.runningLock.Unlock()
+	if t.running {
+		log.Printf("topic[%s] is running already", t.name)
+		return
+	}
+	t.running = true
+	t.tasks.setRunning(true)
+
 	// log.Printf("topic[%s] is starting...", t.name)
+	t.wg.Add(1)
 	go t.backgroundClean()
 }
 
-func (t *topic) newLine(name string, recycle time.Duration) (*line, error) {
+func (t *topic) newLine(name string, recycle time.Duration, startID *uint64, lifo bool) (*line, error) {
 	inflight := list.New()
 	imap := make(map[uint64]bool)
 	l := new(line)
@@ -302,11 +582,32 @@ func (t *topic) newLine(name string, recycle time.Duration) (*line, error) {
 	} else {
 		l.head = 0
 	}
+	if startID != nil {
+		head := t.getHead()
+		if *startID < head {
+			return nil, utils.NewError(
+				utils.ErrBadRequest,
+				`start id is below the head `+strconv.FormatUint(head, 10),
+			)
+		}
+		l.head = *startID
+		if tail := t.getTail(); l.head > tail {
+			l.head = tail
+		}
+	}
 	l.recycle = recycle
-	l.recycleKey = t.name + "/" + name + keyLineRecycle
+	l.storeKey = t.q.keys.line(t.name, name)
+	l.recycleKey = t.q.keys.lineRecycle(t.name, name)
+	l.configKey = t.q.keys.lineConfig(t.name, name)
+	l.lifoKey = t.q.keys.lineLifo(t.name, name)
+	if lifo {
+		l.lifo = &lifoState{Mark: l.head}
+	}
 	l.inflight = inflight
 	l.ihead = l.head
 	l.imap = imap
+	l.since = t.q.now().UnixNano()
+	l.waiters = make(map[uint64]chan bool)
 	l.t = t
 
 	err := l.exportLine()
@@ -321,49 +622,95 @@ func (t *topic) newLine(name string, recycle time.Duration) (*line, error) {
 	return l, nil
 }
 
-func (t *topic) createLine(name string, recycle time.Duration, fromEtcd bool) error {
+func (t *topic) createLine(name string, recycle time.Duration, startID *uint64, lifo bool, cfg LineConfig, fromEtcd bool) error {
 	t.linesLock.Lock()
 	defer t.linesLock.Unlock()
 	_, ok := t.lines[name]
-	if ok {
+	if ok || t.lazy[name] {
 		return utils.NewError(
 			utils.ErrLineExisted,
 			`topic createLine`,
 		)
 	}
+	max := t.q.options().MaxLinesPerTopic
+	if max > 0 && len(t.lines)+len(t.lazy) >= max {
+		return utils.NewError(
+			utils.ErrTooManyLines,
+			`topic createLine`,
+		)
+	}
+
+	err := checkLineConfig(cfg)
+	if err != nil {
+		return err
+	}
 
-	l, err := t.newLine(name, recycle)
+	l, err := t.newLine(name, recycle, startID, lifo)
 	if err != nil {
 		return err
 	}
+	if cfg != (LineConfig{}) {
+		err = l.configure(cfg)
+		if err != nil {
+			l.remove()
+			return err
+		}
+	}
 
 	t.lines[name] = l
 
 	err = t.exportTopic()
 	if err != nil {
-		t.linesLock.Lock()
 		delete(t.lines, name)
-		t.linesLock.Unlock()
+		l.remove()
 		return err
 	}
 
 	if !fromEtcd {
-		t.q.registerLine(t.name, l.name, l.recycle.String())
+		t.q.registerLine(t.name, l.name, l.getRecycle().String())
 	}
 
 	log.Printf("topic[%s] line[%s:%v] created.", t.name, name, recycle)
+	t.q.emit(LifecycleCreate, t.name, name)
 	return nil
 }
 
 func (t *topic) push(data []byte) error {
-	t.tailLock.Lock()
-	defer t.tailLock.Unlock()
+	e := new(Envelope)
+	e.Data = data
+	return t.pushEnvelope(e)
+}
+
+// pushLocked stores data at the tail, the caller must hold t.tailLock
+func (t *topic) pushLocked(data []byte) error {
+	e := new(Envelope)
+	e.Data = data
+	return t.pushEnvelopeLocked(e)
+}
+
+func (t *topic) pushEnvelopeLocked(e *Envelope) error {
+	err := t.allowPush(1)
+	if err != nil {
+		return err
+	}
+	return t.storeEnvelopeLocked(e)
+}
 
-	key := utils.Acatui(t.name, ":", t.tail)
-	err := t.q.setData(key, data)
+// storeEnvelopeLocked stores e at the tail without the push limit, the
+// caller must hold t.tailLock
+func (t *topic) storeEnvelopeLocked(e *Envelope) error {
+	if e.Pushed == 0 && atomic.LoadInt32(&t.agedLines) > 0 {
+		e.Pushed = t.q.now().UnixNano()
+	}
+	err := t.indexAttrs(t.tail, e.Attrs)
 	if err != nil {
 		return err
 	}
+	err = t.setEnvelope(t.tail, e)
+	if err != nil {
+		t.unindexAttrs(t.tail, e.Attrs)
+		return err
+	}
 	// log.Printf("topic[%s] %s pushed.", t.name, string(data))
 
 	t.tail++
@@ -373,20 +720,128 @@ func (t *topic) push(data []byte) error {
 		return err
 	}
 
+	t.q.audit(AuditPush, t.name, "", t.tail-1)
+	t.touch()
+	t.notifyPushed()
 	return nil
 }
 
-func (t *topic) mPush(datas [][]byte) error {
+func (t *topic) pushEnvelope(e *Envelope) error {
+	err := t.validatePush([][]byte{e.Data}, e.Attrs)
+	if err != nil {
+		return err
+	}
+
+	if t.writes != nil {
+		err = t.allowPush(1)
+		if err != nil {
+			return err
+		}
+		// the caller may reuse data once the push returns
+		buffered := *e
+		buffered.Data = append([]byte(nil), e.Data...)
+		return t.writes.enqueue(asyncWrite{e: &buffered})
+	}
+
 	t.tailLock.Lock()
-	defer t.tailLock.Unlock()
+	err = t.pushEnvelopeLocked(e)
+	due := err == nil && t.countPushes(1)
+	t.tailLock.Unlock()
+
+	return t.flushPushes(due, err)
+}
+
+func (t *topic) pushAndWait(name string, data []byte, timeout time.Duration) error {
+	t.loadLazy(name)
+	t.linesLock.RLock()
+	l, ok := t.lines[name]
+	t.linesLock.RUnlock()
+	if !ok {
+		return utils.NewError(
+			utils.ErrLineNotExisted,
+			`topic pushAndWait`,
+		)
+	}
+	if l.getRecycle() == 0 {
+		// messages of a line without recycle are never confirmed
+		return utils.NewError(
+			utils.ErrBadRequest,
+			`line has no recycle to wait for`,
+		)
+	}
 
+	err := t.validatePush([][]byte{data}, nil)
+	if err != nil {
+		return err
+	}
+
+	// the buffered pushes go first, so the message keeps its order
+	err = t.awaitWrites(false)
+	if err != nil {
+		return err
+	}
+
+	// register the waiter before the message is visible, otherwise a
+	// quick consumer may confirm it before we start waiting
+	t.tailLock.Lock()
+	id := t.tail
+	done := l.addWaiter(id)
+	err = t.pushLocked(data)
+	due := err == nil && t.countPushes(1)
+	t.tailLock.Unlock()
+	err = t.flushPushes(due, err)
+	if err != nil {
+		l.delWaiter(id)
+		return err
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-t.q.opts.Clock.After(timeout):
+		l.delWaiter(id)
+		return utils.NewError(
+			utils.ErrTimeout,
+			`topic pushAndWait`,
+		)
+	}
+}
+
+func (t *topic) mPush(datas [][]byte) ([]uint64, error) {
+	err := t.validatePush(datas, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = t.allowPush(len(datas))
+	if err != nil {
+		return nil, err
+	}
+	// the buffered pushes go first, so the batch keeps its order
+	err = t.awaitWrites(false)
+	if err != nil {
+		return nil, err
+	}
+
+	t.tailLock.Lock()
+	ids, err := t.mPushLocked(datas)
+	due := err == nil && t.countPushes(len(datas))
+	t.tailLock.Unlock()
+
+	return ids, t.flushPushes(due, err)
+}
+
+// mPushLocked stores datas at the tail, the caller must hold t.tailLock
+func (t *topic) mPushLocked(datas [][]byte) ([]uint64, error) {
 	oldTail := t.tail
+	var pushed int64
+	if atomic.LoadInt32(&t.agedLines) > 0 {
+		pushed = t.q.now().UnixNano()
+	}
 	for _, data := range datas {
-		key := utils.Acatui(t.name, ":", t.tail)
-		err := t.q.setData(key, data)
+		err := t.setEnvelope(t.tail, &Envelope{Data: data, Pushed: pushed})
 		if err != nil {
 			t.tail = oldTail
-			return err
+			return nil, err
 		}
 		// log.Printf("topic[%s] %s pushed.", t.name, string(data))
 		t.tail++
@@ -395,43 +850,154 @@ func (t *topic) mPush(datas [][]byte) error {
 	err := t.exportTail()
 	if err != nil {
 		t.tail = oldTail
-		return err
+		return nil, err
 	}
+	t.q.auditPushes(t.name, oldTail, len(datas))
+	t.touch()
+	t.notifyPushed()
 
-	return nil
+	ids := make([]uint64, len(datas))
+	for i := range ids {
+		ids[i] = oldTail + uint64(i)
+	}
+	return ids, nil
 }
 
-func (t *topic) pop(name string) (uint64, []byte, error) {
+// popLine returns the line to pop from, which is created first if it does
+// not exist and the AutoCreateLines option is set. It returns ErrPaused if
+// the topic or the line is paused.
+func (t *topic) popLine(name, op string) (*line, error) {
+	t.touch()
+	t.loadLazy(name)
 	t.linesLock.RLock()
 	l, ok := t.lines[name]
 	t.linesLock.RUnlock()
-	if !ok {
+	if ok {
+		return l, t.checkPaused(l, op)
+	}
+	if !t.q.options().AutoCreateLines || name == "" {
 		// log.Printf("topic[%s] line[%s] not existed.", t.name, name)
-		return 0, nil, utils.NewError(
+		return nil, utils.NewError(
+			utils.ErrLineNotExisted,
+			`topic `+op,
+		)
+	}
+
+	err := t.createLine(name, 0, nil, false, LineConfig{}, false)
+	if err != nil && !isLineExisted(err) {
+		return nil, err
+	}
+
+	t.linesLock.RLock()
+	l, ok = t.lines[name]
+	t.linesLock.RUnlock()
+	if !ok {
+		// removed right after being created
+		return nil, utils.NewError(
 			utils.ErrLineNotExisted,
-			`topic pop`,
+			`topic `+op,
 		)
 	}
+	return l, t.checkPaused(l, op)
+}
+
+func (t *topic) pop(name string) (*Message, error) {
+	l, err := t.popLine(name, "pop")
+	if err != nil {
+		return nil, err
+	}
 
-	return l.pop()
+	m, err := l.pop()
+	if err != nil {
+		return nil, err
+	}
+	t.q.audit(AuditPop, t.name, l.name, m.ID)
+	return t.intercept(l, m)
 }
 
-func (t *topic) mPop(name string, n int) ([]uint64, [][]byte, error) {
+func (t *topic) process(name string, handler func(id uint64, data []byte) error) error {
+	t.touch()
+	t.loadLazy(name)
 	t.linesLock.RLock()
 	l, ok := t.lines[name]
 	t.linesLock.RUnlock()
 	if !ok {
 		// log.Printf("topic[%s] line[%s] not existed.", t.name, name)
-		return nil, nil, utils.NewError(
+		return utils.NewError(
 			utils.ErrLineNotExisted,
-			`topic mPop`,
+			`topic process`,
 		)
 	}
+	err := t.checkPaused(l, "process")
+	if err != nil {
+		return err
+	}
+
+	m, err := l.pop()
+	if err != nil {
+		return err
+	}
+	t.q.audit(AuditPop, t.name, l.name, m.ID)
+	m, err = t.intercept(l, m)
+	if err != nil {
+		return err
+	}
+
+	err = handler(m.ID, m.Data)
+	if l.getRecycle() == 0 {
+		return err
+	}
+	if err != nil {
+		l.requeue(m.ID)
+		return err
+	}
+	return l.confirm(m.ID)
+}
+
+func (t *topic) mPop(name string, n int) ([]uint64, [][]byte, error) {
+	l, err := t.popLine(name, "mPop")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ids, datas, err := l.mPop(n)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, id := range ids {
+		t.q.audit(AuditPop, t.name, l.name, id)
+	}
+	err = t.interceptDatas(l, ids, datas)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ids, datas, nil
+}
 
-	return l.mPop(n)
+func (t *topic) mPopBytes(name string, maxBytes int) ([]Message, error) {
+	l, err := t.popLine(name, "mPopBytes")
+	if err != nil {
+		return nil, err
+	}
+
+	ms, err := l.mPopBytes(maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Message, len(ms))
+	for i, m := range ms {
+		t.q.audit(AuditPop, t.name, l.name, m.ID)
+		m, err = t.intercept(l, m)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = *m
+	}
+	return res, nil
 }
 
 func (t *topic) confirm(name string, id uint64) error {
+	t.loadLazy(name)
 	t.linesLock.RLock()
 	l, ok := t.lines[name]
 	t.linesLock.RUnlock()
@@ -446,7 +1012,41 @@ func (t *topic) confirm(name string, id uint64) error {
 	return l.confirm(id)
 }
 
+// requeue makes the inflight message id of the line the next one to pop.
+// A line without recycle has nothing to requeue, which is an error unless
+// the line has ConfirmNoop, like a confirm.
+func (t *topic) requeue(name string, id uint64) error {
+	t.loadLazy(name)
+	t.linesLock.RLock()
+	l, ok := t.lines[name]
+	t.linesLock.RUnlock()
+	if !ok {
+		return utils.NewError(
+			utils.ErrLineNotExisted,
+			`topic requeue`,
+		)
+	}
+
+	if l.getRecycle() == 0 {
+		if l.getConfig().ConfirmNoop {
+			return nil
+		}
+		return utils.NewError(
+			utils.ErrConfirmNotApplicable,
+			`topic requeue`,
+		)
+	}
+	if !l.requeue(id) {
+		return utils.NewError(
+			utils.ErrNotDelivered,
+			`topic requeue`,
+		)
+	}
+	return nil
+}
+
 func (t *topic) statLine(name string) (*Stat, error) {
+	t.loadLazy(name)
 	t.linesLock.RLock()
 	l, ok := t.lines[name]
 	t.linesLock.RUnlock()
@@ -463,6 +1063,7 @@ func (t *topic) statLine(name string) (*Stat, error) {
 }
 
 func (t *topic) stat() *Stat {
+	t.loadLazyAll()
 	qs := new(Stat)
 	qs.Name = t.name
 	qs.Type = "topic"
@@ -486,78 +1087,145 @@ func (t *topic) stat() *Stat {
 	return qs
 }
 
-func (t *topic) emptyLine(name string) error {
+// snapshotStat returns the stat of the topic and its lines taken at one
+// point, holding all their locks while it is taken
+func (t *topic) snapshotStat() *Stat {
+	t.loadLazyAll()
+	t.linesLock.RLock()
+	defer t.linesLock.RUnlock()
+	for _, l := range t.lines {
+		l.inflightLock.RLock()
+		defer l.inflightLock.RUnlock()
+		l.headLock.RLock()
+		defer l.headLock.RUnlock()
+	}
+	t.headLock.RLock()
+	defer t.headLock.RUnlock()
+	t.tailLock.RLock()
+	defer t.tailLock.RUnlock()
+
+	qs := new(Stat)
+	qs.Name = t.name
+	qs.Type = "topic"
+	qs.Head = t.head
+	qs.Tail = t.tail
+	qs.Count = qs.Tail - qs.Head
+	qs.Lines = make([]*Stat, 0, len(t.lines))
+	for _, l := range t.lines {
+		qs.Lines = append(qs.Lines, l.statLocked(t.tail))
+	}
+	sort.Slice(qs.Lines, func(i, j int) bool { return qs.Lines[i].Name < qs.Lines[j].Name })
+	return qs
+}
+
+func (t *topic) emptyLine(name string, dryRun bool) (*Impact, error) {
+	t.loadLazy(name)
 	t.linesLock.RLock()
 	l, ok := t.lines[name]
 	t.linesLock.RUnlock()
 	if !ok {
 		// log.Printf("topic[%s] line[%s] not existed.", t.name, name)
-		return utils.NewError(
+		return nil, utils.NewError(
 			utils.ErrLineNotExisted,
 			`topic emptyLine`,
 		)
 	}
 
-	return l.empty()
+	return l.empty(dryRun)
 }
 
-func (t *topic) empty() error {
+// empty empties the topic and its lines, or only returns the impact if
+// dryRun is set. The messages from the lowest head of the lines are
+// dropped, all of them if there is no line.
+func (t *topic) empty(dryRun bool) (*Impact, error) {
+	t.loadLazyAll()
 	t.linesLock.RLock()
 	defer t.linesLock.RUnlock()
 
+	im := new(Impact)
+	start := t.getTail()
+	if len(t.lines) == 0 {
+		start = t.getHead()
+	}
 	for _, l := range t.lines {
-		err := l.empty()
+		l.headLock.RLock()
+		if l.head < start {
+			start = l.head
+		}
+		l.headLock.RUnlock()
+
+		li, err := l.empty(dryRun)
 		if err != nil {
 			// log.Printf("topic[%s] line[%s] empty error: %s", t.name, name, err)
-			return err
+			return nil, err
 		}
+		im.addLine(li)
 	}
 
 	t.headLock.Lock()
 	defer t.headLock.Unlock()
 	t.tailLock.RLock()
 	defer t.tailLock.RUnlock()
+	if start < t.tail {
+		im.Messages = t.tail - start
+	}
+	if dryRun {
+		return im, nil
+	}
 	t.head = t.tail
 	err := t.exportHead()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	log.Printf("topic[%s] empty succ", t.name)
-	return nil
+	return im, nil
 }
 
 func (t *topic) close() {
+	t.stopWrites()
 	close(t.quit)
 	t.wg.Wait()
 }
 
-func (t *topic) removeLine(name string, fromEtcd bool) error {
-	t.linesLock.RLock()
-	defer t.linesLock.RUnlock()
+// removeLine removes the line, or only returns the impact if dryRun is set
+func (t *topic) removeLine(name string, fromEtcd, dryRun bool) (*Impact, error) {
+	t.linesLock.Lock()
+	defer t.linesLock.Unlock()
+	if t.lazy[name] {
+		t.loadLazyLocked(name)
+	}
 	l, ok := t.lines[name]
 	if !ok {
 		// log.Printf("topic[%s] line[%s] not existed.", t.name, name)
-		return utils.NewError(
+		return nil, utils.NewError(
 			utils.ErrLineNotExisted,
 			`topic statLine`,
 		)
 	}
 
+	l.inflightLock.RLock()
+	l.headLock.RLock()
+	im := l.impact(t.getTail(), true)
+	l.headLock.RUnlock()
+	l.inflightLock.RUnlock()
+	if dryRun {
+		return im, nil
+	}
+
 	delete(t.lines, name)
 	err := t.exportTopic()
 	if err != nil {
-		t.linesLock.Lock()
 		t.lines[name] = l
-		t.linesLock.Unlock()
-		return err
+		return nil, err
 	}
 
 	if !fromEtcd {
 		t.q.unRegisterLine(t.name, name)
 	}
+	t.q.emit(LifecycleRemove, t.name, name)
 
-	return l.remove()
+	return im, l.remove()
 }
 
 func (t *topic) removeLines() error {
@@ -575,11 +1243,14 @@ func (t *topic) removeLines() error {
 }
 
 func (t *topic) removeMsgData() error {
+	err := t.removeAttrsData()
+	if err != nil {
+		log.Printf("topic[%s] remove attrs error; %s", t.name, err)
+	}
 	for i := t.head; i < t.tail; i++ {
-		key := utils.Acatui(t.name, ":", i)
-		err := t.q.delData(key)
+		err := t.deleteMessage(i)
 		if err != nil {
-			log.Printf("topic[%s] del data[%s] error; %s", t.name, key, err)
+			log.Printf("topic[%s] del data[%s] error; %s", t.name, t.messageKey(i), err)
 			continue
 		}
 	}
@@ -592,6 +1263,7 @@ func (t *topic) remove() error {
 	t.linesLock.Lock()
 	defer t.linesLock.Unlock()
 
+	t.loadLazyAllLocked()
 	err := t.removeLines()
 	if err != nil {
 		log.Printf("topic[%s] removeLines error: %s", t.name, err)
@@ -616,6 +1288,11 @@ func (t *topic) remove() error {
 		log.Printf("topic[%s] removeTopicData error: %s", t.name, err)
 	}
 
+	err = t.removeConfigData()
+	if err != nil {
+		log.Printf("topic[%s] removeConfigData error: %s", t.name, err)
+	}
+
 	err = t.removeMsgData()
 	if err != nil {
 		log.Printf("topic[%s] removeMsgData error: %s", t.name, err)
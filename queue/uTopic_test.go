@@ -0,0 +1,335 @@
+package queue
+
+import (
+	"errors"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buaazp/uq/store"
+	"github.com/buaazp/uq/utils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// flakyStore is a storage whose Set fails for the next fails calls
+type flakyStore struct {
+	store.Storage
+	mu    sync.Mutex
+	fails int
+}
+
+func (f *flakyStore) setFails(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fails = n
+}
+
+func (f *flakyStore) Set(key string, data []byte) error {
+	f.mu.Lock()
+	if f.fails > 0 {
+		f.fails--
+		f.mu.Unlock()
+		return errors.New("flaky set")
+	}
+	f.mu.Unlock()
+	return f.Storage.Set(key, data)
+}
+
+func TestBackupLinesRetry(t *testing.T) {
+	Convey("Test Background Backup Retries Failed Lines", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		fs := &flakyStore{Storage: mdb}
+
+		var failed []string
+		opts := &Options{
+			OnExportError: func(topicName, lineName string, err error) {
+				failed = append(failed, topicName+"/"+lineName)
+			},
+		}
+		fq, err := NewUnitedQueueWithOptions(fs, "127.0.0.1", 9689, nil, "uq", opts)
+		So(err, ShouldBeNil)
+		defer fq.Close()
+
+		So(fq.Create("foo", ""), ShouldBeNil)
+		So(fq.Create("foo/x", "10s"), ShouldBeNil)
+		tp := fq.topics["foo"]
+
+		fs.setFails(2)
+		quit := tp.backupLines()
+		So(quit, ShouldBeFalse)
+		So(len(failed), ShouldEqual, 0)
+
+		fs.setFails(100)
+		quit = tp.backupLines()
+		So(quit, ShouldBeFalse)
+		So(len(failed), ShouldEqual, 1)
+		So(failed[0], ShouldEqual, "foo/x")
+		fs.setFails(0)
+	})
+}
+
+func TestMaxLinesPerTopic(t *testing.T) {
+	Convey("Test Lines Limit of a Topic", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		opts := &Options{MaxLinesPerTopic: 2}
+		lq, err := NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", opts)
+		So(err, ShouldBeNil)
+		defer lq.Close()
+
+		So(lq.Create("foo", ""), ShouldBeNil)
+		So(lq.Create("foo/x", ""), ShouldBeNil)
+		So(lq.Create("foo/y", ""), ShouldBeNil)
+
+		err = lq.Create("foo/z", "")
+		So(err, ShouldNotBeNil)
+		So(errorCode(err), ShouldEqual, utils.ErrTooManyLines)
+
+		So(lq.Remove("foo/y"), ShouldBeNil)
+		So(lq.Create("foo/z", ""), ShouldBeNil)
+	})
+}
+
+func TestLineIdleExpire(t *testing.T) {
+	Convey("Test Idle Lines Are Expired", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		clock := newFakeClock()
+		opts := &Options{Clock: clock, LineIdleExpire: time.Hour}
+		eq, err := NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", opts)
+		So(err, ShouldBeNil)
+		defer eq.Close()
+
+		So(eq.Create("foo", ""), ShouldBeNil)
+		So(eq.Create("foo/x", "1m"), ShouldBeNil)
+		So(eq.Create("foo/y", ""), ShouldBeNil)
+		So(eq.Push("foo", []byte("bar")), ShouldBeNil)
+		tp := eq.topics["foo"]
+
+		clock.Advance(30 * time.Minute)
+		id, _, err := eq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(eq.Confirm(id), ShouldBeNil)
+
+		qs, err := eq.Stat("foo/x")
+		So(err, ShouldBeNil)
+		So(qs.LastPop, ShouldEqual, clock.Now().Format(time.RFC3339Nano))
+		So(qs.LastConfirm, ShouldEqual, clock.Now().Format(time.RFC3339Nano))
+		ls := tp.lines["x"].genLineStore()
+		So(ls.LastPop, ShouldEqual, clock.Now().UnixNano())
+
+		clock.Advance(31 * time.Minute)
+		tp.expireLines()
+		_, err = eq.Stat("foo/y")
+		So(err, ShouldNotBeNil)
+		_, err = eq.Stat("foo/x")
+		So(err, ShouldBeNil)
+
+		clock.Advance(30 * time.Minute)
+		tp.expireLines()
+		_, err = eq.Stat("foo/x")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestPopLostMessage(t *testing.T) {
+	Convey("Test Pop Skips a Lost Message", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		opts := &Options{DeadLetterTopic: "dead"}
+		dq, err := NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", opts)
+		So(err, ShouldBeNil)
+		defer dq.Close()
+
+		So(dq.Create("dead", ""), ShouldBeNil)
+		So(dq.Create("dead/x", ""), ShouldBeNil)
+		So(dq.Create("foo", ""), ShouldBeNil)
+		So(dq.Create("foo/x", "1m"), ShouldBeNil)
+		_, err = dq.PushBatch("foo", [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+		So(err, ShouldBeNil)
+
+		So(mdb.Del(dq.topics["foo"].messageKey(0)), ShouldBeNil)
+		key, data, err := dq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(key, ShouldEqual, "foo/x/1")
+		So(string(data), ShouldEqual, "b")
+
+		_, data, err = dq.Pop("dead/x")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "foo/x/0")
+
+		So(mdb.Del(dq.topics["foo"].messageKey(2)), ShouldBeNil)
+		_, _, err = dq.Pop("foo/x")
+		So(err, ShouldNotBeNil)
+		So(errorCode(err), ShouldEqual, utils.ErrNone)
+
+		So(dq.Confirm(key), ShouldBeNil)
+		qs, err := dq.Stat("foo/x")
+		So(err, ShouldBeNil)
+		So(qs.Head, ShouldEqual, 3)
+		So(qs.IHead, ShouldEqual, 3)
+	})
+}
+
+func TestTopicStartTwice(t *testing.T) {
+	Convey("Test Starting a Running Topic", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		sq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer sq.Close()
+
+		So(sq.Create("foo", ""), ShouldBeNil)
+		tp := sq.topics["foo"]
+		So(tp.running, ShouldBeTrue)
+
+		before := runtime.NumGoroutine()
+		tp.start()
+		time.Sleep(10 * time.Millisecond)
+		So(runtime.NumGoroutine(), ShouldBeLessThanOrEqualTo, before)
+	})
+}
+
+func TestPersistEvery(t *testing.T) {
+	Convey("Test Persist the Topic Every N Pushes", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		opts := &Options{PersistEvery: 2}
+		pq, err := NewUnitedQueueWithOptions(mdb, "127.0.0.1", 9689, nil, "uq", opts)
+		So(err, ShouldBeNil)
+		defer pq.Close()
+
+		So(pq.Create("foo", ""), ShouldBeNil)
+		So(pq.Create("foo/x", "1m"), ShouldBeNil)
+		So(pq.Push("foo", []byte("a")), ShouldBeNil)
+		_, _, err = pq.Pop("foo/x")
+		So(err, ShouldBeNil)
+
+		lineKey := pq.keys.line("foo", "x")
+		loadLine := func() *UnitedLineStore {
+			data, err := mdb.Get(lineKey)
+			So(err, ShouldBeNil)
+			ls := new(UnitedLineStore)
+			So(ls.Unmarshal(data), ShouldBeNil)
+			return ls
+		}
+		So(loadLine().Head, ShouldEqual, 0)
+
+		So(pq.Push("foo", []byte("b")), ShouldBeNil)
+		So(loadLine().Head, ShouldEqual, 1)
+
+		_, _, err = pq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		_, err = pq.PushBatch("foo", [][]byte{[]byte("c"), []byte("d")})
+		So(err, ShouldBeNil)
+		So(loadLine().Head, ShouldEqual, 2)
+	})
+}
+
+// busyStore is a storage which counts the Sets running at once
+type busyStore struct {
+	store.Storage
+	mu      sync.Mutex
+	running int
+	max     int
+}
+
+func (b *busyStore) Set(key string, data []byte) error {
+	b.mu.Lock()
+	b.running++
+	if b.running > b.max {
+		b.max = b.running
+	}
+	b.mu.Unlock()
+
+	time.Sleep(time.Millisecond)
+	err := b.Storage.Set(key, data)
+
+	b.mu.Lock()
+	b.running--
+	b.mu.Unlock()
+	return err
+}
+
+func (b *busyStore) maxRunning() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.max
+}
+
+func TestMaintenanceWorkers(t *testing.T) {
+	Convey("Test Background Work Is Bounded by the Workers", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		bdb := &busyStore{Storage: mdb}
+		opts := &Options{
+			MaintenanceWorkers: 2,
+			BackupInterval:     5 * time.Millisecond,
+		}
+		mq, err := NewUnitedQueueWithOptions(bdb, "127.0.0.1", 9689, nil, "uq", opts)
+		So(err, ShouldBeNil)
+		So(mq.Reconfigure(Options{MaintenanceWorkers: 3}), ShouldNotBeNil)
+
+		for i := 0; i < 20; i++ {
+			name := "foo" + strconv.Itoa(i)
+			So(mq.Create(name, ""), ShouldBeNil)
+			So(mq.Create(name+"/x", ""), ShouldBeNil)
+		}
+		bdb.mu.Lock()
+		bdb.max = 0
+		bdb.mu.Unlock()
+
+		time.Sleep(100 * time.Millisecond)
+		max := bdb.maxRunning()
+		So(max, ShouldBeGreaterThan, 0)
+		So(max, ShouldBeLessThanOrEqualTo, 2)
+		So(mq.Close(), ShouldBeNil)
+	})
+}
+
+func TestConfirmAdvancesIHead(t *testing.T) {
+	Convey("Test Confirming the Oldest Advances the Confirmed Head", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		cq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer cq.Close()
+
+		So(cq.Create("foo", ""), ShouldBeNil)
+		So(cq.Create("foo/x", "1m"), ShouldBeNil)
+		_, err = cq.PushBatch("foo", [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")})
+		So(err, ShouldBeNil)
+		keys := make([]string, 3)
+		for i := range keys {
+			keys[i], _, err = cq.Pop("foo/x")
+			So(err, ShouldBeNil)
+		}
+
+		So(cq.Confirm(keys[2]), ShouldBeNil)
+		So(cq.Confirm(keys[1]), ShouldBeNil)
+		qs, err := cq.Stat("foo/x")
+		So(err, ShouldBeNil)
+		So(qs.IHead, ShouldEqual, 0)
+
+		So(cq.Confirm(keys[0]), ShouldBeNil)
+		qs, err = cq.Stat("foo/x")
+		So(err, ShouldBeNil)
+		So(qs.IHead, ShouldEqual, 3)
+		l := cq.topics["foo"].lines["x"]
+		So(l.imap, ShouldBeEmpty)
+
+		ft := cq.topics["foo"]
+		So(ft.exportLines(), ShouldBeNil)
+		data, err := mdb.Get(l.storeKey)
+		So(err, ShouldBeNil)
+		var ls UnitedLineStore
+		So(ls.Unmarshal(data), ShouldBeNil)
+		So(ls.Ihead, ShouldEqual, 3)
+
+		ft.clean()
+		So(ft.getHead(), ShouldEqual, 3)
+	})
+}
@@ -0,0 +1,173 @@
+package queue
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/buaazp/uq/utils"
+)
+
+// Problem is an inconsistency of the storage found by Validate
+type Problem struct {
+	// Topic is the name of the topic
+	Topic string
+	// Line is the name of the line, empty for the problems of the topic
+	Line string
+	// Desc describes the inconsistency
+	Desc string
+}
+
+func (p Problem) String() string {
+	name := p.Topic
+	if p.Line != "" {
+		name += "/" + p.Line
+	}
+	return name + ": " + p.Desc
+}
+
+type problems []Problem
+
+func (ps *problems) add(topicName, lineName, format string, args ...interface{}) {
+	*ps = append(*ps, Problem{
+		Topic: topicName,
+		Line:  lineName,
+		Desc:  fmt.Sprintf(format, args...),
+	})
+}
+
+// Validate checks the invariants of the data in the storage and reports
+// every violation. It reads the state as it was last exported and never
+// changes anything.
+func (u *UnitedQueue) Validate() []Problem {
+	var ps problems
+
+	data, err := u.getData(storageKeyWord)
+	if err != nil {
+		if !isDataNotExisted(err) {
+			ps.add("", "", "queue store unreadable: %s", err)
+		}
+		return ps
+	}
+	var qs UnitedQueueStore
+	err = qs.Unmarshal(data)
+	if err != nil {
+		ps.add("", "", "queue store corrupted: %s", err)
+		return ps
+	}
+
+	for _, topicName := range qs.Topics {
+		u.validateTopic(topicName, &ps)
+	}
+	return ps
+}
+
+// CheckSequence returns the ids between the head and the tail of the topic
+// which have no message in the storage. It never changes anything.
+func (u *UnitedQueue) CheckSequence(topicName string) ([]uint64, error) {
+	topicName = u.trimKey(topicName)
+
+	t, ok := u.getTopic(topicName)
+	if !ok {
+		return nil, utils.NewError(
+			utils.ErrTopicNotExisted,
+			`queue checkSequence`,
+		)
+	}
+
+	// hold the head so the clean does not delete messages under the check
+	t.headLock.RLock()
+	defer t.headLock.RUnlock()
+
+	var gaps []uint64
+	tail := t.getTail()
+	for id := t.head; id < tail; id++ {
+		ok, err := t.hasMessage(id)
+		if err != nil {
+			return gaps, err
+		}
+		if !ok {
+			gaps = append(gaps, id)
+		}
+	}
+	return gaps, nil
+}
+
+func (u *UnitedQueue) validateTopic(topicName string, ps *problems) {
+	data, err := u.getData(u.keys.topic(topicName))
+	if err != nil {
+		ps.add(topicName, "", "topic store unreadable: %s", err)
+		return
+	}
+	var ts UnitedTopicStore
+	err = ts.Unmarshal(data)
+	if err != nil {
+		ps.add(topicName, "", "topic store corrupted: %s", err)
+		return
+	}
+
+	head, okHead := u.validateOffset(topicName, u.keys.topicHead(topicName), ps)
+	tail, okTail := u.validateOffset(topicName, u.keys.topicTail(topicName), ps)
+	if !okHead || !okTail {
+		return
+	}
+	if head > tail {
+		ps.add(topicName, "", "head %d is above tail %d", head, tail)
+	}
+
+	for _, lineName := range ts.Lines {
+		u.validateLine(topicName, lineName, head, tail, ps)
+	}
+}
+
+func (u *UnitedQueue) validateOffset(topicName, key string, ps *problems) (uint64, bool) {
+	data, err := u.getData(key)
+	if err != nil {
+		ps.add(topicName, "", "%s unreadable: %s", key, err)
+		return 0, false
+	}
+	if len(data) != 8 {
+		ps.add(topicName, "", "%s has %d bytes", key, len(data))
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(data), true
+}
+
+func (u *UnitedQueue) validateLine(topicName, lineName string, head, tail uint64, ps *problems) {
+	data, err := u.getData(u.keys.line(topicName, lineName))
+	if err != nil {
+		ps.add(topicName, lineName, "line store unreadable: %s", err)
+		return
+	}
+	var ls UnitedLineStore
+	err = ls.Unmarshal(data)
+	if err != nil {
+		ps.add(topicName, lineName, "line store corrupted: %s", err)
+		return
+	}
+
+	recycleData, err := u.getData(u.keys.lineRecycle(topicName, lineName))
+	if err != nil {
+		ps.add(topicName, lineName, "recycle unreadable: %s", err)
+	} else if _, err := time.ParseDuration(string(recycleData)); err != nil {
+		ps.add(topicName, lineName, "recycle corrupted: %s", err)
+	}
+
+	// a LIFO line has inflights above its head
+	_, err = u.getData(u.keys.lineLifo(topicName, lineName))
+	lifo := err == nil
+
+	if ls.Head < head || ls.Head > tail {
+		ps.add(topicName, lineName, "head %d is out of [%d, %d]", ls.Head, head, tail)
+	}
+	if ls.Ihead > ls.Head {
+		ps.add(topicName, lineName, "ihead %d is above head %d", ls.Ihead, ls.Head)
+	}
+	for _, msg := range ls.Inflights {
+		if msg.Tid < head {
+			ps.add(topicName, lineName, "inflight %d is below topic head %d", msg.Tid, head)
+		} else if msg.Tid >= ls.Head && !lifo {
+			ps.add(topicName, lineName, "inflight %d is not below line head %d", msg.Tid, ls.Head)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package queue
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/buaazp/uq/store"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestValidate(t *testing.T) {
+	Convey("Test Validate the Storage", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		vq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer vq.Close()
+
+		So(len(vq.Validate()), ShouldEqual, 0)
+
+		So(vq.Create("foo", ""), ShouldBeNil)
+		So(vq.Create("foo/x", "1m"), ShouldBeNil)
+		So(vq.Create("foo/y", ""), ShouldBeNil)
+		So(vq.Create("bar", ""), ShouldBeNil)
+		So(vq.Push("foo", []byte("a")), ShouldBeNil)
+		_, _, err = vq.Pop("foo/x")
+		So(err, ShouldBeNil)
+		So(vq.exportTopics(), ShouldBeNil)
+		So(len(vq.Validate()), ShouldEqual, 0)
+
+		head := make([]byte, 8)
+		binary.LittleEndian.PutUint64(head, 1)
+		So(mdb.Set(vq.keys.topicHead("foo"), head), ShouldBeNil)
+		So(mdb.Del(vq.keys.line("foo", "y")), ShouldBeNil)
+		So(mdb.Del(vq.keys.topic("bar")), ShouldBeNil)
+
+		ps := vq.Validate()
+		So(len(ps), ShouldEqual, 3)
+		found := make(map[string]bool)
+		for _, p := range ps {
+			found[p.Topic+"/"+p.Line] = true
+		}
+		So(found["foo/x"], ShouldBeTrue)
+		So(found["foo/y"], ShouldBeTrue)
+		So(found["bar/"], ShouldBeTrue)
+		So(Problem{"foo", "x", "inflight 0 is below topic head 1"}.String(), ShouldEqual, "foo/x: inflight 0 is below topic head 1")
+	})
+}
+
+func TestCheckSequence(t *testing.T) {
+	Convey("Test Check the Sequence of a Topic", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		sq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer sq.Close()
+
+		_, err = sq.CheckSequence("foo")
+		So(err, ShouldNotBeNil)
+
+		So(sq.Create("foo", ""), ShouldBeNil)
+		_, err = sq.PushBatch("foo", [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")})
+		So(err, ShouldBeNil)
+		gaps, err := sq.CheckSequence("foo")
+		So(err, ShouldBeNil)
+		So(gaps, ShouldBeEmpty)
+
+		So(mdb.Del(sq.topics["foo"].messageKey(1)), ShouldBeNil)
+		So(mdb.Del(sq.topics["foo"].messageKey(3)), ShouldBeNil)
+		gaps, err = sq.CheckSequence("foo")
+		So(err, ShouldBeNil)
+		So(gaps, ShouldResemble, []uint64{1, 3})
+	})
+}
@@ -0,0 +1,91 @@
+package queue
+
+import (
+	"github.com/buaazp/uq/utils"
+)
+
+// weight returns the Weight of the line, 1 if it is not set
+func (l *line) weight() int {
+	w := l.getConfig().Weight
+	if w <= 0 {
+		return 1
+	}
+	return w
+}
+
+// PopWeighted pops a message from one of the lines of the targets
+// "topic/line" and returns the target with the message. The lines with
+// messages are served in proportion to their Weight over the calls, by a
+// smooth weighted round robin, so a line of weight 3 gets about three pops
+// for every pop of a line of weight 1 while both have messages. An empty
+// line is skipped without losing its turn. It returns ErrNone if every line
+// is empty.
+func (u *UnitedQueue) PopWeighted(targets []string) (string, *Message, error) {
+	if len(targets) == 0 {
+		return "", nil, utils.NewError(
+			utils.ErrBadRequest,
+			`pop weighted no targets`,
+		)
+	}
+	err := u.checkWritable("popWeighted")
+	if err != nil {
+		return "", nil, err
+	}
+	lines := make([]*line, len(targets))
+	for i, target := range targets {
+		t, lName, err := u.lineTopic(target, "popWeighted")
+		if err != nil {
+			return "", nil, u.wrapError("popWeighted", target, err)
+		}
+		lines[i], err = t.popLine(lName, "popWeighted")
+		if err != nil {
+			return "", nil, u.wrapError("popWeighted", target, err)
+		}
+	}
+
+	u.weightedLock.Lock()
+	defer u.weightedLock.Unlock()
+	weights := make([]int, len(lines))
+	for i, l := range lines {
+		weights[i] = l.weight()
+	}
+	left := make([]bool, len(lines))
+	for i := range left {
+		left[i] = true
+	}
+	for n := len(lines); n > 0; n-- {
+		total := 0
+		best := -1
+		for i, l := range lines {
+			if !left[i] {
+				continue
+			}
+			total += weights[i]
+			l.weighted += weights[i]
+			if best < 0 || l.weighted > lines[best].weighted {
+				best = i
+			}
+		}
+
+		m, err := u.PopMessage(targets[best])
+		if err == nil {
+			lines[best].weighted -= total
+			return targets[best], m, nil
+		}
+		e, ok := utils.AsError(err)
+		if !ok || e.ErrorCode != utils.ErrNone {
+			return "", nil, err
+		}
+		// the round is taken back, as if the empty line was not there
+		for i, l := range lines {
+			if left[i] {
+				l.weighted -= weights[i]
+			}
+		}
+		left[best] = false
+	}
+	return "", nil, utils.NewError(
+		utils.ErrNone,
+		`queue popWeighted`,
+	)
+}
@@ -0,0 +1,51 @@
+package queue
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/buaazp/uq/store"
+	"github.com/buaazp/uq/utils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPopWeighted(t *testing.T) {
+	Convey("Test Pop the Lines in Proportion to Their Weights", t, func() {
+		mdb, err := store.NewMemStore()
+		So(err, ShouldBeNil)
+		wq, err := NewUnitedQueue(mdb, "127.0.0.1", 9689, nil, "uq")
+		So(err, ShouldBeNil)
+		defer wq.Close()
+
+		for _, key := range []string{"foo", "foo/a", "bar", "bar/b", "baz", "baz/c"} {
+			So(wq.Create(key, ""), ShouldBeNil)
+		}
+		So(wq.ConfigureLine("foo/a", LineConfig{Weight: 3}), ShouldBeNil)
+		So(wq.ConfigureLine("baz/c", LineConfig{Weight: 5}), ShouldBeNil)
+		So(errorCode(wq.ConfigureLine("bar/b", LineConfig{Weight: -1})), ShouldEqual, utils.ErrBadRequest)
+		for i := 0; i < 8; i++ {
+			So(wq.Push("foo", []byte("a")), ShouldBeNil)
+			So(wq.Push("bar", []byte("b")), ShouldBeNil)
+		}
+
+		targets := []string{"foo/a", "bar/b", "baz/c"}
+		var got []string
+		for i := 0; i < 12; i++ {
+			target, m, err := wq.PopWeighted(targets)
+			So(err, ShouldBeNil)
+			So(string(m.Data), ShouldEqual, target[len(target)-1:])
+			got = append(got, string(m.Data))
+		}
+		// baz/c is empty and skipped
+		So(strings.Join(got, ""), ShouldEqual, "aabaaabaaabb")
+
+		for i := 0; i < 4; i++ {
+			_, _, err = wq.PopWeighted(targets)
+			So(err, ShouldBeNil)
+		}
+		_, _, err = wq.PopWeighted(targets)
+		So(errorCode(err), ShouldEqual, utils.ErrNone)
+		_, _, err = wq.PopWeighted([]string{"foo/x"})
+		So(errorCode(err), ShouldEqual, utils.ErrLineNotExisted)
+	})
+}
@@ -0,0 +1,136 @@
+package queue
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"time"
+)
+
+const (
+	// MaxWireFrame is the largest body of a frame DecodeMessage accepts,
+	// so a bad length does not allocate a huge buffer
+	MaxWireFrame   int = 64 << 20
+	wireHeaderSize     = 4
+)
+
+// EncodeMessage writes m to w as one frame for the network entry points. A
+// frame is a 4 bytes big endian length of the body, and the body is the
+// uvarint ID, the Key, the uvarint Delivered, the varint unix nano Deadline
+// (0 for never), the uvarint count of the Attrs followed by their names and
+// values sorted by name, and the Data to the end. Every string is prefixed
+// by its uvarint length. The frame is written with a single Write.
+func EncodeMessage(w io.Writer, m *Message) error {
+	names := make([]string, 0, len(m.Attrs))
+	size := wireHeaderSize + 4*binary.MaxVarintLen64 + len(m.Key) + len(m.Data)
+	for name, value := range m.Attrs {
+		names = append(names, name)
+		size += 2*binary.MaxVarintLen64 + len(name) + len(value)
+	}
+	sort.Strings(names)
+
+	var deadline int64
+	if !m.Deadline.IsZero() {
+		deadline = m.Deadline.UnixNano()
+	}
+
+	buf := make([]byte, size)
+	i := wireHeaderSize
+	i += binary.PutUvarint(buf[i:], m.ID)
+	i += putWireString(buf[i:], m.Key)
+	i += binary.PutUvarint(buf[i:], uint64(m.Delivered))
+	i += binary.PutVarint(buf[i:], deadline)
+	i += binary.PutUvarint(buf[i:], uint64(len(names)))
+	for _, name := range names {
+		i += putWireString(buf[i:], name)
+		i += putWireString(buf[i:], m.Attrs[name])
+	}
+	i += copy(buf[i:], m.Data)
+
+	if i-wireHeaderSize > MaxWireFrame {
+		return errors.New("wire: message too large")
+	}
+	binary.BigEndian.PutUint32(buf, uint32(i-wireHeaderSize))
+	_, err := w.Write(buf[:i])
+	return err
+}
+
+func putWireString(buf []byte, s string) int {
+	n := binary.PutUvarint(buf, uint64(len(s)))
+	return n + copy(buf[n:], s)
+}
+
+// DecodeMessage reads a frame written by EncodeMessage from r. It returns
+// io.EOF if r ends before the frame, and io.ErrUnexpectedEOF if it ends in
+// the middle of it.
+func DecodeMessage(r io.Reader) (*Message, error) {
+	var header [wireHeaderSize]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if uint64(size) > uint64(MaxWireFrame) {
+		return nil, errors.New("wire: frame too large")
+	}
+	body := make([]byte, size)
+	_, err = io.ReadFull(r, body)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(Message)
+	i := 0
+	id, n := binary.Uvarint(body)
+	if n <= 0 {
+		return nil, errors.New("wire: short id")
+	}
+	m.ID = id
+	i += n
+	m.Key, n, err = readBinaryString(body[i:])
+	if err != nil {
+		return nil, errors.New("wire: short key")
+	}
+	i += n
+	delivered, n := binary.Uvarint(body[i:])
+	if n <= 0 {
+		return nil, errors.New("wire: short delivered")
+	}
+	m.Delivered = uint32(delivered)
+	i += n
+	deadline, n := binary.Varint(body[i:])
+	if n <= 0 {
+		return nil, errors.New("wire: short deadline")
+	}
+	if deadline != 0 {
+		m.Deadline = time.Unix(0, deadline)
+	}
+	i += n
+	count, n := binary.Uvarint(body[i:])
+	if n <= 0 {
+		return nil, errors.New("wire: short attrs")
+	}
+	i += n
+	if count > 0 {
+		m.Attrs = make(map[string]string)
+	}
+	for j := uint64(0); j < count; j++ {
+		name, n, err := readBinaryString(body[i:])
+		if err != nil {
+			return nil, errors.New("wire: short attrs")
+		}
+		i += n
+		value, n, err := readBinaryString(body[i:])
+		if err != nil {
+			return nil, errors.New("wire: short attrs")
+		}
+		i += n
+		m.Attrs[name] = value
+	}
+	m.Data = body[i:]
+	return m, nil
+}
@@ -0,0 +1,65 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWireMessage(t *testing.T) {
+	Convey("Test Messages Round Trip the Wire Format", t, func() {
+		deadline := time.Unix(1420070400, 123)
+		ms := []*Message{
+			{ID: 7, Key: "foo/x/7", Data: []byte("bar"), Delivered: 2, Deadline: deadline, Attrs: map[string]string{"a": "1", "b": ""}},
+			{ID: 0, Key: "", Data: nil},
+		}
+		var buf bytes.Buffer
+		for _, m := range ms {
+			So(EncodeMessage(&buf, m), ShouldBeNil)
+		}
+
+		m, err := DecodeMessage(&buf)
+		So(err, ShouldBeNil)
+		So(m.ID, ShouldEqual, 7)
+		So(m.Key, ShouldEqual, "foo/x/7")
+		So(string(m.Data), ShouldEqual, "bar")
+		So(m.Delivered, ShouldEqual, 2)
+		So(m.Deadline.Equal(deadline), ShouldBeTrue)
+		So(m.Attrs, ShouldResemble, map[string]string{"a": "1", "b": ""})
+
+		m, err = DecodeMessage(&buf)
+		So(err, ShouldBeNil)
+		So(m.ID, ShouldEqual, 0)
+		So(m.Data, ShouldBeEmpty)
+		So(m.Deadline.IsZero(), ShouldBeTrue)
+		So(m.Attrs, ShouldBeNil)
+
+		_, err = DecodeMessage(&buf)
+		So(err, ShouldEqual, io.EOF)
+	})
+
+	Convey("Test Bad Frames Are Rejected", t, func() {
+		var buf bytes.Buffer
+		So(EncodeMessage(&buf, &Message{ID: 1, Key: "foo/x/1", Data: []byte("bar")}), ShouldBeNil)
+		frame := buf.Bytes()
+
+		_, err := DecodeMessage(bytes.NewReader(frame[:len(frame)-1]))
+		So(err, ShouldEqual, io.ErrUnexpectedEOF)
+		_, err = DecodeMessage(bytes.NewReader(frame[:2]))
+		So(err, ShouldEqual, io.ErrUnexpectedEOF)
+
+		huge := make([]byte, 4)
+		binary.BigEndian.PutUint32(huge, uint32(MaxWireFrame+1))
+		_, err = DecodeMessage(bytes.NewReader(huge))
+		So(err, ShouldNotBeNil)
+
+		// the key claims more than the body
+		short := []byte{0, 0, 0, 2, 1, 9}
+		_, err = DecodeMessage(bytes.NewReader(short))
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -41,6 +41,7 @@ func (*UnitedQueueStore) ProtoMessage()    {}
 type UnitedTopicStore struct {
 	Lines            []string `protobuf:"bytes,1,rep" json:"Lines,omitempty"`
 	Persist          bool     `protobuf:"varint,2,req" json:"Persist"`
+	IdleExpire       int64    `protobuf:"varint,3,opt" json:"IdleExpire"`
 	XXX_unrecognized []byte   `json:"-"`
 }
 
@@ -51,6 +52,7 @@ func (*UnitedTopicStore) ProtoMessage()    {}
 type InflightMessage struct {
 	Tid              uint64 `protobuf:"varint,1,req" json:"Tid"`
 	Exptime          int64  `protobuf:"varint,2,req" json:"Exptime"`
+	Delivered        uint32 `protobuf:"varint,3,opt" json:"Delivered"`
 	XXX_unrecognized []byte `json:"-"`
 }
 
@@ -62,6 +64,8 @@ type UnitedLineStore struct {
 	Head             uint64             `protobuf:"varint,1,req" json:"Head"`
 	Ihead            uint64             `protobuf:"varint,2,req" json:"Ihead"`
 	Inflights        []*InflightMessage `protobuf:"bytes,3,rep" json:"Inflights,omitempty"`
+	LastPop          int64              `protobuf:"varint,4,opt" json:"LastPop"`
+	LastConfirm      int64              `protobuf:"varint,5,opt" json:"LastConfirm"`
 	XXX_unrecognized []byte             `json:"-"`
 }
 
@@ -143,6 +147,9 @@ func (m *UnitedTopicStore) MarshalTo(data []byte) (int, error) {
 		data[i] = 0
 	}
 	i++
+	data[i] = 0x18
+	i++
+	i = encodeVarintUq(data, i, uint64(m.IdleExpire))
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
@@ -170,6 +177,9 @@ func (m *InflightMessage) MarshalTo(data []byte) (int, error) {
 	data[i] = 0x10
 	i++
 	i = encodeVarintUq(data, i, uint64(m.Exptime))
+	data[i] = 0x18
+	i++
+	i = encodeVarintUq(data, i, uint64(m.Delivered))
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
@@ -209,6 +219,12 @@ func (m *UnitedLineStore) MarshalTo(data []byte) (int, error) {
 			i += n
 		}
 	}
+	data[i] = 0x20
+	i++
+	i = encodeVarintUq(data, i, uint64(m.LastPop))
+	data[i] = 0x28
+	i++
+	i = encodeVarintUq(data, i, uint64(m.LastConfirm))
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
@@ -267,6 +283,7 @@ func (m *UnitedTopicStore) Size() (n int) {
 		}
 	}
 	n += 2
+	n += 1 + sovUq(uint64(m.IdleExpire))
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -278,6 +295,7 @@ func (m *InflightMessage) Size() (n int) {
 	_ = l
 	n += 1 + sovUq(uint64(m.Tid))
 	n += 1 + sovUq(uint64(m.Exptime))
+	n += 1 + sovUq(uint64(m.Delivered))
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -295,6 +313,8 @@ func (m *UnitedLineStore) Size() (n int) {
 			n += 1 + l + sovUq(uint64(l))
 		}
 	}
+	n += 1 + sovUq(uint64(m.LastPop))
+	n += 1 + sovUq(uint64(m.LastConfirm))
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -448,6 +468,22 @@ func (m *UnitedTopicStore) Unmarshal(data []byte) error {
 			}
 			m.Persist = bool(v != 0)
 			hasFields[0] |= uint64(0x00000001)
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field IdleExpire", wireType)
+			}
+			m.IdleExpire = 0
+			for shift := uint(0); ; shift += 7 {
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				m.IdleExpire |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			var sizeOfWire int
 			for {
@@ -532,6 +568,22 @@ func (m *InflightMessage) Unmarshal(data []byte) error {
 				}
 			}
 			hasFields[0] |= uint64(0x00000002)
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Delivered", wireType)
+			}
+			m.Delivered = 0
+			for shift := uint(0); ; shift += 7 {
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				m.Delivered |= (uint32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			var sizeOfWire int
 			for {
@@ -647,6 +699,38 @@ func (m *UnitedLineStore) Unmarshal(data []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field LastPop", wireType)
+			}
+			m.LastPop = 0
+			for shift := uint(0); ; shift += 7 {
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				m.LastPop |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field LastConfirm", wireType)
+			}
+			m.LastConfirm = 0
+			for shift := uint(0); ; shift += 7 {
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				m.LastConfirm |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			var sizeOfWire int
 			for {
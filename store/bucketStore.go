@@ -0,0 +1,134 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// MaxBuckets is the most buckets of a BucketStore
+	MaxBuckets int = 256
+
+	bucketTagLen int = 2
+)
+
+// BucketStore is the storage which prefixes every key with the tag of a
+// bucket chosen by the hash of the key, so the keys written one after
+// another, like the ids of the messages of a topic, are spread across the
+// key space of the storage instead of filling the same files. Keys scans
+// every bucket and strips the tags, so the callers see the keys they set.
+type BucketStore struct {
+	storage Storage
+	buckets int
+	hash    func(key string) int
+}
+
+// NewBucketStore returns a new BucketStore of so many buckets on the
+// storage, at most MaxBuckets. The key is stored in the bucket hash(key)
+// modulo the buckets, a nil hash uses FNV-1a. The buckets and the hash must
+// not change between runs, nor the storage be used without them, or the
+// stored keys are lost.
+func NewBucketStore(storage Storage, buckets int, hash func(key string) int) (*BucketStore, error) {
+	if storage == nil {
+		return nil, errors.New(errNilStorage)
+	}
+	if buckets <= 0 || buckets > MaxBuckets {
+		return nil, fmt.Errorf("bucket store needs 1 to %d buckets", MaxBuckets)
+	}
+	if hash == nil {
+		hash = fnvHash
+	}
+
+	bs := new(BucketStore)
+	bs.storage = storage
+	bs.buckets = buckets
+	bs.hash = hash
+
+	return bs, nil
+}
+
+func bucketTag(i int) string {
+	return fmt.Sprintf("%02x", i)
+}
+
+// stored returns the key stored for key
+func (s *BucketStore) stored(key string) string {
+	i := s.hash(key) % s.buckets
+	if i < 0 {
+		i += s.buckets
+	}
+	return bucketTag(i) + key
+}
+
+// Set implements the Set interface
+func (s *BucketStore) Set(key string, data []byte) error {
+	return s.storage.Set(s.stored(key), data)
+}
+
+// Get implements the Get interface
+func (s *BucketStore) Get(key string) ([]byte, error) {
+	return s.storage.Get(s.stored(key))
+}
+
+// Del implements the Del interface
+func (s *BucketStore) Del(key string) error {
+	return s.storage.Del(s.stored(key))
+}
+
+// Keys implements the KeyLister interface, it merges the keys of the
+// prefix in every bucket
+func (s *BucketStore) Keys(prefix string) ([]string, error) {
+	var keys []string
+	for i := 0; i < s.buckets; i++ {
+		bucketKeys, err := ListKeys(s.storage, bucketTag(i)+prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range bucketKeys {
+			keys = append(keys, key[bucketTagLen:])
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// SetWithTTL implements the ExpiringStore interface, it sets the key
+// without the ttl if the storage cannot expire it
+func (s *BucketStore) SetWithTTL(key string, data []byte, ttl time.Duration) error {
+	return setWithTTL(s.storage, s.stored(key), data, ttl)
+}
+
+func (s *BucketStore) canExpire() bool {
+	return CanExpire(s.storage)
+}
+
+func (s *BucketStore) canListKeys() bool {
+	return CanListKeys(s.storage)
+}
+
+// CompactRange implements the Compactable interface, it compacts the
+// storage if it is Compactable
+func (s *BucketStore) CompactRange() error {
+	c, ok := s.storage.(Compactable)
+	if !ok {
+		return nil
+	}
+	return c.CompactRange()
+}
+
+// CloseIdle implements the IdleCloser interface, it closes the idle
+// connections of the storage if it is an IdleCloser
+func (s *BucketStore) CloseIdle() error {
+	c, ok := s.storage.(IdleCloser)
+	if !ok {
+		return nil
+	}
+	return c.CloseIdle()
+}
+
+// Close implements the Close interface
+func (s *BucketStore) Close() error {
+	return s.storage.Close()
+}
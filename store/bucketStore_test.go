@@ -0,0 +1,74 @@
+package store
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBucketStore(t *testing.T) {
+	Convey("Test Bucket Store", t, func() {
+		ms, err := NewMemStore()
+		So(err, ShouldBeNil)
+		_, err = NewBucketStore(nil, 4, nil)
+		So(err, ShouldNotBeNil)
+		_, err = NewBucketStore(ms, 0, nil)
+		So(err, ShouldNotBeNil)
+		_, err = NewBucketStore(ms, MaxBuckets+1, nil)
+		So(err, ShouldNotBeNil)
+
+		bs, err := NewBucketStore(ms, 3, func(key string) int {
+			return -len(key)
+		})
+		So(err, ShouldBeNil)
+		So(bs.Set("a", []byte("1")), ShouldBeNil)
+		So(bs.Set("ab", []byte("2")), ShouldBeNil)
+		So(bs.Set("abc", []byte("3")), ShouldBeNil)
+		So(bs.Set("b", []byte("4")), ShouldBeNil)
+
+		data, err := ms.Get("01ab")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "2")
+		data, err = bs.Get("abc")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "3")
+
+		keys, err := bs.Keys("a")
+		So(err, ShouldBeNil)
+		So(keys, ShouldResemble, []string{"a", "ab", "abc"})
+		keys, err = bs.Keys("")
+		So(err, ShouldBeNil)
+		So(keys, ShouldResemble, []string{"a", "ab", "abc", "b"})
+
+		So(bs.Del("ab"), ShouldBeNil)
+		_, err = bs.Get("ab")
+		So(err, ShouldEqual, ErrNotExisted)
+		So(bs.CompactRange(), ShouldBeNil)
+		So(bs.Close(), ShouldBeNil)
+	})
+
+	Convey("Test Bucket Store Spreads the Sequential Keys", t, func() {
+		ms, err := NewMemStore()
+		So(err, ShouldBeNil)
+		bs, err := NewBucketStore(ms, 16, nil)
+		So(err, ShouldBeNil)
+		for _, key := range []string{"m/0", "m/1", "m/2", "m/3", "m/4", "m/5", "m/6", "m/7"} {
+			So(bs.Set(key, []byte(key)), ShouldBeNil)
+		}
+		stored, err := ms.Keys("")
+		So(err, ShouldBeNil)
+		tags := make(map[string]bool)
+		for _, key := range stored {
+			So(strings.HasPrefix(key[bucketTagLen:], "m/"), ShouldBeTrue)
+			tags[key[:bucketTagLen]] = true
+		}
+		So(len(tags), ShouldBeGreaterThan, 1)
+
+		keys, err := bs.Keys("m/")
+		So(err, ShouldBeNil)
+		So(keys, ShouldHaveLength, 8)
+		So(keys[0], ShouldEqual, "m/0")
+		So(keys[7], ShouldEqual, "m/7")
+	})
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 // LevelStore is the goleveldb storage
@@ -41,7 +42,11 @@ func (l *LevelStore) Set(key string, data []byte) error {
 
 // Get implements the Get interface
 func (l *LevelStore) Get(key string) ([]byte, error) {
-	return l.db.Get([]byte(key), nil)
+	data, err := l.db.Get([]byte(key), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNotExisted
+	}
+	return data, err
 
 	// data, err := l.db.Get(keyByte, nil)
 	// if err != nil {
@@ -62,6 +67,26 @@ func (l *LevelStore) Del(key string) error {
 	// return nil
 }
 
+// Keys implements the KeyLister interface
+func (l *LevelStore) Keys(prefix string) ([]string, error) {
+	var keys []string
+	iter := l.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	for iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	iter.Release()
+	err := iter.Error()
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// CompactRange implements the Compactable interface
+func (l *LevelStore) CompactRange() error {
+	return l.db.CompactRange(util.Range{})
+}
+
 // Close implements the Close interface
 func (l *LevelStore) Close() error {
 	err := l.db.Close()
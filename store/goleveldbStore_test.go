@@ -43,6 +43,18 @@ func TestGetLevel(t *testing.T) {
 	})
 }
 
+func TestKeysLevel(t *testing.T) {
+	Convey("Test Level Store Keys", t, func() {
+		ldb.Set("foo:1", []byte("bar"))
+		keys, err := ListKeys(ldb, "foo")
+		So(err, ShouldBeNil)
+		So(len(keys), ShouldEqual, 2)
+		So(keys[0], ShouldEqual, "foo")
+		So(keys[1], ShouldEqual, "foo:1")
+		ldb.Del("foo:1")
+	})
+}
+
 func TestDelLevel(t *testing.T) {
 	Convey("Test Level Store Del", t, func() {
 		err = ldb.Del("foo")
@@ -50,6 +62,15 @@ func TestDelLevel(t *testing.T) {
 	})
 }
 
+func TestCompactLevel(t *testing.T) {
+	Convey("Test Level Store Compact", t, func() {
+		c, ok := ldb.(Compactable)
+		So(ok, ShouldBeTrue)
+		err = c.CompactRange()
+		So(err, ShouldBeNil)
+	})
+}
+
 func TestCloseLevel(t *testing.T) {
 	Convey("Test Level Store Close", t, func() {
 		err = ldb.Close()
@@ -0,0 +1,159 @@
+package store
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IdleStore is the storage which releases the idle connections of an
+// IdleCloser storage once no call is made for a while. The storage
+// reconnects on the next call by itself, so the wrapper is transparent.
+type IdleStore struct {
+	// lastUse is the unix nano of the last call, accessed atomically
+	lastUse int64
+
+	storage Storage
+	closer  IdleCloser
+	idle    time.Duration
+	now     func() time.Time
+	// after is time.After, replaced by the tests
+	after func(d time.Duration) <-chan time.Time
+
+	quit     chan bool
+	quitOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewIdleStore returns a new IdleStore which releases the connections of
+// storage after idle without any call. The storage must be an IdleCloser.
+func NewIdleStore(storage Storage, idle time.Duration) (*IdleStore, error) {
+	if storage == nil {
+		return nil, errors.New(errNilStorage)
+	}
+	c, ok := storage.(IdleCloser)
+	if !ok {
+		return nil, errors.New("idle store needs an IdleCloser storage")
+	}
+	if idle <= 0 {
+		return nil, errors.New("idle store needs a positive idle period")
+	}
+
+	is := newIdleStore(storage, c, idle, time.Now, time.After)
+	return is, nil
+}
+
+func newIdleStore(storage Storage, c IdleCloser, idle time.Duration, now func() time.Time, after func(time.Duration) <-chan time.Time) *IdleStore {
+	is := new(IdleStore)
+	is.storage = storage
+	is.closer = c
+	is.idle = idle
+	is.now = now
+	is.after = after
+	is.quit = make(chan bool)
+	is.touch()
+
+	is.wg.Add(1)
+	go is.run()
+	return is
+}
+
+func (i *IdleStore) touch() {
+	atomic.StoreInt64(&i.lastUse, i.now().UnixNano())
+}
+
+// run closes the idle connections once per idle period without calls
+func (i *IdleStore) run() {
+	defer i.wg.Done()
+	var released int64
+	wait := i.idle
+	for {
+		select {
+		case <-i.after(wait):
+		case <-i.quit:
+			return
+		}
+
+		last := atomic.LoadInt64(&i.lastUse)
+		wait = time.Duration(last + int64(i.idle) - i.now().UnixNano())
+		if wait > 0 {
+			continue
+		}
+		wait = i.idle
+		if last == released {
+			continue
+		}
+		released = last
+		err := i.closer.CloseIdle()
+		if err != nil {
+			log.Printf("idle store close idle error: %s", err)
+		}
+	}
+}
+
+// Set implements the Set interface
+func (i *IdleStore) Set(key string, data []byte) error {
+	i.touch()
+	return i.storage.Set(key, data)
+}
+
+// Get implements the Get interface
+func (i *IdleStore) Get(key string) ([]byte, error) {
+	i.touch()
+	return i.storage.Get(key)
+}
+
+// Del implements the Del interface
+func (i *IdleStore) Del(key string) error {
+	i.touch()
+	return i.storage.Del(key)
+}
+
+// Keys implements the KeyLister interface
+func (i *IdleStore) Keys(prefix string) ([]string, error) {
+	i.touch()
+	return ListKeys(i.storage, prefix)
+}
+
+func (i *IdleStore) canListKeys() bool {
+	return CanListKeys(i.storage)
+}
+
+// SetWithTTL implements the ExpiringStore interface, it sets the key
+// without the ttl if the storage cannot expire it
+func (i *IdleStore) SetWithTTL(key string, data []byte, ttl time.Duration) error {
+	i.touch()
+	return setWithTTL(i.storage, key, data, ttl)
+}
+
+func (i *IdleStore) canExpire() bool {
+	return CanExpire(i.storage)
+}
+
+// CloseIdle implements the IdleCloser interface
+func (i *IdleStore) CloseIdle() error {
+	return i.closer.CloseIdle()
+}
+
+// CompactRange implements the Compactable interface, it does nothing if the
+// storage is not Compactable
+func (i *IdleStore) CompactRange() error {
+	c, ok := i.storage.(Compactable)
+	if !ok {
+		return nil
+	}
+	i.touch()
+	return c.CompactRange()
+}
+
+// Close implements the Close interface, it stops releasing the connections
+// and closes the storage. It can be called more than once.
+func (i *IdleStore) Close() error {
+	i.quitOnce.Do(func() {
+		close(i.quit)
+	})
+	i.wg.Wait()
+	return i.storage.Close()
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// idleCounter is a storage counting its CloseIdle calls
+type idleCounter struct {
+	Storage
+	closes int32
+}
+
+func (c *idleCounter) CloseIdle() error {
+	atomic.AddInt32(&c.closes, 1)
+	return nil
+}
+
+func TestIdleStore(t *testing.T) {
+	Convey("Test Idle Store Releases the Idle Connections", t, func() {
+		mdb, err := NewMemStore()
+		So(err, ShouldBeNil)
+		_, err = NewIdleStore(mdb, time.Second)
+		So(err, ShouldNotBeNil)
+		c := &idleCounter{Storage: mdb}
+		_, err = NewIdleStore(c, 0)
+		So(err, ShouldNotBeNil)
+
+		clock := time.Unix(1420070400, 0).UnixNano()
+		now := func() time.Time {
+			return time.Unix(0, atomic.LoadInt64(&clock))
+		}
+		advance := func(d time.Duration) {
+			atomic.AddInt64(&clock, int64(d))
+		}
+		tick := make(chan time.Time)
+		after := func(time.Duration) <-chan time.Time {
+			return tick
+		}
+		is := newIdleStore(c, c, time.Second, now, after)
+
+		// every tick is taken once the previous one is handled
+		advance(2 * time.Second)
+		tick <- now()
+		tick <- now()
+		So(atomic.LoadInt32(&c.closes), ShouldEqual, 1)
+
+		So(is.Set("foo", []byte("bar")), ShouldBeNil)
+		tick <- now()
+		tick <- now()
+		So(atomic.LoadInt32(&c.closes), ShouldEqual, 1)
+
+		advance(2 * time.Second)
+		tick <- now()
+		data, err := is.Get("foo")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "bar")
+		So(is.Close(), ShouldBeNil)
+		So(atomic.LoadInt32(&c.closes), ShouldEqual, 2)
+		So(func() { is.Close() }, ShouldNotPanic)
+	})
+}
+
+func TestShardedCloseIdle(t *testing.T) {
+	Convey("Test Sharded Store Closes the Idle Connections of Its Shards", t, func() {
+		mdb, err := NewMemStore()
+		So(err, ShouldBeNil)
+		c := &idleCounter{Storage: mdb}
+		other, err := NewMemStore()
+		So(err, ShouldBeNil)
+		ss, err := NewShardedStore([]Storage{c, other}, nil)
+		So(err, ShouldBeNil)
+		So(ss.CloseIdle(), ShouldBeNil)
+		So(c.closes, ShouldEqual, 1)
+	})
+}
@@ -1,7 +1,9 @@
 package store
 
 import (
-	"errors"
+	"bytes"
+	"sort"
+	"strings"
 	"sync"
 )
 
@@ -25,7 +27,7 @@ func (m *MemStore) Set(key string, data []byte) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	m.db[key] = data
+	m.db[key] = append([]byte(nil), data...)
 	return nil
 }
 
@@ -36,9 +38,9 @@ func (m *MemStore) Get(key string) ([]byte, error) {
 
 	data, ok := m.db[key]
 	if !ok {
-		return nil, errors.New(errNotExisted)
+		return nil, ErrNotExisted
 	}
-	return data, nil
+	return append([]byte(nil), data...), nil
 }
 
 // Del implements the Del interface
@@ -48,13 +50,46 @@ func (m *MemStore) Del(key string) error {
 
 	_, ok := m.db[key]
 	if !ok {
-		return errors.New(errNotExisted)
+		return ErrNotExisted
 	}
 
 	delete(m.db, key)
 	return nil
 }
 
+// CompareAndSwap implements the CASStore interface
+func (m *MemStore) CompareAndSwap(key string, old, new []byte) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, ok := m.db[key]
+	if old == nil {
+		if ok {
+			return false, nil
+		}
+	} else if !ok || !bytes.Equal(data, old) {
+		return false, nil
+	}
+
+	m.db[key] = new
+	return true, nil
+}
+
+// Keys implements the KeyLister interface
+func (m *MemStore) Keys(prefix string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var keys []string
+	for key := range m.db {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
 // Close implements the Close interface
 func (m *MemStore) Close() error {
 	m.mu.Lock()
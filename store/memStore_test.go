@@ -38,6 +38,18 @@ func TestGetMem(t *testing.T) {
 	})
 }
 
+func TestKeysMem(t *testing.T) {
+	Convey("Test Mem Store Keys", t, func() {
+		mdb.Set("foo:1", []byte("bar"))
+		keys, err := ListKeys(mdb, "foo")
+		So(err, ShouldBeNil)
+		So(len(keys), ShouldEqual, 2)
+		So(keys[0], ShouldEqual, "foo")
+		So(keys[1], ShouldEqual, "foo:1")
+		mdb.Del("foo:1")
+	})
+}
+
 func TestDelMem(t *testing.T) {
 	Convey("Test Mem Store Del", t, func() {
 		err = mdb.Del("foo")
@@ -48,6 +60,29 @@ func TestDelMem(t *testing.T) {
 	})
 }
 
+func TestCompareAndSwapMem(t *testing.T) {
+	Convey("Test Mem Store Compare And Swap", t, func() {
+		cas := mdb.(CASStore)
+		ok, err := cas.CompareAndSwap("lock", nil, []byte("a"))
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+		ok, err = cas.CompareAndSwap("lock", nil, []byte("b"))
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+		ok, err = cas.CompareAndSwap("lock", []byte("b"), []byte("c"))
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+		ok, err = cas.CompareAndSwap("lock", []byte("a"), []byte("c"))
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		data, err := mdb.Get("lock")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "c")
+		So(mdb.Del("lock"), ShouldBeNil)
+	})
+}
+
 func TestCloseMem(t *testing.T) {
 	Convey("Test Mem Store Close", t, func() {
 		err = mdb.Close()
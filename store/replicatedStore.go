@@ -0,0 +1,191 @@
+package store
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// ReplicaPolicy is the policy of a ReplicatedStore when writing the
+// secondary storage fails
+type ReplicaPolicy int
+
+const (
+	// ReplicaBestEffort logs the secondary failures and goes on
+	ReplicaBestEffort ReplicaPolicy = iota
+	// ReplicaStrict returns the secondary failures to the caller
+	ReplicaStrict
+)
+
+// ReplicatedStore is the storage which mirrors every write to a secondary
+// storage. Reads are always served by the primary one.
+type ReplicatedStore struct {
+	primary   Storage
+	secondary Storage
+	policy    ReplicaPolicy
+}
+
+// NewReplicatedStore returns a new ReplicatedStore
+func NewReplicatedStore(primary, secondary Storage, policy ReplicaPolicy) (*ReplicatedStore, error) {
+	if primary == nil || secondary == nil {
+		return nil, errors.New(errNilStorage)
+	}
+	rs := new(ReplicatedStore)
+	rs.primary = primary
+	rs.secondary = secondary
+	rs.policy = policy
+
+	return rs, nil
+}
+
+func (r *ReplicatedStore) secondaryError(op, key string, err error) error {
+	if r.policy == ReplicaStrict {
+		return err
+	}
+	log.Printf("replica %s key[%s] error: %s", op, key, err)
+	return nil
+}
+
+// Set implements the Set interface
+func (r *ReplicatedStore) Set(key string, data []byte) error {
+	err := r.primary.Set(key, data)
+	if err != nil {
+		return err
+	}
+
+	err = r.secondary.Set(key, data)
+	if err != nil {
+		return r.secondaryError("set", key, err)
+	}
+	return nil
+}
+
+// SetWithTTL implements the ExpiringStore interface. Each storage sets the
+// key without the ttl if it cannot expire it, so the secondary one may keep
+// the keys the primary one expires.
+func (r *ReplicatedStore) SetWithTTL(key string, data []byte, ttl time.Duration) error {
+	err := setWithTTL(r.primary, key, data, ttl)
+	if err != nil {
+		return err
+	}
+
+	err = setWithTTL(r.secondary, key, data, ttl)
+	if err != nil {
+		return r.secondaryError("set", key, err)
+	}
+	return nil
+}
+
+// canExpire follows the primary storage, which serves the reads
+func (r *ReplicatedStore) canExpire() bool {
+	return CanExpire(r.primary)
+}
+
+// Get implements the Get interface
+func (r *ReplicatedStore) Get(key string) ([]byte, error) {
+	return r.primary.Get(key)
+}
+
+// Del implements the Del interface
+func (r *ReplicatedStore) Del(key string) error {
+	err := r.primary.Del(key)
+	if err != nil {
+		return err
+	}
+
+	err = r.secondary.Del(key)
+	if err != nil {
+		return r.secondaryError("del", key, err)
+	}
+	return nil
+}
+
+// Keys implements the KeyLister interface
+func (r *ReplicatedStore) Keys(prefix string) ([]string, error) {
+	return ListKeys(r.primary, prefix)
+}
+
+// canListKeys follows the primary storage, which serves the reads
+func (r *ReplicatedStore) canListKeys() bool {
+	return CanListKeys(r.primary)
+}
+
+// Reconcile copies the keys which exist in the primary storage but are
+// missing in the secondary one. It returns the number of copied keys and
+// is meant to be called on startup before the queue is loaded. The primary
+// storage must list its keys, and a failed read of the secondary one stops
+// it rather than overwriting the key.
+func (r *ReplicatedStore) Reconcile() (int, error) {
+	keys, err := ListKeys(r.primary, "")
+	if err != nil {
+		return 0, err
+	}
+
+	copied := 0
+	for _, key := range keys {
+		_, err := r.secondary.Get(key)
+		if err == nil {
+			continue
+		}
+		if err != ErrNotExisted {
+			return copied, err
+		}
+		data, err := r.primary.Get(key)
+		if err != nil {
+			return copied, err
+		}
+		err = r.secondary.Set(key, data)
+		if err != nil {
+			return copied, err
+		}
+		copied++
+	}
+	return copied, nil
+}
+
+// CompactRange implements the Compactable interface, it compacts the primary
+// and the secondary storages which are Compactable
+func (r *ReplicatedStore) CompactRange() error {
+	if c, ok := r.primary.(Compactable); ok {
+		err := c.CompactRange()
+		if err != nil {
+			return err
+		}
+	}
+	if c, ok := r.secondary.(Compactable); ok {
+		err := c.CompactRange()
+		if err != nil {
+			return r.secondaryError("compact", "", err)
+		}
+	}
+	return nil
+}
+
+// CloseIdle implements the IdleCloser interface, it closes the idle
+// connections of the primary and the secondary storages which are
+// IdleClosers
+func (r *ReplicatedStore) CloseIdle() error {
+	if c, ok := r.primary.(IdleCloser); ok {
+		err := c.CloseIdle()
+		if err != nil {
+			return err
+		}
+	}
+	if c, ok := r.secondary.(IdleCloser); ok {
+		err := c.CloseIdle()
+		if err != nil {
+			return r.secondaryError("close idle", "", err)
+		}
+	}
+	return nil
+}
+
+// Close implements the Close interface
+func (r *ReplicatedStore) Close() error {
+	err := r.primary.Close()
+	err2 := r.secondary.Close()
+	if err != nil {
+		return err
+	}
+	return err2
+}
@@ -0,0 +1,106 @@
+package store
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// downStore is a storage which fails every read
+type downStore struct {
+	Storage
+}
+
+func (downStore) Get(key string) ([]byte, error) {
+	return nil, errors.New("down")
+}
+
+var (
+	rdb       *ReplicatedStore
+	primary   Storage
+	secondary Storage
+)
+
+func TestNewReplicatedStore(t *testing.T) {
+	Convey("Test New Replicated Store", t, func() {
+		primary, err = NewMemStore()
+		So(err, ShouldBeNil)
+		secondary, err = NewMemStore()
+		So(err, ShouldBeNil)
+
+		rdb, err = NewReplicatedStore(primary, secondary, ReplicaStrict)
+		So(err, ShouldBeNil)
+		So(rdb, ShouldNotBeNil)
+
+		rdb2, err2 := NewReplicatedStore(primary, nil, ReplicaStrict)
+		So(err2, ShouldNotBeNil)
+		So(rdb2, ShouldBeNil)
+	})
+}
+
+func TestSetReplicated(t *testing.T) {
+	Convey("Test Replicated Store Set", t, func() {
+		err = rdb.Set("foo", []byte("bar"))
+		So(err, ShouldBeNil)
+
+		data, err := secondary.Get("foo")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "bar")
+	})
+}
+
+func TestDelReplicated(t *testing.T) {
+	Convey("Test Replicated Store Del", t, func() {
+		err = rdb.Del("foo")
+		So(err, ShouldBeNil)
+
+		_, err = secondary.Get("foo")
+		So(err, ShouldNotBeNil)
+
+		primary.Set("foo", []byte("bar"))
+		err = rdb.Del("foo")
+		So(err, ShouldNotBeNil)
+
+		rdb.policy = ReplicaBestEffort
+		primary.Set("foo", []byte("bar"))
+		err = rdb.Del("foo")
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestReconcileReplicated(t *testing.T) {
+	Convey("Test Replicated Store Reconcile", t, func() {
+		primary.Set("foo", []byte("bar"))
+		primary.Set("zp", []byte("buaa"))
+		secondary.Set("zp", []byte("buaa"))
+
+		n, err := rdb.Reconcile()
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1)
+
+		data, err := secondary.Get("foo")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "bar")
+
+		// a failed read of the secondary is not taken as a missing key
+		ms, err := NewMemStore()
+		So(err, ShouldBeNil)
+		So(ms.Set("foo", []byte("old")), ShouldBeNil)
+		ds, err := NewReplicatedStore(primary, downStore{ms}, ReplicaStrict)
+		So(err, ShouldBeNil)
+		n, err = ds.Reconcile()
+		So(err, ShouldNotBeNil)
+		So(n, ShouldEqual, 0)
+		data, err = ms.Get("foo")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "old")
+	})
+}
+
+func TestCloseReplicated(t *testing.T) {
+	Convey("Test Replicated Store Close", t, func() {
+		err = rdb.Close()
+		So(err, ShouldBeNil)
+	})
+}
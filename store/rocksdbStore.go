@@ -3,6 +3,8 @@ package store
 // to avoid cgo build, hide rocksdb now.
 /*
 import (
+	"strings"
+
 	"github.com/DanielMorsing/rocksdb"
 )
 
@@ -47,6 +49,20 @@ func (r *RockStore) Del(key string) error {
 	return r.db.Delete(r.wo, []byte(key))
 }
 
+func (r *RockStore) Keys(prefix string) ([]string, error) {
+	var keys []string
+	it := r.db.NewIterator(r.ro)
+	defer it.Close()
+	for it.Seek([]byte(prefix)); it.Valid(); it.Next() {
+		key := string(it.Key())
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+		keys = append(keys, key)
+	}
+	return keys, it.GetError()
+}
+
 func (r *RockStore) Close() error {
 	r.db.Close()
 	return nil
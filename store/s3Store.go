@@ -0,0 +1,356 @@
+package store
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	s3Algorithm  string = "AWS4-HMAC-SHA256"
+	s3DateFormat string = "20060102T150405Z"
+	s3MaxListed  string = "1000"
+)
+
+var errS3Closed = errors.New("S3 Store Is Closed")
+
+// S3Config is the bucket of an S3Store
+type S3Config struct {
+	// Endpoint is the URL of the S3 compatible service, e.g.
+	// "https://s3.us-east-1.amazonaws.com". The bucket is addressed in the
+	// path of the URL.
+	Endpoint string
+	// Region is the region the requests are signed for
+	Region string
+	// Bucket is the bucket of the objects
+	Bucket string
+	// Prefix is prepended to every key to name its object, so one bucket
+	// can hold several storages
+	Prefix string
+	// AccessKey and SecretKey are the credentials to sign the requests
+	// with, SessionToken is needed with the temporary ones only
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// Client sends the requests, nil means a client with a 30 seconds
+	// timeout
+	Client *http.Client
+}
+
+// S3Store is the storage of objects in an S3 compatible bucket, one object
+// for each key. Every call is a request to the service, so it only suits
+// the topics with a low write rate, or behind a storage buffering the
+// writes. Del does not report a key which does not exist, as the service
+// does not tell.
+type S3Store struct {
+	endpoint *url.URL
+	cfg      S3Config
+	client   *http.Client
+	now      func() time.Time
+
+	// calls is the calls running, Close waits for them
+	calls  sync.WaitGroup
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewS3Store returns a new S3Store on the bucket of cfg
+func NewS3Store(cfg S3Config) (*S3Store, error) {
+	if cfg.Bucket == "" || cfg.Region == "" {
+		return nil, errors.New("s3 store needs a bucket and a region")
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, errors.New("s3 store bad endpoint: " + cfg.Endpoint)
+	}
+
+	s := new(S3Store)
+	s.endpoint = endpoint
+	s.cfg = cfg
+	s.client = cfg.Client
+	if s.client == nil {
+		s.client = &http.Client{Timeout: 30 * time.Second}
+	}
+	s.now = time.Now
+	return s, nil
+}
+
+// begin counts a call, or returns an error if the store is closed
+func (s *S3Store) begin() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return errS3Closed
+	}
+	s.calls.Add(1)
+	return nil
+}
+
+// Set implements the Set interface
+func (s *S3Store) Set(key string, data []byte) error {
+	err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer s.calls.Done()
+
+	resp, err := s.do(http.MethodPut, s.cfg.Prefix+key, nil, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+// Get implements the Get interface
+func (s *S3Store) Get(key string) ([]byte, error) {
+	err := s.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer s.calls.Done()
+
+	resp, err := s.do(http.MethodGet, s.cfg.Prefix+key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotExisted
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error(resp)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Del implements the Del interface
+func (s *S3Store) Del(key string) error {
+	err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer s.calls.Done()
+
+	resp, err := s.do(http.MethodDelete, s.cfg.Prefix+key, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// Keys implements the KeyLister interface, it lists the objects page by page
+func (s *S3Store) Keys(prefix string) ([]string, error) {
+	err := s.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer s.calls.Done()
+
+	var keys []string
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("max-keys", s3MaxListed)
+	query.Set("prefix", s.cfg.Prefix+prefix)
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = s3Error(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(object.Key, s.cfg.Prefix))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// CloseIdle implements the IdleCloser interface, it closes the connections
+// kept alive by the client
+func (s *S3Store) CloseIdle() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// Close implements the Close interface, it waits for the calls running
+// and fails the later ones
+func (s *S3Store) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.calls.Wait()
+	return nil
+}
+
+// do sends the signed request of the object, or of the bucket with an
+// empty object
+func (s *S3Store) do(method, object string, query url.Values, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.cfg.Bucket
+	if object != "" {
+		u.Path += "/" + object
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3EscapeQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	sum := sha256.Sum256(body)
+	s3Sign(req, hex.EncodeToString(sum[:]), s.cfg, s.now().UTC())
+	return s.client.Do(req)
+}
+
+// s3Sign signs req with the signature version 4 of the payload hash
+func s3Sign(req *http.Request, payloadHash string, cfg S3Config, t time.Time) {
+	amzDate := t.Format(s3DateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", cfg.SessionToken)
+	}
+
+	scope := amzDate[:8] + "/" + cfg.Region + "/s3/aws4_request"
+	signedHeaders, canonical := s3CanonicalRequest(req, payloadHash)
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := s3Algorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := s3HMAC([]byte("AWS4"+cfg.SecretKey), amzDate[:8])
+	key = s3HMAC(key, cfg.Region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+// s3CanonicalRequest returns the signed headers and the canonical request
+// of req, the host and the x-amz headers are signed
+func s3CanonicalRequest(req *http.Request, payloadHash string) (string, string) {
+	headers := map[string]string{"host": req.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	buf.WriteString(req.Method + "\n")
+	buf.WriteString(req.URL.EscapedPath() + "\n")
+	buf.WriteString(s3EscapeQuery(req.URL.Query()) + "\n")
+	for _, name := range names {
+		buf.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	buf.WriteString("\n" + signedHeaders + "\n" + payloadHash)
+	return signedHeaders, buf.String()
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape escapes s the way signature version 4 does, every byte but the
+// unreserved ones, and the slashes too unless keepSlash is set
+func s3Escape(s string, keepSlash bool) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && keepSlash {
+			buf.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&buf, "%%%02X", c)
+	}
+	return buf.String()
+}
+
+func s3EscapePath(path string) string {
+	return s3Escape(path, true)
+}
+
+// s3EscapeQuery returns the canonical query, sorted by the escaped names
+func s3EscapeQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(name, false)+"="+s3Escape(value, false))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// s3Error returns the error of the response which failed
+func s3Error(resp *http.Response) error {
+	var result struct {
+		Code    string
+		Message string
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if xml.Unmarshal(body, &result) == nil && result.Code != "" {
+		return fmt.Errorf("s3 %s: %s", result.Code, result.Message)
+	}
+	return fmt.Errorf("s3 status %d", resp.StatusCode)
+}
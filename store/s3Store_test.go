@@ -0,0 +1,136 @@
+package store
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeS3 is a bucket which checks the signatures, and lists two objects a
+// page to exercise the continuation
+type fakeS3 struct {
+	cfg     S3Config
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	date, err := time.Parse(s3DateFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	s3Sign(r, r.Header.Get("X-Amz-Content-Sha256"), f.cfg, date)
+	if r.Header.Get("Authorization") != auth {
+		http.Error(w, "<Error><Code>SignatureDoesNotMatch</Code></Error>", http.StatusForbidden)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	object := strings.TrimPrefix(r.URL.Path, "/"+f.cfg.Bucket)
+	if object == "" {
+		f.list(w, r)
+		return
+	}
+	object = object[1:]
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := ioutil.ReadAll(r.Body)
+		f.objects[object] = data
+	case http.MethodGet:
+		data, ok := f.objects[object]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case http.MethodDelete:
+		delete(f.objects, object)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	var names []string
+	prefix := r.URL.Query().Get("prefix")
+	for name := range f.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	from, _ := strconv.Atoi(r.URL.Query().Get("continuation-token"))
+	names = names[from:]
+
+	var result s3ListResult
+	if len(names) > 2 {
+		names = names[:2]
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(from + 2)
+	}
+	for _, name := range names {
+		result.Contents = append(result.Contents, struct{ Key string }{name})
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+func TestS3Store(t *testing.T) {
+	Convey("Test S3 Store on a Fake Bucket", t, func() {
+		cfg := S3Config{
+			Region:    "us-east-1",
+			Bucket:    "uq",
+			Prefix:    "p/",
+			AccessKey: "ak",
+			SecretKey: "sk",
+		}
+		fake := &fakeS3{cfg: cfg, objects: make(map[string][]byte)}
+		server := httptest.NewServer(fake)
+		defer server.Close()
+		cfg.Endpoint = server.URL
+
+		_, err := NewS3Store(S3Config{Endpoint: server.URL})
+		So(err, ShouldNotBeNil)
+		s, err := NewS3Store(cfg)
+		So(err, ShouldBeNil)
+
+		for _, key := range []string{"/t/foo", "/t/foo:head", "/l/fo%2Fo/x y", "/t/foo:tail", "/t/bar"} {
+			So(s.Set(key, []byte("v"+key)), ShouldBeNil)
+		}
+		So(fake.objects, ShouldContainKey, "p//l/fo%2Fo/x y")
+		data, err := s.Get("/l/fo%2Fo/x y")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "v/l/fo%2Fo/x y")
+		_, err = s.Get("/t/baz")
+		So(err, ShouldEqual, ErrNotExisted)
+
+		keys, err := s.Keys("/t/foo")
+		So(err, ShouldBeNil)
+		So(keys, ShouldResemble, []string{"/t/foo", "/t/foo:head", "/t/foo:tail"})
+		So(s.Del("/t/foo:head"), ShouldBeNil)
+		So(s.Del("/t/foo:head"), ShouldBeNil)
+		keys, err = s.Keys("/t/")
+		So(err, ShouldBeNil)
+		So(keys, ShouldResemble, []string{"/t/bar", "/t/foo", "/t/foo:tail"})
+
+		bad := cfg
+		bad.SecretKey = "bad"
+		bs, err := NewS3Store(bad)
+		So(err, ShouldBeNil)
+		_, err = bs.Get("/t/foo")
+		So(err.Error(), ShouldContainSubstring, "SignatureDoesNotMatch")
+
+		So(s.Close(), ShouldBeNil)
+		So(s.Set("/t/foo", []byte("v")), ShouldEqual, errS3Closed)
+	})
+}
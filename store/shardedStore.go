@@ -0,0 +1,152 @@
+package store
+
+import (
+	"errors"
+	"hash/fnv"
+	"sort"
+	"time"
+)
+
+// ShardedStore is the storage which spreads keys across several storages,
+// so the writes are not bound to a single file or disk
+type ShardedStore struct {
+	shards []Storage
+	hash   func(key string) int
+}
+
+// NewShardedStore returns a new ShardedStore. The key is stored in the
+// shard hash(key) modulo the number of shards, a nil hash uses FNV-1a. The
+// mapping must not change between runs, or the stored keys are lost.
+func NewShardedStore(shards []Storage, hash func(key string) int) (*ShardedStore, error) {
+	if len(shards) == 0 {
+		return nil, errors.New(errNilStorage)
+	}
+	for _, shard := range shards {
+		if shard == nil {
+			return nil, errors.New(errNilStorage)
+		}
+	}
+	if hash == nil {
+		hash = fnvHash
+	}
+
+	ss := new(ShardedStore)
+	ss.shards = shards
+	ss.hash = hash
+
+	return ss, nil
+}
+
+func fnvHash(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32())
+}
+
+func (s *ShardedStore) shard(key string) Storage {
+	i := s.hash(key) % len(s.shards)
+	if i < 0 {
+		i += len(s.shards)
+	}
+	return s.shards[i]
+}
+
+// Set implements the Set interface
+func (s *ShardedStore) Set(key string, data []byte) error {
+	return s.shard(key).Set(key, data)
+}
+
+// SetWithTTL implements the ExpiringStore interface, it sets the key
+// without the ttl if its shard cannot expire it
+func (s *ShardedStore) SetWithTTL(key string, data []byte, ttl time.Duration) error {
+	return setWithTTL(s.shard(key), key, data, ttl)
+}
+
+// canExpire tells whether every shard can expire the keys
+func (s *ShardedStore) canExpire() bool {
+	for _, shard := range s.shards {
+		if !CanExpire(shard) {
+			return false
+		}
+	}
+	return true
+}
+
+// canListKeys tells whether every shard can list its keys
+func (s *ShardedStore) canListKeys() bool {
+	for _, shard := range s.shards {
+		if !CanListKeys(shard) {
+			return false
+		}
+	}
+	return true
+}
+
+// Get implements the Get interface
+func (s *ShardedStore) Get(key string) ([]byte, error) {
+	return s.shard(key).Get(key)
+}
+
+// Del implements the Del interface
+func (s *ShardedStore) Del(key string) error {
+	return s.shard(key).Del(key)
+}
+
+// Keys implements the KeyLister interface
+func (s *ShardedStore) Keys(prefix string) ([]string, error) {
+	var keys []string
+	for _, shard := range s.shards {
+		shardKeys, err := ListKeys(shard, prefix)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, shardKeys...)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// CompactRange implements the Compactable interface, it compacts the shards
+// which are Compactable and skips the others
+func (s *ShardedStore) CompactRange() error {
+	for _, shard := range s.shards {
+		c, ok := shard.(Compactable)
+		if !ok {
+			continue
+		}
+		err := c.CompactRange()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CloseIdle implements the IdleCloser interface, it closes the idle
+// connections of the shards which are IdleClosers
+func (s *ShardedStore) CloseIdle() error {
+	var first error
+	for _, shard := range s.shards {
+		c, ok := shard.(IdleCloser)
+		if !ok {
+			continue
+		}
+		err := c.CloseIdle()
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Close implements the Close interface
+func (s *ShardedStore) Close() error {
+	var first error
+	for _, shard := range s.shards {
+		err := shard.Close()
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
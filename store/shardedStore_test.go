@@ -0,0 +1,46 @@
+package store
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestShardedStore(t *testing.T) {
+	Convey("Test Sharded Store", t, func() {
+		_, err := NewShardedStore(nil, nil)
+		So(err, ShouldNotBeNil)
+
+		shards := make([]Storage, 3)
+		for i := range shards {
+			shards[i], err = NewMemStore()
+			So(err, ShouldBeNil)
+		}
+		ss, err := NewShardedStore(shards, func(key string) int {
+			return -len(key)
+		})
+		So(err, ShouldBeNil)
+
+		So(ss.Set("a", []byte("1")), ShouldBeNil)
+		So(ss.Set("ab", []byte("2")), ShouldBeNil)
+		So(ss.Set("abc", []byte("3")), ShouldBeNil)
+		So(ss.Set("b", []byte("4")), ShouldBeNil)
+
+		data, err := shards[1].Get("ab")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "2")
+		data, err = ss.Get("abc")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "3")
+
+		keys, err := ss.Keys("a")
+		So(err, ShouldBeNil)
+		So(keys, ShouldResemble, []string{"a", "ab", "abc"})
+
+		So(ss.Del("ab"), ShouldBeNil)
+		_, err = ss.Get("ab")
+		So(err, ShouldNotBeNil)
+
+		So(ss.Close(), ShouldBeNil)
+	})
+}
@@ -0,0 +1,123 @@
+package store
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// SQLiteDriver is the database/sql driver name used by SQLiteStore. To
+// avoid cgo build the driver is not imported here, the program using
+// SQLiteStore must import one, e.g. github.com/mattn/go-sqlite3.
+var SQLiteDriver = "sqlite3"
+
+// SQLiteStore is the sqlite storage, which keeps the data in a single table
+// kv(key TEXT PRIMARY KEY, value BLOB) so it can be inspected with sql
+type SQLiteStore struct {
+	path string
+	db   *sql.DB
+}
+
+// NewSQLiteStore returns a new SQLiteStore
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open(SQLiteDriver, path)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite has a single writer, one connection avoids the busy errors
+	db.SetMaxOpenConns(1)
+
+	stmts := []string{
+		"PRAGMA journal_mode=WAL",
+		"PRAGMA case_sensitive_like=ON",
+		"CREATE TABLE IF NOT EXISTS kv (key TEXT PRIMARY KEY, value BLOB)",
+	}
+	for _, stmt := range stmts {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	ss := new(SQLiteStore)
+	ss.path = path
+	ss.db = db
+
+	return ss, nil
+}
+
+// Set implements the Set interface
+func (s *SQLiteStore) Set(key string, data []byte) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO kv (key, value) VALUES (?, ?)", key, data)
+	return err
+}
+
+// Get implements the Get interface
+func (s *SQLiteStore) Get(key string) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRow("SELECT value FROM kv WHERE key = ?", key).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotExisted
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Del implements the Del interface
+func (s *SQLiteStore) Del(key string) error {
+	_, err := s.db.Exec("DELETE FROM kv WHERE key = ?", key)
+	return err
+}
+
+// CompareAndSwap implements the CASStore interface, each case is a single
+// statement so it is atomic across the processes sharing the file
+func (s *SQLiteStore) CompareAndSwap(key string, old, new []byte) (bool, error) {
+	var result sql.Result
+	var err error
+	if old == nil {
+		result, err = s.db.Exec("INSERT OR IGNORE INTO kv (key, value) VALUES (?, ?)", key, new)
+	} else {
+		result, err = s.db.Exec("UPDATE kv SET value = ? WHERE key = ? AND value = ?", new, key, old)
+	}
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// Keys implements the KeyLister interface
+func (s *SQLiteStore) Keys(prefix string) ([]string, error) {
+	pattern := likeEscaper.Replace(prefix) + "%"
+	rows, err := s.db.Query(`SELECT key FROM kv WHERE key LIKE ? ESCAPE '\' ORDER BY key`, pattern)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		err = rows.Scan(&key)
+		if err != nil {
+			return nil, err
+		}
+		// in case the connection is reopened without case_sensitive_like
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, rows.Err()
+}
+
+// Close implements the Close interface
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,67 @@
+package store
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	sqlitePath = "/tmp/uq.store.test.sqlite"
+)
+
+func sqliteDriverRegistered() bool {
+	for _, driver := range sql.Drivers() {
+		if driver == SQLiteDriver {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSQLiteStore(t *testing.T) {
+	if !sqliteDriverRegistered() {
+		t.Skip("no sqlite driver registered")
+	}
+
+	Convey("Test SQLite Store", t, func() {
+		ss, err := NewSQLiteStore(sqlitePath)
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(sqlitePath)
+
+		So(ss.Set("foo", []byte("bar")), ShouldBeNil)
+		So(ss.Set("foo", []byte("baz")), ShouldBeNil)
+		So(ss.Set("fo%", []byte("1")), ShouldBeNil)
+		So(ss.Set("Foo", []byte("2")), ShouldBeNil)
+
+		data, err := ss.Get("foo")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "baz")
+		_, err = ss.Get("bar")
+		So(err, ShouldEqual, ErrNotExisted)
+
+		keys, err := ss.Keys("fo")
+		So(err, ShouldBeNil)
+		So(keys, ShouldResemble, []string{"fo%", "foo"})
+		keys, err = ss.Keys("fo%")
+		So(err, ShouldBeNil)
+		So(keys, ShouldResemble, []string{"fo%"})
+
+		ok, err := ss.CompareAndSwap("lock", nil, []byte("a"))
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+		ok, err = ss.CompareAndSwap("lock", nil, []byte("b"))
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeFalse)
+		ok, err = ss.CompareAndSwap("lock", []byte("a"), []byte("c"))
+		So(err, ShouldBeNil)
+		So(ok, ShouldBeTrue)
+
+		So(ss.Del("foo"), ShouldBeNil)
+		_, err = ss.Get("foo")
+		So(err, ShouldNotBeNil)
+		So(ss.Close(), ShouldBeNil)
+	})
+}
@@ -1,14 +1,126 @@
 package store
 
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotExisted is returned by Get when the key is not in the storage
+var ErrNotExisted = errors.New("Data Not Existed")
+
+// ErrKeysNotListed is returned by ListKeys when the storage can not list
+// its keys
+var ErrKeysNotListed = errors.New("Storage Keys Not Listed")
+
 const (
-	errNotExisted     string = "Data Not Existed"
 	errModeNotMatched string = "Storage Mode Not Matched"
+	errNilStorage     string = "Storage Is Nil"
 )
 
-// Storage is the storage of uq
+// Storage is the storage of uq. Set must not keep data after it returns,
+// since the callers reuse the buffers, and Get must return a slice which
+// is not shared, since the callers hand it out and may change it.
 type Storage interface {
 	Set(key string, data []byte) error
 	Get(key string) ([]byte, error)
 	Del(key string) error
 	Close() error
 }
+
+// KeyLister is implemented by the storages which can list their keys. The
+// callers should check with CanListKeys, as the features built on listing
+// the keys, like the message attributes, are not available without it.
+type KeyLister interface {
+	// Keys returns the keys starting with prefix in their order
+	Keys(prefix string) ([]string, error)
+}
+
+// CASStore is implemented by the storages which can compare and swap a key
+// atomically, even across the processes sharing the storage. The callers
+// should check for it and fall back when the storage does not implement it.
+type CASStore interface {
+	// CompareAndSwap sets key to new if its value equals old, a nil old
+	// means the key must not exist. It reports whether the key is set.
+	CompareAndSwap(key string, old, new []byte) (bool, error)
+}
+
+// Compactable is implemented by the storages which can reclaim the space
+// of the deleted keys on demand. The storages which do not implement it
+// reclaim it by themselves, or never.
+type Compactable interface {
+	// CompactRange compacts the whole storage. It may take a while and
+	// slows down the other calls, so it is better run at low traffic.
+	CompactRange() error
+}
+
+// IdleCloser is implemented by the storages holding network connections,
+// which can release the idle ones and reconnect on the next call. The calls
+// running are not affected, so nothing is lost.
+type IdleCloser interface {
+	// CloseIdle closes the connections not used by a call
+	CloseIdle() error
+}
+
+// ExpiringStore is implemented by the storages which can expire a key by
+// themselves, like Redis. The queue stores the messages with a deadline
+// through it, so their space is reclaimed once they expire rather than
+// after every line passes them. The storages which do not implement it
+// keep the expired messages until the topic is cleaned.
+type ExpiringStore interface {
+	// SetWithTTL sets key like Set, and removes it after ttl
+	SetWithTTL(key string, data []byte, ttl time.Duration) error
+}
+
+// expiryForwarder is implemented by the wrappers of other storages, which
+// forward SetWithTTL but can only expire the keys if those storages can
+type expiryForwarder interface {
+	canExpire() bool
+}
+
+// CanExpire tells whether the storage expires the keys set with SetWithTTL
+// by itself. A wrapper like BucketStore is an ExpiringStore whatever it
+// wraps, and sets the keys without a ttl if the storage it wraps cannot
+// expire them, so the callers check with CanExpire rather than for the
+// interface.
+func CanExpire(s Storage) bool {
+	if f, ok := s.(expiryForwarder); ok {
+		return f.canExpire()
+	}
+	_, ok := s.(ExpiringStore)
+	return ok
+}
+
+// setWithTTL sets key on the storage with ttl if it can expire it, or
+// without the ttl otherwise
+func setWithTTL(s Storage, key string, data []byte, ttl time.Duration) error {
+	if CanExpire(s) {
+		return s.(ExpiringStore).SetWithTTL(key, data, ttl)
+	}
+	return s.Set(key, data)
+}
+
+// keyForwarder is implemented by the wrappers of other storages, which
+// forward Keys but can only list the keys if those storages can
+type keyForwarder interface {
+	canListKeys() bool
+}
+
+// CanListKeys tells whether the storage lists its keys. A wrapper like
+// BucketStore is a KeyLister whatever it wraps, so the callers check with
+// CanListKeys rather than for the interface.
+func CanListKeys(s Storage) bool {
+	if f, ok := s.(keyForwarder); ok {
+		return f.canListKeys()
+	}
+	_, ok := s.(KeyLister)
+	return ok
+}
+
+// ListKeys returns the keys of the storage starting with prefix, or
+// ErrKeysNotListed if it can not list them
+func ListKeys(s Storage, prefix string) ([]string, error) {
+	if !CanListKeys(s) {
+		return nil, ErrKeysNotListed
+	}
+	return s.(KeyLister).Keys(prefix)
+}
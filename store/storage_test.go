@@ -0,0 +1,126 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// ttlStore records the ttls of the keys set with SetWithTTL
+type ttlStore struct {
+	*MemStore
+	ttls map[string]time.Duration
+}
+
+func newTTLStore() *ttlStore {
+	ms, _ := NewMemStore()
+	return &ttlStore{MemStore: ms, ttls: make(map[string]time.Duration)}
+}
+
+func (s *ttlStore) SetWithTTL(key string, data []byte, ttl time.Duration) error {
+	s.ttls[key] = ttl
+	return s.Set(key, data)
+}
+
+// CloseIdle makes the ttlStore an IdleCloser for the IdleStore
+func (s *ttlStore) CloseIdle() error {
+	return nil
+}
+
+// plainStore is a storage which can not list its keys
+type plainStore struct {
+	ms *MemStore
+}
+
+func (s plainStore) Set(key string, data []byte) error { return s.ms.Set(key, data) }
+func (s plainStore) Get(key string) ([]byte, error)    { return s.ms.Get(key) }
+func (s plainStore) Del(key string) error              { return s.ms.Del(key) }
+func (s plainStore) Close() error                      { return s.ms.Close() }
+
+func TestCanListKeys(t *testing.T) {
+	Convey("Test the Wrappers List the Keys Only If They Can", t, func() {
+		ms, err := NewMemStore()
+		So(err, ShouldBeNil)
+		ps := plainStore{ms}
+		So(CanListKeys(ms), ShouldBeTrue)
+		So(CanListKeys(ps), ShouldBeFalse)
+		So(ps.Set("a", []byte("1")), ShouldBeNil)
+		_, err = ListKeys(ps, "")
+		So(err, ShouldEqual, ErrKeysNotListed)
+
+		bs, err := NewBucketStore(ps, 1, nil)
+		So(err, ShouldBeNil)
+		So(CanListKeys(bs), ShouldBeFalse)
+		_, err = bs.Keys("")
+		So(err, ShouldEqual, ErrKeysNotListed)
+
+		rs, err := NewReplicatedStore(ps, ms, ReplicaStrict)
+		So(err, ShouldBeNil)
+		So(CanListKeys(rs), ShouldBeFalse)
+		_, err = rs.Reconcile()
+		So(err, ShouldEqual, ErrKeysNotListed)
+		rs, err = NewReplicatedStore(ms, ps, ReplicaStrict)
+		So(err, ShouldBeNil)
+		So(CanListKeys(rs), ShouldBeTrue)
+
+		ss, err := NewShardedStore([]Storage{ms, ps}, nil)
+		So(err, ShouldBeNil)
+		So(CanListKeys(ss), ShouldBeFalse)
+		ss, err = NewShardedStore([]Storage{ms, rs}, nil)
+		So(err, ShouldBeNil)
+		So(CanListKeys(ss), ShouldBeTrue)
+		keys, err := ss.Keys("")
+		So(err, ShouldBeNil)
+		So(keys, ShouldContain, "a")
+	})
+}
+
+func TestCanExpire(t *testing.T) {
+	Convey("Test the Wrappers Forward SetWithTTL", t, func() {
+		ms, err := NewMemStore()
+		So(err, ShouldBeNil)
+		So(CanExpire(ms), ShouldBeFalse)
+		ts := newTTLStore()
+		So(CanExpire(ts), ShouldBeTrue)
+
+		bs, err := NewBucketStore(ts, 1, nil)
+		So(err, ShouldBeNil)
+		So(CanExpire(bs), ShouldBeTrue)
+		So(bs.SetWithTTL("a", []byte("1"), time.Minute), ShouldBeNil)
+		So(ts.ttls["00a"], ShouldEqual, time.Minute)
+
+		plain, err := NewBucketStore(ms, 1, nil)
+		So(err, ShouldBeNil)
+		So(CanExpire(plain), ShouldBeFalse)
+		So(plain.SetWithTTL("a", []byte("1"), time.Minute), ShouldBeNil)
+		data, err := plain.Get("a")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "1")
+
+		rs, err := NewReplicatedStore(ts, ms, ReplicaStrict)
+		So(err, ShouldBeNil)
+		So(CanExpire(rs), ShouldBeTrue)
+		So(rs.SetWithTTL("b", []byte("2"), time.Second), ShouldBeNil)
+		So(ts.ttls["b"], ShouldEqual, time.Second)
+		data, err = ms.Get("b")
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "2")
+
+		is, err := NewIdleStore(ts, time.Hour)
+		So(err, ShouldBeNil)
+		defer is.Close()
+		So(CanExpire(is), ShouldBeTrue)
+		So(is.SetWithTTL("d", []byte("4"), time.Millisecond), ShouldBeNil)
+		So(ts.ttls["d"], ShouldEqual, time.Millisecond)
+
+		ss, err := NewShardedStore([]Storage{ts, newTTLStore()}, func(string) int { return 0 })
+		So(err, ShouldBeNil)
+		So(CanExpire(ss), ShouldBeTrue)
+		So(ss.SetWithTTL("c", []byte("3"), time.Hour), ShouldBeNil)
+		So(ts.ttls["c"], ShouldEqual, time.Hour)
+		ss, err = NewShardedStore([]Storage{ts, ms}, nil)
+		So(err, ShouldBeNil)
+		So(CanExpire(ss), ShouldBeFalse)
+	})
+}
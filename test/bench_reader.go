@@ -50,7 +50,7 @@ func main() {
 	key := *topic + "/x"
 	err = messageQueue.Create(key, "")
 	if err != nil {
-		if e := err.(*utils.Error); e.ErrorCode != utils.ErrLineExisted {
+		if e, ok := utils.AsError(err); !ok || e.ErrorCode != utils.ErrLineExisted {
 			fmt.Printf("line create error: %s\n", err)
 			return
 		}
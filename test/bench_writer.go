@@ -51,7 +51,7 @@ func main() {
 
 	err = messageQueue.Create(*topic, "")
 	if err != nil {
-		if e := err.(*utils.Error); e.ErrorCode != utils.ErrTopicExisted {
+		if e, ok := utils.AsError(err); !ok || e.ErrorCode != utils.ErrTopicExisted {
 			fmt.Printf("topic create error: %s\n", err)
 			return
 		}
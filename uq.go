@@ -11,6 +11,7 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/buaazp/uq/admin"
 	"github.com/buaazp/uq/entry"
@@ -29,6 +30,22 @@ var (
 	logFile   string
 	etcd      string
 	cluster   string
+	maxLines  int
+	maxTopics int
+	lineIdle  time.Duration
+	persistN  int
+	workers   int
+	storeWait time.Duration
+	asyncBuf  int
+	spillDir  string
+	buckets   int
+	cacheSize int
+	warmup    string
+	warmupN   int
+	auditLog  string
+	readOnly  bool
+	checksum  bool
+	separator string
 )
 
 func init() {
@@ -39,9 +56,25 @@ func init() {
 	flag.StringVar(&protocol, "protocol", "redis", "frontend interface type [redis/mc/http]")
 	flag.StringVar(&db, "db", "goleveldb", "backend storage type [goleveldb/memdb]")
 	flag.StringVar(&dir, "dir", "./data", "backend storage path")
+	flag.IntVar(&buckets, "key-buckets", 0, "spread the keys across the buckets of the storage, must not change once data is stored, 0 means none")
 	flag.StringVar(&logFile, "log", "", "uq log path")
 	flag.StringVar(&etcd, "etcd", "", "etcd service location")
 	flag.StringVar(&cluster, "cluster", "uq", "cluster name in etcd")
+	flag.IntVar(&maxLines, "max-lines", 0, "max lines of one topic, 0 means unlimited")
+	flag.IntVar(&maxTopics, "max-topics", 0, "max topics of the queue, 0 means unlimited")
+	flag.DurationVar(&lineIdle, "line-expire", 0, "remove lines idle for the duration, 0 means never")
+	flag.IntVar(&persistN, "persist-every", 0, "persist the topic after every n pushes, 0 means only on interval")
+	flag.IntVar(&workers, "maintenance-workers", 0, "max topics doing background backup or clean at once, 0 means unlimited")
+	flag.StringVar(&auditLog, "audit-log", "", "append the pushes, pops and confirms to the file, empty means none")
+	flag.IntVar(&asyncBuf, "async-push-buffer", 0, "buffer the pushes of every topic and store them in background, 0 means store at once")
+	flag.StringVar(&spillDir, "async-spill-dir", "", "spill the async pushes to files in the directory while the buffer is full, empty means wait")
+	flag.IntVar(&cacheSize, "read-cache-size", 0, "keep the messages read last in memory up to the bytes, 0 means no cache")
+	flag.StringVar(&warmup, "warmup", "", "topics to read into the read cache at startup, separated by commas")
+	flag.IntVar(&warmupN, "warmup-messages", 1000, "last messages of every warmup topic to read")
+	flag.DurationVar(&storeWait, "store-timeout", 0, "retry opening the storage for the duration, 0 means no retry")
+	flag.BoolVar(&readOnly, "read-only", false, "serve the storage for inspection, every change is rejected")
+	flag.BoolVar(&checksum, "checksum", false, "store the values of a new storage with checksums verified on read")
+	flag.StringVar(&separator, "separator", "/", "separator of the topic, the line and the id in the keys")
 }
 
 func belong(single string, team []string) bool {
@@ -117,6 +150,13 @@ func main() {
 		fmt.Printf("store init error: %s\n", err)
 		return
 	}
+	if buckets > 0 {
+		storage, err = store.NewBucketStore(storage, buckets, nil)
+		if err != nil {
+			fmt.Printf("store init error: %s\n", err)
+			return
+		}
+	}
 
 	var etcdServers []string
 	if etcd != "" {
@@ -134,12 +174,43 @@ func main() {
 	// 	storage.Close()
 	// 	return
 	// }
-	messageQueue, err = queue.NewUnitedQueue(storage, ip, port, etcdServers, cluster)
+	opts := &queue.Options{
+		MaxLinesPerTopic:   maxLines,
+		MaxTopics:          maxTopics,
+		LineIdleExpire:     lineIdle,
+		PersistEvery:       persistN,
+		MaintenanceWorkers: workers,
+		StoreOpenTimeout:   storeWait,
+		AsyncPushBuffer:    asyncBuf,
+		AsyncSpillDir:      spillDir,
+		ReadCacheSize:      cacheSize,
+		ReadOnly:           readOnly,
+		Checksum:           checksum,
+		Separator:          separator,
+	}
+	if auditLog != "" {
+		sink, err := queue.NewFileAuditSink(auditLog)
+		if err != nil {
+			fmt.Printf("audit log init error: %s\n", err)
+			storage.Close()
+			return
+		}
+		defer sink.Close()
+		opts.AuditSink = sink
+	}
+	unitedQueue, err := queue.NewUnitedQueueWithOptions(storage, ip, port, etcdServers, cluster, opts)
 	if err != nil {
 		fmt.Printf("queue init error: %s\n", err)
 		storage.Close()
 		return
 	}
+	messageQueue = unitedQueue
+	if warmup != "" {
+		err = unitedQueue.Warmup(strings.Split(warmup, ","), warmupN)
+		if err != nil {
+			fmt.Printf("queue warmup error: %s\n", err)
+		}
+	}
 
 	var entrance entry.Entrance
 	if protocol == "http" {
@@ -210,7 +281,10 @@ func main() {
 		entrance.Stop()
 		log.Printf("entrance stoped.")
 	case <-entryFailed:
-		messageQueue.Close()
+		err := messageQueue.Close()
+		if err != nil {
+			fmt.Printf("queue close error: %s\n", err)
+		}
 	case <-adminFailed:
 		entrance.Stop()
 	}
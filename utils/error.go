@@ -2,6 +2,7 @@ package utils
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 )
@@ -21,6 +22,26 @@ const (
 	ErrTopicExisted = 105
 	// ErrLineExisted is line has been existed error
 	ErrLineExisted = 106
+	// ErrTimeout is the waiting timeout error
+	ErrTimeout = 107
+	// ErrTooManyLines is the lines of topic exceed the limit error
+	ErrTooManyLines = 108
+	// ErrDataNotExisted is the data missing from the storage error
+	ErrDataNotExisted = 109
+	// ErrRateLimited is the push rate exceeds the limit error
+	ErrRateLimited = 110
+	// ErrConfirmNotApplicable is the confirm on a line without recycle error
+	ErrConfirmNotApplicable = 111
+	// ErrTooManyTopics is the topics of queue exceed the limit error
+	ErrTooManyTopics = 112
+	// ErrReadOnly is the change of a queue opened read only error
+	ErrReadOnly = 113
+	// ErrChecksumMismatch is the stored value failing its checksum error
+	ErrChecksumMismatch = 114
+	// ErrNotLoaded is the change of a queue not loaded yet error
+	ErrNotLoaded = 115
+	// ErrPaused is the pop of a paused topic or line error
+	ErrPaused = 116
 	// ErrBadRequest is bad request error
 	ErrBadRequest = 400
 	// ErrInternalError is internal error
@@ -35,13 +56,25 @@ var errorMap = map[int]string{
 	ErrNotDelivered:    "Message Not Delivered",
 
 	// 400
-	ErrBadKey:       "Bad Key Format",
-	ErrTopicExisted: "Topic Has Existed",
-	ErrLineExisted:  "Line Has Existed",
-	ErrBadRequest:   "Bad Client Request",
+	ErrBadKey:        "Bad Key Format",
+	ErrTopicExisted:  "Topic Has Existed",
+	ErrLineExisted:   "Line Has Existed",
+	ErrBadRequest:    "Bad Client Request",
+	ErrTimeout:       "Wait Timeout",
+	ErrTooManyLines:  "Too Many Lines",
+	ErrTooManyTopics: "Too Many Topics",
+	ErrRateLimited:   "Rate Limited",
+	ErrReadOnly:      "Read Only",
+	ErrNotLoaded:     "Not Loaded",
+	ErrPaused:        "Paused",
+
+	ErrConfirmNotApplicable: "Confirm Not Applicable",
 
 	// 500
-	ErrInternalError: "Internal Error",
+	ErrInternalError:  "Internal Error",
+	ErrDataNotExisted: "Data Not Existed",
+
+	ErrChecksumMismatch: "Checksum Mismatch",
 }
 
 var errorStatus = map[int]int{
@@ -49,7 +82,15 @@ var errorStatus = map[int]int{
 	ErrTopicNotExisted: http.StatusNotFound,
 	ErrLineNotExisted:  http.StatusNotFound,
 	ErrNotDelivered:    http.StatusNotFound,
+	ErrTimeout:         http.StatusRequestTimeout,
+	ErrRateLimited:     http.StatusTooManyRequests,
+	ErrReadOnly:        http.StatusForbidden,
+	ErrNotLoaded:       http.StatusServiceUnavailable,
+	ErrPaused:          http.StatusServiceUnavailable,
 	ErrInternalError:   http.StatusInternalServerError,
+	ErrDataNotExisted:  http.StatusInternalServerError,
+
+	ErrChecksumMismatch: http.StatusInternalServerError,
 }
 
 // Error is the error type in uq
@@ -73,6 +114,20 @@ func (e Error) Error() string {
 	return ItoaQuick(e.ErrorCode) + " " + e.Message + " (" + e.Cause + ")"
 }
 
+// Is reports whether target is an *Error of the same code, so errors.Is
+// matches an error of the code through the wrappers
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.ErrorCode == e.ErrorCode
+}
+
+// AsError finds the first *Error in the chain of err
+func AsError(err error) (*Error, bool) {
+	var e *Error
+	ok := errors.As(err, &e)
+	return e, ok
+}
+
 func (e Error) statusCode() int {
 	status, ok := errorStatus[e.ErrorCode]
 	if !ok {